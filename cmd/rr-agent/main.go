@@ -2,23 +2,48 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"rackroom/internal/agent"
+	"rackroom/internal/shared"
 )
 
 func main() {
 	configPath := flag.String("config", "./agent.json", "path to agent config json")
+	printConfig := flag.Bool("print-config", false, "print the effective config (secrets redacted) and public key, then exit")
+	check := flag.Bool("check", false, "send one signed request to the server, report whether connectivity and auth work, then exit")
 	flag.Parse()
 
+	if *printConfig {
+		if err := printEffectiveConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	a, err := agent.New(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *check {
+		os.Exit(runCheck(a))
+	}
+
+	// Cancelled on SIGINT/SIGTERM; running jobs see it through their context.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	ctx := context.Background()
 	if err := a.EnrollIfNeeded(ctx); err != nil {
 		log.Fatal(err)
 	}
@@ -26,26 +51,143 @@ func main() {
 
 	heartbeatTicker := time.NewTicker(time.Duration(a.Cfg.HeartbeatSeconds) * time.Second)
 	pollTicker := time.NewTicker(time.Duration(a.Cfg.PollSeconds) * time.Second)
+	defer heartbeatTicker.Stop()
+	defer pollTicker.Stop()
+
+	runner := a.NewJobRunner()
+
+	// Set when the server answers 503 + Retry-After; heartbeats and polls
+	// pause until then instead of adding to its load.
+	var backoffUntil time.Time
+	backoff := func(err error) {
+		if wait, ok := agent.RetryAfter(err); ok {
+			backoffUntil = time.Now().Add(wait)
+		}
+	}
 
 	for {
 		select {
+		case <-ctx.Done():
+			stop() // a second signal kills the agent right away
+			log.Printf("shutting down; interrupting running jobs")
+			runner.Wait()
+			return
 		case <-heartbeatTicker.C:
-			if err := a.SendHeartbeat(ctx); err != nil {
+			if time.Now().Before(backoffUntil) {
+				continue
+			}
+			err := a.SendHeartbeat(ctx)
+			if err != nil {
 				log.Printf("heartbeat error: %v", err)
+				backoff(err)
 			}
+			a.ReenrollIfForgotten(ctx, err)
 		case <-pollTicker.C:
-			jobs, err := a.PollJobs(ctx)
+			if time.Now().Before(backoffUntil) {
+				continue
+			}
+			// Never ask for more than we can start right away.
+			batch := runner.Free()
+			if batch == 0 {
+				continue
+			}
+			if n := a.Cfg.PollBatchSize; n > 0 && n < batch {
+				batch = n
+			}
+			jobs, err := a.PollJobs(ctx, batch)
+			a.ReenrollIfForgotten(ctx, err)
 			if err != nil {
 				log.Printf("poll error: %v", err)
+				backoff(err)
 				continue
 			}
 			for _, job := range jobs {
-				log.Printf("running job %s: %s", job.JobID, job.Command)
-				res := a.RunJob(ctx, job)
-				if err := a.PostResult(ctx, res); err != nil {
-					log.Printf("post result error: %v", err)
-				}
+				runner.Submit(ctx, job)
 			}
 		}
 	}
 }
+
+// runCheck reports the outcome of a.Check for a field tech and returns the
+// process exit code (0 = the server accepts this agent).
+func runCheck(a *agent.Agent) int {
+	fmt.Printf("server:   %s\n", a.Cfg.ServerURL)
+	fmt.Printf("agent_id: %s\n", a.Cfg.AgentID)
+	fmt.Printf("key:      %s\n", a.Cfg.PrivateKeyPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := a.Check(ctx)
+	if err != nil {
+		fmt.Printf("FAILED: %v\n", err)
+		return 1
+	}
+	fmt.Printf("OK: signed request accepted in %s (approval_status=%s, server protocol %d)\n",
+		res.Latency.Round(time.Millisecond), res.Ping.ApprovalStatus, res.Ping.ProtocolVersion)
+	if skew := res.ClockSkew; skew > time.Minute || skew < -time.Minute {
+		fmt.Printf("warning: clock differs from the server's by %s; requests fail past 10m\n", skew)
+	}
+	return 0
+}
+
+// printEffectiveConfig shows what the agent would actually run with: the
+// config file after defaults, with secrets redacted, plus the public key
+// derived from the private key on disk. It never creates a key or enrolls.
+func printEffectiveConfig(path string) error {
+	cfg, err := shared.LoadAgentConfig(path)
+	if err != nil {
+		return err
+	}
+	if cfg.PrivateKeyPath == "" {
+		cfg.PrivateKeyPath = agent.DefaultKeyPath()
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = agent.DefaultServiceName()
+	}
+	if cfg.OutputEncoding == "" {
+		cfg.OutputEncoding = "auto"
+	}
+	if cfg.DefaultShell == "" {
+		cfg.DefaultShell = agent.DefaultShell()
+	}
+
+	if cfg.EnrollToken != "" {
+		cfg.EnrollToken = "REDACTED"
+	}
+	if cfg.HMACSecret != "" {
+		cfg.HMACSecret = "REDACTED"
+	}
+	for name, c := range cfg.RunAsCredentials {
+		c.Password = "REDACTED"
+		cfg.RunAsCredentials[name] = c
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	fmt.Printf("config file: %s\n", abs)
+
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+
+	keyB64, err := os.ReadFile(cfg.PrivateKeyPath)
+	switch {
+	case os.IsNotExist(err):
+		fmt.Printf("public key: none yet (%s is created on first run)\n", cfg.PrivateKeyPath)
+	case err != nil:
+		fmt.Printf("public key: unreadable: %v\n", err)
+	default:
+		priv, err := shared.DecodePrivKey(strings.TrimSpace(string(keyB64)))
+		if err != nil {
+			fmt.Printf("public key: invalid private key in %s: %v\n", cfg.PrivateKeyPath, err)
+			break
+		}
+		pub := priv.Public().(ed25519.PublicKey)
+		fmt.Printf("public key: %s\n", base64.StdEncoding.EncodeToString(pub))
+	}
+	return nil
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"rackroom/internal/server"
 )
 
 func main() {
+	prune := flag.Bool("prune", false, "apply RR_RETAIN_* retention rules now")
+	dryRun := flag.Bool("dry-run", false, "with -prune: only report what would be deleted")
+	flag.Parse()
+
 	dbPath := os.Getenv("RR_DB_PATH")
 	if dbPath == "" {
 		dbPath = "./data/rackroom.db"
@@ -21,6 +27,26 @@ func main() {
 	}
 	defer db.Close()
 
+	if *prune {
+		policy := server.RetentionPolicyFromEnv()
+		if !policy.Enabled() {
+			fmt.Println("No retention rules set (RR_RETAIN_<TABLE>_MAX_AGE / _MAX_ROWS)")
+			return
+		}
+		results, err := server.PruneRetention(db, policy, time.Now(), *dryRun)
+		for _, r := range results {
+			verb := "Deleted"
+			if r.DryRun {
+				verb = "Would delete"
+			}
+			fmt.Printf("%s %d row(s) from %s\n", verb, r.Deleted, r.Table)
+		}
+		if err != nil {
+			log.Fatalf("prune failed: %v", err)
+		}
+		return
+	}
+
 	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' ORDER BY name;`)
 	if err != nil {
 		log.Fatalf("query failed: %v", err)
@@ -34,6 +60,20 @@ func main() {
 		fmt.Println(" -", name)
 	}
 
+	st, err := server.SQLiteSchemaStatus(db)
+	if err != nil {
+		fmt.Println("Schema version: ERROR ->", err)
+	} else {
+		fmt.Println("Schema version:", st.Version)
+		fmt.Println("Migrations applied:")
+		for _, m := range st.Applied {
+			fmt.Printf(" - %s  %s\n", m.Version, time.Unix(m.AppliedAt, 0).UTC().Format(time.RFC3339))
+		}
+		for _, v := range st.Pending {
+			fmt.Println("Migration pending:", v)
+		}
+	}
+
 	// Optional: show agent count
 	var n int
 	_ = db.QueryRow(`SELECT COUNT(*) FROM agents;`).Scan(&n)
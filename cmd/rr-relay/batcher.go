@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// maxBatchBodyBytes is how much heartbeat JSON goes into one batch (before
+// compression), keeping the gzipped request well under the server's body
+// limit. A heartbeat bigger than this on its own is forwarded by itself.
+const maxBatchBodyBytes = 4 << 20
+
+// heartbeatWait bounds how long an agent's heartbeat is held, short of the
+// agent's own 20s client timeout.
+const heartbeatWait = 15 * time.Second
+
+// pendingHeartbeat is one agent heartbeat waiting for its batch's answer.
+type pendingHeartbeat struct {
+	entry shared.HeartbeatBatchEntry
+	done  chan shared.HeartbeatBatchResult // buffered, receives exactly once
+}
+
+type batcher struct {
+	upstream   *url.URL
+	client     *http.Client
+	interval   time.Duration
+	maxEntries int
+	in         chan *pendingHeartbeat
+
+	// noBatch is set once the server answered 404 to a batch (it predates
+	// /v1/heartbeat/batch); heartbeats are then forwarded one by one.
+	noBatch atomic.Bool
+}
+
+// ServeHTTP takes an agent's POST /v1/heartbeat, queues it for the next
+// batch and answers with what the server said about this entry.
+func (b *batcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, []byte(`{"error":"method not allowed"}`))
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, []byte(`{"error":"bad body"}`))
+		return
+	}
+	p := &pendingHeartbeat{
+		entry: shared.HeartbeatBatchEntry{Headers: map[string]string{}, Body: string(body)},
+		done:  make(chan shared.HeartbeatBatchResult, 1),
+	}
+	for _, h := range shared.HeartbeatBatchHeaders {
+		if v := r.Header.Get(h); v != "" {
+			p.entry.Headers[h] = v
+		}
+	}
+
+	if len(body) > maxBatchBodyBytes || b.noBatch.Load() {
+		go b.forwardSingle(p)
+	} else {
+		select {
+		case b.in <- p:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	select {
+	case res := <-p.done:
+		writeJSON(w, res.Status, res.Body)
+	case <-time.After(heartbeatWait):
+		writeJSON(w, 504, []byte(`{"error":"relay: no answer from upstream in time"}`))
+	case <-r.Context().Done():
+	}
+}
+
+// run collects heartbeats and sends a batch when it is full (by count or
+// size) or interval after its first heartbeat arrived.
+func (b *batcher) run() {
+	var (
+		batch []*pendingHeartbeat
+		size  int
+		timer <-chan time.Time
+	)
+	flush := func() {
+		if len(batch) > 0 {
+			go b.send(batch)
+		}
+		batch, size, timer = nil, 0, nil
+	}
+	for {
+		select {
+		case p := <-b.in:
+			if size+len(p.entry.Body) > maxBatchBodyBytes {
+				flush()
+			}
+			batch = append(batch, p)
+			size += len(p.entry.Body)
+			if timer == nil {
+				timer = time.After(b.interval)
+			}
+			if len(batch) >= b.maxEntries || len(batch) >= shared.MaxHeartbeatBatchEntries {
+				flush()
+			}
+		case <-timer:
+			flush()
+		}
+	}
+}
+
+// send posts one batch and hands every waiting heartbeat its result.
+func (b *batcher) send(batch []*pendingHeartbeat) {
+	req := shared.HeartbeatBatchRequest{Entries: make([]shared.HeartbeatBatchEntry, len(batch))}
+	for i, p := range batch {
+		req.Entries[i] = p.entry
+	}
+	resp, status, err := b.postBatch(req)
+	if status == http.StatusNotFound {
+		if !b.noBatch.Swap(true) {
+			log.Printf("relay: upstream has no /v1/heartbeat/batch; forwarding heartbeats one by one")
+		}
+		for _, p := range batch {
+			go b.forwardSingle(p)
+		}
+		return
+	}
+	if err == nil && len(resp.Results) != len(batch) {
+		err = fmt.Errorf("%d results for %d entries", len(resp.Results), len(batch))
+	}
+	if err != nil {
+		log.Printf("relay: batch of %d failed: %v", len(batch), err)
+		for _, p := range batch {
+			p.done <- upstreamError(status)
+		}
+		return
+	}
+	for i, p := range batch {
+		p.done <- resp.Results[i]
+	}
+}
+
+// postBatch sends req gzipped. status is the HTTP status, 0 if none arrived.
+func (b *batcher) postBatch(req shared.HeartbeatBatchRequest) (*shared.HeartbeatBatchResponse, int, error) {
+	plain, err := json.Marshal(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write(plain)
+	if err := zw.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatWait)
+	defer cancel()
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, b.upstream.String()+"/v1/heartbeat/batch", &buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	hr.Header.Set("Content-Encoding", "gzip")
+	res, err := b.client.Do(hr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		return nil, res.StatusCode, fmt.Errorf("HTTP %d: %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+	var out shared.HeartbeatBatchResponse
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, res.StatusCode, fmt.Errorf("unexpected response: %w", err)
+	}
+	return &out, res.StatusCode, nil
+}
+
+// forwardSingle sends one heartbeat to /v1/heartbeat as the agent would
+// have, for heartbeats too big to batch or a server without batching.
+func (b *batcher) forwardSingle(p *pendingHeartbeat) {
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatWait)
+	defer cancel()
+	hr, err := http.NewRequestWithContext(ctx, http.MethodPost, b.upstream.String()+"/v1/heartbeat", bytes.NewReader([]byte(p.entry.Body)))
+	if err != nil {
+		p.done <- upstreamError(0)
+		return
+	}
+	hr.Header.Set("Content-Type", "application/json")
+	for k, v := range p.entry.Headers {
+		hr.Header.Set(k, v)
+	}
+	res, err := b.client.Do(hr)
+	if err != nil {
+		log.Printf("relay: heartbeat forward failed: %v", err)
+		p.done <- upstreamError(0)
+		return
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	p.done <- shared.HeartbeatBatchResult{Status: res.StatusCode, Body: bytes.TrimSpace(body)}
+}
+
+// upstreamError is the answer for heartbeats whose batch got no usable
+// response: the server's own 5xx status if it sent one, else 502.
+func upstreamError(status int) shared.HeartbeatBatchResult {
+	if status < 500 {
+		return shared.HeartbeatBatchResult{Status: http.StatusBadGateway, Body: json.RawMessage(`{"error":"relay: upstream unavailable"}`)}
+	}
+	return shared.HeartbeatBatchResult{Status: status, Body: json.RawMessage(`{"error":"relay: upstream returned ` + strconv.Itoa(status) + `"}`)}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(append(body, '\n'))
+}
@@ -1 +1,138 @@
+// rr-relay sits between the agents at one site and rr-server. Agents point
+// server_url at it; it forwards their heartbeats in batches
+// (POST /v1/heartbeat/batch) and proxies every other request unchanged, so a
+// site holds a few WAN connections instead of one or more per agent. It
+// holds no keys: the server verifies each agent's own signature.
 package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	// Where to forward to (RR_RELAY_UPSTREAM), e.g. https://rr.example.com
+	upstreamURL := os.Getenv("RR_RELAY_UPSTREAM")
+	if upstreamURL == "" {
+		log.Fatalf("RR_RELAY_UPSTREAM is required (the rr-server base URL)")
+	}
+	upstream, err := url.Parse(strings.TrimRight(upstreamURL, "/"))
+	if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+		log.Fatalf("RR_RELAY_UPSTREAM: invalid URL %q", upstreamURL)
+	}
+
+	// Listen address for the site's agents (RR_RELAY_ADDR)
+	addr := os.Getenv("RR_RELAY_ADDR")
+	if addr == "" {
+		addr = ":8086"
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	b := &batcher{
+		upstream: upstream,
+		client:   client,
+		// How long a heartbeat may wait for others to join its batch (RR_RELAY_FLUSH_INTERVAL)
+		interval: envDuration("RR_RELAY_FLUSH_INTERVAL", 2*time.Second),
+		// Heartbeats per batch (RR_RELAY_MAX_BATCH), at most shared.MaxHeartbeatBatchEntries
+		maxEntries: envInt("RR_RELAY_MAX_BATCH", 100),
+		in:         make(chan *pendingHeartbeat),
+	}
+	go b.run()
+
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/heartbeat", b.ServeHTTP)
+	mux.Handle("/", proxy)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	log.Printf("rr-relay listening on %s, forwarding to %s (batches of up to %d every %s)", addr, upstream, b.maxEntries, b.interval)
+
+	// HTTPS for the agents (optional): RR_TLS_CERT + RR_TLS_KEY (PEM files)
+	certFile, keyFile := os.Getenv("RR_TLS_CERT"), os.Getenv("RR_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatalf("RR_TLS_CERT and RR_TLS_KEY must be set together")
+	}
+	if certFile != "" {
+		log.Fatal(srv.ListenAndServeTLS(certFile, keyFile))
+	}
+	log.Printf("tls: disabled; agent payloads travel in cleartext to the relay (set RR_TLS_CERT/RR_TLS_KEY)")
+	log.Fatal(srv.ListenAndServe())
+}
+
+// Body limits match rr-server's readBody.
+const (
+	maxBodyBytes        = 2 << 20
+	maxDecodedBodyBytes = 16 << 20
+)
+
+// readBody reads an agent's request body, decompressing gzip, since batch
+// entries carry the plain JSON the agent's X-Body-Sha256 covers.
+func readBody(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	raw := io.LimitReader(r.Body, maxBodyBytes)
+
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return io.ReadAll(raw)
+	case "gzip":
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		b, err := io.ReadAll(io.LimitReader(zr, maxDecodedBodyBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxDecodedBodyBytes {
+			return nil, errors.New("decompressed body too large")
+		}
+		return b, nil
+	default:
+		return nil, errors.New("unsupported content encoding: " + enc)
+	}
+}
+
+// envInt parses a positive integer from an env var.
+func envInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("config: ignoring invalid %s=%q (using %d)", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envDuration parses a Go duration (e.g. "2s") from an env var.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("config: ignoring invalid %s=%q (using %s)", key, v, def)
+		return def
+	}
+	return d
+}
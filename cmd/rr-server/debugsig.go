@@ -0,0 +1,71 @@
+//go:build debugsig
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"rackroom/internal/server"
+	"rackroom/internal/shared"
+)
+
+// verifySignatureRequest is the body of /v1/admin/debug/verify-signature:
+// the inputs of one signed request, as the agent sent them (X-PubKey,
+// X-Timestamp, X-Signature, X-Body-Sha256). Query is the canonical query
+// (shared.CanonicalQuery), "" when the request had none. When BodySHA is
+// empty it is computed from Body.
+type verifySignatureRequest struct {
+	PubKey    string `json:"pubkey"`
+	Timestamp string `json:"timestamp"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Query     string `json:"query"`
+	BodySHA   string `json:"body_sha"`
+	Body      string `json:"body"`
+	Signature string `json:"signature"`
+}
+
+// registerDebugSignature adds POST /v1/admin/debug/verify-signature, which
+// runs shared.Verify on the given inputs and returns the result together with
+// the exact message that was checked, for reproducing signature failures.
+// Development builds only:
+//
+//	go build -tags debugsig ./cmd/rr-server
+func registerDebugSignature(mux *http.ServeMux, api *server.API) {
+	log.Printf("debug: /v1/admin/debug/verify-signature is compiled in (debugsig build tag)")
+	mux.HandleFunc("/v1/admin/debug/verify-signature", api.RequireServiceKey(func(w http.ResponseWriter, r *http.Request) {
+		reply := func(code int, v any) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(code)
+			_ = json.NewEncoder(w).Encode(v)
+		}
+		if r.Method != http.MethodPost {
+			reply(405, map[string]any{"error": "method not allowed"})
+			return
+		}
+		var req verifySignatureRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			reply(400, map[string]any{"error": "bad json"})
+			return
+		}
+		pub, err := shared.DecodePubKey(req.PubKey)
+		if err != nil {
+			reply(400, map[string]any{"error": "bad pubkey: " + err.Error()})
+			return
+		}
+		bodySHA := req.BodySHA
+		if bodySHA == "" {
+			bodySHA = shared.BodySHA256([]byte(req.Body))
+		}
+
+		msg := shared.SignedMessage(req.Timestamp, req.Method, req.Path, req.Query, bodySHA)
+		reply(200, map[string]any{
+			"valid":    shared.Verify(pub, req.Signature, req.Timestamp, req.Method, req.Path, req.Query, bodySHA),
+			"message":  string(msg),
+			"body_sha": bodySHA,
+		})
+	}))
+}
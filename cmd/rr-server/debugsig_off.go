@@ -0,0 +1,13 @@
+//go:build !debugsig
+
+package main
+
+import (
+	"net/http"
+
+	"rackroom/internal/server"
+)
+
+// registerDebugSignature is a no-op: without the debugsig build tag the
+// verify-signature handler isn't in the binary at all.
+func registerDebugSignature(mux *http.ServeMux, api *server.API) {}
@@ -0,0 +1,37 @@
+//go:build debugsql
+
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+
+	"rackroom/internal/server"
+)
+
+// registerDebugSQL adds POST /debug/sql, which runs the request body as SQL
+// against the server's database. Development builds only:
+//
+//	go build -tags debugsql ./cmd/rr-server
+func registerDebugSQL(mux *http.ServeMux, api *server.API, db *sql.DB) {
+	log.Printf("debug: /debug/sql is compiled in (debugsql build tag); never ship this binary")
+	mux.HandleFunc("/debug/sql", api.RequireServiceKey(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if len(body) == 0 {
+			http.Error(w, "empty body", 400)
+			return
+		}
+		if _, err := db.Exec(string(body)); err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.WriteHeader(200)
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
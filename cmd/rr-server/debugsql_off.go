@@ -0,0 +1,14 @@
+//go:build !debugsql
+
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"rackroom/internal/server"
+)
+
+// registerDebugSQL is a no-op: without the debugsql build tag the
+// /debug/sql handler isn't in the binary at all.
+func registerDebugSQL(mux *http.ServeMux, api *server.API, db *sql.DB) {}
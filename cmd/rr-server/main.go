@@ -1,16 +1,43 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"database/sql"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"rackroom/internal/server"
+	"rackroom/internal/shared"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash (for RR_UI_PASSWORD_HASH) and exit")
+	flag.Parse()
+
+	if *hashPassword {
+		pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(pw, "\r\n")), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
 	// Enroll token (dev default is fine locally; override in env)
 	enrollToken := os.Getenv("RR_ENROLL_TOKEN")
 	if enrollToken == "" {
@@ -23,70 +50,352 @@ func main() {
 		addr = ":8085"
 	}
 
-	// DB path (SQLite)
+	// Database: RR_DB_DRIVER is "sqlite" (default, RR_DB_PATH) or "postgres" (RR_DB_DSN)
+	dbDriver := os.Getenv("RR_DB_DRIVER")
+	if dbDriver == "" {
+		dbDriver = "sqlite"
+	}
+
+	// DB path (SQLite); its directory also holds the webhook dead-letter file
 	dbPath := os.Getenv("RR_DB_PATH")
 	if dbPath == "" {
 		dbPath = "./data/rackroom.db"
 	}
-
-	// Ensure DB directory exists
 	dbDir := filepath.Dir(dbPath)
-	if dbDir != "." && dbDir != "" {
-		if err := os.MkdirAll(dbDir, 0700); err != nil {
-			log.Fatalf("failed to create db dir %s: %v", dbDir, err)
+
+	var (
+		db    *sql.DB
+		store server.Store
+	)
+	switch dbDriver {
+	case "sqlite":
+		// Ensure DB directory exists
+		if dbDir != "." && dbDir != "" {
+			if err := os.MkdirAll(dbDir, 0700); err != nil {
+				log.Fatalf("failed to create db dir %s: %v", dbDir, err)
+			}
 		}
-	}
 
-	// Open DB + run migrations
-	db, err := server.OpenDB(dbPath)
-	if err != nil {
-		log.Fatalf("failed to open db %s: %v", dbPath, err)
-	}
+		// Open DB + run migrations
+		var err error
+		db, err = server.OpenDB(dbPath)
+		if err != nil {
+			log.Fatalf("failed to open db %s: %v", dbPath, err)
+		}
 
-	if err := server.RunMigrations(db); err != nil {
-		log.Fatalf("migrations failed: %v", err)
-	}
+		if err := server.RunMigrations(db); err != nil {
+			log.Fatalf("migrations failed: %v", err)
+		}
 
-	store := server.NewSQLiteStore(db)
+		store = server.NewSQLiteStore(db)
+
+	case "postgres":
+		dsn := os.Getenv("RR_DB_DSN")
+		if dsn == "" {
+			log.Fatalf("RR_DB_DRIVER=postgres needs RR_DB_DSN")
+		}
+		var err error
+		db, err = server.OpenPostgresDB(dsn)
+		if err != nil {
+			log.Fatalf("failed to open postgres db: %v", err)
+		}
+
+		if err := server.RunPostgresMigrations(db); err != nil {
+			log.Fatalf("migrations failed: %v", err)
+		}
+
+		store = server.NewPostgresStore(db)
+
+	default:
+		log.Fatalf("RR_DB_DRIVER: unknown driver %q (want sqlite or postgres)", dbDriver)
+	}
 
 	api := &server.API{
 		Store:       store,
 		EnrollToken: enrollToken,
+		// Manual approval for new agents (RR_REQUIRE_APPROVAL=1); default auto-approve
+		RequireApproval: envBool("RR_REQUIRE_APPROVAL"),
+		// Agent requests must carry a matching X-Agent-Id and X-PubKey (RR_STRICT_AGENT_IDENTITY=1)
+		StrictAgentIdentity: envBool("RR_STRICT_AGENT_IDENTITY"),
+		// Reject unsigned job polls (RR_REQUIRE_SIGNED_POLL=1) once all agents sign them
+		RequireSignedPoll: envBool("RR_REQUIRE_SIGNED_POLL"),
+		// Issue hmac signing secrets over plain HTTP too (RR_ALLOW_INSECURE_HMAC_SECRET=1), for labs
+		AllowInsecureHMACSecret: envBool("RR_ALLOW_INSECURE_HMAC_SECRET"),
+		// Allowed clock skew on signed agent requests, either way (RR_AUTH_SKEW_SECONDS)
+		AuthSkewSeconds: int64(envInt("RR_AUTH_SKEW_SECONDS", 600)),
+		// Jobs per poll when the agent doesn't ask (RR_POLL_BATCH) and the cap on what it may ask for
+		PollBatchDefault: envInt("RR_POLL_BATCH", 5),
+		PollBatchMax:     envInt("RR_POLL_BATCH_MAX", 50),
+		// Bytes kept of each of a job result's stdout and stderr (RR_MAX_RESULT_OUTPUT_BYTES)
+		MaxResultOutputBytes: envInt("RR_MAX_RESULT_OUTPUT_BYTES", 4<<20),
+		// New agents the enroll token may register (RR_ENROLL_MAX_REGISTRATIONS); default unlimited
+		MaxEnrollRegistrations: envInt("RR_ENROLL_MAX_REGISTRATIONS", 0),
+		// Only pre-authorized keys may enroll, never the token (RR_REQUIRE_ENROLL_KEY=1)
+		RequireEnrollKey: envBool("RR_REQUIRE_ENROLL_KEY"),
+		// Oldest agent protocol accepted at enroll (RR_MIN_PROTOCOL_VERSION)
+		MinProtocolVersion: envInt("RR_MIN_PROTOCOL_VERSION", shared.MinProtocolVersion),
+		// Agents seen within this window count as online (default 300s)
+		OnlineWindowSeconds: int64(envDuration("RR_ONLINE_WINDOW", 5*time.Minute) / time.Second),
+		// Missed heartbeat intervals before an agent is marked late (RR_MISSED_HEARTBEATS)
+		MissedHeartbeats: envInt("RR_MISSED_HEARTBEATS", 3),
+		// Jobs that may wait for one agent before submits get 429 (RR_MAX_QUEUED_JOBS); default unlimited
+		MaxQueuedJobsPerAgent: envInt("RR_MAX_QUEUED_JOBS", 0),
+		// URL handed to provisioning scripts (RR_PUBLIC_URL); default is the host the caller used
+		PublicURL: os.Getenv("RR_PUBLIC_URL"),
+	}
+
+	// Both need enrollment state PostgresStore doesn't keep yet
+	if dbDriver != "sqlite" && (api.RequireEnrollKey || api.MaxEnrollRegistrations > 0) {
+		log.Fatalf("RR_REQUIRE_ENROLL_KEY and RR_ENROLL_MAX_REGISTRATIONS need RR_DB_DRIVER=sqlite")
+	}
+
+	// Last-resort command blocklist checked at dispatch (optional): one regexp per line
+	if path := os.Getenv("RR_COMMAND_BLOCKLIST_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("RR_COMMAND_BLOCKLIST_FILE: %v", err)
+		}
+		bl, err := server.ParseCommandBlocklist(string(b))
+		if err != nil {
+			log.Fatalf("RR_COMMAND_BLOCKLIST_FILE %s: %v", path, err)
+		}
+		api.CommandBlocklist = bl
+		log.Printf("command blocklist: %d pattern(s) from %s", bl.Len(), path)
 	}
 
+	// Tags for new agents by source CIDR or enroll token (optional); RR_ENROLL_TAG_MODE=override makes them server-set
+	if path := os.Getenv("RR_ENROLL_TAG_RULES_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("RR_ENROLL_TAG_RULES_FILE: %v", err)
+		}
+		rules, err := server.ParseEnrollTagRules(string(b))
+		if err != nil {
+			log.Fatalf("RR_ENROLL_TAG_RULES_FILE %s: %v", path, err)
+		}
+		switch mode := os.Getenv("RR_ENROLL_TAG_MODE"); mode {
+		case "", "merge":
+		case "override":
+			rules.Override = true
+		default:
+			log.Fatalf("RR_ENROLL_TAG_MODE: want merge or override, got %q", mode)
+		}
+		api.EnrollTagRules = rules
+		log.Printf("enroll tag rules: %d rule(s) from %s (override=%t)", rules.Len(), path, rules.Override)
+	}
+
+	// Site-defined facts taken from inventory paths (optional), one "<name> <path>" per line
+	if path := os.Getenv("RR_CUSTOM_FACTS_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("RR_CUSTOM_FACTS_FILE: %v", err)
+		}
+		cf, err := server.ParseCustomFacts(string(b))
+		if err != nil {
+			log.Fatalf("RR_CUSTOM_FACTS_FILE %s: %v", path, err)
+		}
+		api.CustomFacts = cf
+		log.Printf("custom facts: %d fact(s) from %s", cf.Len(), path)
+	}
+
+	// Reverse proxies allowed to set X-Forwarded-For (optional): RR_TRUSTED_PROXIES="10.0.0.0/8,127.0.0.1"
+	if v := os.Getenv("RR_TRUSTED_PROXIES"); v != "" {
+		tp, err := server.ParseTrustedProxies(v)
+		if err != nil {
+			log.Fatalf("RR_TRUSTED_PROXIES: %v", err)
+		}
+		api.TrustedProxies = tp
+		log.Printf("trusted proxies: %s", v)
+	}
+
+	// Facts-changed webhook (optional): RR_FACTS_WEBHOOK_URL + RR_FACTS_WEBHOOK_SECRET
+	if url := os.Getenv("RR_FACTS_WEBHOOK_URL"); url != "" {
+		// An empty HMAC key would sign deliveries anyone can forge.
+		if os.Getenv("RR_FACTS_WEBHOOK_SECRET") == "" {
+			log.Fatalf("RR_FACTS_WEBHOOK_URL needs RR_FACTS_WEBHOOK_SECRET (the key receivers verify X-RR-Signature with)")
+		}
+		deadLetter := os.Getenv("RR_FACTS_WEBHOOK_DEADLETTER")
+		if deadLetter == "" {
+			deadLetter = filepath.Join(dbDir, "webhook_deadletter.jsonl")
+		}
+		api.FactsWebhook = server.NewFactsWebhook(url, os.Getenv("RR_FACTS_WEBHOOK_SECRET"), deadLetter)
+		log.Printf("facts webhook: %s (dead letters: %s)", url, deadLetter)
+	}
+
+	// Operator login for the web UI (optional): RR_UI_PASSWORD_HASH is a bcrypt hash
+	if hash := os.Getenv("RR_UI_PASSWORD_HASH"); hash != "" {
+		api.UIPasswordHash = hash
+		api.Sessions = server.NewSessionStore(envDuration("RR_SESSION_TTL", 8*time.Hour))
+		log.Printf("operator login: enabled (session ttl %s)", api.Sessions.TTL)
+	}
+
+	// Retention pruning (optional): RR_RETAIN_<TABLE>_MAX_AGE / _MAX_ROWS
+	retention := server.RetentionPolicyFromEnv()
+	if retention.Enabled() && dbDriver != "sqlite" {
+		log.Printf("retention: not supported with RR_DB_DRIVER=%s, skipped", dbDriver)
+	} else if retention.Enabled() {
+		interval := envDuration("RR_RETENTION_INTERVAL", 6*time.Hour)
+		go server.RunRetention(db, retention, interval, nil)
+		log.Printf("retention: enabled (every %s)", interval)
+	}
+
+	// Offline detection for the liveness event feed
+	go api.RunLivenessMonitor(envDuration("RR_LIVENESS_INTERVAL", 30*time.Second), nil)
+
+	// Fail running jobs whose agent never reported back (RR_JOB_REAP_GRACE past their timeout)
+	go api.RunJobReaper(envDuration("RR_JOB_REAP_INTERVAL", time.Minute), envDuration("RR_JOB_REAP_GRACE", 10*time.Minute), nil)
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v1/enroll", api.Enroll)
+	mux.HandleFunc("/v1/enroll/challenge", api.EnrollChallenge)
+	mux.HandleFunc("/v1/auth/login", api.Login)
+	mux.HandleFunc("/v1/auth/logout", api.Logout)
 	// admin (v0 – no auth yet)
 	mux.HandleFunc("/v1/admin/agents", api.RequireServiceKey(api.AdminListAgents))
 	mux.HandleFunc("/v1/admin/agents/facts", api.RequireServiceKey(api.AdminAgentsFacts))
-	mux.HandleFunc("/v1/admin/agents/", api.RequireServiceKey(api.AdminLatestInventory))
-	mux.HandleFunc("/debug/sql", api.RequireServiceKey(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", 405)
-			return
-		}
-		body, _ := io.ReadAll(r.Body)
-		if len(body) == 0 {
-			http.Error(w, "empty body", 400)
-			return
-		}
-		if _, err := db.Exec(string(body)); err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		w.WriteHeader(200)
-		_, _ = w.Write([]byte("ok"))
-	}))
+	mux.HandleFunc("/v1/admin/agents/pending", api.RequireServiceKey(api.AdminPendingAgents))
+	mux.HandleFunc("/v1/admin/agents/stale", api.RequireServiceKey(api.AdminStaleAgents))
+	mux.HandleFunc("/v1/admin/agents/no-inventory", api.RequireServiceKey(api.AdminAgentsNoInventory))
+	mux.HandleFunc("/v1/admin/agents/needing-updates", api.RequireServiceKey(api.AdminAgentsNeedingUpdates))
+	mux.HandleFunc("/v1/admin/agents/events", api.RequireServiceKey(api.AdminFleetEvents))
+	mux.HandleFunc("/v1/admin/agents/queues", api.RequireServiceKey(api.AdminQueueDepths))
+	mux.HandleFunc("/v1/admin/agents/tags/bulk", api.RequireServiceKey(api.AdminBulkAgentTags))
+	mux.HandleFunc("/v1/admin/agents/", api.RequireServiceKey(api.AdminAgentRoutes))
+	mux.HandleFunc("/v1/admin/stats", api.RequireServiceKey(api.AdminStats))
+	mux.HandleFunc("/v1/admin/schema", api.RequireServiceKey(api.AdminSchema))
+	mux.HandleFunc("/v1/admin/stream/heartbeats", api.RequireServiceKey(api.AdminStreamHeartbeats))
+	mux.HandleFunc("/v1/admin/facts/distribution", api.RequireServiceKey(api.AdminFactsDistribution))
+	mux.HandleFunc("/v1/admin/facts/query", api.RequireServiceKey(api.AdminFactsQuery))
+	mux.HandleFunc("/v1/admin/jobs", api.RequireServiceKey(api.AdminListJobs))
+	mux.HandleFunc("/v1/admin/jobs/batch/", api.RequireServiceKey(api.AdminJobBatchRoutes))
+	mux.HandleFunc("/v1/admin/jobs/", api.RequireServiceKey(api.AdminJobRoutes))
+	mux.HandleFunc("/v1/admin/templates", api.RequireServiceKey(api.AdminTemplates))
+	mux.HandleFunc("/v1/admin/templates/", api.RequireServiceKey(api.AdminTemplateRoutes))
+	mux.HandleFunc("/v1/admin/groups", api.RequireServiceKey(api.AdminGroups))
+	mux.HandleFunc("/v1/admin/groups/", api.RequireServiceKey(api.AdminGroupRoutes))
+	mux.HandleFunc("/v1/admin/policies", api.RequireServiceKey(api.AdminPolicies))
+	mux.HandleFunc("/v1/admin/policies/", api.RequireServiceKey(api.AdminPolicyRoutes))
+	mux.HandleFunc("/v1/admin/dead-letter-results", api.RequireServiceKey(api.AdminDeadLetterResults))
+	mux.HandleFunc("/v1/admin/dead-letter-results/", api.RequireServiceKey(api.AdminDeadLetterResult))
+	mux.HandleFunc("/v1/admin/keys", api.RequireServiceKey(api.AdminServiceKeys))
+	mux.HandleFunc("/v1/admin/provisioning", api.RequireServiceKey(api.AdminProvisioning))
+	mux.HandleFunc("/v1/admin/enroll-keys", api.RequireServiceKey(api.AdminEnrollKeys))
+	mux.HandleFunc("/v1/admin/enroll-keys/", api.RequireServiceKey(api.AdminEnrollKeyRoutes))
+	mux.HandleFunc("/v1/admin/keys/", api.RequireServiceKey(api.AdminServiceKeyRoutes))
+	// POST /debug/sql only exists in binaries built with -tags debugsql
+	registerDebugSQL(mux, api, db)
+	// POST /v1/admin/debug/verify-signature only with -tags debugsig
+	registerDebugSignature(mux, api)
+	// Request latency histograms; RR_SLOW_REQUEST (default 2s) also logs slow requests
+	metrics := server.NewRequestMetrics(envDuration("RR_SLOW_REQUEST", 2*time.Second))
+	mux.HandleFunc("/metrics", api.RequireServiceKey(metrics.ServeHTTP))
 	// Signed endpoints
 	mux.HandleFunc("/v1/heartbeat", api.RequireAgentAuth(api.Heartbeat))
+	// Heartbeats forwarded by rr-relay; each entry is signed by its agent
+	mux.HandleFunc("/v1/heartbeat/batch", api.HeartbeatBatch)
 	mux.HandleFunc("/v1/job_result", api.RequireAgentAuth(api.JobResult))
+	mux.HandleFunc("/v1/ping", api.RequireAgentAuth(api.Ping))
+	mux.HandleFunc("/v1/agent/whoami", api.AllowDisabledAgentAuth(api.AgentWhoami))
+	mux.HandleFunc("/v1/hmac-secret", api.RequireAgentAuth(api.AgentHMACSecret))
 	// Polling + submit (v0)
-	mux.HandleFunc("/v1/jobs/poll", api.PollJobs)
+	mux.HandleFunc("/v1/jobs/poll", api.OptionalAgentAuth(api.PollJobs))
 	mux.HandleFunc("/v1/jobs/submit", api.SubmitJob)
-	mux.Handle("/", http.FileServer(http.Dir("./web/rmm-ui")))
+	// Web UI: RR_UI_DIR (default ./web/rmm-ui); a placeholder page if it's missing
+	uiDir := os.Getenv("RR_UI_DIR")
+	if uiDir == "" {
+		uiDir = "./web/rmm-ui"
+	}
+	mux.Handle("/", server.UIHandler(uiDir))
 	log.Printf("rr-server listening on %s", addr)
-	log.Printf("db: %s", dbPath)
-	log.Printf("enroll token: via RR_ENROLL_TOKEN")
+	if dbDriver == "sqlite" {
+		log.Printf("db: %s", dbPath)
+	} else {
+		log.Printf("db: %s (admin templates, keys, enroll keys, groups and stats unavailable)", dbDriver)
+	}
+	if api.RequireEnrollKey {
+		log.Printf("enroll: pre-authorized keys only (RR_REQUIRE_ENROLL_KEY)")
+	} else {
+		log.Printf("enroll token: via RR_ENROLL_TOKEN")
+	}
+	if api.RequireApproval {
+		log.Printf("enroll approval: manual (RR_REQUIRE_APPROVAL)")
+	}
+	log.Printf("agent auth: timestamps accepted within ±%ds of server time", api.AuthSkewSeconds)
 
-	log.Fatal(http.ListenAndServe(addr, mux))
+	// Connection timeouts bound how long a slow or stalled client can hold a
+	// connection. A handler that legitimately needs longer (e.g. a long-poll)
+	// should extend its own deadline with http.NewResponseController(w).
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           server.WithRequestID(metrics.Wrap(server.Recover(mux))), // request ids, timing + panic recovery on every route
+		ReadHeaderTimeout: envDuration("RR_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       envDuration("RR_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("RR_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       envDuration("RR_IDLE_TIMEOUT", 120*time.Second),
+	}
+
+	// HTTPS (optional): RR_TLS_CERT + RR_TLS_KEY (PEM files), RR_TLS_MIN_VERSION (default 1.2)
+	certFile, keyFile := os.Getenv("RR_TLS_CERT"), os.Getenv("RR_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatalf("RR_TLS_CERT and RR_TLS_KEY must be set together")
+	}
+	if certFile != "" {
+		srv.TLSConfig = &tls.Config{MinVersion: envTLSVersion("RR_TLS_MIN_VERSION", tls.VersionTLS12)}
+		log.Printf("tls: enabled (min version %s)", tls.VersionName(srv.TLSConfig.MinVersion))
+		log.Fatal(srv.ListenAndServeTLS(certFile, keyFile))
+	}
+	log.Printf("tls: disabled; agent payloads travel in cleartext (set RR_TLS_CERT/RR_TLS_KEY)")
+	log.Fatal(srv.ListenAndServe())
+}
+
+// envBool reports whether an env var is set to a truthy value (1/true/yes/on).
+func envBool(key string) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
+
+// envInt parses a positive integer from an env var.
+func envInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("config: ignoring invalid %s=%q (using %d)", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envTLSVersion parses a minimum TLS version ("1.2" or "1.3") from an env var.
+func envTLSVersion(key string, def uint16) uint16 {
+	v := strings.TrimSpace(os.Getenv(key))
+	switch v {
+	case "":
+		return def
+	case "1.2":
+		return tls.VersionTLS12
+	case "1.3":
+		return tls.VersionTLS13
+	}
+	log.Printf("config: ignoring invalid %s=%q (using %s)", key, v, tls.VersionName(def))
+	return def
+}
+
+// envDuration parses a Go duration (e.g. "30s", "8h") from an env var.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("config: ignoring invalid %s=%q (using %s)", key, v, def)
+		return def
+	}
+	return d
 }
@@ -2,7 +2,13 @@ module rackroom
 
 go 1.25
 
-require github.com/google/uuid v1.6.0
+require (
+	github.com/google/uuid v1.6.0
+	github.com/lib/pq v1.12.3
+	golang.org/x/crypto v0.42.0
+	golang.org/x/text v0.29.0
+	modernc.org/sqlite v1.42.2
+)
 
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
@@ -14,5 +20,4 @@ require (
 	modernc.org/libc v1.66.10 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.11.0 // indirect
-	modernc.org/sqlite v1.42.2 // indirect
 )
@@ -2,17 +2,23 @@ package agent
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"rackroom/internal/shared"
@@ -25,6 +31,31 @@ type Agent struct {
 	Client     *http.Client
 	invCache   []byte
 	lastInvAt  int64
+	invTriedAt int64 // last collection attempt, successful or not
+
+	invUnsupported bool   // set once collection reports errInventoryUnsupported
+	gzipRejected   bool   // server refused a gzip heartbeat; send plain from now on
+	invError       string // last collection failure, reported until one succeeds
+
+	// Free space on the agent's volume (see checkDisk).
+	diskCheckedAt   time.Time
+	diskFree        int64
+	diskPressure    bool
+	diskUnsupported bool
+
+	logFile *rotatingFile // nil without log_file
+
+	// Re-enrollment after the server forgot us (see ReenrollIfForgotten).
+	unknownStreak  int
+	reenrollWait   time.Duration
+	nextReenrollAt time.Time
+	reenrollHinted bool // "add an enroll_token" already logged
+
+	logAgentID atomic.Value // agent_id stamped on log_file lines
+
+	idMu sync.RWMutex // guards Cfg's identity fields (see identity.go)
+
+	jobs jobState // reported in heartbeats
 }
 
 func New(configPath string) (*Agent, error) {
@@ -35,18 +66,31 @@ func New(configPath string) (*Agent, error) {
 	a := &Agent{
 		ConfigPath: configPath,
 		Cfg:        cfg,
-		Client:     &http.Client{Timeout: 20 * time.Second},
+		Client:     &http.Client{Timeout: 20 * time.Second, Transport: requestIDTransport{http.DefaultTransport}},
+	}
+	if err := a.setupLogging(); err != nil {
+		return nil, err
 	}
 	if cfg.PrivateKeyPath == "" {
-		cfg.PrivateKeyPath = defaultKeyPath()
+		cfg.PrivateKeyPath = DefaultKeyPath()
+	}
+	if err := validateShells(cfg); err != nil {
+		return nil, err
 	}
 	if err := a.ensureKey(); err != nil {
 		return nil, err
 	}
+	if cfg.TimeOffsetSeconds != 0 {
+		log.Printf("clock: signing with time_offset_seconds=%d (local clock adjusted by %s)",
+			cfg.TimeOffsetSeconds, time.Duration(cfg.TimeOffsetSeconds)*time.Second)
+	}
+	a.loadInventoryCache()
 	return a, nil
 }
 
-func defaultKeyPath() string {
+// DefaultKeyPath is where the agent keeps its private key when
+// private_key_path isn't configured.
+func DefaultKeyPath() string {
 	if runtime.GOOS == "windows" {
 		return `C:\ProgramData\RackRoom\agent.key`
 	}
@@ -88,9 +132,11 @@ func (a *Agent) ensureKey() error {
 
 func (a *Agent) EnrollIfNeeded(ctx context.Context) error {
 	if a.Cfg.AgentID != "" {
+		a.syncIdentity(ctx)
+		a.ensureHMACSecret(ctx)
 		return nil
 	}
-	if a.Cfg.EnrollToken == "" {
+	if a.Cfg.EnrollToken == "" && !a.Cfg.EnrollWithKey {
 		return errors.New("missing enroll_token and no agent_id")
 	}
 
@@ -105,7 +151,18 @@ func (a *Agent) EnrollIfNeeded(ctx context.Context) error {
 			OS:       runtime.GOOS,
 			Arch:     runtime.GOARCH,
 		},
-		Tags: a.Cfg.Tags,
+		Tags:            a.Cfg.Tags,
+		Capabilities:    capabilities(a.Cfg),
+		ProtocolVersion: shared.ProtocolVersion,
+	}
+	if a.Cfg.EnrollWithKey {
+		challenge, err := a.enrollChallenge(ctx, pubB64)
+		if err != nil {
+			return err
+		}
+		req.EnrollToken = ""
+		req.Challenge = challenge
+		req.Signature = shared.SignEnrollChallenge(a.Priv, challenge)
 	}
 	body, _ := json.Marshal(req)
 
@@ -120,6 +177,12 @@ func (a *Agent) EnrollIfNeeded(ctx context.Context) error {
 	defer resp.Body.Close()
 
 	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		var er shared.EnrollResponse
+		_ = json.Unmarshal(b, &er)
+		return fmt.Errorf("enroll refused: agent protocol %d is older than the server minimum %d; upgrade the agent",
+			shared.ProtocolVersion, er.MinProtocolVersion)
+	}
 	if resp.StatusCode != 200 {
 		return errors.New("enroll failed: " + string(b))
 	}
@@ -127,11 +190,24 @@ func (a *Agent) EnrollIfNeeded(ctx context.Context) error {
 	var er shared.EnrollResponse
 	_ = json.Unmarshal(b, &er)
 
-	a.Cfg.AgentID = er.AgentID
-	a.Cfg.EnrollToken = "" // one-time use
-	if err := shared.SaveAgentConfig(a.ConfigPath, a.Cfg); err != nil {
+	if er.ProtocolVersion != 0 && er.ProtocolVersion < shared.ProtocolVersion {
+		log.Printf("enroll: server speaks protocol %d (agent %d); newer features may be unavailable",
+			er.ProtocolVersion, shared.ProtocolVersion)
+	}
+
+	a.updateIdentity(func(cfg *shared.AgentConfig) {
+		cfg.AgentID = er.AgentID
+		cfg.ServerProtocolVersion = er.ProtocolVersion
+		cfg.ServerMinProtocolVersion = er.MinProtocolVersion
+		cfg.EnrollToken = "" // one-time use
+		cfg.HMACSecret = ""  // belonged to the previous agent_id, if any
+	})
+	a.logAgentID.Store(er.AgentID)
+	if err := a.saveConfig(); err != nil {
 		return err
 	}
+	a.syncIdentity(ctx)
+	a.ensureHMACSecret(ctx)
 	return nil
 }
 
@@ -143,9 +219,11 @@ func hostname() string {
 	return h
 }
 
+// signedRequest builds a signed request for path, which may carry a query
+// string; the query is signed in canonical form so it can't be altered.
 func (a *Agent) signedRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
-	url := strings.TrimRight(a.Cfg.ServerURL, "/") + path
-	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	u := strings.TrimRight(a.Cfg.ServerURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -153,14 +231,21 @@ func (a *Agent) signedRequest(ctx context.Context, method, path string, body []b
 	pub := a.Priv.Public().(ed25519.PublicKey)
 	req.Header.Set("X-PubKey", base64.StdEncoding.EncodeToString(pub))
 
-	ts := time.Now().Unix()
+	ts := time.Now().Unix() + a.Cfg.TimeOffsetSeconds
 	tsStr := itoa(ts)
 
 	bodySha := shared.BodySHA256(body)
-	sig := shared.Sign(a.Priv, tsStr, method, path, bodySha)
+	query := shared.CanonicalQuery(req.URL.Query())
+	var sig string
+	if secret := a.hmacSecret(); secret != nil {
+		req.Header.Set(shared.AuthModeHeader, shared.AuthModeHMAC)
+		sig = shared.SignHMAC(secret, tsStr, method, req.URL.Path, query, bodySha)
+	} else {
+		sig = shared.Sign(a.Priv, tsStr, method, req.URL.Path, query, bodySha)
+	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Agent-Id", a.Cfg.AgentID)
+	req.Header.Set("X-Agent-Id", a.agentID())
 	req.Header.Set("X-Timestamp", tsStr)
 	req.Header.Set("X-Body-Sha256", bodySha)
 	req.Header.Set("X-Signature", sig)
@@ -191,50 +276,140 @@ func itoa(n int64) string {
 func (a *Agent) SendHeartbeat(ctx context.Context) error {
 	now := time.Now().Unix()
 
-	// Refresh inventory every 10 minutes (600s)
-	if a.invCache == nil || now-a.lastInvAt >= 600 {
-		if inv, err := collectInventoryJSON(); err == nil && len(inv) > 0 {
+	// Refresh inventory every InventorySeconds; a snapshot cached on disk by a
+	// previous run counts, so restarts don't all re-collect at once. A failed
+	// collection is retried on the same schedule, not on every heartbeat.
+	every := int64(a.Cfg.InventorySeconds)
+	if !a.invUnsupported && now-a.invTriedAt >= every && (a.invCache == nil || now-a.lastInvAt >= every) {
+		a.invTriedAt = now
+		timeout := time.Duration(a.Cfg.InventoryTimeoutSeconds) * time.Second
+		inv, err := collectInventoryJSON(ctx, timeout, inventoryOptions{
+			topProcesses: a.Cfg.InventoryProcesses,
+			peripherals:  a.Cfg.InventoryPeripherals,
+			updates:      a.Cfg.InventoryUpdates,
+		})
+		switch {
+		case errors.Is(err, errInventoryUnsupported):
+			a.invUnsupported = true
+			log.Printf("inventory: %v (%s); heartbeats will carry no inventory", err, runtime.GOOS)
+		case err != nil:
+			log.Printf("inventory: collect failed: %v", err)
+			a.invError = err.Error()
+		case len(inv) == 0:
+			log.Printf("inventory: collector returned no data")
+		default:
+			a.invError = ""
 			a.invCache = inv
 			a.lastInvAt = now
+			a.saveInventoryCache()
 		}
 	}
 
+	a.checkDisk(time.Now())
+
 	hb := shared.HeartbeatRequest{
-		AgentID: a.Cfg.AgentID,
+		AgentID: a.agentID(),
 		Info: shared.AgentInfo{
 			Hostname: hostname(),
 			OS:       runtime.GOOS,
 			Arch:     runtime.GOARCH,
 		},
-		Tags:      a.Cfg.Tags,
-		Inventory: a.invCache, // <-- []byte (json.RawMessage)
+		Tags:           a.Cfg.Tags,
+		Capabilities:   capabilities(a.Cfg),
+		Inventory:      a.invCache, // <-- []byte (json.RawMessage)
+		InventoryError: a.invError,
+
+		HeartbeatIntervalSeconds: a.Cfg.HeartbeatSeconds,
+		Jobs:                     a.jobs.snapshot(time.Now(), a.maxParallelJobs()),
+		DiskFreeBytes:            a.diskFree,
+		DiskPressure:             a.diskPressure,
+		QuickFacts:               collectQuickFacts(time.Now()),
 	}
 
 	body, _ := json.Marshal(hb)
 
-	req, err := a.signedRequest(ctx, "POST", "/v1/heartbeat", body)
+	// Inventory makes heartbeats the largest thing we upload; compress those.
+	if len(hb.Inventory) > 0 && !a.gzipRejected {
+		code, msg, err := a.postHeartbeat(ctx, body, true)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusBadRequest && code != http.StatusUnsupportedMediaType {
+			return heartbeatStatus(code, msg)
+		}
+		// Older servers can't read gzip bodies; fall through to a plain retry.
+		if code, msg, err = a.postHeartbeat(ctx, body, false); err != nil {
+			return err
+		}
+		if code == 200 {
+			log.Printf("heartbeat: server rejected gzip body; sending uncompressed from now on")
+			a.gzipRejected = true
+		}
+		return heartbeatStatus(code, msg)
+	}
+
+	code, msg, err := a.postHeartbeat(ctx, body, false)
 	if err != nil {
 		return err
 	}
+	return heartbeatStatus(code, msg)
+}
+
+// postHeartbeat sends one heartbeat. The signature (X-Body-Sha256) always
+// covers the uncompressed JSON, which is what the server hashes after
+// decoding.
+func (a *Agent) postHeartbeat(ctx context.Context, body []byte, compress bool) (int, string, error) {
+	req, err := a.signedRequest(ctx, "POST", "/v1/heartbeat", body)
+	if err != nil {
+		return 0, "", err
+	}
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return 0, "", err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+		req.ContentLength = int64(buf.Len())
+		req.GetBody = nil
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 
 	resp, err := a.Client.Do(req)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
-		return errors.New("heartbeat failed: " + string(b))
+		if err := busyError("heartbeat", resp, b); err != nil {
+			return resp.StatusCode, string(b), err
+		}
+		if err := unknownAgentError("heartbeat", resp.StatusCode, b); err != nil {
+			return resp.StatusCode, string(b), err
+		}
+		return resp.StatusCode, string(b), nil
 	}
+	return 200, "", nil
+}
 
+func heartbeatStatus(code int, msg string) error {
+	if code != 200 {
+		return errors.New("heartbeat failed: " + msg)
+	}
 	return nil
 }
 
-func (a *Agent) PollJobs(ctx context.Context) ([]shared.Job, error) {
-	// polling endpoint is not signed yet (fine for v0)
-	url := strings.TrimRight(a.Cfg.ServerURL, "/") + "/v1/jobs/poll?agent_id=" + a.Cfg.AgentID
-	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+// PollJobs asks for up to max queued jobs.
+func (a *Agent) PollJobs(ctx context.Context, max int) ([]shared.Job, error) {
+	// Signed (query included) so agent_id can't be swapped to drain another
+	// agent's queue.
+	req, err := a.signedRequest(ctx, "GET", "/v1/jobs/poll?agent_id="+url.QueryEscape(a.agentID())+"&max="+itoa(int64(max)), nil)
+	if err != nil {
+		return nil, err
+	}
 
 	resp, err := a.Client.Do(req)
 	if err != nil {
@@ -244,6 +419,12 @@ func (a *Agent) PollJobs(ctx context.Context) ([]shared.Job, error) {
 
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
+		if err := busyError("poll", resp, b); err != nil {
+			return nil, err
+		}
+		if err := unknownAgentError("poll", resp.StatusCode, b); err != nil {
+			return nil, err
+		}
 		return nil, errors.New("poll failed: " + string(b))
 	}
 
@@ -256,21 +437,60 @@ func (a *Agent) PollJobs(ctx context.Context) ([]shared.Job, error) {
 
 func (a *Agent) RunJob(ctx context.Context, job shared.Job) shared.JobResult {
 	start := time.Now().Unix()
-	exitCode, out, errOut := execCommand(ctx, job)
-	finish := time.Now().Unix()
-
-	return shared.JobResult{
-		JobID:      job.JobID,
-		AgentID:    a.Cfg.AgentID,
-		ExitCode:   exitCode,
-		Stdout:     out,
-		Stderr:     errOut,
-		StartedAt:  start,
-		FinishedAt: finish,
+	res := execCommand(ctx, job, a.Cfg)
+	res.JobID = job.JobID
+	res.AgentID = a.agentID()
+	res.StartedAt = start
+	res.FinishedAt = time.Now().Unix()
+	return res
+}
+
+// killGrace is how long execCommand waits, after killing a timed-out job,
+// for its output pipes to close. Children the shell started can keep them
+// open; past this point the output captured so far is returned as is.
+const killGrace = 2 * time.Second
+
+// execCommand runs job and returns the result's exit code, output and
+// output encoding (see encodeOutput); RunJob fills in the rest. On timeout
+// the process is killed, the output captured up to then is kept and marked
+// partial, and the exit code is shared.ExitCodeTimeout. Cancelling ctx (the
+// agent shutting down) kills it the same way but reports
+// shared.ExitCodeInterrupted. A shell the host can't run fails with
+// shared.ExitCodeShellUnavailable before anything is started. Jobs with
+// hooks are run by execHookedCommand.
+func execCommand(ctx context.Context, job shared.Job, cfg *shared.AgentConfig) shared.JobResult {
+	command, err := job.PlainCommand()
+	if err != nil {
+		return shared.JobResult{ExitCode: 1, Stderr: "[rr-agent] " + err.Error() + "\n"}
+	}
+	if job.HasHooks() {
+		return execHookedCommand(ctx, job, cfg, command)
 	}
+	st := runStep(ctx, job, cfg, command)
+	res := shared.JobResult{ExitCode: st.exitCode, TimedOut: st.timedOut, Interrupted: st.interrupted}
+	res.Stdout, res.Stderr, res.OutputEncoding = encodeOutput(st.stdout, st.stderr, cfg.OutputEncoding)
+	return res
+}
+
+// stepResult is the raw outcome of one script run by runStep.
+type stepResult struct {
+	exitCode       int
+	stdout, stderr []byte
+	timedOut       bool
+	interrupted    bool
 }
 
-func execCommand(ctx context.Context, job shared.Job) (int, string, string) {
+// markPartial appends note to stderr on a line of its own.
+func markPartial(stderr *bytes.Buffer, note string) {
+	if stderr.Len() > 0 && !bytes.HasSuffix(stderr.Bytes(), []byte("\n")) {
+		stderr.WriteString("\n")
+	}
+	stderr.WriteString("[rr-agent] " + note + "; output above is partial\n")
+}
+
+// runStep runs script in job's shell, as job's user, bounded by job's
+// timeout.
+func runStep(ctx context.Context, job shared.Job, cfg *shared.AgentConfig, script string) stepResult {
 	timeout := time.Duration(job.TimeoutSeconds) * time.Second
 	if timeout <= 0 {
 		timeout = 30 * time.Second
@@ -278,27 +498,36 @@ func execCommand(ctx context.Context, job shared.Job) (int, string, string) {
 	cctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	var cmd *exec.Cmd
-
-	switch strings.ToLower(job.Shell) {
-	case "bash":
-		cmd = exec.CommandContext(cctx, "bash", "-lc", job.Command)
-	case "cmd":
-		cmd = exec.CommandContext(cctx, "cmd.exe", "/C", job.Command)
-	default:
-		// fallback
-		if runtime.GOOS == "windows" {
-			cmd = exec.CommandContext(cctx, "cmd.exe", "/C", job.Command)
-		} else {
-			cmd = exec.CommandContext(cctx, "bash", "-lc", job.Command)
-		}
+	argv, err := shellArgv(cfg, job.Shell, script)
+	if err != nil {
+		return stepResult{exitCode: shared.ExitCodeShellUnavailable, stderr: []byte("[rr-agent] " + err.Error() + "\n")}
+	}
+
+	cmd, cleanup, err := commandFor(cctx, argv, job.RunAs, cfg.RunAsCredentials)
+	if err != nil {
+		return stepResult{exitCode: 1, stderr: []byte(err.Error())}
 	}
+	defer cleanup()
+	cmd.WaitDelay = killGrace
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
+
+	// Our own deadline, not the agent shutting down (that cancels ctx too).
+	if errors.Is(cctx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		markPartial(&stderr, "job timed out after "+timeout.String())
+		return stepResult{exitCode: shared.ExitCodeTimeout, stdout: stdout.Bytes(), stderr: stderr.Bytes(), timedOut: true}
+	}
+	// Killed because the agent is stopping; a step that finished on its own
+	// just before that keeps its real result.
+	if ctx.Err() != nil && err != nil {
+		markPartial(&stderr, "job interrupted: agent shutting down")
+		return stepResult{exitCode: shared.ExitCodeInterrupted, stdout: stdout.Bytes(), stderr: stderr.Bytes(), interrupted: true}
+	}
+
 	exitCode := 0
 	if err != nil {
 		exitCode = 1
@@ -306,11 +535,81 @@ func execCommand(ctx context.Context, job shared.Job) (int, string, string) {
 			exitCode = ee.ExitCode()
 		}
 	}
-	return exitCode, stdout.String(), stderr.String()
+	return stepResult{exitCode: exitCode, stdout: stdout.Bytes(), stderr: stderr.Bytes()}
 }
 
+// execHookedCommand runs pre_command, command and post_command as separate
+// steps, each delimited in both streams by a "[rr-agent] --- <step> ---"
+// line. A failing pre_command skips command; post_command always runs. The
+// job's exit code is the first non-zero step's, so a failed teardown isn't
+// hidden behind a successful command.
+func execHookedCommand(ctx context.Context, job shared.Job, cfg *shared.AgentConfig, command string) shared.JobResult {
+	var stdout, stderr bytes.Buffer
+	var res shared.JobResult
+	run := func(name, script string) int {
+		st := runStep(ctx, job, cfg, script)
+		for _, stream := range []struct {
+			buf *bytes.Buffer
+			out []byte
+		}{{&stdout, st.stdout}, {&stderr, st.stderr}} {
+			stream.buf.WriteString("[rr-agent] --- " + name + " ---\n")
+			stream.buf.Write(stream.out)
+			if len(stream.out) > 0 && !bytes.HasSuffix(stream.out, []byte("\n")) {
+				stream.buf.WriteString("\n")
+			}
+		}
+		if st.exitCode != 0 {
+			stderr.WriteString(fmt.Sprintf("[rr-agent] %s exited %d\n", name, st.exitCode))
+			if res.ExitCode == 0 {
+				res.ExitCode = st.exitCode
+			}
+		}
+		res.TimedOut = res.TimedOut || st.timedOut
+		res.Interrupted = res.Interrupted || st.interrupted
+		return st.exitCode
+	}
+
+	if job.PreCommand == "" || run("pre_command", job.PreCommand) == 0 {
+		run("command", command)
+	} else {
+		stderr.WriteString("[rr-agent] pre_command failed; command not run\n")
+	}
+	if job.PostCommand != "" && ctx.Err() == nil {
+		run("post_command", job.PostCommand)
+	}
+
+	res.Stdout, res.Stderr, res.OutputEncoding = encodeOutput(stdout.Bytes(), stderr.Bytes(), cfg.OutputEncoding)
+	return res
+}
+
+// postResultAttempts bounds how often PostResult waits out a busy server
+// before giving up on a result.
+const postResultAttempts = 4
+
+// PostResult uploads a job result. A result exists only in memory, so when
+// the server says it's busy (503 + Retry-After) we wait as told and retry
+// rather than drop it. Retrying never records a result twice: the server
+// keeps the first one and acknowledges repeats with "already_recorded".
 func (a *Agent) PostResult(ctx context.Context, res shared.JobResult) error {
 	body, _ := json.Marshal(res)
+	var err error
+	for i := 1; i <= postResultAttempts; i++ {
+		if err = a.postResult(ctx, body); err == nil {
+			return nil
+		}
+		wait, ok := RetryAfter(err)
+		if !ok || i == postResultAttempts {
+			break
+		}
+		log.Printf("job %s: %v", res.JobID, err)
+		if err := sleepCtx(ctx, wait); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (a *Agent) postResult(ctx context.Context, body []byte) error {
 	req, err := a.signedRequest(ctx, "POST", "/v1/job_result", body)
 	if err != nil {
 		return err
@@ -324,6 +623,12 @@ func (a *Agent) PostResult(ctx context.Context, res shared.JobResult) error {
 
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
+		if err := busyError("post result", resp, b); err != nil {
+			return err
+		}
+		if err := unknownAgentError("post result", resp.StatusCode, b); err != nil {
+			return err
+		}
 		return errors.New("post result failed: " + string(b))
 	}
 	return nil
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"context"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+func TestRunJobTimeoutKeepsPartialOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs bash and sleep")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not installed")
+	}
+
+	// Plain bash -c: the built-in bash -lc reads the login profile, which on
+	// some hosts alone takes longer than the timeout.
+	a := &Agent{Cfg: &shared.AgentConfig{AgentID: "agent-1", Shells: map[string][]string{"bash": {"bash", "-c"}}}}
+	job := shared.Job{JobID: "job-1", Shell: "bash", Command: "echo x; sleep 5", TimeoutSeconds: 1}
+
+	start := time.Now()
+	res := a.RunJob(context.Background(), job)
+	if took := time.Since(start); took > 1*time.Second+killGrace+time.Second {
+		t.Errorf("RunJob took %s, want about the 1s timeout", took)
+	}
+
+	if !res.TimedOut {
+		t.Errorf("TimedOut = false, want true")
+	}
+	if res.ExitCode != shared.ExitCodeTimeout {
+		t.Errorf("ExitCode = %d, want %d", res.ExitCode, shared.ExitCodeTimeout)
+	}
+	if !strings.Contains(res.Stdout, "x") {
+		t.Errorf("Stdout = %q, want the output written before the timeout", res.Stdout)
+	}
+	if !strings.Contains(res.Stderr, "output above is partial") {
+		t.Errorf("Stderr = %q, want the partial-output marker", res.Stderr)
+	}
+	if res.JobID != job.JobID || res.AgentID != "agent-1" {
+		t.Errorf("JobID/AgentID = %q/%q, want %q/agent-1", res.JobID, res.AgentID, job.JobID)
+	}
+}
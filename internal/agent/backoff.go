@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter caps how long one server hint can silence the agent, so a
+// bogus header can't take it offline for hours.
+const maxRetryAfter = 5 * time.Minute
+
+// ServerBusyError is a 503 that carried a Retry-After hint: the server is
+// temporarily overloaded (e.g. its database is locked) and asked clients to
+// wait instead of retrying straight away.
+type ServerBusyError struct {
+	Op         string
+	RetryAfter time.Duration
+	Msg        string
+}
+
+func (e *ServerBusyError) Error() string {
+	return fmt.Sprintf("%s: server busy, retry after %s: %s", e.Op, e.RetryAfter, e.Msg)
+}
+
+// RetryAfter reports the back-off the server asked for, if err carries one.
+func RetryAfter(err error) (time.Duration, bool) {
+	var be *ServerBusyError
+	if errors.As(err, &be) {
+		return be.RetryAfter, true
+	}
+	return 0, false
+}
+
+// busyError returns a ServerBusyError for a 503 with a usable Retry-After,
+// or nil for any other response (those keep their existing handling).
+func busyError(op string, resp *http.Response, body []byte) error {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return nil
+	}
+	return &ServerBusyError{Op: op, RetryAfter: d, Msg: strings.TrimSpace(string(body))}
+}
+
+// parseRetryAfter accepts both RFC 9110 forms: delay-seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if n, err := strconv.Atoi(v); err == nil {
+		if n < 0 {
+			return 0, false
+		}
+		d = time.Duration(n) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+	} else {
+		return 0, false
+	}
+	return min(d, maxRetryAfter), true
+}
+
+// sleepCtx waits for d or until ctx is done, whichever is first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// CheckResult is what a successful connectivity check learned.
+type CheckResult struct {
+	Ping    shared.PingResponse
+	Latency time.Duration
+	// ClockSkew is the server's clock minus ours (time_offset_seconds
+	// included), to the second.
+	ClockSkew time.Duration
+}
+
+// Check sends one signed GET /v1/ping through the same signing path as
+// heartbeats and polls, and turns the usual ways that goes wrong (DNS, TLS,
+// refused connection, clock skew, signature, deleted agent) into an error
+// that says which one it was. It never enrolls.
+func (a *Agent) Check(ctx context.Context) (*CheckResult, error) {
+	if a.Cfg.ServerURL == "" {
+		return nil, errors.New("server_url is not set in the config")
+	}
+	if a.Cfg.AgentID == "" {
+		return nil, errors.New("not enrolled yet (no agent_id in the config); run the agent once with an enroll_token")
+	}
+
+	req, err := a.signedRequest(ctx, "GET", "/v1/ping", nil)
+	if err != nil {
+		return nil, fmt.Errorf("bad server_url %q: %w", a.Cfg.ServerURL, err)
+	}
+	start := time.Now()
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, transportError(req.URL.Host, err)
+	}
+	defer resp.Body.Close()
+	latency := time.Since(start)
+	b, _ := io.ReadAll(resp.Body)
+
+	var body struct {
+		Error      string `json:"error"`
+		ServerTime int64  `json:"server_time"`
+	}
+	_ = json.Unmarshal(b, &body)
+	ours := time.Now().Unix() + a.Cfg.TimeOffsetSeconds
+	skew := time.Duration(body.ServerTime-ours) * time.Second
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var ping shared.PingResponse
+		if err := json.Unmarshal(b, &ping); err != nil || !ping.Ok {
+			return nil, fmt.Errorf("unexpected ping response: %s", strings.TrimSpace(string(b)))
+		}
+		return &CheckResult{Ping: ping, Latency: latency, ClockSkew: skew}, nil
+	case http.StatusUnauthorized:
+		switch body.Error {
+		case "timestamp outside window":
+			if body.ServerTime == 0 {
+				return nil, errors.New("clock skew: the server rejected our timestamp; check this host's system time")
+			}
+			return nil, fmt.Errorf("clock skew: our clock is %s; fix the system time (or set time_offset_seconds)", describeSkew(skew))
+		case "hmac not established":
+			return nil, errors.New("the server has no hmac signing secret for this agent; remove hmac_secret from the config so a new one is fetched")
+		case "bad signature":
+			if a.hmacSecret() != nil {
+				return nil, errors.New("hmac signature rejected: hmac_secret doesn't match the server's; remove it from the config so a new one is fetched")
+			}
+			return nil, fmt.Errorf("signature rejected: the key at %s isn't the one the server has for agent_id=%s (key replaced after enrolling?)",
+				a.Cfg.PrivateKeyPath, a.Cfg.AgentID)
+		case "unknown agent":
+			return nil, fmt.Errorf("the server doesn't know agent_id=%s (deleted?); add an enroll_token to the config to re-enroll", a.Cfg.AgentID)
+		case "agent identity mismatch":
+			return nil, fmt.Errorf("identity mismatch: agent_id=%s is registered with a different public key", a.Cfg.AgentID)
+		}
+	case http.StatusForbidden:
+		if body.Error == "agent disabled" {
+			return nil, fmt.Errorf("agent_id=%s is disabled on the server", a.Cfg.AgentID)
+		}
+	case http.StatusNotFound:
+		return nil, errors.New("the server has no /v1/ping; it is older than this agent (signing can't be checked)")
+	case http.StatusServiceUnavailable:
+		return nil, fmt.Errorf("server busy: %s", strings.TrimSpace(string(b)))
+	}
+	return nil, fmt.Errorf("unexpected HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+}
+
+// describeSkew phrases a server-minus-ours clock difference from our side.
+func describeSkew(skew time.Duration) string {
+	if skew < 0 {
+		return (-skew).String() + " ahead of the server's"
+	}
+	return skew.String() + " behind the server's"
+}
+
+// transportError names the network-level reason a request to host failed.
+func transportError(host string, err error) error {
+	var (
+		dnsErr  *net.DNSError
+		certErr *tls.CertificateVerificationError
+		recErr  tls.RecordHeaderError
+		netErr  net.Error
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return fmt.Errorf("DNS: can't resolve %q: %v", dnsErr.Name, dnsErr.Err)
+	case errors.As(err, &certErr):
+		return fmt.Errorf("TLS: the server's certificate isn't trusted: %v", certErr.Err)
+	case errors.As(err, &recErr):
+		return fmt.Errorf("TLS: handshake with %s failed; is server_url https:// for a plain-HTTP server?", host)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("connection refused by %s; is rr-server running and is the port right?", host)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("timed out talking to %s (firewall or wrong address?)", host)
+	}
+	return fmt.Errorf("request to %s failed: %w", host, err)
+}
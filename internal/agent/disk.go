@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// diskCheckInterval is how often heartbeats re-read the free space.
+const diskCheckInterval = time.Minute
+
+var errDiskUnsupported = errors.New("free space not available on this platform")
+
+// checkDisk refreshes diskFree and diskPressure from the volume holding the
+// agent's config (and normally its key, caches and log) at most every
+// diskCheckInterval. Entering pressure is logged and deletes the rotated log
+// files, the one thing the agent can free by itself. Main loop only.
+func (a *Agent) checkDisk(now time.Time) {
+	if a.Cfg.DiskMinFreeMB < 0 || a.diskUnsupported || now.Sub(a.diskCheckedAt) < diskCheckInterval {
+		return
+	}
+	a.diskCheckedAt = now
+
+	dir := filepath.Dir(a.ConfigPath)
+	free, err := diskFreeBytes(dir)
+	if errors.Is(err, errDiskUnsupported) {
+		a.diskUnsupported = true
+		return
+	}
+	if err != nil {
+		log.Printf("disk: checking free space of %s failed: %v", dir, err)
+		return
+	}
+	a.diskFree = int64(free)
+
+	min := uint64(a.Cfg.DiskMinFreeMB) << 20
+	switch {
+	case free < min && !a.diskPressure:
+		a.diskPressure = true
+		log.Printf("disk: only %d MB free on %s (disk_min_free_mb=%d); reporting disk pressure", free>>20, dir, a.Cfg.DiskMinFreeMB)
+		if a.logFile != nil {
+			if n := a.logFile.removeBackups(); n > 0 {
+				log.Printf("disk: removed %d rotated log file(s)", n)
+			}
+		}
+	case free >= min && a.diskPressure:
+		a.diskPressure = false
+		log.Printf("disk: %d MB free on %s again; disk pressure cleared", free>>20, dir)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows && !linux && !darwin && !freebsd
+
+package agent
+
+func diskFreeBytes(string) (uint64, error) {
+	return 0, errDiskUnsupported
+}
@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package agent
+
+import "syscall"
+
+// diskFreeBytes is the space available to the agent on the volume of path.
+func diskFreeBytes(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
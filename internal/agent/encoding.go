@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+
+	"rackroom/internal/shared"
+)
+
+// Job output is stored server-side as UTF-8 text. Windows console programs
+// usually write in the OEM code page (437/850/...), which shows up as mojibake
+// if we pass the bytes through unchanged.
+//
+// AgentConfig.OutputEncoding controls the conversion:
+//   - "" / "auto": keep valid UTF-8; otherwise decode with the system OEM
+//     code page on Windows (invalid bytes replaced elsewhere)
+//   - "utf-8":     never transcode (invalid bytes are replaced)
+//   - "cp437", "cp850", "cp1252", ...: always decode from that code page
+//
+// Output that isn't text at all (see isBinaryOutput) is sent base64-encoded
+// instead, with JobResult.OutputEncoding set, so the bytes survive intact.
+
+var codePages = map[int]encoding.Encoding{
+	437:  charmap.CodePage437,
+	850:  charmap.CodePage850,
+	852:  charmap.CodePage852,
+	855:  charmap.CodePage855,
+	858:  charmap.CodePage858,
+	860:  charmap.CodePage860,
+	862:  charmap.CodePage862,
+	863:  charmap.CodePage863,
+	865:  charmap.CodePage865,
+	866:  charmap.CodePage866,
+	874:  charmap.Windows874,
+	1250: charmap.Windows1250,
+	1251: charmap.Windows1251,
+	1252: charmap.Windows1252,
+	1253: charmap.Windows1253,
+	1254: charmap.Windows1254,
+	1255: charmap.Windows1255,
+	1256: charmap.Windows1256,
+	1257: charmap.Windows1257,
+	1258: charmap.Windows1258,
+}
+
+// codePageByName accepts "cp1252", "windows-1252", "ibm437" or a bare "1252".
+func codePageByName(name string) (encoding.Encoding, bool) {
+	n := strings.ToLower(strings.TrimSpace(name))
+	for _, p := range []string{"windows-", "cp", "ibm"} {
+		n = strings.TrimPrefix(n, p)
+	}
+	num, err := strconv.Atoi(n)
+	if err != nil {
+		return nil, false
+	}
+	enc, ok := codePages[num]
+	return enc, ok
+}
+
+// decodeOutput converts raw process output to UTF-8 according to mode.
+func decodeOutput(b []byte, mode string) string {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "utf-8", "utf8":
+		return strings.ToValidUTF8(string(b), "�")
+	case "", "auto":
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		if enc, ok := codePages[oemCodePage()]; ok {
+			return decodeWith(enc, b)
+		}
+		return strings.ToValidUTF8(string(b), "�")
+	}
+
+	if enc, ok := codePageByName(mode); ok {
+		return decodeWith(enc, b)
+	}
+	return strings.ToValidUTF8(string(b), "�")
+}
+
+func decodeWith(enc encoding.Encoding, b []byte) string {
+	out, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return strings.ToValidUTF8(string(b), "�")
+	}
+	return string(out)
+}
+
+// encodeOutput prepares stdout and stderr for a JobResult. If either is
+// binary, both are sent as base64 of the raw bytes and the encoding is
+// shared.PayloadEncodingBase64; otherwise both are decoded to UTF-8 per mode
+// and the encoding is "" (UTF-8).
+func encodeOutput(stdout, stderr []byte, mode string) (string, string, string) {
+	if isBinaryOutput(stdout, mode) || isBinaryOutput(stderr, mode) {
+		return base64.StdEncoding.EncodeToString(stdout), base64.StdEncoding.EncodeToString(stderr), shared.PayloadEncodingBase64
+	}
+	return decodeOutput(stdout, mode), decodeOutput(stderr, mode), ""
+}
+
+// isBinaryOutput reports whether b can't be turned into text without losing
+// bytes: it has NULs (text in any supported code page has none), or it isn't
+// valid UTF-8 and mode has no code page to decode it with.
+func isBinaryOutput(b []byte, mode string) bool {
+	if bytes.IndexByte(b, 0) >= 0 {
+		return true
+	}
+	if utf8.Valid(b) {
+		return false
+	}
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "utf-8", "utf8":
+		return true
+	case "", "auto":
+		_, ok := codePages[oemCodePage()]
+		return !ok
+	}
+	_, ok := codePageByName(mode)
+	return !ok
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package agent
+
+// oemCodePage returns 0: non-Windows output is expected to be UTF-8 already.
+func oemCodePage() int { return 0 }
@@ -0,0 +1,11 @@
+package agent
+
+import "syscall"
+
+var procGetOEMCP = syscall.NewLazyDLL("kernel32.dll").NewProc("GetOEMCP")
+
+// oemCodePage is the code page console programs write in by default.
+func oemCodePage() int {
+	cp, _, _ := procGetOEMCP.Call()
+	return int(cp)
+}
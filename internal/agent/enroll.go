@@ -1 +1,49 @@
 package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"rackroom/internal/shared"
+)
+
+// enrollChallenge asks the server for a challenge to sign for key
+// enrollment (enroll_with_key). The server only hands one out for a public
+// key an admin pre-authorized.
+func (a *Agent) enrollChallenge(ctx context.Context, pubB64 string) (string, error) {
+	body, _ := json.Marshal(shared.EnrollChallengeRequest{PublicKey: pubB64})
+	url := strings.TrimRight(a.Cfg.ServerURL, "/") + "/v1/enroll/challenge"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return "", fmt.Errorf("enroll refused: public key %s is not pre-authorized on the server (or its authorization expired or was used)", pubB64)
+	case http.StatusNotFound:
+		return "", fmt.Errorf("enroll failed: the server does not support key enrollment")
+	default:
+		return "", fmt.Errorf("enroll challenge failed: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+
+	var cr shared.EnrollChallengeResponse
+	if err := json.Unmarshal(b, &cr); err != nil || cr.Challenge == "" {
+		return "", fmt.Errorf("enroll challenge failed: unexpected response: %s", strings.TrimSpace(string(b)))
+	}
+	return cr.Challenge, nil
+}
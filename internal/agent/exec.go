@@ -1 +1,27 @@
 package agent
+
+import (
+	"rackroom/internal/shared"
+)
+
+// capabilities reports what execCommand can run on this host. It's sent on
+// enroll and every heartbeat so the server can refuse jobs we'd fail.
+func capabilities(cfg *shared.AgentConfig) []string {
+	caps := []string{
+		shared.CapabilityKind(shared.JobKindCommand),
+		shared.CapabilityKind(shared.JobKindUninstall),
+		shared.CapabilityKind(shared.JobKindGetFile),
+	}
+	for _, name := range availableShells(cfg) {
+		caps = append(caps, shared.CapabilityShell(name))
+	}
+	if runAsSupported(cfg) {
+		caps = append(caps, shared.CapabilityFeature("run_as"))
+	}
+	caps = append(caps, shared.CapabilityFeature("base64_command"))
+	caps = append(caps, shared.CapabilityFeature("job_hooks"))
+	if cfg.InventoryUpdates {
+		caps = append(caps, shared.CapabilityFeature("pending_updates"))
+	}
+	return caps
+}
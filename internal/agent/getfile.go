@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// GetFile handles a JobKindGetFile job: it reads the file named by
+// job.Command and returns its bytes base64-encoded in Stdout. Files over
+// shared.MaxGetFileBytes are refused rather than truncated, so a download is
+// always the whole file.
+func (a *Agent) GetFile(job shared.Job) shared.JobResult {
+	res := shared.JobResult{JobID: job.JobID, AgentID: a.agentID(), StartedAt: time.Now().Unix()}
+	b, err := readFileCapped(job.Command, shared.MaxGetFileBytes)
+	if err != nil {
+		res.ExitCode = 1
+		res.Stderr = "get_file: " + err.Error() + "\n"
+	} else {
+		res.Stdout = base64.StdEncoding.EncodeToString(b)
+		res.OutputEncoding = shared.PayloadEncodingBase64
+	}
+	res.FinishedAt = time.Now().Unix()
+	return res
+}
+
+// readFileCapped reads the regular file at path, failing if it holds more
+// than max bytes (checked on the read too, in case it grew since the stat).
+func readFileCapped(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	tooLarge := fmt.Errorf("%s is larger than %d bytes", path, max)
+	if fi.Size() > max {
+		return nil, tooLarge
+	}
+	b, err := io.ReadAll(io.LimitReader(f, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > max {
+		return nil, tooLarge
+	}
+	return b, nil
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"rackroom/internal/shared"
+)
+
+// hmacSecret is the decoded HMAC signing secret when hmac_signing is on and
+// one has been established, else nil (sign with ed25519).
+func (a *Agent) hmacSecret() []byte {
+	a.idMu.RLock()
+	encoded := a.Cfg.HMACSecret
+	a.idMu.RUnlock()
+	if !a.Cfg.HMACSigning || encoded == "" {
+		return nil
+	}
+	secret, err := shared.DecodeHMACSecret(encoded)
+	if err != nil {
+		return nil
+	}
+	return secret
+}
+
+// ensureHMACSecret fetches and saves an HMAC signing secret if hmac_signing
+// is on and there isn't one yet. Failing only costs speed: requests stay
+// ed25519-signed and the next start tries again.
+func (a *Agent) ensureHMACSecret(ctx context.Context) {
+	if !a.Cfg.HMACSigning || a.Cfg.AgentID == "" || a.hmacSecret() != nil {
+		return
+	}
+	// Drop an undecodable one so this request is ed25519-signed.
+	a.updateIdentity(func(cfg *shared.AgentConfig) { cfg.HMACSecret = "" })
+	secret, err := a.fetchHMACSecret(ctx)
+	if err != nil {
+		log.Printf("auth: no hmac signing secret, using ed25519: %v", err)
+		return
+	}
+	a.updateIdentity(func(cfg *shared.AgentConfig) { cfg.HMACSecret = secret })
+	if err := a.saveConfig(); err != nil {
+		log.Printf("auth: saving hmac signing secret failed (using it for this run only): %v", err)
+		return
+	}
+	log.Printf("auth: hmac signing enabled")
+}
+
+func (a *Agent) fetchHMACSecret(ctx context.Context) (string, error) {
+	req, err := a.signedRequest(ctx, "POST", "/v1/hmac-secret", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("the server does not support hmac signing")
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var hr shared.HMACSecretResponse
+	if err := json.Unmarshal(b, &hr); err != nil {
+		return "", fmt.Errorf("unexpected response: %s", strings.TrimSpace(string(b)))
+	}
+	if _, err := shared.DecodeHMACSecret(hr.Secret); err != nil {
+		return "", fmt.Errorf("server sent a bad secret: %w", err)
+	}
+	return hr.Secret, nil
+}
@@ -0,0 +1,33 @@
+package agent
+
+import "rackroom/internal/shared"
+
+// The identity part of Cfg (AgentID, EnrollToken, HMACSecret and the server
+// protocol versions) can change after start: enrolling, re-enrolling and
+// whoami rewrite it from the main loop while job workers are signing and
+// posting results. Writers go through updateIdentity and saveConfig; code
+// that may run off the main loop reads through agentID and hmacSecret. The
+// main loop itself may read those fields directly, since it is the only
+// writer.
+
+// agentID is Cfg.AgentID, safe to call from any goroutine.
+func (a *Agent) agentID() string {
+	a.idMu.RLock()
+	defer a.idMu.RUnlock()
+	return a.Cfg.AgentID
+}
+
+// updateIdentity applies f to Cfg with the identity lock held. Main loop
+// only.
+func (a *Agent) updateIdentity(f func(cfg *shared.AgentConfig)) {
+	a.idMu.Lock()
+	defer a.idMu.Unlock()
+	f(a.Cfg)
+}
+
+// saveConfig writes Cfg to ConfigPath.
+func (a *Agent) saveConfig() error {
+	a.idMu.RLock()
+	defer a.idMu.RUnlock()
+	return shared.SaveAgentConfig(a.ConfigPath, a.Cfg)
+}
@@ -1,10 +1,99 @@
 package agent
 
-import "runtime"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
 
-func collectInventoryJSON() ([]byte, error) {
-	if runtime.GOOS == "windows" {
-		return collectWindowsInventoryJSON()
+// errInventoryUnsupported is returned on platforms without a collector yet.
+// It's a distinct error (rather than a nil payload) so the heartbeat loop can
+// say so once instead of silently sending no inventory forever.
+var errInventoryUnsupported = errors.New("inventory collection not implemented on this OS")
+
+// inventoryOptions are the optional parts of an inventory snapshot.
+type inventoryOptions struct {
+	topProcesses int  // top N processes under "processes" (0 = off)
+	peripherals  bool // network drives and printers (Windows only)
+	updates      bool // pending OS updates under "pending_updates"
+}
+
+// collectInventoryJSON collects the platform inventory plus the optional
+// parts opts enables. The whole collection is bounded by timeout; collector
+// processes still running at the deadline are killed and a timeout error is
+// returned. The optional parts are added on a best-effort basis: if one
+// fails (or runs out of time) the snapshot is sent without it.
+func collectInventoryJSON(ctx context.Context, timeout time.Duration, opts inventoryOptions) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	inv, err := collectPlatformInventory(ctx, opts.peripherals)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("collector timed out after %s and was killed", timeout)
+		}
+		return nil, err
+	}
+	if opts.topProcesses > 0 {
+		if inv, err = withProcesses(ctx, inv, opts.topProcesses); err != nil {
+			log.Printf("inventory: process list failed: %v", err)
+		}
+	}
+	if opts.updates {
+		if inv, err = withPendingUpdates(ctx, inv); err != nil {
+			log.Printf("inventory: pending updates check failed: %v", err)
+		}
+	}
+	return inv, nil
+}
+
+// inventoryCacheFile holds the last collected inventory next to the agent
+// config, so a restarted agent can reuse it until it's InventorySeconds old.
+type inventoryCacheFile struct {
+	CollectedAt int64           `json:"collected_at"`
+	Inventory   json.RawMessage `json:"inventory"`
+}
+
+func (a *Agent) inventoryCachePath() string {
+	return filepath.Join(filepath.Dir(a.ConfigPath), "inventory_cache.json")
+}
+
+// loadInventoryCache seeds invCache from disk. A missing, unreadable or
+// future-dated cache is ignored; the next heartbeat simply collects fresh.
+func (a *Agent) loadInventoryCache() {
+	b, err := os.ReadFile(a.inventoryCachePath())
+	if err != nil {
+		return
+	}
+	var c inventoryCacheFile
+	if err := json.Unmarshal(b, &c); err != nil || len(c.Inventory) == 0 {
+		return
+	}
+	if c.CollectedAt > time.Now().Unix() {
+		return
+	}
+	a.invCache = c.Inventory
+	a.lastInvAt = c.CollectedAt
+}
+
+func (a *Agent) saveInventoryCache() {
+	b, err := json.Marshal(inventoryCacheFile{CollectedAt: a.lastInvAt, Inventory: a.invCache})
+	if err != nil {
+		return
+	}
+	// Write-then-rename so a crash mid-write never leaves a torn cache.
+	path := a.inventoryCachePath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		log.Printf("inventory: cache write failed: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Printf("inventory: cache write failed: %v", err)
 	}
-	return nil, nil // later: linux inventory
 }
@@ -0,0 +1,195 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// linuxInventory is the "linux" inventory schema (server.LinuxInventory).
+// Only the fields we can read cheaply are filled in so far; the server
+// ignores the rest when absent.
+type linuxInventory struct {
+	Schema      string `json:"schema"`
+	CollectedAt int64  `json:"collected_at"`
+	Hostname    string `json:"hostname"`
+
+	UptimeSeconds int64 `json:"uptime_seconds,omitempty"`
+	BootTime      int64 `json:"boot_time,omitempty"`
+
+	Timezone struct {
+		Name             string `json:"name"`
+		UTCOffsetMinutes int64  `json:"utc_offset_minutes"`
+	} `json:"timezone"`
+	Locale string `json:"locale"`
+
+	Gateways   []string `json:"gateways"`    // null = routing table unreadable
+	DNSServers []string `json:"dns_servers"` // null = no resolv.conf
+}
+
+func collectPlatformInventory(context.Context, bool) ([]byte, error) {
+	now := time.Now()
+	inv := linuxInventory{
+		Schema:      "linux",
+		CollectedAt: now.Unix(),
+		Hostname:    hostname(),
+		Locale:      linuxLocale(),
+		Gateways:    linuxGateways(),
+		DNSServers:  linuxDNSServers(),
+	}
+	if boot := linuxBootTime(); boot > 0 {
+		inv.BootTime = boot
+		inv.UptimeSeconds = max(now.Unix()-boot, 0)
+	}
+	_, offset := now.Zone()
+	inv.Timezone.Name = linuxTimezone()
+	inv.Timezone.UTCOffsetMinutes = int64(offset / 60)
+	return json.Marshal(inv)
+}
+
+// linuxBootTime reads the kernel's boot timestamp (btime in /proc/stat),
+// 0 if it can't.
+func linuxBootTime() int64 {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "btime "); ok {
+			n, _ := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// linuxGateways lists the IPv4 default routes' gateways from
+// /proc/net/route, one per interface that has one, in table order.
+func linuxGateways() []string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	const rtfGateway = 0x2
+	gateways := []string{}
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// Iface Destination Gateway Flags ..., addresses in host byte order
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 32)
+		if err != nil || flags&rtfGateway == 0 {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ip := net.IPv4(byte(gw), byte(gw>>8), byte(gw>>16), byte(gw>>24)).String()
+		if !slices.Contains(gateways, ip) {
+			gateways = append(gateways, ip)
+		}
+	}
+	return gateways
+}
+
+// linuxDNSServers lists the nameservers of /etc/resolv.conf. When that only
+// points at systemd-resolved's local stub, the upstream servers it forwards
+// to are read from the resolv.conf resolved maintains instead.
+func linuxDNSServers() []string {
+	servers := resolvConfNameservers("/etc/resolv.conf")
+	if len(servers) == 1 && servers[0] == "127.0.0.53" {
+		if upstream := resolvConfNameservers("/run/systemd/resolve/resolv.conf"); len(upstream) > 0 {
+			return upstream
+		}
+	}
+	return servers
+}
+
+// resolvConfNameservers returns the nameserver entries of a resolv.conf,
+// nil if it can't be read.
+func resolvConfNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	servers := []string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && !slices.Contains(servers, fields[1]) {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// linuxTimezone prefers TZ, then /etc/timezone (Debian/Ubuntu), then the
+// /etc/localtime symlink target (everything systemd-based).
+func linuxTimezone() string {
+	if tz := strings.TrimPrefix(os.Getenv("TZ"), ":"); tz != "" {
+		return tz
+	}
+	if b, err := os.ReadFile("/etc/timezone"); err == nil {
+		if tz := strings.TrimSpace(string(b)); tz != "" {
+			return tz
+		}
+	}
+	if target, err := filepath.EvalSymlinks("/etc/localtime"); err == nil {
+		if i := strings.Index(target, "zoneinfo/"); i >= 0 {
+			return target[i+len("zoneinfo/"):]
+		}
+	}
+	return time.Local.String()
+}
+
+// linuxLocale follows the usual precedence (LC_ALL, then LANG) and falls
+// back to the system default, since services usually run without LANG.
+func linuxLocale() string {
+	for _, k := range []string{"LC_ALL", "LANG"} {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	for _, path := range []string{"/etc/locale.conf", "/etc/default/locale"} {
+		if v := readEnvFileValue(path, "LANG"); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// readEnvFileValue returns KEY's value from a shell-style KEY=value file.
+func readEnvFileValue(path, key string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if v, ok := strings.CutPrefix(line, key+"="); ok {
+			return strings.Trim(v, `"'`)
+		}
+	}
+	return ""
+}
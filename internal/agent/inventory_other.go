@@ -0,0 +1,9 @@
+//go:build !windows && !linux
+
+package agent
+
+import "context"
+
+func collectPlatformInventory(context.Context, bool) ([]byte, error) {
+	return nil, errInventoryUnsupported // later: linux inventory
+}
@@ -2,12 +2,39 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"os/exec"
 )
 
-func collectWindowsInventoryJSON() ([]byte, error) {
+// windowsPeripheralsScript adds the optional network_drives and printers keys
+// to $inv. Either cmdlet can be missing (Server Core, no spooler) or fail for
+// a service account; that just leaves an empty list.
+const windowsPeripheralsScript = `
+$drives = @(Get-SmbMapping -ErrorAction SilentlyContinue | ForEach-Object {
+  [pscustomobject]@{
+    local_path = $_.LocalPath
+    remote_path = $_.RemotePath
+    status = [string]$_.Status
+  }
+})
+$printers = @(Get-Printer -ErrorAction SilentlyContinue | ForEach-Object {
+  [pscustomobject]@{
+    name = $_.Name
+    driver = $_.DriverName
+    port = $_.PortName
+    shared = [bool]$_.Shared
+    type = [string]$_.Type
+    status = [string]$_.PrinterStatus
+  }
+})
+$inv | Add-Member -NotePropertyName network_drives -NotePropertyValue $drives
+$inv | Add-Member -NotePropertyName printers -NotePropertyValue $printers
+`
+
+func collectWindowsInventoryJSON(ctx context.Context, peripherals bool) ([]byte, error) {
 	// PowerShell emits JSON we can forward directly to server.
-	// Keep it simple and stable: OS, CPU, RAM, disks, IPs, uptime.
+	// Keep it simple and stable: OS, CPU, RAM, disks, IPs, gateways and DNS
+	// servers, uptime/boot time.
 	script := `
 $os = Get-CimInstance Win32_OperatingSystem
 $cpu = Get-CimInstance Win32_Processor | Select-Object -First 1
@@ -19,10 +46,16 @@ $disks = Get-CimInstance Win32_LogicalDisk -Filter "DriveType=3" | ForEach-Objec
     FileSystem = $_.FileSystem
   }
 }
+$tz = [System.TimeZoneInfo]::Local
 $ips = Get-NetIPAddress -AddressFamily IPv4 -ErrorAction SilentlyContinue | Where-Object {$_.IPAddress -ne "127.0.0.1"} |
   Select-Object -ExpandProperty IPAddress
+$gateways = @(Get-NetRoute -AddressFamily IPv4 -DestinationPrefix "0.0.0.0/0" -ErrorAction SilentlyContinue |
+  Where-Object {$_.NextHop -ne "0.0.0.0"} | Select-Object -ExpandProperty NextHop -Unique)
+$dns = @(Get-DnsClientServerAddress -AddressFamily IPv4 -ErrorAction SilentlyContinue |
+  Select-Object -ExpandProperty ServerAddresses -Unique)
 
-[pscustomobject]@{
+$inv = [pscustomobject]@{
+  schema = "windows"
   collected_at = [int64]([DateTimeOffset]::UtcNow.ToUnixTimeSeconds())
   hostname = $env:COMPUTERNAME
   os = @{
@@ -40,12 +73,27 @@ $ips = Get-NetIPAddress -AddressFamily IPv4 -ErrorAction SilentlyContinue | Wher
     free_bytes  = [int64]$os.FreePhysicalMemory * 1024
   }
   uptime_seconds = [int64]((Get-Date) - $os.LastBootUpTime).TotalSeconds
+  boot_time = [int64]([DateTimeOffset]$os.LastBootUpTime).ToUnixTimeSeconds()
   disks = $disks
   ipv4 = $ips
-} | ConvertTo-Json -Depth 6 -Compress
+  gateways = $gateways
+  dns_servers = $dns
+  timezone = @{
+    name = $tz.Id
+    utc_offset_minutes = [int64]$tz.GetUtcOffset([DateTime]::Now).TotalMinutes
+  }
+  locale = (Get-Culture).Name
+}
 `
+	if peripherals {
+		script += windowsPeripheralsScript
+	}
+	script += "$inv | ConvertTo-Json -Depth 6 -Compress\n"
 
-	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	// CommandContext kills powershell at the deadline; WaitDelay stops a
+	// wedged WMI provider child holding the pipes open from blocking us.
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.WaitDelay = killGrace
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &out
@@ -54,3 +102,7 @@ $ips = Get-NetIPAddress -AddressFamily IPv4 -ErrorAction SilentlyContinue | Wher
 	}
 	return out.Bytes(), nil
 }
+
+func collectPlatformInventory(ctx context.Context, peripherals bool) ([]byte, error) {
+	return collectWindowsInventoryJSON(ctx, peripherals)
+}
@@ -1 +1,114 @@
 package agent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// JobRunner executes polled jobs on a bounded number of concurrent workers
+// and posts each result as soon as its job finishes, so one slow job doesn't
+// hold up quick ones.
+type JobRunner struct {
+	a   *Agent
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func (a *Agent) NewJobRunner() *JobRunner {
+	return &JobRunner{a: a, sem: make(chan struct{}, a.maxParallelJobs())}
+}
+
+func (a *Agent) maxParallelJobs() int {
+	if a.Cfg.MaxParallelJobs <= 0 {
+		return 1
+	}
+	return a.Cfg.MaxParallelJobs
+}
+
+// Free reports how many workers are idle right now. The main loop skips
+// polling when it's zero so the server doesn't mark jobs running that we
+// can't start yet.
+func (jr *JobRunner) Free() int {
+	return cap(jr.sem) - len(jr.sem)
+}
+
+// Submit schedules job on a worker. It never blocks the caller; if all
+// workers are busy the job waits for a free slot (or ctx cancellation).
+func (jr *JobRunner) Submit(ctx context.Context, job shared.Job) {
+	jr.wg.Add(1)
+	jr.a.jobs.queued()
+	go func() {
+		defer jr.wg.Done()
+
+		select {
+		case jr.sem <- struct{}{}:
+			jr.a.jobs.started()
+		case <-ctx.Done():
+			jr.a.jobs.dropped()
+			// The server already has it as running; say so instead of
+			// leaving it to the reaper.
+			log.Printf("job %s not started: %v", job.JobID, ctx.Err())
+			now := time.Now().Unix()
+			jr.post(ctx, shared.JobResult{
+				JobID:       job.JobID,
+				AgentID:     jr.a.agentID(),
+				ExitCode:    shared.ExitCodeInterrupted,
+				Stderr:      "[rr-agent] job not started: agent shutting down\n",
+				StartedAt:   now,
+				FinishedAt:  now,
+				Interrupted: true,
+			})
+			return
+		}
+		defer func() {
+			<-jr.sem
+			jr.a.jobs.done(time.Now())
+		}()
+
+		if job.Kind == shared.JobKindUninstall {
+			log.Printf("running job %s: uninstall", job.JobID)
+			jr.a.Uninstall(ctx, job)
+			return
+		}
+
+		if job.Kind == shared.JobKindGetFile {
+			log.Printf("running job %s: get_file %s", job.JobID, job.Command)
+			jr.post(ctx, jr.a.GetFile(job))
+			return
+		}
+
+		log.Printf("running job %s: %s", job.JobID, job.Command)
+		res := jr.a.RunJob(ctx, job)
+		if res.Interrupted {
+			log.Printf("job %s interrupted; posting partial result", job.JobID)
+		}
+		jr.post(ctx, res)
+	}()
+}
+
+// shutdownPostGrace is how long a result may still take to post once the
+// agent is stopping.
+const shutdownPostGrace = 10 * time.Second
+
+// post uploads res. Cancelling ctx (the agent stopping) doesn't abort the
+// upload but only starts a shutdownPostGrace countdown, so a job the shutdown
+// killed still gets its partial result to the server.
+func (jr *JobRunner) post(ctx context.Context, res shared.JobResult) {
+	pctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { time.AfterFunc(shutdownPostGrace, cancel) })
+	defer stop()
+
+	if err := jr.a.PostResult(pctx, res); err != nil {
+		log.Printf("post result error: %v", err)
+	}
+}
+
+// Wait blocks until every submitted job has finished.
+func (jr *JobRunner) Wait() {
+	jr.wg.Wait()
+}
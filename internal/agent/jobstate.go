@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// recentJobsWindow is how far back heartbeats count finished jobs.
+const recentJobsWindow = 15 * time.Minute
+
+// jobState counts what the JobRunner is doing, for heartbeats. The zero value
+// is ready to use.
+type jobState struct {
+	mu       sync.Mutex
+	running  int
+	waiting  int
+	finished []time.Time // within recentJobsWindow, oldest first
+	last     time.Time
+}
+
+// queued is a polled job waiting for a worker.
+func (s *jobState) queued() {
+	s.mu.Lock()
+	s.waiting++
+	s.mu.Unlock()
+}
+
+// started moves a queued job to running.
+func (s *jobState) started() {
+	s.mu.Lock()
+	s.waiting--
+	s.running++
+	s.mu.Unlock()
+}
+
+// dropped is a queued job that never started (the agent is stopping).
+func (s *jobState) dropped() {
+	s.mu.Lock()
+	s.waiting--
+	s.mu.Unlock()
+}
+
+// done is a running job that finished at now.
+func (s *jobState) done(now time.Time) {
+	s.mu.Lock()
+	s.running--
+	s.finished = append(s.pruneLocked(now), now)
+	s.last = now
+	s.mu.Unlock()
+}
+
+func (s *jobState) snapshot(now time.Time, maxParallel int) *shared.AgentJobState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = s.pruneLocked(now)
+	st := &shared.AgentJobState{
+		Running:             s.running,
+		Waiting:             s.waiting,
+		MaxParallel:         maxParallel,
+		CompletedRecent:     len(s.finished),
+		RecentWindowSeconds: int(recentJobsWindow / time.Second),
+	}
+	if !s.last.IsZero() {
+		st.LastFinishedAt = s.last.Unix()
+	}
+	return st
+}
+
+func (s *jobState) pruneLocked(now time.Time) []time.Time {
+	i := 0
+	for i < len(s.finished) && now.Sub(s.finished[i]) > recentJobsWindow {
+		i++
+	}
+	return s.finished[i:]
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultLogMaxSizeMB = 10
+	// logBackups is how many rotated files (log_file.1 ... .3) are kept.
+	logBackups = 3
+)
+
+// setupLogging sends everything logged through the log package to
+// cfg.LogFile as structured key=value lines carrying the agent_id, rotating
+// the file at log_max_size_mb. Without a log_file, logging stays on stderr.
+func (a *Agent) setupLogging() error {
+	if a.Cfg.LogFile == "" {
+		return nil
+	}
+	maxMB := a.Cfg.LogMaxSizeMB
+	if maxMB <= 0 {
+		maxMB = defaultLogMaxSizeMB
+	}
+	f, err := openRotatingFile(a.Cfg.LogFile, int64(maxMB)<<20)
+	if err != nil {
+		return fmt.Errorf("log_file: %w", err)
+	}
+	a.logFile = f
+	a.logAgentID.Store(a.Cfg.AgentID)
+	// Once slog has a default handler, log.Printf goes through it too.
+	slog.SetDefault(slog.New(agentLogHandler{Handler: slog.NewTextHandler(f, nil), agentID: &a.logAgentID}))
+	return nil
+}
+
+// agentLogHandler adds the current agent_id to every record; it changes
+// when the agent (re-)enrolls, so it can't be a fixed attribute.
+type agentLogHandler struct {
+	slog.Handler
+	agentID *atomic.Value
+}
+
+func (h agentLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, _ := h.agentID.Load().(string); id != "" {
+		r.AddAttrs(slog.String("agent_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h agentLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return agentLogHandler{Handler: h.Handler.WithAttrs(attrs), agentID: h.agentID}
+}
+
+func (h agentLogHandler) WithGroup(name string) slog.Handler {
+	return agentLogHandler{Handler: h.Handler.WithGroup(name), agentID: h.agentID}
+}
+
+// requestIDTransport logs every request the server answered with an error
+// status, with the request id the server echoed, so an agent-side failure
+// can be found in the server log.
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 400 {
+		slog.Warn("server request failed",
+			"method", req.Method, "path", req.URL.Path, "status", resp.StatusCode,
+			"request_id", resp.Header.Get("X-Request-Id"))
+	}
+	return resp, err
+}
+
+// rotatingFile is an append-only log file that is renamed to path.1 (older
+// ones shifting up to path.<logBackups>) once a write would take it past max.
+type rotatingFile struct {
+	path string
+	max  int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, max int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, max: max}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.max {
+		// A failed rotation keeps writing to the current file; losing
+		// rotation beats losing log lines.
+		_ = r.rotate()
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// removeBackups deletes the rotated files (path.1 ... path.<logBackups>)
+// and returns how many there were.
+func (r *rotatingFile) removeBackups() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for i := 1; i <= logBackups; i++ {
+		if os.Remove(fmt.Sprintf("%s.%d", r.path, i)) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// rotate closes the file before renaming it, which Windows requires.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	for i := logBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
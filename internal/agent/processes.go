@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+)
+
+// processInfo is one entry of the optional "processes" inventory key.
+// CPUSeconds is CPU time used since the process started (what Task Manager
+// and Get-Process call CPU), not a current percentage.
+type processInfo struct {
+	PID        int     `json:"pid"`
+	Name       string  `json:"name"`
+	CPUSeconds float64 `json:"cpu_seconds"`
+	RSSBytes   int64   `json:"rss_bytes"`
+}
+
+// topProcesses keeps the n heaviest processes by CPU time and the n heaviest
+// by memory (so at most 2n), ordered by CPU time.
+func topProcesses(all []processInfo, n int) []processInfo {
+	if n <= 0 || len(all) == 0 {
+		return nil
+	}
+	keep := map[int]bool{}
+	pick := func(less func(a, b processInfo) bool) {
+		sort.Slice(all, func(i, j int) bool { return less(all[i], all[j]) })
+		for i := 0; i < n && i < len(all); i++ {
+			keep[all[i].PID] = true
+		}
+	}
+	pick(func(a, b processInfo) bool { return a.RSSBytes > b.RSSBytes })
+	pick(func(a, b processInfo) bool { return a.CPUSeconds > b.CPUSeconds })
+
+	out := make([]processInfo, 0, len(keep))
+	for _, p := range all { // still sorted by CPU
+		if keep[p.PID] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// withProcesses adds the top-n process list to an inventory JSON object.
+// Collection failures leave the inventory as it was; processes are a
+// troubleshooting extra, not worth losing a snapshot over.
+func withProcesses(ctx context.Context, inv []byte, n int) ([]byte, error) {
+	all, err := collectProcesses(ctx)
+	if err != nil {
+		return inv, err
+	}
+	return withInventoryKey(inv, "processes", topProcesses(all, n))
+}
+
+// withInventoryKey sets key to v in an inventory JSON object, returning inv
+// unchanged on error.
+func withInventoryKey(inv []byte, key string, v any) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(inv, &doc); err != nil {
+		return inv, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return inv, err
+	}
+	doc[key] = b
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return inv, err
+	}
+	return out, nil
+}
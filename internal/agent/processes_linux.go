@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is USER_HZ, the unit of utime/stime in /proc/<pid>/stat. It's
+// 100 on every mainstream Linux build.
+const clockTicks = 100
+
+// collectProcesses reads /proc directly; processes that exit mid-scan or
+// can't be read are skipped.
+func collectProcesses(ctx context.Context) ([]processInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pageSize := int64(os.Getpagesize())
+
+	var out []processInfo
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		if p, ok := parseProcStat(pid, string(b), pageSize); ok {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// parseProcStat parses "pid (comm) state ppid ...". comm may itself contain
+// spaces and parentheses, so the fields are split after the last ')'.
+func parseProcStat(pid int, stat string, pageSize int64) (processInfo, bool) {
+	open := strings.IndexByte(stat, '(')
+	end := strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return processInfo{}, false
+	}
+	fields := strings.Fields(stat[end+1:])
+	// fields[0] is state (field 3); utime/stime are fields 14/15, rss is 24.
+	if len(fields) < 22 {
+		return processInfo{}, false
+	}
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+	return processInfo{
+		PID:        pid,
+		Name:       stat[open+1 : end],
+		CPUSeconds: float64(utime+stime) / clockTicks,
+		RSSBytes:   rss * pageSize,
+	}, true
+}
@@ -0,0 +1,9 @@
+//go:build !windows && !linux
+
+package agent
+
+import "context"
+
+func collectProcesses(context.Context) ([]processInfo, error) {
+	return nil, errInventoryUnsupported
+}
@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+)
+
+func collectProcesses(ctx context.Context) ([]processInfo, error) {
+	// CPU is $null for processes we aren't allowed to query; those count as 0.
+	// -InputObject keeps a one-element result an array.
+	script := `$p = @(Get-Process | ForEach-Object {
+  [pscustomobject]@{ pid = $_.Id; name = $_.ProcessName; cpu_seconds = [double]$_.CPU; rss_bytes = [int64]$_.WorkingSet64 }
+})
+ConvertTo-Json -InputObject $p -Compress`
+
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.WaitDelay = killGrace
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	var procs []processInfo
+	if err := json.Unmarshal(out.Bytes(), &procs); err != nil {
+		return nil, err
+	}
+	return procs, nil
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// collectQuickFacts reads memory from /proc/meminfo, the root filesystem's
+// size with statfs and the boot time from /proc/stat. Whatever can't be read
+// is left zero.
+func collectQuickFacts(now time.Time) *shared.QuickFacts {
+	q := &shared.QuickFacts{CollectedAt: now.Unix()}
+	q.RAMTotalBytes, q.RAMFreeBytes = linuxMemory()
+
+	var st syscall.Statfs_t
+	if syscall.Statfs("/", &st) == nil {
+		q.DiskTotalBytes = int64(st.Blocks) * int64(st.Bsize)
+		q.DiskFreeBytes = int64(st.Bavail) * int64(st.Bsize)
+	}
+	if boot := linuxBootTime(); boot > 0 {
+		q.BootTime = boot
+		q.UptimeSeconds = max(now.Unix()-boot, 0)
+	}
+	return q
+}
+
+// linuxMemory returns MemTotal and MemAvailable (what can be allocated
+// without swapping, page cache included) in bytes.
+func linuxMemory() (total, available int64) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// "MemTotal:       16318480 kB"
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !linux
+
+package agent
+
+import (
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// collectQuickFacts has no implementation on this OS; heartbeats carry none.
+func collectQuickFacts(time.Time) *shared.QuickFacts {
+	return nil
+}
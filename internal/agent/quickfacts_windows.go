@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"rackroom/internal/shared"
+)
+
+var (
+	procGlobalMemoryStatusEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GlobalMemoryStatusEx")
+	procGetTickCount64       = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount64")
+	procGetLogicalDrives     = syscall.NewLazyDLL("kernel32.dll").NewProc("GetLogicalDrives")
+	procGetDriveTypeW        = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDriveTypeW")
+)
+
+// memoryStatusEx is MEMORYSTATUSEX.
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+const driveFixed = 3 // DRIVE_FIXED, Win32_LogicalDisk DriveType=3
+
+// collectQuickFacts uses kernel32 directly, so unlike the inventory it
+// starts no PowerShell. Disk figures sum the fixed drives, as the
+// inventory's do.
+func collectQuickFacts(now time.Time) *shared.QuickFacts {
+	q := &shared.QuickFacts{CollectedAt: now.Unix()}
+
+	ms := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	if r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms))); r != 0 {
+		q.RAMTotalBytes = int64(ms.TotalPhys)
+		q.RAMFreeBytes = int64(ms.AvailPhys)
+	}
+
+	if r, _, _ := procGetTickCount64.Call(); r != 0 {
+		q.UptimeSeconds = int64(r) / 1000
+		q.BootTime = now.Unix() - q.UptimeSeconds
+	}
+
+	drives, _, _ := procGetLogicalDrives.Call()
+	for i := 0; i < 26; i++ {
+		if drives&(1<<i) == 0 {
+			continue
+		}
+		root, err := syscall.UTF16PtrFromString(string(rune('A'+i)) + `:\`)
+		if err != nil {
+			continue
+		}
+		if t, _, _ := procGetDriveTypeW.Call(uintptr(unsafe.Pointer(root))); t != driveFixed {
+			continue
+		}
+		var avail, total, free uint64
+		r, _, _ := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(root)),
+			uintptr(unsafe.Pointer(&avail)), uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+		if r != 0 {
+			q.DiskTotalBytes += int64(total)
+			q.DiskFreeBytes += int64(free)
+		}
+	}
+	return q
+}
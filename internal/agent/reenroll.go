@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// ErrUnknownAgent is wrapped into the error of a signed request the server
+// answered with "unknown agent" (401 from its auth check, 404 from a poll):
+// it no longer has a record for our agent_id (typically an admin deleted
+// it). Retrying as is can never succeed.
+var ErrUnknownAgent = errors.New("server does not know this agent_id")
+
+const (
+	// reenrollAfter is how many unknown-agent answers in a row it takes
+	// before we give up on the stored agent_id, so a single odd response
+	// (a server restored from an old backup, say) doesn't trigger it.
+	reenrollAfter = 3
+
+	// Re-enroll attempts are spaced out, doubling up to the max, so an agent
+	// that keeps getting forgotten (or has a bad token) doesn't hammer enroll.
+	reenrollFirstWait = 5 * time.Minute
+	reenrollMaxWait   = time.Hour
+)
+
+// unknownAgentError returns an error wrapping ErrUnknownAgent if the response
+// is the server's "unknown agent" rejection, nil otherwise.
+func unknownAgentError(op string, code int, body []byte) error {
+	if code != http.StatusUnauthorized && code != http.StatusNotFound {
+		return nil
+	}
+	var e struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &e) != nil || e.Error != "unknown agent" {
+		return nil
+	}
+	return fmt.Errorf("%s failed: %w", op, ErrUnknownAgent)
+}
+
+// ReenrollIfForgotten is fed the outcome of each heartbeat and poll. After
+// reenrollAfter unknown-agent errors in a row it drops the stored agent_id
+// and enrolls again, using the enroll_token currently in the config file
+// (the one from the first enrollment was cleared, so an operator drops a new
+// one in to let the agent rejoin). If enrolling fails the old agent_id is
+// kept and the next attempt waits longer. With enroll_with_key no token is
+// needed, but the key must be pre-authorized again. Call it from the main
+// loop only.
+func (a *Agent) ReenrollIfForgotten(ctx context.Context, err error) {
+	if !errors.Is(err, ErrUnknownAgent) {
+		if err == nil {
+			a.unknownStreak = 0
+			a.reenrollHinted = false
+		}
+		return
+	}
+	a.unknownStreak++
+	now := time.Now()
+	if a.unknownStreak < reenrollAfter || now.Before(a.nextReenrollAt) {
+		return
+	}
+
+	// Looking for a token is just a file read, so it's done every time; only
+	// actual enroll attempts are spaced out.
+	oldID := a.Cfg.AgentID
+	onDisk, lerr := shared.LoadAgentConfig(a.ConfigPath)
+	if lerr != nil || (onDisk.EnrollToken == "" && !a.Cfg.EnrollWithKey) {
+		if !a.reenrollHinted {
+			log.Printf("enroll: server no longer knows agent_id=%s; add an enroll_token to %s to re-enroll",
+				oldID, a.ConfigPath)
+			a.reenrollHinted = true
+		}
+		return
+	}
+
+	if a.reenrollWait == 0 {
+		a.reenrollWait = reenrollFirstWait
+	} else {
+		a.reenrollWait = min(a.reenrollWait*2, reenrollMaxWait)
+	}
+	a.nextReenrollAt = now.Add(a.reenrollWait)
+
+	log.Printf("enroll: server no longer knows agent_id=%s; re-enrolling", oldID)
+	a.updateIdentity(func(cfg *shared.AgentConfig) {
+		cfg.AgentID = ""
+		cfg.EnrollToken = onDisk.EnrollToken
+	})
+	if err := a.EnrollIfNeeded(ctx); err != nil {
+		a.updateIdentity(func(cfg *shared.AgentConfig) {
+			cfg.AgentID = oldID
+			cfg.EnrollToken = ""
+		})
+		log.Printf("enroll: re-enroll failed: %v (next attempt in %s)", err, a.reenrollWait)
+		return
+	}
+	log.Printf("enroll: re-enrolled as agent_id=%s (was %s)", a.Cfg.AgentID, oldID)
+	a.unknownStreak = 0
+	a.reenrollWait = 0
+	a.nextReenrollAt = time.Time{}
+	a.reenrollHinted = false
+}
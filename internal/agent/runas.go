@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"context"
+	"os/exec"
+
+	"rackroom/internal/shared"
+)
+
+// commandFor builds the command for job, switching user first when the job
+// asks for run_as. cleanup must be called once the command has finished.
+// A run_as that can't be honoured is an error; the job never silently runs
+// as the agent's own account instead.
+func commandFor(ctx context.Context, argv []string, ra *shared.RunAs, creds map[string]shared.RunAsCredential) (*exec.Cmd, func(), error) {
+	if ra == nil || (ra.User == "" && ra.Credential == "") {
+		return exec.CommandContext(ctx, argv[0], argv[1:]...), func() {}, nil
+	}
+	return runAsCommand(ctx, argv, ra, creds)
+}
@@ -0,0 +1,77 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"rackroom/internal/shared"
+)
+
+// runAsSupported: as root we can switch user ourselves; otherwise only if
+// sudo is around (whether it lets us is only known when a job runs).
+func runAsSupported(*shared.AgentConfig) bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	_, err := exec.LookPath("sudo")
+	return err == nil
+}
+
+func runAsCommand(ctx context.Context, argv []string, ra *shared.RunAs, _ map[string]shared.RunAsCredential) (*exec.Cmd, func(), error) {
+	if ra.User == "" {
+		return nil, nil, errors.New("run_as: user is required")
+	}
+	u, err := user.Lookup(ra.User)
+	if err != nil {
+		return nil, nil, fmt.Errorf("run_as: unknown user %q", ra.User)
+	}
+
+	if os.Geteuid() != 0 {
+		if cur, err := user.Current(); err == nil && cur.Uid == u.Uid {
+			return exec.CommandContext(ctx, argv[0], argv[1:]...), func() {}, nil
+		}
+		if _, err := exec.LookPath("sudo"); err != nil {
+			return nil, nil, errors.New("run_as: agent is not running as root and sudo is not installed")
+		}
+		// -n fails with "a password is required" instead of hanging on a prompt.
+		args := append([]string{"-n", "-H", "-u", u.Username, "--"}, argv...)
+		return exec.CommandContext(ctx, "sudo", args...), func() {}, nil
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("run_as: bad uid for %q", ra.User)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("run_as: bad gid for %q", ra.User)
+	}
+	var groups []uint32
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := strconv.ParseUint(id, 10, 32); err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}}
+	cmd.Env = append(os.Environ(), "HOME="+u.HomeDir, "USER="+u.Username, "LOGNAME="+u.Username)
+	if st, err := os.Stat(u.HomeDir); err == nil && st.IsDir() {
+		cmd.Dir = u.HomeDir
+	}
+	return cmd, func() {}, nil
+}
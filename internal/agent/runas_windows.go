@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"rackroom/internal/shared"
+)
+
+var procLogonUserW = syscall.NewLazyDLL("advapi32.dll").NewProc("LogonUserW")
+
+const (
+	logon32LogonInteractive = 2
+	logon32ProviderDefault  = 0
+)
+
+// runAsSupported: a Windows logon needs a password, so run_as only works for
+// credentials configured on this agent.
+func runAsSupported(cfg *shared.AgentConfig) bool {
+	return len(cfg.RunAsCredentials) > 0
+}
+
+// runAsCommand logs the credential's user on and starts the command with
+// that token (CreateProcessAsUser). The agent service account needs the
+// "Replace a process level token" right, which LocalSystem has.
+func runAsCommand(ctx context.Context, argv []string, ra *shared.RunAs, creds map[string]shared.RunAsCredential) (*exec.Cmd, func(), error) {
+	if ra.Credential == "" {
+		return nil, nil, errors.New("run_as: Windows jobs need run_as.credential (an entry in the agent's run_as_credentials)")
+	}
+	c, ok := creds[ra.Credential]
+	if !ok {
+		return nil, nil, fmt.Errorf("run_as: unknown credential %q", ra.Credential)
+	}
+	if ra.User != "" && !strings.EqualFold(ra.User, c.User) {
+		return nil, nil, fmt.Errorf("run_as: credential %q is for user %q, not %q", ra.Credential, c.User, ra.User)
+	}
+
+	domain := c.Domain
+	if domain == "" {
+		domain = "."
+	}
+	tok, err := logonUser(c.User, domain, c.Password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("run_as: logon failed for %s\\%s: %v", domain, c.User, err)
+	}
+
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Token: tok, HideWindow: true}
+	return cmd, func() { tok.Close() }, nil
+}
+
+func logonUser(user, domain, password string) (syscall.Token, error) {
+	u, err := syscall.UTF16PtrFromString(user)
+	if err != nil {
+		return 0, err
+	}
+	d, err := syscall.UTF16PtrFromString(domain)
+	if err != nil {
+		return 0, err
+	}
+	p, err := syscall.UTF16PtrFromString(password)
+	if err != nil {
+		return 0, err
+	}
+	var h syscall.Handle
+	r, _, e := procLogonUserW.Call(
+		uintptr(unsafe.Pointer(u)),
+		uintptr(unsafe.Pointer(d)),
+		uintptr(unsafe.Pointer(p)),
+		logon32LogonInteractive,
+		logon32ProviderDefault,
+		uintptr(unsafe.Pointer(&h)),
+	)
+	if r == 0 {
+		return 0, e
+	}
+	return syscall.Token(h), nil
+}
@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+
+	"rackroom/internal/shared"
+)
+
+// shellSpec is how a job shell name turns into a process: argv with the
+// command appended, after wrap (if any) has adjusted it.
+type shellSpec struct {
+	argv []string
+	wrap func(command string) string
+}
+
+var builtinShells = map[string]shellSpec{
+	"bash": {argv: []string{"bash", "-lc"}},
+	"cmd":  {argv: []string{"cmd.exe", "/C"}},
+	"powershell": {
+		argv: []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command"},
+		// Force UTF-8 on the pipe so output needs no guessing.
+		wrap: func(command string) string {
+			return "[Console]::OutputEncoding = [System.Text.Encoding]::UTF8; " + command
+		},
+	},
+}
+
+// DefaultShell is the shell for jobs that don't name one when default_shell
+// isn't configured.
+func DefaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "cmd"
+	}
+	return "bash"
+}
+
+// shellFor looks up name (the default shell if empty) in the configured
+// shells, then the built-ins.
+func shellFor(cfg *shared.AgentConfig, name string) (string, shellSpec, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = strings.ToLower(cfg.DefaultShell)
+		if name == "" {
+			name = DefaultShell()
+		}
+	}
+	for n, argv := range cfg.Shells {
+		if strings.ToLower(n) == name {
+			return name, shellSpec{argv: argv}, true
+		}
+	}
+	spec, ok := builtinShells[name]
+	return name, spec, ok
+}
+
+// shellArgv builds the argv for running command in shell, failing with a
+// readable error when the shell is unknown or its binary isn't installed
+// rather than letting exec report a bare "file not found".
+func shellArgv(cfg *shared.AgentConfig, shell, command string) ([]string, error) {
+	name, spec, ok := shellFor(cfg, shell)
+	if !ok {
+		return nil, fmt.Errorf("shell %q is not configured on this agent", name)
+	}
+	if _, err := exec.LookPath(spec.argv[0]); err != nil {
+		return nil, fmt.Errorf("shell %q is not available on this host (%s not found)", name, spec.argv[0])
+	}
+	if spec.wrap != nil {
+		command = spec.wrap(command)
+	}
+	return append(append([]string(nil), spec.argv...), command), nil
+}
+
+// availableShells lists the shell names whose binary is installed, sorted.
+func availableShells(cfg *shared.AgentConfig) []string {
+	var out []string
+	seen := map[string]bool{}
+	check := func(name string) {
+		name = strings.ToLower(name)
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		_, spec, _ := shellFor(cfg, name)
+		if _, err := exec.LookPath(spec.argv[0]); err == nil {
+			out = append(out, name)
+		}
+	}
+	for name := range cfg.Shells {
+		check(name)
+	}
+	for name := range builtinShells {
+		check(name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// validateShells checks the shells config at startup. A malformed entry or
+// an unknown default_shell is an error; a configured shell whose binary is
+// missing is only logged, since jobs for it fail cleanly anyway.
+func validateShells(cfg *shared.AgentConfig) error {
+	for name, argv := range cfg.Shells {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("shells: empty shell name")
+		}
+		if len(argv) == 0 || strings.TrimSpace(argv[0]) == "" {
+			return fmt.Errorf("shells: %q needs at least a program, e.g. [\"/bin/sh\", \"-c\"]", name)
+		}
+		if _, err := exec.LookPath(argv[0]); err != nil {
+			log.Printf("shells: %q (%s) not found on this host; jobs using it will fail", name, argv[0])
+		}
+	}
+	name, spec, ok := shellFor(cfg, "")
+	if !ok {
+		return fmt.Errorf("default_shell %q is neither configured in shells nor built in", name)
+	}
+	if _, err := exec.LookPath(spec.argv[0]); err != nil {
+		log.Printf("shells: default shell %q (%s) not found on this host; set default_shell", name, spec.argv[0])
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// DefaultServiceName is the service the agent is registered as when
+// service_name isn't configured.
+func DefaultServiceName() string {
+	if runtime.GOOS == "windows" {
+		return "RackRoomAgent"
+	}
+	return "rr-agent"
+}
+
+// Uninstall handles a JobKindUninstall job: it reports success first (the key
+// is needed to sign the result), then deletes the key, config and inventory
+// cache, deregisters the service and exits the process. It refuses unless the
+// job's Confirm matches this agent's id. The agent binary itself is left in
+// place.
+func (a *Agent) Uninstall(ctx context.Context, job shared.Job) {
+	start := time.Now().Unix()
+	agentID := a.agentID()
+	res := shared.JobResult{JobID: job.JobID, AgentID: agentID, StartedAt: start}
+
+	if job.Confirm == "" || job.Confirm != agentID {
+		res.ExitCode = 1
+		res.Stderr = "uninstall: confirm does not match this agent's id; refusing"
+		res.FinishedAt = time.Now().Unix()
+		if err := a.PostResult(ctx, res); err != nil {
+			log.Printf("post result error: %v", err)
+		}
+		return
+	}
+
+	service := a.Cfg.ServiceName
+	if service == "" {
+		service = DefaultServiceName()
+	}
+	res.Stdout = "uninstalling agent " + agentID + " (service " + service + ")\n"
+	res.FinishedAt = time.Now().Unix()
+
+	// Without a recorded result the server would show the job running
+	// forever, so only proceed once it has been told.
+	if err := a.PostResult(ctx, res); err != nil {
+		log.Printf("uninstall: aborted, could not report result: %v", err)
+		return
+	}
+
+	for _, path := range []string{
+		a.Cfg.PrivateKeyPath,
+		a.inventoryCachePath(),
+		a.inventoryCachePath() + ".tmp",
+		a.ConfigPath,
+	} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("uninstall: remove %s: %v", path, err)
+		}
+	}
+	if err := deregisterService(service); err != nil {
+		log.Printf("uninstall: %v", err)
+	}
+
+	log.Printf("uninstall: agent %s removed; exiting", agentID)
+	os.Exit(0)
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// deregisterService disables the systemd unit and queues its stop. The stop
+// is --no-block because it stops this very process; we exit right after.
+func deregisterService(name string) error {
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return nil // not systemd; nothing registered
+	}
+	unit := name + ".service"
+	if err := exec.Command("systemctl", "cat", unit).Run(); err != nil {
+		return nil // no such unit (agent run by hand)
+	}
+	if out, err := exec.Command("systemctl", "disable", unit).CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl disable %s: %v: %s", unit, err, strings.TrimSpace(string(out)))
+	}
+	return exec.Command("systemctl", "stop", "--no-block", unit).Run()
+}
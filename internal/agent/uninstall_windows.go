@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// deregisterService removes the Windows service entry. A running service is
+// only marked for deletion; the SCM drops it once this process exits.
+func deregisterService(name string) error {
+	if err := exec.Command("sc.exe", "query", name).Run(); err != nil {
+		return nil // not installed as a service
+	}
+	if out, err := exec.Command("sc.exe", "delete", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("sc delete %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
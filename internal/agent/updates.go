@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"context"
+	"strings"
+)
+
+// maxReportedUpdates caps the update list in a snapshot; Count is always the
+// full number.
+const maxReportedUpdates = 200
+
+// pendingUpdates is the optional "pending_updates" inventory key
+// (server.PendingUpdates).
+type pendingUpdates struct {
+	Source  string          `json:"source"` // "windows_update" | "apt" | "dnf" | "yum"
+	Count   int             `json:"count"`
+	Updates []pendingUpdate `json:"updates"`
+}
+
+// pendingUpdate is one available update. Version is the candidate package
+// version (Linux); KB and Severity come from Windows Update. Security is
+// false when the source can't tell.
+type pendingUpdate struct {
+	Title    string `json:"title"`
+	Version  string `json:"version,omitempty"`
+	KB       string `json:"kb,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Security bool   `json:"security,omitempty"`
+}
+
+// withPendingUpdates adds the pending OS updates to an inventory JSON
+// object. Like processes, a failed check leaves the inventory as it was.
+func withPendingUpdates(ctx context.Context, inv []byte) ([]byte, error) {
+	pu, err := collectPendingUpdates(ctx)
+	if err != nil {
+		return inv, err
+	}
+	pu.Count = len(pu.Updates)
+	if len(pu.Updates) > maxReportedUpdates {
+		pu.Updates = pu.Updates[:maxReportedUpdates]
+	}
+	if pu.Updates == nil {
+		pu.Updates = []pendingUpdate{}
+	}
+	return withInventoryKey(inv, "pending_updates", pu)
+}
+
+// firstLine is the first line of a tool's stderr, for error messages.
+func firstLine(s string) string {
+	s, _, _ = strings.Cut(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// collectPendingUpdates lists upgradable packages with whichever package
+// manager the host has. apt reports against the package lists from the last
+// "apt update"; dnf/yum may refresh expired metadata first.
+func collectPendingUpdates(ctx context.Context) (*pendingUpdates, error) {
+	if _, err := exec.LookPath("apt"); err == nil {
+		out, err := runUpdateTool(ctx, "apt", "list", "--upgradable")
+		if err != nil {
+			return nil, err
+		}
+		return &pendingUpdates{Source: "apt", Updates: parseAptUpgradable(out)}, nil
+	}
+	for _, tool := range []string{"dnf", "yum"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		out, err := runUpdateTool(ctx, tool, "-q", "check-update")
+		if err != nil {
+			return nil, err
+		}
+		return &pendingUpdates{Source: tool, Updates: parseCheckUpdate(out)}, nil
+	}
+	return nil, errors.New("no supported package manager (apt, dnf, yum)")
+}
+
+// runUpdateTool runs a package manager listing. check-update exits 100 when
+// updates are available, which isn't a failure.
+func runUpdateTool(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.WaitDelay = killGrace
+	cmd.Env = append(cmd.Environ(), "LC_ALL=C")
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 100) {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, firstLine(stderr.String()))
+	}
+	return out.Bytes(), nil
+}
+
+// parseAptUpgradable parses "apt list --upgradable" lines like
+//
+//	openssl/jammy-updates,jammy-security 3.0.2-0ubuntu1.15 amd64 [upgradable from: 3.0.2-0ubuntu1.14]
+//
+// A package counts as a security update when one of its suites is *-security.
+func parseAptUpgradable(out []byte) []pendingUpdate {
+	var updates []pendingUpdate
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		name, suites, ok := strings.Cut(fields[0], "/")
+		if !ok {
+			continue // "Listing..." and warnings
+		}
+		updates = append(updates, pendingUpdate{
+			Title:    name,
+			Version:  fields[1],
+			Security: strings.Contains(suites, "-security"),
+		})
+	}
+	return updates
+}
+
+// parseCheckUpdate parses "dnf/yum check-update" lines ("name.arch version
+// repo"), stopping at the obsoletes section.
+func parseCheckUpdate(out []byte) []pendingUpdate {
+	var updates []pendingUpdate
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "Obsoleting Packages") {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasPrefix(line, " ") {
+			continue
+		}
+		updates = append(updates, pendingUpdate{Title: fields[0], Version: fields[1]})
+	}
+	return updates
+}
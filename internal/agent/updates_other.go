@@ -0,0 +1,9 @@
+//go:build !windows && !linux
+
+package agent
+
+import "context"
+
+func collectPendingUpdates(context.Context) (*pendingUpdates, error) {
+	return nil, errInventoryUnsupported
+}
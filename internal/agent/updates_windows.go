@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+)
+
+// collectPendingUpdates asks the Windows Update Agent (COM) for applicable
+// updates that aren't installed or hidden. The search goes to Windows Update
+// or the configured WSUS server, so it can be slow.
+func collectPendingUpdates(ctx context.Context) (*pendingUpdates, error) {
+	script := `$searcher = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher()
+$result = $searcher.Search("IsInstalled=0 and IsHidden=0 and Type='Software'")
+$u = @($result.Updates | ForEach-Object {
+  [pscustomobject]@{
+    title = $_.Title
+    kb = (@($_.KBArticleIDs) | ForEach-Object { "KB$_" }) -join ","
+    severity = [string]$_.MsrcSeverity
+    security = [bool](@($_.Categories) | Where-Object { $_.Name -eq "Security Updates" })
+  }
+})
+ConvertTo-Json -InputObject $u -Compress`
+
+	cmd := exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.WaitDelay = killGrace
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("windows update search: %w: %s", err, firstLine(stderr.String()))
+	}
+	var updates []pendingUpdate
+	if err := json.Unmarshal(out.Bytes(), &updates); err != nil {
+		return nil, err
+	}
+	return &pendingUpdates{Source: "windows_update", Updates: updates}, nil
+}
@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"rackroom/internal/shared"
+)
+
+// syncIdentity asks the server who we are and adopts the canonical agent_id
+// if it differs from the configured one (the server re-associated us by
+// public key, e.g. after the config was restored from another machine's
+// backup). Failures are only logged: an older server has no whoami, and the
+// agent works as before without it.
+func (a *Agent) syncIdentity(ctx context.Context) {
+	if a.Cfg.AgentID == "" {
+		return
+	}
+	who, err := a.Whoami(ctx)
+	if err != nil {
+		log.Printf("whoami: %v", err)
+		return
+	}
+	if who.Disabled {
+		log.Printf("whoami: agent_id=%s is disabled on the server", who.AgentID)
+	}
+	if who.AgentID == "" || who.AgentID == a.Cfg.AgentID {
+		return
+	}
+	log.Printf("whoami: server knows this key as agent_id=%s (configured %s); adopting it", who.AgentID, a.Cfg.AgentID)
+	a.updateIdentity(func(cfg *shared.AgentConfig) { cfg.AgentID = who.AgentID })
+	a.logAgentID.Store(who.AgentID)
+	if err := a.saveConfig(); err != nil {
+		log.Printf("whoami: saving agent_id failed (using it for this run only): %v", err)
+	}
+}
+
+// Whoami sends a signed GET /v1/agent/whoami.
+func (a *Agent) Whoami(ctx context.Context) (*shared.WhoamiResponse, error) {
+	req, err := a.signedRequest(ctx, "GET", "/v1/agent/whoami", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("the server does not support whoami")
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var who shared.WhoamiResponse
+	if err := json.Unmarshal(b, &who); err != nil {
+		return nil, fmt.Errorf("unexpected response: %s", strings.TrimSpace(string(b)))
+	}
+	return &who, nil
+}
@@ -1 +1,171 @@
 package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// -----------------------------------------------------------------------------
+// Operator sessions (browser UI auth)
+// -----------------------------------------------------------------------------
+//
+// The bundled web UI can't carry X-RR-Key without embedding it in JS, so
+// operators log in with a password instead. A successful login sets a
+// short-lived HttpOnly session cookie that RequireServiceKey accepts as an
+// alternative to the service key.
+//
+// The password is configured as a bcrypt hash (RR_UI_PASSWORD_HASH); generate
+// one with `echo -n 'secret' | rr-server -hash-password`.
+
+const sessionCookieName = "rr_session"
+
+// SessionStore holds active operator sessions in memory. Sessions don't
+// survive a server restart, which is fine for a short-lived login.
+type SessionStore struct {
+	TTL time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]int64 // token -> expires_at (unix)
+}
+
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	if ttl <= 0 {
+		ttl = 8 * time.Hour
+	}
+	return &SessionStore{TTL: ttl, sessions: make(map[string]int64)}
+}
+
+func (ss *SessionStore) Create() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	now := time.Now().Unix()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for t, exp := range ss.sessions {
+		if exp <= now {
+			delete(ss.sessions, t)
+		}
+	}
+	ss.sessions[token] = now + int64(ss.TTL/time.Second)
+	return token, nil
+}
+
+func (ss *SessionStore) Valid(token string) bool {
+	if ss == nil || token == "" {
+		return false
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	exp, ok := ss.sessions[token]
+	if !ok {
+		return false
+	}
+	if exp <= time.Now().Unix() {
+		delete(ss.sessions, token)
+		return false
+	}
+	return true
+}
+
+func (ss *SessionStore) Delete(token string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.sessions, token)
+}
+
+// validSession reports whether the request carries a live operator session.
+func (api *API) validSession(r *http.Request) bool {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return false
+	}
+	return api.Sessions.Valid(c.Value)
+}
+
+// Login exchanges the operator password for a session cookie.
+//
+// Route:
+//   POST /v1/auth/login   body: {"password": "..."}
+
+func (api *API) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if api.UIPasswordHash == "" || api.Sessions == nil {
+		writeJSON(w, 404, map[string]any{"error": "operator login not configured"})
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(api.UIPasswordHash), []byte(req.Password)) != nil {
+		log.Printf("auth: operator login failed remote=%s", api.clientIP(r))
+		writeJSON(w, 401, map[string]any{"error": "invalid password"})
+		return
+	}
+
+	token, err := api.Sessions.Create()
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "session error"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(api.Sessions.TTL / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, 200, map[string]any{"ok": true, "expires_in": int(api.Sessions.TTL / time.Second)})
+}
+
+// Logout ends the caller's session (if any) and clears the cookie.
+//
+// Route:
+//   POST /v1/auth/logout
+
+func (api *API) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil && api.Sessions != nil {
+		api.Sessions.Delete(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
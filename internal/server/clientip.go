@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Client IP resolution (reverse-proxy aware)
+// -----------------------------------------------------------------------------
+//
+// Behind a reverse proxy r.RemoteAddr is the proxy, not the client.
+// X-Forwarded-For is only honored when the direct peer is in TrustedProxies;
+// otherwise anyone could claim any address by setting the header. Use
+// api.clientIP(r) anywhere a client address is logged or keyed on. The same
+// goes for X-Forwarded-Proto, read by api.requestTLS(r).
+
+// TrustedProxies is a list of networks whose X-Forwarded-For we believe.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs or bare IPs
+// (e.g. "10.0.0.0/8, 127.0.0.1").
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var out TrustedProxies
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", part, err)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func (tp TrustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the best-known client address for r.
+//
+// With a trusted peer, X-Forwarded-For is walked right to left (each proxy
+// appends the address it received from) and the first untrusted hop is the
+// client. If every hop is trusted, the left-most one is used.
+func (api *API) clientIP(r *http.Request) string {
+	peer := peerHost(r)
+	if len(api.TrustedProxies) == 0 || !api.TrustedProxies.contains(net.ParseIP(peer)) {
+		return peer
+	}
+
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(h, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				hops = append(hops, part)
+			}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Garbage in the chain: stop at the last address we could verify.
+			break
+		}
+		client = ip.String()
+		if !api.TrustedProxies.contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// requestTLS reports whether r reached us over TLS: directly, or through a
+// trusted proxy whose X-Forwarded-Proto (the last value, the one it set)
+// says https.
+func (api *API) requestTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !api.TrustedProxies.contains(net.ParseIP(peerHost(r))) {
+		return false
+	}
+	vals := r.Header.Values("X-Forwarded-Proto")
+	if len(vals) == 0 {
+		return false
+	}
+	last := vals[len(vals)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.EqualFold(strings.TrimSpace(last), "https")
+}
+
+// peerHost is the address of the direct peer, without the port.
+func peerHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// TestConcurrentEnrollHeartbeatPoll runs many agents' enroll, heartbeat and
+// poll traffic against one server at once; run it with -race to check the
+// handlers' shared state.
+func TestConcurrentEnrollHeartbeatPoll(t *testing.T) {
+	api, _ := newTestAPI(t)
+	api.EnrollToken = "tok"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/enroll", api.Enroll)
+	mux.HandleFunc("/v1/heartbeat", api.RequireAgentAuth(api.Heartbeat))
+	mux.HandleFunc("/v1/jobs/poll", api.OptionalAgentAuth(api.PollJobs))
+	srv := httptest.NewServer(WithRequestID(Recover(mux)))
+	defer srv.Close()
+
+	const agents, rounds = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, agents)
+	for i := 0; i < agents; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := runTestAgent(srv.URL, i, rounds); err != nil {
+				errs <- fmt.Errorf("agent %d: %w", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	list, err := api.Store.ListAgents(100)
+	if err != nil {
+		t.Fatalf("ListAgents: %v", err)
+	}
+	if len(list) != agents {
+		t.Errorf("%d agents enrolled, want %d", len(list), agents)
+	}
+}
+
+// runTestAgent enrolls one agent, then heartbeats and polls rounds times.
+func runTestAgent(base string, i, rounds int) error {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	pubB64 := base64.StdEncoding.EncodeToString(pub)
+	info := shared.AgentInfo{Hostname: "host-" + strconv.Itoa(i), OS: "linux", Arch: "amd64"}
+
+	var enrolled shared.EnrollResponse
+	body, _ := json.Marshal(shared.EnrollRequest{EnrollToken: "tok", PublicKey: pubB64, Info: info})
+	if err := doTestRequest(http.MethodPost, base+"/v1/enroll", body, nil, &enrolled); err != nil {
+		return fmt.Errorf("enroll: %w", err)
+	}
+
+	signed := func(method, path, query string, body []byte) http.Header {
+		return signAgentRequest(priv, enrolled.AgentID, method, path, query, body)
+	}
+	for r := 0; r < rounds; r++ {
+		hb, _ := json.Marshal(shared.HeartbeatRequest{AgentID: enrolled.AgentID, Info: info})
+		if err := doTestRequest(http.MethodPost, base+"/v1/heartbeat", hb, signed(http.MethodPost, "/v1/heartbeat", "", hb), nil); err != nil {
+			return fmt.Errorf("heartbeat %d: %w", r, err)
+		}
+		q := "agent_id=" + enrolled.AgentID
+		if err := doTestRequest(http.MethodGet, base+"/v1/jobs/poll?"+q, nil, signed(http.MethodGet, "/v1/jobs/poll", q, nil), nil); err != nil {
+			return fmt.Errorf("poll %d: %w", r, err)
+		}
+	}
+	return nil
+}
+
+// doTestRequest sends one request and decodes a 200 answer into out (if
+// non-nil); any other status is an error. Like an agent, it retries a 503
+// (SQLite busy with another writer), after a short pause instead of the
+// Retry-After the server asks for.
+func doTestRequest(method, url string, body []byte, h http.Header, out any) error {
+	var (
+		status int
+		b      []byte
+	)
+	for attempt := 0; attempt < 20; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+		}
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		b, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if status = resp.StatusCode; status != http.StatusServiceUnavailable {
+			break
+		}
+	}
+	if status != 200 {
+		return fmt.Errorf("HTTP %d: %s", status, bytes.TrimSpace(b))
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
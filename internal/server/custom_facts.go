@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Custom facts (site-defined inventory keys)
+// -----------------------------------------------------------------------------
+//
+// Sites add their own fields to the inventory (an asset tag, a department)
+// through collector additions; the built-in facts only know the fields of the
+// OS models. RR_CUSTOM_FACTS_FILE names such fields by their path in the
+// inventory JSON:
+//
+//	# <name>       <path>
+//	asset_tag      custom.asset_tag
+//	department     custom.org.department
+//	first_nic_mac  nics.0.mac
+//
+// A path is object keys separated by dots; a number also indexes an array.
+// Every inventory a heartbeat stores replaces the agent's custom facts
+// (agent_custom_facts) with the values found, whether or not the rest of it
+// matched the expected shape; paths it doesn't have are left out. Strings
+// are kept as they are, numbers and booleans as their JSON text, objects and
+// arrays as compact JSON. They show up as custom_facts in the facts view.
+
+// CustomFacts is a parsed RR_CUSTOM_FACTS_FILE. A nil *CustomFacts extracts
+// nothing.
+type CustomFacts struct {
+	facts []customFact
+}
+
+type customFact struct {
+	name string
+	path []string
+}
+
+// maxCustomFactBytes bounds one stored value.
+const maxCustomFactBytes = 4 << 10
+
+var customFactName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// ParseCustomFacts reads one fact per line; blank lines and lines starting
+// with # are skipped.
+func ParseCustomFacts(text string) (*CustomFacts, error) {
+	cf := &CustomFacts{}
+	seen := map[string]bool{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want <name> <path>", i+1)
+		}
+		name, path := fields[0], fields[1]
+		if !customFactName.MatchString(name) {
+			return nil, fmt.Errorf("line %d: name must be lowercase letters, digits and _, starting with a letter, got %q", i+1, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("line %d: %s is defined twice", i+1, name)
+		}
+		seen[name] = true
+		keys := strings.Split(path, ".")
+		for _, k := range keys {
+			if k == "" {
+				return nil, fmt.Errorf("line %d: empty key in path %q", i+1, path)
+			}
+		}
+		cf.facts = append(cf.facts, customFact{name: name, path: keys})
+	}
+	return cf, nil
+}
+
+// Len is the number of facts.
+func (cf *CustomFacts) Len() int {
+	if cf == nil {
+		return 0
+	}
+	return len(cf.facts)
+}
+
+// Extract returns the configured facts found in an inventory payload, by
+// name. A payload that isn't a JSON object yields none.
+func (cf *CustomFacts) Extract(payload []byte) map[string]string {
+	if cf.Len() == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var root any
+	if err := dec.Decode(&root); err != nil {
+		return nil
+	}
+	out := map[string]string{}
+	for _, f := range cf.facts {
+		v, ok := lookupPath(root, f.path)
+		if !ok {
+			continue
+		}
+		if s, ok := customFactValue(v); ok {
+			out[f.name] = s
+		}
+	}
+	return out
+}
+
+// lookupPath walks keys down from v.
+func lookupPath(v any, keys []string) (any, bool) {
+	for _, k := range keys {
+		switch node := v.(type) {
+		case map[string]any:
+			next, ok := node[k]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case []any:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// customFactValue renders a value for storage; null and values over
+// maxCustomFactBytes aren't kept.
+func customFactValue(v any) (string, bool) {
+	var s string
+	switch x := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		s = x
+	case json.Number:
+		s = x.String()
+	case bool:
+		s = strconv.FormatBool(x)
+	default:
+		b, err := json.Marshal(x)
+		if err != nil {
+			return "", false
+		}
+		s = string(b)
+	}
+	if len(s) > maxCustomFactBytes {
+		return "", false
+	}
+	return s, true
+}
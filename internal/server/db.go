@@ -1,11 +1,16 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
+// OpenDB opens the SQLite database and sets connection pragmas. It does not
+// touch the schema; call RunMigrations for that.
 func OpenDB(path string) (*sql.DB, error) {
 	db, err := sql.Open("sqlite", path)
 	if err != nil {
@@ -17,55 +22,26 @@ func OpenDB(path string) (*sql.DB, error) {
 	if _, err := db.Exec(`PRAGMA foreign_keys=ON;`); err != nil {
 		return nil, err
 	}
-
-	if err := migrate(db); err != nil {
-		return nil, err
-	}
 	return db, nil
 }
 
-func migrate(db *sql.DB) error {
-	stmts := []string{
-		`CREATE TABLE IF NOT EXISTS agents (
-			id TEXT PRIMARY KEY,
-			public_key TEXT NOT NULL UNIQUE,
-			hostname TEXT NOT NULL,
-			os TEXT NOT NULL,
-			arch TEXT NOT NULL,
-			tags_json TEXT NOT NULL DEFAULT '[]',
-			created_at INTEGER NOT NULL,
-			last_seen INTEGER NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS jobs (
-			id TEXT PRIMARY KEY,
-			target_agent_id TEXT NOT NULL,
-			kind TEXT NOT NULL,
-			shell TEXT NOT NULL,
-			command TEXT NOT NULL,
-			timeout_seconds INTEGER NOT NULL,
-			status TEXT NOT NULL,
-			created_at INTEGER NOT NULL,
-			started_at INTEGER,
-			finished_at INTEGER,
-			FOREIGN KEY(target_agent_id) REFERENCES agents(id)
-		);`,
-		`CREATE INDEX IF NOT EXISTS idx_jobs_target_status ON jobs(target_agent_id, status, created_at);`,
-		`CREATE TABLE IF NOT EXISTS job_results (
-			job_id TEXT PRIMARY KEY,
-			agent_id TEXT NOT NULL,
-			exit_code INTEGER NOT NULL,
-			stdout TEXT NOT NULL,
-			stderr TEXT NOT NULL,
-			started_at INTEGER NOT NULL,
-			finished_at INTEGER NOT NULL,
-			FOREIGN KEY(job_id) REFERENCES jobs(id),
-			FOREIGN KEY(agent_id) REFERENCES agents(id)
-		);`,
+// isTransientDBError reports whether a store call failed because the
+// database was momentarily unavailable (busy/locked by another writer, or a
+// query ran past its deadline) rather than because of a real fault. Retrying
+// such a call later is expected to succeed.
+func isTransientDBError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if isTransientPostgresError(err) {
+		return true
 	}
-	for _, s := range stmts {
-		if _, err := db.Exec(s); err != nil {
-			return err
+	var se *sqlite.Error
+	if errors.As(err, &se) {
+		switch se.Code() & 0xff { // primary code; extended codes carry detail in the high bits
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return true
 		}
 	}
-	return nil
+	return false
 }
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Dead-lettered job results
+// -----------------------------------------------------------------------------
+//
+// A signed result the server refuses (unparseable body, bad output encoding,
+// a job it doesn't know) may still carry the output of something that really
+// ran on the host. JobResult answers the agent as before but first keeps the
+// body in dead_letter_results with the reason, for an operator to inspect.
+// Results from agents pending approval aren't kept: none of their jobs ran.
+// RR_RETAIN_DEAD_LETTERS_MAX_AGE / _MAX_ROWS bound the table like the others.
+
+// deadLetterResult records a refused result post. Failing to record it is
+// only logged; the agent gets the original rejection either way.
+func (api *API) deadLetterResult(r *http.Request, agentID, jobID, reason string, body []byte) {
+	err := api.Store.AddDeadLetterResult(DeadLetterResult{
+		ReceivedAt: time.Now().Unix(),
+		AgentID:    agentID,
+		JobID:      jobID,
+		Reason:     reason,
+		Payload:    string(body),
+	})
+	if err != nil {
+		log.Printf("jobs: dead-lettering result failed agent_id=%s job_id=%s: %v", agentID, jobID, err)
+		return
+	}
+	log.Printf("jobs: result dead-lettered agent_id=%s job_id=%s reason=%q remote=%s", agentID, jobID, reason, api.clientIP(r))
+}
+
+// AdminDeadLetterResults lists refused job results, newest first, without
+// their payloads.
+//
+// Route:
+//   GET /v1/admin/dead-letter-results?limit=N
+
+func (api *API) AdminDeadLetterResults(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	results, err := api.Store.ListDeadLetterResults(queryInt(r, "limit", 100, 1000))
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"results": results})
+}
+
+// AdminDeadLetterResult returns one refused result including the body the
+// agent posted.
+//
+// Mounted on the "/v1/admin/dead-letter-results/" prefix:
+//   GET /v1/admin/dead-letter-results/{id}
+
+func (api *API) AdminDeadLetterResult(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/v1/admin/dead-letter-results/"), 10, 64)
+	if err != nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown dead letter route", "path": r.URL.Path})
+		return
+	}
+	d, err := api.Store.GetDeadLetterResult(id)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if d == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown dead letter"})
+		return
+	}
+	writeJSON(w, 200, d)
+}
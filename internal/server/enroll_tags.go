@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Enroll tag rules (server-assigned tags by enrollment context)
+// -----------------------------------------------------------------------------
+//
+// RR_ENROLL_TAG_RULES_FILE maps how an agent enrolled to tags it gets, so a
+// site can be classified without touching each agent's config:
+//
+//	# <match>            <tag> [<tag>...]
+//	cidr:10.20.0.0/16    site-nyc
+//	token:ENROLL-NYC     site-nyc managed
+//
+// cidr matches the enrolling client's address (see clientIP); token matches
+// the enroll token it used (never for key enrollment). Every matching rule
+// contributes. Rules apply when an agent is first enrolled; the tags are
+// recorded as its enroll tags (agents.enroll_tags_json). In merge mode they
+// are kept in the agent's tags next to whatever it declares itself; in
+// override mode they become server-set tags (tags_source "server"), which
+// the agent can't change and an admin can replace or release as usual.
+
+// EnrollTagRules is a parsed RR_ENROLL_TAG_RULES_FILE. A nil *EnrollTagRules
+// assigns nothing.
+type EnrollTagRules struct {
+	// Override makes assigned tags replace the agent's own
+	// (RR_ENROLL_TAG_MODE=override) instead of being merged with them.
+	Override bool
+
+	rules []enrollTagRule
+}
+
+type enrollTagRule struct {
+	cidr  *net.IPNet // or
+	token string
+	tags  []string
+}
+
+// ParseEnrollTagRules reads one rule per line; blank lines and lines
+// starting with # are skipped.
+func ParseEnrollTagRules(text string) (*EnrollTagRules, error) {
+	rs := &EnrollTagRules{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want <match> <tag> [<tag>...]", i+1)
+		}
+		rule := enrollTagRule{tags: normalizeTags(fields[1:])}
+		kind, value, _ := strings.Cut(fields[0], ":")
+		switch kind {
+		case "cidr":
+			_, n, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			rule.cidr = n
+		case "token":
+			if value == "" {
+				return nil, fmt.Errorf("line %d: empty token", i+1)
+			}
+			rule.token = value
+		default:
+			return nil, fmt.Errorf("line %d: match must be cidr:<cidr> or token:<token>, got %q", i+1, fields[0])
+		}
+		rs.rules = append(rs.rules, rule)
+	}
+	return rs, nil
+}
+
+// Len is the number of rules.
+func (rs *EnrollTagRules) Len() int {
+	if rs == nil {
+		return 0
+	}
+	return len(rs.rules)
+}
+
+// Match returns the tags of every rule matching an enrollment from clientIP
+// with token ("" for key enrollment), deduplicated in rule order.
+func (rs *EnrollTagRules) Match(clientIP, token string) []string {
+	if rs == nil {
+		return nil
+	}
+	ip := net.ParseIP(clientIP)
+	var tags []string
+	for _, rule := range rs.rules {
+		switch {
+		case rule.cidr != nil && ip != nil && rule.cidr.Contains(ip):
+		case rule.token != "" && token != "" && subtle.ConstantTimeCompare([]byte(rule.token), []byte(token)) == 1:
+		default:
+			continue
+		}
+		tags = append(tags, rule.tags...)
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return normalizeTags(tags)
+}
+
+// withEnrollTags adds an agent's enroll tags (enroll_tags_json) to the tags
+// it declares.
+func withEnrollTags(tags []string, enrollTagsJSON string) []string {
+	var enrollTags []string
+	if json.Unmarshal([]byte(enrollTagsJSON), &enrollTags) != nil || len(enrollTags) == 0 {
+		return tags
+	}
+	return normalizeTags(append(append([]string(nil), tags...), enrollTags...))
+}
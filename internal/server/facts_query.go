@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Facts queries (selecting agents by their derived facts)
+// -----------------------------------------------------------------------------
+//
+// A shared.FactSelector is a list of conditions on agent facts, all of which
+// must hold ("disk_free_bytes < 5 GiB and os_caption contains Server").
+// Only agents with stored facts can match. Used for previewing a selection
+// (POST /v1/admin/facts/query) and for targeting jobs at it (SubmitJob with
+// "selector").
+
+// factQueryField is one fact a selector may test. column (a column or an
+// expression over agents a and agent_facts f) is interpolated into SQL, so
+// factsQueryFields is the guard.
+type factQueryField struct {
+	column  string
+	numeric bool
+}
+
+var factsQueryFields = map[string]factQueryField{
+	"hostname":           {column: "a.hostname"},
+	"os_caption":         {column: "f.os_caption"},
+	"os_version":         {column: "f.os_version"},
+	"os_build":           {column: "f.os_build"},
+	"cpu_name":           {column: "f.cpu_name"},
+	"cpu_cores":          {column: "f.cpu_cores", numeric: true},
+	"cpu_logical":        {column: "f.cpu_logical", numeric: true},
+	"ram_total_bytes":    {column: "f.ram_total_bytes", numeric: true},
+	"ram_free_bytes":     {column: "f.ram_free_bytes", numeric: true},
+	"uptime_seconds":     {column: factsUptimeColumn, numeric: true},
+	"boot_time":          {column: "f.boot_time", numeric: true},
+	"ipv4_primary":       {column: "f.ipv4_primary"},
+	"disk_total_bytes":   {column: "f.disk_total_bytes", numeric: true},
+	"disk_free_bytes":    {column: "f.disk_free_bytes", numeric: true},
+	"timezone":           {column: "f.timezone"},
+	"utc_offset_minutes": {column: "f.utc_offset_minutes", numeric: true},
+	"locale":             {column: "f.locale"},
+	"updates_pending":    {column: "f.updates_pending", numeric: true},
+}
+
+var (
+	factsNumericOps = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+	factsTextOps    = map[string]bool{"=": true, "!=": true, "prefix": true, "contains": true}
+)
+
+// maxFactConditions bounds how much SQL one selector can produce.
+const maxFactConditions = 16
+
+// validateFactSelector checks every condition against factsQueryFields and
+// normalizes numeric values to int64 where they're whole numbers.
+func validateFactSelector(sel *shared.FactSelector) error {
+	if len(sel.Where) == 0 {
+		return fmt.Errorf("selector needs at least one condition")
+	}
+	if len(sel.Where) > maxFactConditions {
+		return fmt.Errorf("selector has more than %d conditions", maxFactConditions)
+	}
+	for i, c := range sel.Where {
+		f, ok := factsQueryFields[c.Field]
+		if !ok {
+			return fmt.Errorf("selector condition %d: unknown field %q (allowed: %v)", i, c.Field, factsQueryFieldNames())
+		}
+		if f.numeric {
+			if !factsNumericOps[c.Op] {
+				return fmt.Errorf("selector condition %d: op must be one of = != < <= > >= for %s", i, c.Field)
+			}
+			v, ok := factNumber(c.Value)
+			if !ok {
+				return fmt.Errorf("selector condition %d: %s needs a number", i, c.Field)
+			}
+			sel.Where[i].Value = v
+			continue
+		}
+		if !factsTextOps[c.Op] {
+			return fmt.Errorf("selector condition %d: op must be one of = != prefix contains for %s", i, c.Field)
+		}
+		if _, ok := c.Value.(string); !ok {
+			return fmt.Errorf("selector condition %d: %s needs a string", i, c.Field)
+		}
+	}
+	return nil
+}
+
+// factNumber returns a numeric selector value as int64 when it is a whole
+// number and float64 otherwise. Values decoded from a request are json.Number
+// (see shared.FactCondition), so a disk size past 2^53 stays exact.
+func factNumber(v any) (any, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, true
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, false
+		}
+		return factNumber(f)
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<53 {
+			return int64(n), true
+		}
+		return n, true
+	case int64:
+		return n, true
+	}
+	return nil, false
+}
+
+func factsQueryFieldNames() []string {
+	names := make([]string, 0, len(factsQueryFields))
+	for name := range factsQueryFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -15,12 +15,73 @@ type AgentFactsView struct {
 	RAMFreeBytes  int64 `json:"ram_free_bytes"`
 
 	UptimeSeconds int64  `json:"uptime_seconds"`
+	BootTime      int64  `json:"boot_time"` // 0 = unknown
 	IPv4Primary   string `json:"ipv4_primary"`
 
 	DiskTotalBytes int64 `json:"disk_total_bytes"`
 	DiskFreeBytes  int64 `json:"disk_free_bytes"`
 
-	UpdatedAt int64    `json:"updated_at"`
-	LastSeen  int64    `json:"last_seen"`
-	Tags      []string `json:"tags"`
+	Timezone         string `json:"timezone"`
+	UTCOffsetMinutes int64  `json:"utc_offset_minutes"`
+	Locale           string `json:"locale"`
+
+	Gateways   []string `json:"gateways"` // null = not reported
+	DNSServers []string `json:"dns_servers"`
+
+	UpdatesPending *int64 `json:"updates_pending"` // null = not reported
+
+	UpdatedAt    int64    `json:"updated_at"`
+	QuickFactsAt int64    `json:"quick_facts_at"` // RAM, disk and uptime as of then; 0 = inventory only
+	LastSeen     int64    `json:"last_seen"`
+	Tags         []string `json:"tags"`
+
+	// CustomFacts are the site-defined facts (RR_CUSTOM_FACTS_FILE) from
+	// the agent's latest inventory.
+	CustomFacts map[string]string `json:"custom_facts,omitempty"`
+}
+
+// factsView presents facts derived for rec in the same shape as the stored
+// facts listing.
+func factsView(f AgentFacts, rec *AgentRecord) AgentFactsView {
+	return AgentFactsView{
+		AgentID:          f.AgentID,
+		Hostname:         rec.Info.Hostname,
+		OSCaption:        f.OSCaption,
+		OSVersion:        f.OSVersion,
+		OSBuild:          f.OSBuild,
+		CPUName:          f.CPUName,
+		CPUCores:         f.CPUCores,
+		CPULogical:       f.CPULogical,
+		RAMTotalBytes:    f.RAMTotalBytes,
+		RAMFreeBytes:     f.RAMFreeBytes,
+		UptimeSeconds:    f.UptimeSeconds,
+		BootTime:         f.BootTime,
+		IPv4Primary:      f.IPv4Primary,
+		DiskTotalBytes:   f.DiskTotalBytes,
+		DiskFreeBytes:    f.DiskFreeBytes,
+		Timezone:         f.Timezone,
+		UTCOffsetMinutes: f.UTCOffsetMinutes,
+		Locale:           f.Locale,
+		Gateways:         f.Gateways,
+		DNSServers:       f.DNSServers,
+		UpdatesPending:   f.UpdatesPending,
+		UpdatedAt:        f.UpdatedAt,
+		LastSeen:         rec.LastSeen,
+		Tags:             rec.Tags,
+	}
+}
+
+// FactCount is one bucket of a facts distribution.
+type FactCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// factsGroupableFields are the agent_facts columns FactsDistribution may
+// group by. The name is interpolated into SQL, so this list is the guard.
+var factsGroupableFields = map[string]bool{
+	"os_caption": true,
+	"os_version": true,
+	"os_build":   true,
+	"cpu_name":   true,
 }
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// get_file jobs (collecting a file from an agent)
+// -----------------------------------------------------------------------------
+//
+// A get_file job's Command is the path to fetch. The agent answers with the
+// file base64 in stdout (output_encoding "base64"), or exit code 1 and the
+// reason in stderr; files over shared.MaxGetFileBytes are refused. Policies
+// and the blocklist see the path as the command, so a deny rule can keep
+// e.g. /etc/shadow off limits. The file is downloaded from
+// GET /v1/admin/jobs/{job_id}/file, never in part: a result the server's
+// output cap cut is refused there.
+
+// maxGetFilePath bounds the path a get_file job may name.
+const maxGetFilePath = 4096
+
+// prepareGetFile checks a get_file job on submit: a plain path, no shell or
+// run_as (the agent reads the file itself, as its own user).
+func prepareGetFile(job *shared.Job) error {
+	if job.CommandEncoding != "" {
+		return errors.New("get_file takes a plain path; command_encoding is not supported")
+	}
+	if job.RunAs != nil {
+		return errors.New("run_as is not supported for get_file jobs")
+	}
+	job.Command = strings.TrimSpace(job.Command)
+	switch {
+	case job.Command == "":
+		return errors.New("get_file needs the file path in command")
+	case len(job.Command) > maxGetFilePath:
+		return errors.New("get_file path is longer than " + strconv.Itoa(maxGetFilePath) + " bytes")
+	case strings.ContainsRune(job.Command, 0):
+		return errors.New("get_file path contains a NUL byte")
+	}
+	job.Shell = ""
+	return nil
+}
+
+// AdminJobFile returns the file collected by a finished get_file job as an
+// attachment named after the requested path.
+//
+// Route:
+//   GET /v1/admin/jobs/{job_id}/file
+
+func (api *API) AdminJobFile(w http.ResponseWriter, r *http.Request, jobID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	job, err := api.Store.GetJobDetail(jobID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if job == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown job"})
+		return
+	}
+	if job.Kind != shared.JobKindGetFile {
+		writeJSON(w, 400, map[string]any{"error": "not a get_file job", "kind": job.Kind})
+		return
+	}
+	if job.Status != "done" || job.OutputEncoding != shared.PayloadEncodingBase64 {
+		writeJSON(w, 409, map[string]any{"error": "no file collected", "status": job.Status, "stderr": job.Stderr})
+		return
+	}
+	if job.Truncated {
+		// The server cut the stored output (RR_MAX_RESULT_OUTPUT_BYTES below
+		// the base64 size of the file); a download is always the whole file.
+		writeJSON(w, 409, map[string]any{"error": "stored file was truncated by the server's output cap", "max_result_output_bytes": api.maxResultOutputBytes()})
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(job.Stdout)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "stored file is not valid base64"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": getFileName(job.Command)}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(200)
+	_, _ = w.Write(b)
+}
+
+// getFileName is the last element of a Linux or Windows path.
+func getFileName(path string) string {
+	name := path[strings.LastIndexAny(path, `/\`)+1:]
+	if name == "" {
+		return "file"
+	}
+	return name
+}
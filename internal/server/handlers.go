@@ -6,7 +6,10 @@
 //
 // High-level flow:
 //   - /v1/enroll: agent enrollment (exchange public key + basic info)
+//   - /v1/enroll/challenge: challenge for enrolling a pre-authorized key
 //   - /v1/heartbeat: signed agent updates (presence + optional inventory)
+//   - /v1/ping: signed no-op for agent connectivity/auth checks
+//   - /v1/hmac-secret: shared secret for agents that sign with HMAC
 //   - /v1/jobs/*: lightweight job queue (poll + submit + result)
 //   - /v1/admin/*: human/admin read endpoints (locked behind service key)
 //
@@ -22,13 +25,23 @@ package server
 // -----------------------------------------------------------------------------
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
-	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"rackroom/internal/shared"
 
@@ -48,23 +61,226 @@ func firstN(s string, n int) string {
 type API struct {
 	Store       Store
 	EnrollToken string
+
+	// RequireApproval puts newly enrolled agents in the pending state until
+	// an admin approves them. Default (false) keeps auto-approve behavior.
+	RequireApproval bool
+
+	// FactsWebhook, if set, is notified when an agent's facts change materially.
+	FactsWebhook *FactsWebhook
+
+	// UIPasswordHash (bcrypt) enables operator login for the web UI; the
+	// resulting sessions are tracked in Sessions.
+	UIPasswordHash string
+	Sessions       *SessionStore
+
+	// OnlineWindowSeconds is how recently an agent must have been seen to
+	// count as online (default 300).
+	OnlineWindowSeconds int64
+
+	// MissedHeartbeats is how many of its own reported heartbeat intervals an
+	// online agent may miss before the liveness monitor marks it late
+	// (default 3; negative disables).
+	MissedHeartbeats int
+
+	// RequireSignedPoll rejects unsigned /v1/jobs/poll requests. Leave it off
+	// until every agent is new enough to sign its polls.
+	RequireSignedPoll bool
+
+	// StrictAgentIdentity makes RequireAgentAuth demand both X-Agent-Id and
+	// X-PubKey and reject requests where they don't name the same agent,
+	// instead of re-associating identity by pubkey. An agent_id with no
+	// record still gets "unknown agent", so deleted agents can re-enroll.
+	StrictAgentIdentity bool
+
+	// AllowInsecureHMACSecret lets /v1/hmac-secret answer requests that
+	// didn't arrive over TLS (see requestTLS). Off, the secret, which signs
+	// for the agent from then on, never crosses the wire in cleartext.
+	AllowInsecureHMACSecret bool
+
+	// AuthSkewSeconds is how far a signed request's X-Timestamp may be from
+	// the server clock, either way (default 600). Tighter narrows the replay
+	// window; looser tolerates agents with poor time sync.
+	AuthSkewSeconds int64
+
+	// PollBatchDefault is how many jobs a poll returns when the agent doesn't
+	// ask for a number (default 5); requests are clamped to PollBatchMax (default 50).
+	PollBatchDefault int
+	PollBatchMax     int
+
+	// MaxResultOutputBytes caps what is stored of each of a result's stdout
+	// and stderr (default defaultMaxResultOutputBytes), whatever the agent
+	// sent; longer output is cut and the result marked truncated.
+	MaxResultOutputBytes int
+
+	// MinProtocolVersion is the oldest agent protocol accepted at enroll
+	// (default shared.MinProtocolVersion); older agents get 426.
+	MinProtocolVersion int
+
+	// MaxEnrollRegistrations caps how many new agents each enroll token
+	// (EnrollToken or a minted one) may register (0 = unlimited), bounding
+	// what a leaked token can do.
+	// Re-enrolling a known public key doesn't count.
+	MaxEnrollRegistrations int
+
+	// RequireEnrollKey rejects token enrollment: new agents must use a key an
+	// admin pre-authorized through /v1/admin/enroll-keys.
+	RequireEnrollKey bool
+
+	// MaxQueuedJobsPerAgent bounds how many jobs may wait for one agent
+	// (0 = unlimited). An offline agent's queue stops growing there and
+	// submitters get 429 instead of a silent backlog.
+	MaxQueuedJobsPerAgent int
+
+	// PublicURL is the base URL agents should use to reach this server,
+	// handed out by /v1/admin/provisioning. Empty derives it from the request.
+	PublicURL string
+
+	// TrustedProxies are peers whose X-Forwarded-For is honored (see clientIP).
+	TrustedProxies TrustedProxies
+
+	// CommandBlocklist is checked as jobs are dispatched; matching jobs are
+	// marked blocked instead of handed out (nil = none).
+	CommandBlocklist *CommandBlocklist
+
+	// EnrollTagRules assign tags to newly enrolled agents by source address
+	// or enroll token (nil = none).
+	EnrollTagRules *EnrollTagRules
+
+	// CustomFacts name inventory fields kept as custom facts (nil = none).
+	CustomFacts *CustomFacts
+
+	stats       statsCache
+	serviceKeys serviceKeyCache
+	heartbeats  heartbeatHub
+}
+
+// dbRetryAfterSeconds is the Retry-After hint sent with transient DB failures.
+const dbRetryAfterSeconds = 5
+
+// writeDBError answers a failed store call. Transient failures (see
+// isTransientDBError) get 503 plus Retry-After so agents back off instead
+// of piling on; a method the store backend lacks (ErrNotSupported) is 501;
+// anything else stays a plain 500.
+
+func writeDBError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotSupported) {
+		writeJSON(w, 501, map[string]any{"error": "not supported by this database backend"})
+		return
+	}
+	var sumErr *InventoryChecksumError
+	if errors.As(err, &sumErr) {
+		log.Printf("inventory: checksum mismatch agent_id=%s snapshot_id=%s; not serving it", sumErr.AgentID, sumErr.SnapshotID)
+		writeJSON(w, 500, map[string]any{"error": "stored inventory is corrupt (checksum mismatch)", "snapshot_id": sumErr.SnapshotID})
+		return
+	}
+	if isTransientDBError(err) {
+		w.Header().Set("Retry-After", strconv.Itoa(dbRetryAfterSeconds))
+		writeJSON(w, 503, map[string]any{"error": "database busy", "retry_after": dbRetryAfterSeconds})
+		return
+	}
+	writeJSON(w, 500, map[string]any{"error": "db error"})
 }
 
 // writeJSON writes a JSON response with a status code.
 // This is the standard response helper for API endpoints.
 
 func writeJSON(w http.ResponseWriter, code int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		code = 500
+		b = []byte(`{"error":"encode error"}`)
+	}
+	writeRaw(w, code, append(b, '\n'))
+}
+
+// writeRaw writes an already-encoded JSON body with an explicit Content-Length,
+// so HEAD responses report the size a GET would return.
+func writeRaw(w http.ResponseWriter, code int, body []byte) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(code)
-	_ = json.NewEncoder(w).Encode(v)
+	_, _ = w.Write(body)
+}
+
+// isRead reports whether r is a GET or HEAD. Read handlers accept both;
+// net/http drops the body for HEAD, so the handler logic stays identical.
+func isRead(r *http.Request) bool {
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
 }
 
 // readBody reads the request body with a size limit and closes it.
 // The limit prevents accidental large payloads from consuming memory.
+//
+// Bodies sent with Content-Encoding: gzip (agents compress heartbeats that
+// carry inventory) are decompressed here, so handlers and X-Body-Sha256 always
+// see the plain JSON. The decompressed size is capped separately so a small
+// compressed body can't expand without bound.
+
+const (
+	maxBodyBytes        = 2 << 20
+	maxDecodedBodyBytes = 16 << 20
+)
+
+var errBodyTooLarge = errors.New("decompressed body too large")
 
 func readBody(r *http.Request) ([]byte, error) {
 	defer r.Body.Close()
-	return io.ReadAll(io.LimitReader(r.Body, 2<<20))
+	raw := io.LimitReader(r.Body, maxBodyBytes)
+
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return io.ReadAll(raw)
+	case "gzip":
+		zr, err := gzip.NewReader(raw)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		b, err := io.ReadAll(io.LimitReader(zr, maxDecodedBodyBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxDecodedBodyBytes {
+			return nil, errBodyTooLarge
+		}
+		return b, nil
+	default:
+		return nil, errors.New("unsupported content encoding: " + enc)
+	}
+}
+
+// requireJSON answers 415 unless the request declares a JSON body
+// (application/json, any parameters such as charset allowed), so a form
+// post or text body gets a clear error instead of a generic "bad json".
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err == nil && mt == "application/json" {
+		return true
+	}
+	if ct == "" {
+		ct = "none"
+	}
+	writeJSON(w, 415, map[string]any{"error": "Content-Type must be application/json (got " + ct + ")"})
+	return false
+}
+
+// queryInt reads a non-negative integer query param, falling back to def
+// when absent/invalid and clamping to max (if max > 0).
+
+func queryInt(r *http.Request, key string, def, max int) int {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def
+	}
+	n, _ := parseInt64(v)
+	if n <= 0 && v != "0" {
+		return def
+	}
+	if max > 0 && n > int64(max) {
+		return max
+	}
+	return int(n)
 }
 
 // -----------------------------------------------------------------------------
@@ -76,14 +292,18 @@ func readBody(r *http.Request) ([]byte, error) {
 // Expects POST JSON: shared.EnrollRequest (includes EnrollToken, PublicKey, Info, Tags).
 // On success, returns shared.EnrollResponse with a new AgentID.
 //
-// This is intentionally simple for v0: enrollment is authorized by a shared enroll token.
-// Later we can swap this for per-tenant enrollment, short-lived tokens, or UI-driven enrollment.
+// Enrollment is authorized by the shared enroll token, by a short-lived token
+// minted through /v1/admin/provisioning, or by a signed challenge for a
+// pre-authorized key (see handlers_enroll_keys.go).
 
 func (api *API) Enroll(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
+	if !requireJSON(w, r) {
+		return
+	}
 	body, err := readBody(r)
 	if err != nil {
 		writeJSON(w, 400, map[string]any{"error": "bad body"})
@@ -96,24 +316,164 @@ func (api *API) Enroll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.EnrollToken == "" || req.EnrollToken != api.EnrollToken {
-		writeJSON(w, 401, map[string]any{"error": "invalid enroll token"})
+	// A signature means key enrollment; the token, if any, is ignored.
+	byKey := req.Signature != ""
+	if byKey {
+		validSig, err := api.validEnrollSignature(req)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if !validSig {
+			log.Printf("enroll: rejected key enrollment hostname=%s remote=%s", req.Info.Hostname, api.clientIP(r))
+			writeJSON(w, 401, map[string]any{"error": "invalid enroll signature"})
+			return
+		}
+	} else {
+		if api.RequireEnrollKey {
+			writeJSON(w, 401, map[string]any{"error": "enrollment requires a pre-authorized key"})
+			return
+		}
+		validToken, err := api.validEnrollToken(req.EnrollToken)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if !validToken {
+			writeJSON(w, 401, map[string]any{"error": "invalid enroll token"})
+			return
+		}
+	}
+
+	version := req.ProtocolVersion
+	if version <= 0 {
+		version = 1 // agents that predate negotiation
+	}
+	if version < api.minProtocolVersion() {
+		log.Printf("enroll: rejected protocol_version=%d hostname=%s remote=%s", version, req.Info.Hostname, api.clientIP(r))
+		writeJSON(w, http.StatusUpgradeRequired, map[string]any{
+			"error":                "agent protocol version no longer supported; upgrade the agent",
+			"protocol_version":     shared.ProtocolVersion,
+			"min_protocol_version": api.minProtocolVersion(),
+		})
 		return
 	}
 
-	agentID, err := api.Store.CreateAgent(req.PublicKey, req.Info, req.Tags)
+	approval := ApprovalApproved
+	if api.RequireApproval {
+		approval = ApprovalPending
+	}
+
+	// One transaction, so a registration is only counted for an agent that
+	// was created, and two enrolls of the same new key can't both count one.
+	var (
+		agentID    string
+		enrollTags []string
+	)
+	err = api.Store.InTx(func(st Store) error {
+		// Already enrolled agents neither use up a registration nor get
+		// enroll tags again.
+		var known *AgentRecord
+		if (api.MaxEnrollRegistrations > 0 && !byKey) || api.EnrollTagRules.Len() > 0 {
+			var err error
+			if known, err = st.GetAgentByPubKey(req.PublicKey); err != nil {
+				return err
+			}
+		}
+		if api.MaxEnrollRegistrations > 0 && !byKey && known == nil {
+			ok, err := st.ReserveEnrollRegistration(enrollTokenHash(req.EnrollToken), api.MaxEnrollRegistrations)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errEnrollLimitReached
+			}
+		}
+
+		var err error
+		if agentID, err = st.CreateAgent(req.PublicKey, req.Info, req.Tags, approval); err != nil {
+			return err
+		}
+		if err := st.SetAgentCapabilities(agentID, req.Capabilities); err != nil {
+			return err
+		}
+		if err := st.SetAgentProtocolVersion(agentID, req.ProtocolVersion); err != nil {
+			return err
+		}
+		if byKey {
+			if err := st.MarkEnrollKeyUsed(req.PublicKey, agentID, time.Now().Unix()); err != nil {
+				return err
+			}
+		}
+		if known == nil {
+			token := req.EnrollToken
+			if byKey {
+				token = ""
+			}
+			if enrollTags = api.EnrollTagRules.Match(api.clientIP(r), token); len(enrollTags) > 0 {
+				return st.SetAgentEnrollTags(agentID, enrollTags, api.EnrollTagRules.Override)
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errEnrollLimitReached) {
+		log.Printf("enroll: rejected, token registration limit (%d) reached hostname=%s remote=%s",
+			api.MaxEnrollRegistrations, req.Info.Hostname, api.clientIP(r))
+		writeJSON(w, 403, map[string]any{"error": "enroll token registration limit reached"})
+		return
+	}
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+		writeDBError(w, err)
 		return
 	}
+	if len(enrollTags) > 0 {
+		log.Printf("enroll: assigned tags agent_id=%s tags=%v override=%t", agentID, enrollTags, api.EnrollTagRules.Override)
+	}
+
+	msg := "enrolled"
+	if rec, err := api.Store.GetAgentByID(agentID); err == nil && rec != nil && rec.ApprovalStatus == ApprovalPending {
+		msg = "enrolled (pending approval)"
+	}
+	via := "token"
+	if byKey {
+		via = "key"
+	}
+	log.Printf("enroll: agent_id=%s hostname=%s remote=%s via=%s (%s)", agentID, req.Info.Hostname, api.clientIP(r), via, msg)
 
 	writeJSON(w, 200, shared.EnrollResponse{
 		AgentID:    agentID,
 		ServerTime: time.Now().Unix(),
-		Message:    "enrolled",
+		Message:    msg,
+
+		ProtocolVersion:    shared.ProtocolVersion,
+		MinProtocolVersion: api.minProtocolVersion(),
 	})
 }
 
+// errEnrollLimitReached rolls back an enroll whose token has no
+// registrations left.
+var errEnrollLimitReached = errors.New("enroll token registration limit reached")
+
+// enrollTokenHash identifies a token in enroll_token_uses without storing it.
+func enrollTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (api *API) authSkew() int64 {
+	if api.AuthSkewSeconds <= 0 {
+		return 600
+	}
+	return api.AuthSkewSeconds
+}
+
+func (api *API) minProtocolVersion() int {
+	if api.MinProtocolVersion <= 0 {
+		return shared.MinProtocolVersion
+	}
+	return api.MinProtocolVersion
+}
+
 // RequireAgentAuth validates signed agent requests.
 //
 // Expected headers:
@@ -121,17 +481,40 @@ func (api *API) Enroll(w http.ResponseWriter, r *http.Request) {
 // Optional headers (v0 supports multiple identity paths):
 //   - X-Agent-Id: canonical agent id (preferred)
 //   - X-PubKey: fallback identity if agent id is missing/unknown
+// With StrictAgentIdentity both are required and must belong to the same
+// agent; there is no pubkey fallback.
 //
 // Verification steps:
 //   - timestamp sanity window (prevents replay)
 //   - lookup agent record by id or pubkey
-//   - verify signature against stored public key
+//   - verify signature against stored public key; the signed message includes
+//     the canonical query string when the request has one (shared.CanonicalQuery)
+//   - or, with X-Auth-Mode: hmac-sha256, verify an HMAC of the same message
+//     under the agent's shared secret (see AgentHMACSecret)
 //
-// If pubkey-based lookup succeeds, the canonical agent id is attached as
-// X-Canonical-Agent-Id for downstream handlers.
+// The verified agent id is attached as X-Canonical-Agent-Id for downstream
+// handlers (it differs from X-Agent-Id when identity was re-associated via
+// pubkey). The agent's approval status is attached as X-Agent-Approval;
+// handlers decide what a pending agent may do. Both headers are server-set:
+// client-supplied values are dropped.
 
 func (api *API) RequireAgentAuth(next http.HandlerFunc) http.HandlerFunc {
+	return api.agentAuth(api.Store, next, false)
+}
+
+// AllowDisabledAgentAuth is RequireAgentAuth for endpoints a disabled agent
+// may still call (whoami): it passes them on with X-Agent-Approval
+// "disabled" instead of answering 403.
+func (api *API) AllowDisabledAgentAuth(next http.HandlerFunc) http.HandlerFunc {
+	return api.agentAuth(api.Store, next, true)
+}
+
+// agentAuth verifies agent requests against the agents in st.
+func (api *API) agentAuth(st Store, next http.HandlerFunc, allowDisabled bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("X-Canonical-Agent-Id")
+		r.Header.Del("X-Agent-Approval")
+
 		agentID := r.Header.Get("X-Agent-Id")
 		pubKeyB64 := r.Header.Get("X-PubKey")
 		ts := r.Header.Get("X-Timestamp")
@@ -145,11 +528,13 @@ func (api *API) RequireAgentAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// Timestamp sanity window (10 min)
+		// Timestamp sanity window (AuthSkewSeconds, default 10 min)
 		tInt, _ := parseInt64(ts)
 		now := time.Now().Unix()
-		if tInt == 0 || tInt < now-600 || tInt > now+600 {
-			writeJSON(w, 401, map[string]any{"error": "timestamp outside window"})
+		skew := api.authSkew()
+		if tInt == 0 || tInt < now-skew || tInt > now+skew {
+			// server_time lets the agent tell how far off its clock is.
+			writeJSON(w, 401, map[string]any{"error": "timestamp outside window", "server_time": now})
 			return
 		}
 
@@ -157,23 +542,41 @@ func (api *API) RequireAgentAuth(next http.HandlerFunc) http.HandlerFunc {
 		var rec *AgentRecord
 		var err error
 
-		if agentID != "" {
-			rec, err = api.Store.GetAgentByID(agentID)
+		if api.StrictAgentIdentity {
+			var known bool
+			rec, known, err = strictAgentIdentity(st, agentID, pubKeyB64)
+			if err != nil {
+				writeDBError(w, err)
+				return
+			}
+			if !known {
+				// A deleted agent: the answer ReenrollIfForgotten acts on.
+				writeJSON(w, 401, map[string]any{"error": "unknown agent"})
+				return
+			}
+			if rec == nil {
+				log.Printf("auth: rejected agent identity mismatch path=%s agent_id=%q remote=%s", r.URL.Path, agentID, api.clientIP(r))
+				writeJSON(w, 401, map[string]any{"error": "agent identity mismatch"})
+				return
+			}
+		}
+
+		if rec == nil && agentID != "" {
+			rec, err = st.GetAgentByID(agentID)
 			if err != nil {
-				writeJSON(w, 500, map[string]any{"error": "db error"})
+				writeDBError(w, err)
 				return
 			}
 		}
 
 		if rec == nil && pubKeyB64 != "" {
-			rec, err = api.Store.GetAgentByPubKey(pubKeyB64)
+			rec, err = st.GetAgentByPubKey(pubKeyB64)
 			if err != nil {
-				writeJSON(w, 500, map[string]any{"error": "db error"})
+				writeDBError(w, err)
 				return
 			}
 			if rec != nil {
-				// Tell the handler (and optionally the agent) what the canonical agent_id is
-				r.Header.Set("X-Canonical-Agent-Id", rec.AgentID)
+				// Tell the agent what its canonical agent_id is
 				w.Header().Set("X-Canonical-Agent-Id", rec.AgentID)
 			}
 		}
@@ -183,17 +586,88 @@ func (api *API) RequireAgentAuth(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		pub, err := shared.DecodePubKey(rec.PublicKey)
-		if err != nil {
-			writeJSON(w, 500, map[string]any{"error": "server key decode failed"})
-			return
+		query := shared.CanonicalQuery(r.URL.Query())
+		if r.Header.Get(shared.AuthModeHeader) == shared.AuthModeHMAC {
+			secret, err := st.GetAgentHMACSecret(rec.AgentID)
+			if err != nil {
+				writeDBError(w, err)
+				return
+			}
+			key, err := shared.DecodeHMACSecret(secret)
+			if err != nil {
+				writeJSON(w, 401, map[string]any{"error": "hmac not established"})
+				return
+			}
+			if !shared.VerifyHMAC(key, sig, ts, r.Method, r.URL.Path, query, bodySha) {
+				writeJSON(w, 401, map[string]any{"error": "bad signature"})
+				return
+			}
+		} else {
+			pub, err := shared.DecodePubKey(rec.PublicKey)
+			if err != nil {
+				writeJSON(w, 500, map[string]any{"error": "server key decode failed"})
+				return
+			}
+			if !shared.Verify(pub, sig, ts, r.Method, r.URL.Path, query, bodySha) {
+				writeJSON(w, 401, map[string]any{"error": "bad signature"})
+				return
+			}
 		}
 
-		if !shared.Verify(pub, sig, ts, r.Method, r.URL.Path, bodySha) {
-			writeJSON(w, 401, map[string]any{"error": "bad signature"})
+		if rec.ApprovalStatus == ApprovalDisabled && !allowDisabled {
+			writeJSON(w, 403, map[string]any{"error": "agent disabled"})
 			return
 		}
 
+		r.Header.Set("X-Canonical-Agent-Id", rec.AgentID)
+		r.Header.Set("X-Agent-Approval", rec.ApprovalStatus)
+		next(w, r)
+	}
+}
+
+// strictAgentIdentity returns the agent only if agentID and pubKeyB64 are both
+// set and name the same agent; otherwise nil. known is false when agentID
+// has no record at all (as opposed to a key that doesn't match it).
+func strictAgentIdentity(st Store, agentID, pubKeyB64 string) (rec *AgentRecord, known bool, err error) {
+	if agentID == "" || pubKeyB64 == "" {
+		return nil, true, nil
+	}
+	rec, err = st.GetAgentByID(agentID)
+	if err != nil {
+		return nil, true, err
+	}
+	if rec == nil {
+		return nil, false, nil
+	}
+	stored, err := shared.DecodePubKey(rec.PublicKey)
+	if err != nil {
+		return nil, true, nil
+	}
+	sent, err := shared.DecodePubKey(pubKeyB64)
+	if err != nil || !stored.Equal(sent) {
+		return nil, true, nil
+	}
+	return rec, true, nil
+}
+
+// OptionalAgentAuth verifies requests that carry a signature exactly like
+// RequireAgentAuth. Unsigned requests pass through (with the server-set
+// headers stripped) unless RequireSignedPoll is set; it exists so polling can
+// move to signed requests without breaking agents that don't sign yet.
+
+func (api *API) OptionalAgentAuth(next http.HandlerFunc) http.HandlerFunc {
+	signed := api.RequireAgentAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Signature") != "" {
+			signed(w, r)
+			return
+		}
+		if api.RequireSignedPoll {
+			writeJSON(w, 401, map[string]any{"error": "signature required"})
+			return
+		}
+		r.Header.Del("X-Canonical-Agent-Id")
+		r.Header.Del("X-Agent-Approval")
 		next(w, r)
 	}
 }
@@ -206,15 +680,33 @@ func (api *API) RequireAgentAuth(next http.HandlerFunc) http.HandlerFunc {
 //
 // Expects POST JSON: shared.HeartbeatRequest.
 // If inventory is included, it is stored as a snapshot and v0 "facts" are derived
-// (OS version/build, CPU, RAM, disk totals, primary IPv4, etc.).
+// (OS version/build, CPU, RAM, disk totals, primary IPv4, etc.). Quick facts,
+// sent with every heartbeat, then refresh free RAM, disk and uptime.
+// Agents pending approval only update presence; their inventory isn't trusted.
 //
 // This endpoint is signed (RequireAgentAuth) because it mutates server state.
 
 func (api *API) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	api.heartbeat(api.Store, api.notifyFactsChanged, w, r)
+}
+
+// notifyFactsChanged sends ev to the facts webhook, if one is configured.
+func (api *API) notifyFactsChanged(ev FactsChangedEvent) {
+	if api.FactsWebhook != nil {
+		api.FactsWebhook.Notify(ev)
+	}
+}
+
+// heartbeat is Heartbeat writing to st (a batch's transaction) and handing
+// facts webhook events to notify (which a batch holds until it commits).
+func (api *API) heartbeat(st Store, notify func(FactsChangedEvent), w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
+	if !requireJSON(w, r) {
+		return
+	}
 
 	body, err := readBody(r)
 	if err != nil {
@@ -234,42 +726,113 @@ func (api *API) Heartbeat(w http.ResponseWriter, r *http.Request) {
 		hb.AgentID = canon
 	}
 
-	if err := api.Store.UpdateAgentSeen(hb.AgentID, hb.Info, hb.Tags); err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+	if err := st.UpdateAgentSeen(hb.AgentID, hb.Info, hb.Tags); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := st.SetAgentCapabilities(hb.AgentID, hb.Capabilities); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := st.SetAgentHeartbeatInterval(hb.AgentID, hb.HeartbeatIntervalSeconds); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if err := st.SetAgentJobState(hb.AgentID, hb.Jobs); err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if changed, err := st.SetAgentDiskState(hb.AgentID, hb.DiskFreeBytes, hb.DiskPressure); err != nil {
+		writeDBError(w, err)
+		return
+	} else if changed && hb.DiskPressure {
+		log.Printf("heartbeat: agent_id=%s reports disk pressure (%d MB free)", hb.AgentID, hb.DiskFreeBytes>>20)
+	} else if changed {
+		log.Printf("heartbeat: agent_id=%s disk pressure cleared", hb.AgentID)
+	}
+	if changed, err := st.MarkAgentOnline(hb.AgentID, time.Now().Unix()); err != nil {
+		log.Printf("liveness: mark online failed agent_id=%s: %v", hb.AgentID, err)
+	} else if changed {
+		log.Printf("liveness: agent_id=%s online", hb.AgentID)
+	}
+	api.heartbeats.publish(HeartbeatEvent{
+		Type:       "heartbeat",
+		AgentID:    hb.AgentID,
+		Hostname:   hb.Info.Hostname,
+		ServerTime: time.Now().Unix(),
+	})
+	if r.Header.Get("X-Agent-Approval") == ApprovalPending {
+		writeJSON(w, 200, shared.HeartbeatResponse{
+			Ok:         true,
+			ServerTime: time.Now().Unix(),
+		})
 		return
 	}
-	if len(hb.Inventory) > 0 {
-		_ = api.Store.AddInventorySnapshot(hb.AgentID, string(hb.Inventory))
 
-		// Facts extraction (v0)
-		var inv WinInventory
-		if err := json.Unmarshal(hb.Inventory, &inv); err == nil {
-			var diskTotal, diskFree int64
-			for _, d := range inv.Disks {
-				diskTotal += d.Size
-				diskFree += d.Free
+	if hb.InventoryError != "" {
+		log.Printf("heartbeat: agent_id=%s inventory collection failed: %s", hb.AgentID, hb.InventoryError)
+	}
+	if err := st.SetAgentInventoryError(hb.AgentID, hb.InventoryError); err != nil {
+		log.Printf("heartbeat: record inventory error failed agent_id=%s: %v", hb.AgentID, err)
+	}
+
+	switch inventoryPresence(hb.Inventory) {
+	case inventoryNotSent:
+		// Nothing to store; presence was updated above.
+	case inventoryEmpty:
+		log.Printf("heartbeat: agent_id=%s sent an empty inventory; ignoring", hb.AgentID)
+	default:
+		_ = st.AddInventorySnapshot(hb.AgentID, string(hb.Inventory))
+		var custom map[string]string
+		if api.CustomFacts.Len() > 0 {
+			custom = api.CustomFacts.Extract(hb.Inventory)
+			if err := st.SetAgentCustomFacts(hb.AgentID, custom, time.Now().Unix()); err != nil {
+				log.Printf("heartbeat: storing custom facts failed agent_id=%s: %v", hb.AgentID, err)
+			}
+		}
+
+		// Facts extraction (v0), from the OS-independent model
+		inv, schema, err := normalizeInventory(hb.Inventory, hb.Info.OS)
+		if err != nil {
+			// The snapshot is stored as sent, but no facts come out of it;
+			// flag the agent so a broken collector doesn't go unnoticed.
+			log.Printf("heartbeat: agent_id=%s inventory doesn't match the expected %s shape; no facts derived: %v", hb.AgentID, schema, err)
+			if err := st.SetAgentInventoryParseError(hb.AgentID, err.Error()); err != nil {
+				log.Printf("heartbeat: record inventory parse error failed agent_id=%s: %v", hb.AgentID, err)
+			}
+		} else {
+			_ = st.SetAgentInventoryParseError(hb.AgentID, "")
+			facts := withQuickFacts(factsFromInventory(hb.AgentID, inv, time.Now().Unix()), hb.QuickFacts)
+
+			var prev *AgentFacts
+			if api.FactsWebhook != nil {
+				prev, _ = st.GetAgentFacts(hb.AgentID)
 			}
-			ip := ""
-			if len(inv.IPv4) > 0 {
-				ip = inv.IPv4[0]
+			if err := st.UpsertAgentFacts(facts); err == nil && prev != nil {
+				if changes := materialFactChanges(*prev, facts); len(changes) > 0 {
+					if rec, err := st.GetAgentByID(hb.AgentID); err != nil || rec == nil {
+						log.Printf("webhook: facts event dropped agent_id=%s: agent lookup failed: %v", hb.AgentID, err)
+					} else {
+						view := factsView(facts, rec)
+						view.CustomFacts = custom
+						notify(FactsChangedEvent{
+							Event:   "agent.facts_changed",
+							AgentID: hb.AgentID,
+							At:      facts.UpdatedAt,
+							Changes: changes,
+							Facts:   view,
+						})
+					}
+				}
 			}
+		}
+	}
 
-			_ = api.Store.UpsertAgentFacts(AgentFacts{
-				AgentID:        hb.AgentID,
-				UpdatedAt:      time.Now().Unix(),
-				OSCaption:      inv.OS.Caption,
-				OSVersion:      inv.OS.Version,
-				OSBuild:        inv.OS.Build,
-				CPUName:        inv.CPU.Name,
-				CPUCores:       inv.CPU.Cores,
-				CPULogical:     inv.CPU.Logical,
-				RAMTotalBytes:  inv.Memory.TotalBytes,
-				RAMFreeBytes:   inv.Memory.FreeBytes,
-				UptimeSeconds:  inv.UptimeSeconds,
-				IPv4Primary:    ip,
-				DiskTotalBytes: diskTotal,
-				DiskFreeBytes:  diskFree,
-			})
+	// Also when no inventory came (or it didn't parse), and to stamp
+	// quick_facts_at.
+	if hb.QuickFacts != nil {
+		if err := st.UpdateAgentQuickFacts(hb.AgentID, *hb.QuickFacts); err != nil {
+			log.Printf("heartbeat: update quick facts failed agent_id=%s: %v", hb.AgentID, err)
 		}
 	}
 
@@ -281,11 +844,17 @@ func (api *API) Heartbeat(w http.ResponseWriter, r *http.Request) {
 
 // PollJobs allows an agent to request queued work.
 //
-// Expects GET with query param: agent_id.
-// Returns up to N jobs from the queue in shared.JobsPollResponse.
+// Expects GET with query params: agent_id, optional max (batch size).
+// HEAD is deliberately not accepted: polling dequeues jobs, so it is not a
+// safe read. Returns up to max jobs (PollBatchDefault if omitted, clamped to
+// PollBatchMax) in shared.JobsPollResponse.
+// Agents pending approval always get an empty list (enforced in DequeueJobs).
+// An agent_id the server has no record of gets 404 "unknown agent" rather
+// than an empty list, so a deleted or mistyped agent notices.
 //
-// NOTE: In v0 this is not signed. If you want strict security, wrap this with
-// RequireAgentAuth and/or move agent_id into headers so the signature covers identity.
+// Current agents sign this request (query included), in which case the
+// verified agent id wins over the query's agent_id. Unsigned polls from older
+// agents are still accepted unless RequireSignedPoll is set (OptionalAgentAuth).
 
 func (api *API) PollJobs(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -293,39 +862,103 @@ func (api *API) PollJobs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	agentID := r.URL.Query().Get("agent_id")
+	if canon := r.Header.Get("X-Canonical-Agent-Id"); canon != "" {
+		agentID = canon
+	}
 	if agentID == "" {
 		writeJSON(w, 400, map[string]any{"error": "missing agent_id"})
 		return
 	}
 
-	jobs, err := api.Store.DequeueJobs(agentID, 5)
+	batch, ok := api.pollBatchSize(r.URL.Query().Get("max"))
+	if !ok {
+		writeJSON(w, 400, map[string]any{"error": "invalid max"})
+		return
+	}
+
+	exists, err := api.Store.AgentExists(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !exists {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	jobs, blocked, err := api.Store.DequeueJobs(agentID, batch, api.CommandBlocklist)
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+		writeDBError(w, err)
 		return
 	}
+	for _, b := range blocked {
+		log.Printf("jobs: blocked at dispatch job_id=%s agent_id=%s pattern=%q", b.JobID, agentID, b.Pattern)
+	}
 
 	writeJSON(w, 200, shared.JobsPollResponse{Jobs: jobs})
 }
 
+// pollBatchSize validates the client-requested batch size and clamps it.
+func (api *API) pollBatchSize(v string) (int, bool) {
+	def, max := api.PollBatchDefault, api.PollBatchMax
+	if def <= 0 {
+		def = 5
+	}
+	if max <= 0 {
+		max = 50
+	}
+	if def > max {
+		def = max
+	}
+	if v == "" {
+		return def, true
+	}
+	n, _ := parseInt64(v)
+	if n <= 0 {
+		return 0, false
+	}
+	if n > int64(max) {
+		return max, true
+	}
+	return int(n), true
+}
+
 // JobResult accepts an agent's result payload for a previously issued job.
 //
 // Expects POST JSON: shared.JobResult.
 // This endpoint is signed (RequireAgentAuth) because it writes results to storage.
+// Agents pending approval are rejected with 403, as is (and dead-lettered) a
+// result for a job queued for another agent.
 //
 // If RequireAgentAuth re-associated identity via pubkey, we use X-Canonical-Agent-Id.
+//
+// Posting is idempotent, so an agent may retry until it sees a 200: the first
+// result recorded for a job stands, and any later post for that job is
+// answered 200 with "already_recorded": true and changes nothing. Any other
+// status means the result was not recorded (503 is worth retrying after
+// Retry-After; 4xx will fail the same way again).
 
 func (api *API) JobResult(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
+	if !requireJSON(w, r) {
+		return
+	}
 	body, err := readBody(r)
 	if err != nil {
 		writeJSON(w, 400, map[string]any{"error": "bad body"})
 		return
 	}
+	if r.Header.Get("X-Agent-Approval") == ApprovalPending {
+		writeJSON(w, 403, map[string]any{"error": "agent pending approval"})
+		return
+	}
+
 	var res shared.JobResult
 	if err := json.Unmarshal(body, &res); err != nil {
+		api.deadLetterResult(r, r.Header.Get("X-Canonical-Agent-Id"), "", "bad json: "+err.Error(), body)
 		writeJSON(w, 400, map[string]any{"error": "bad json"})
 		return
 	}
@@ -335,174 +968,1102 @@ func (api *API) JobResult(w http.ResponseWriter, r *http.Request) {
 		res.AgentID = canon
 	}
 
-	if err := api.Store.AddResult(res); err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+	if err := validateOutputEncoding(res); err != nil {
+		api.deadLetterResult(r, res.AgentID, res.JobID, err.Error(), body)
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	if res.OutputEncoding == shared.PayloadEncodingUTF8 {
+		res.OutputEncoding = ""
+	}
+
+	// Check first rather than decoding a foreign key failure from AddResult.
+	target, known, err := api.Store.JobTarget(res.JobID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !known {
+		api.deadLetterResult(r, res.AgentID, res.JobID, "unknown job", body)
+		writeJSON(w, 404, map[string]any{"error": "unknown job", "job_id": res.JobID})
+		return
+	}
+	// An agent may only report on its own jobs.
+	if target != res.AgentID {
+		log.Printf("jobs: result refused job_id=%s agent_id=%s: job belongs to agent_id=%s", res.JobID, res.AgentID, target)
+		api.deadLetterResult(r, res.AgentID, res.JobID, "job belongs to another agent", body)
+		writeJSON(w, 403, map[string]any{"error": "job belongs to another agent", "job_id": res.JobID})
+		return
+	}
+
+	stdoutBytes, stderrBytes := len(res.Stdout), len(res.Stderr)
+	if capResultOutput(&res, api.maxResultOutputBytes()) {
+		log.Printf("jobs: result output truncated job_id=%s agent_id=%s stdout_bytes=%d stderr_bytes=%d cap=%d",
+			res.JobID, res.AgentID, stdoutBytes, stderrBytes, api.maxResultOutputBytes())
+	}
+
+	recorded, err := api.Store.AddResult(res)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !recorded {
+		log.Printf("jobs: duplicate result ignored job_id=%s agent_id=%s", res.JobID, res.AgentID)
+		writeJSON(w, 200, map[string]any{"ok": true, "already_recorded": true})
 		return
 	}
 
 	writeJSON(w, 200, map[string]any{"ok": true})
 }
 
-// SubmitJob queues work for a target agent.
-//
-// Expects POST JSON: shared.SubmitJobRequest.
-// This is a v0 admin-style endpoint and should be protected (RequireServiceKey)
-// before exposing rr-server beyond localhost.
+// AgentHMACSecret issues the calling agent a new shared secret for HMAC
+// request signing, replacing any earlier one. It's for agents where ed25519
+// on every request is too costly; the request itself must be ed25519-signed,
+// so only the key holder can obtain (or rotate) the secret, and must have
+// come over TLS unless AllowInsecureHMACSecret is set.
 //
-// Later: integrate with FrontDesk/PatchDay (e.g., "run script", "collect facts", etc.).
+// Route:
+//   POST /v1/hmac-secret   (signed, ed25519 only)
 
-func (api *API) SubmitJob(w http.ResponseWriter, r *http.Request) {
-	// v0 admin endpoint: no auth yet (lock it down later)
+func (api *API) AgentHMACSecret(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
-	body, err := readBody(r)
-	if err != nil {
-		writeJSON(w, 400, map[string]any{"error": "bad body"})
-		return
-	}
-	var req shared.SubmitJobRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		writeJSON(w, 400, map[string]any{"error": "bad json"})
+	if r.Header.Get(shared.AuthModeHeader) == shared.AuthModeHMAC {
+		writeJSON(w, 403, map[string]any{"error": "hmac secret must be requested with an ed25519 signature"})
 		return
 	}
-	if strings.TrimSpace(req.TargetAgentID) == "" {
-		writeJSON(w, 400, map[string]any{"error": "missing target_agent_id"})
+	agentID := r.Header.Get("X-Canonical-Agent-Id")
+	if !api.AllowInsecureHMACSecret && !api.requestTLS(r) {
+		log.Printf("auth: hmac secret refused over plain http agent_id=%s remote=%s", agentID, api.clientIP(r))
+		writeJSON(w, 403, map[string]any{"error": "hmac secret is only issued over TLS"})
 		return
 	}
 
-	job := shared.Job{
-		JobID:          uuid.NewString(),
-		Kind:           req.Kind,
-		Shell:          req.Shell,
-		Command:        req.Command,
-		TimeoutSeconds: req.TimeoutSeconds,
-	}
-	if job.Kind == "" {
-		job.Kind = "command"
-	}
-	if job.TimeoutSeconds <= 0 {
-		job.TimeoutSeconds = 30
+	secret, err := shared.GenHMACSecret()
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "secret generation failed"})
+		return
 	}
-
-	if err := api.Store.QueueJob(req.TargetAgentID, job); err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+	if err := api.Store.SetAgentHMACSecret(agentID, secret); err != nil {
+		writeDBError(w, err)
 		return
 	}
 
-	writeJSON(w, 200, map[string]any{"ok": true, "job_id": job.JobID})
+	log.Printf("auth: hmac signing secret issued agent_id=%s remote=%s", agentID, api.clientIP(r))
+	writeJSON(w, 200, shared.HMACSecretResponse{Secret: secret})
 }
 
-// parseInt64 parses a base-10 integer string without using strconv.
-// Kept tiny for v0; returns 0 if any non-digit is encountered.
+// Ping is a signed no-op. It lets an agent (rr-agent -check) confirm the
+// server is reachable and accepts its identity and signature, without side
+// effects: last_seen isn't touched and pending agents get an answer too.
+//
+// Route:
+//   GET /v1/ping   (signed)
 
-func parseInt64(s string) (int64, error) {
-	var n int64
-	for _, ch := range s {
-		if ch < '0' || ch > '9' {
-			return 0, nil
-		}
-		n = n*10 + int64(ch-'0')
+func (api *API) Ping(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
 	}
-	return n, nil
+	writeJSON(w, 200, shared.PingResponse{
+		Ok:              true,
+		AgentID:         r.Header.Get("X-Canonical-Agent-Id"),
+		ApprovalStatus:  r.Header.Get("X-Agent-Approval"),
+		ServerTime:      time.Now().Unix(),
+		ProtocolVersion: shared.ProtocolVersion,
+	})
 }
 
-// -----------------------------------------------------------------------------
+// AgentWhoami tells a signed agent who the server thinks it is: the canonical
+// agent_id its request resolved to (which differs from the X-Agent-Id it
+// sent when it was re-associated by public key), its effective tags and its
+// approval status. Disabled agents get an answer too, so they can tell why
+// everything else is refused.
+//
+// Route:
+//   GET /v1/agent/whoami   (signed)
+
+func (api *API) AgentWhoami(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	rec, err := api.Store.GetAgentByID(r.Header.Get("X-Canonical-Agent-Id"))
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rec == nil {
+		writeJSON(w, 401, map[string]any{"error": "unknown agent"})
+		return
+	}
+	tags := rec.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	writeJSON(w, 200, shared.WhoamiResponse{
+		AgentID:        rec.AgentID,
+		Hostname:       rec.Info.Hostname,
+		Tags:           tags,
+		TagsSource:     rec.TagsSource,
+		ApprovalStatus: rec.ApprovalStatus,
+		Disabled:       rec.ApprovalStatus == ApprovalDisabled,
+		ServerTime:     time.Now().Unix(),
+	})
+}
+
+// SubmitJob queues work for a target agent.
+//
+// Expects POST JSON: shared.SubmitJobRequest. With target_group_id instead of
+// target_agent_id, one job is queued per group member (see submitGroupJob).
+// This is a v0 admin-style endpoint and should be protected (RequireServiceKey)
+// before exposing rr-server beyond localhost.
+//
+// Later: integrate with FrontDesk/PatchDay (e.g., "run script", "collect facts", etc.).
+
+func (api *API) SubmitJob(w http.ResponseWriter, r *http.Request) {
+	// v0 admin endpoint: no auth yet (lock it down later)
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var req shared.SubmitJobRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+	req.TargetAgentID = strings.TrimSpace(req.TargetAgentID)
+	targets := 0
+	for _, set := range []bool{req.TargetAgentID != "", req.TargetGroupID != "", req.Selector != nil} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		writeJSON(w, 400, map[string]any{"error": "exactly one of target_agent_id, target_group_id or selector is required"})
+		return
+	}
+
+	job := newJob(req.Kind, req.Shell, req.Command, req.TimeoutSeconds)
+	if err := setCommandEncoding(&job, req.CommandEncoding); err != nil {
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	if req.RunAs != nil {
+		if err := validateRunAs(req.RunAs); err != nil {
+			writeJSON(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+		job.RunAs = req.RunAs
+	}
+	if err := validatePriority(req.Priority); err != nil {
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	job.Priority = req.Priority
+	job.PreCommand, job.PostCommand = req.PreCommand, req.PostCommand
+	if job.HasHooks() && job.Kind != shared.JobKindCommand {
+		writeJSON(w, 400, map[string]any{"error": "pre_command and post_command are only for command jobs"})
+		return
+	}
+	if job.Kind == shared.JobKindGetFile {
+		if err := prepareGetFile(&job); err != nil {
+			writeJSON(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.TargetGroupID != "" {
+		if job.Kind == shared.JobKindUninstall {
+			writeJSON(w, 400, map[string]any{"error": "uninstall jobs can't target a group; submit them per agent"})
+			return
+		}
+		api.submitGroupJob(w, r, req.TargetGroupID, job)
+		return
+	}
+	if req.Selector != nil {
+		if job.Kind == shared.JobKindUninstall {
+			writeJSON(w, 400, map[string]any{"error": "uninstall jobs can't target a selector; submit them per agent"})
+			return
+		}
+		api.submitSelectorJob(w, r, req.Selector, job)
+		return
+	}
+
+	rec, err := api.Store.GetAgentByID(req.TargetAgentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rec == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	if job.Kind == shared.JobKindUninstall {
+		// Irreversible on the agent side: demand the target id back as
+		// confirmation. Command is fixed so policies can match "uninstall".
+		if req.Confirm != rec.AgentID {
+			writeJSON(w, 400, map[string]any{"error": "uninstall requires confirm set to the target agent id"})
+			return
+		}
+		job.Command = shared.JobKindUninstall
+		job.CommandEncoding = ""
+		job.Confirm = req.Confirm
+		log.Printf("jobs: uninstall queued for agent_id=%s hostname=%s remote=%s", rec.AgentID, rec.Info.Hostname, api.clientIP(r))
+	}
+	if missing := missingCapabilities(rec, job); len(missing) > 0 {
+		writeJSON(w, 400, map[string]any{
+			"error":   "target agent cannot run this job",
+			"missing": missing,
+		})
+		return
+	}
+
+	verdict, err := api.enforceJobPolicy(r, rec, job)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if verdict != nil {
+		writePolicyRejection(w, verdict)
+		return
+	}
+
+	if err := api.Store.QueueJob(req.TargetAgentID, job, api.MaxQueuedJobsPerAgent); err != nil {
+		if errors.Is(err, ErrQueueFull) {
+			writeQueueFull(w, req.TargetAgentID, api.MaxQueuedJobsPerAgent)
+			return
+		}
+		writeDBError(w, err)
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{"ok": true, "job_id": job.JobID})
+}
+
+// writeQueueFull is the 429 for a submit that would exceed
+// MaxQueuedJobsPerAgent.
+func writeQueueFull(w http.ResponseWriter, agentID string, max int) {
+	writeJSON(w, 429, map[string]any{"error": "queue full", "agent_id": agentID, "max_queued": max})
+}
+
+// newJob builds a shared.Job with a fresh id and the v0 defaults applied
+// (kind "command", 30s timeout).
+
+func newJob(kind, shell, command string, timeoutSeconds int) shared.Job {
+	job := shared.Job{
+		JobID:          uuid.NewString(),
+		Kind:           kind,
+		Shell:          shell,
+		Command:        command,
+		TimeoutSeconds: timeoutSeconds,
+	}
+	if job.Kind == "" {
+		job.Kind = shared.JobKindCommand
+	}
+	if job.TimeoutSeconds <= 0 {
+		job.TimeoutSeconds = 30
+	}
+	return job
+}
+
+var (
+	runAsUserRe       = regexp.MustCompile(`^[A-Za-z0-9._@\\-]{1,104}$`) // user, DOMAIN\user, user@domain
+	runAsCredentialRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+)
+
+// validatePriority keeps priorities in the small shared range so nobody
+// "wins" the queue with an arbitrarily large number.
+func validatePriority(p int) error {
+	if p < shared.JobPriorityMin || p > shared.JobPriorityMax {
+		return fmt.Errorf("priority must be between %d and %d", shared.JobPriorityMin, shared.JobPriorityMax)
+	}
+	return nil
+}
+
+// validateRunAs checks the shape of a run_as request. Whether the user exists
+// (and the agent may switch to it) is only known on the agent.
+func validateRunAs(ra *shared.RunAs) error {
+	if ra.User == "" && ra.Credential == "" {
+		return errors.New("run_as needs a user or credential")
+	}
+	if ra.User != "" && !runAsUserRe.MatchString(ra.User) {
+		return errors.New("invalid run_as.user")
+	}
+	if ra.Credential != "" && !runAsCredentialRe.MatchString(ra.Credential) {
+		return errors.New("invalid run_as.credential")
+	}
+	return nil
+}
+
+// setCommandEncoding records how job.Command was submitted. A base64 command
+// has to decode, so a bad payload is rejected here rather than on the agent.
+func setCommandEncoding(job *shared.Job, enc string) error {
+	if !shared.ValidPayloadEncoding(enc) {
+		return errors.New("command_encoding must be utf8 or base64")
+	}
+	if enc == shared.PayloadEncodingUTF8 {
+		enc = ""
+	}
+	job.CommandEncoding = enc
+	if _, err := job.PlainCommand(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// policyCommand is the text command policies are matched against: the
+// decoded script for base64 jobs, so encoding can't sidestep a deny rule.
+func policyCommand(job shared.Job) string {
+	if cmd, err := job.PlainCommand(); err == nil {
+		return cmd
+	}
+	return job.Command
+}
+
+// policyCommands is everything job will run: policyCommand plus its hooks,
+// each of which must pass policies and the blocklist on its own.
+func policyCommands(job shared.Job) []string {
+	cmds := []string{policyCommand(job)}
+	for _, hook := range []string{job.PreCommand, job.PostCommand} {
+		if hook != "" {
+			cmds = append(cmds, hook)
+		}
+	}
+	return cmds
+}
+
+// validateOutputEncoding checks a result's output_encoding and, for base64,
+// that both streams actually decode.
+func validateOutputEncoding(res shared.JobResult) error {
+	if !shared.ValidPayloadEncoding(res.OutputEncoding) {
+		return errors.New("output_encoding must be utf8 or base64")
+	}
+	if res.OutputEncoding != shared.PayloadEncodingBase64 {
+		return nil
+	}
+	for _, s := range []string{res.Stdout, res.Stderr} {
+		if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+			return errors.New("output is not valid base64")
+		}
+	}
+	return nil
+}
+
+// defaultMaxResultOutputBytes is the per-stream result output cap when
+// MaxResultOutputBytes isn't set.
+const defaultMaxResultOutputBytes = 4 << 20
+
+func (api *API) maxResultOutputBytes() int {
+	if api.MaxResultOutputBytes <= 0 {
+		return defaultMaxResultOutputBytes
+	}
+	return api.MaxResultOutputBytes
+}
+
+// resultTruncatedMarker ends UTF-8 output capResultOutput cut.
+const resultTruncatedMarker = "\n[rr-server: output truncated]\n"
+
+// capResultOutput cuts stdout and stderr to max bytes each and reports
+// whether it cut anything, setting res.Truncated if so. Text is cut at a
+// rune boundary and ends with resultTruncatedMarker; base64 output is cut
+// at a 4-character boundary so it still decodes (to a prefix of the bytes).
+func capResultOutput(res *shared.JobResult, max int) bool {
+	cut := false
+	for _, s := range []*string{&res.Stdout, &res.Stderr} {
+		if len(*s) <= max {
+			continue
+		}
+		cut = true
+		if res.OutputEncoding == shared.PayloadEncodingBase64 {
+			*s = (*s)[:max/4*4]
+			continue
+		}
+		n := max - len(resultTruncatedMarker)
+		if n < 0 {
+			n = 0
+		}
+		for n > 0 && !utf8.RuneStart((*s)[n]) {
+			n--
+		}
+		*s = (*s)[:n] + resultTruncatedMarker
+	}
+	if cut {
+		res.Truncated = true
+	}
+	return cut
+}
+
+// missingCapabilities returns the capabilities job needs that rec doesn't
+// advertise. Agents that never advertised anything predate capabilities and
+// are assumed to run plain commands in any shell, as they always have.
+
+func missingCapabilities(rec *AgentRecord, job shared.Job) []string {
+	caps := rec.Capabilities
+	if len(caps) == 0 {
+		caps = shared.LegacyCapabilities
+	}
+	have := map[string]bool{}
+	for _, c := range caps {
+		have[c] = true
+	}
+
+	var missing []string
+	if c := shared.CapabilityKind(job.Kind); !have[c] {
+		missing = append(missing, c)
+	}
+	if job.Shell != "" && len(rec.Capabilities) > 0 {
+		if c := shared.CapabilityShell(job.Shell); !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	if job.RunAs != nil {
+		if c := shared.CapabilityFeature("run_as"); !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	// Older agents would run the base64 text itself as the script.
+	if job.CommandEncoding == shared.PayloadEncodingBase64 {
+		if c := shared.CapabilityFeature("base64_command"); !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	// ... and silently drop the hooks, running Command without its setup.
+	if job.HasHooks() {
+		if c := shared.CapabilityFeature("job_hooks"); !have[c] {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
+
+// parseInt64 parses a base-10 integer string without using strconv.
+// Kept tiny for v0; returns 0 if any non-digit is encountered.
+
+func parseInt64(s string) (int64, error) {
+	var n int64
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return 0, nil
+		}
+		n = n*10 + int64(ch-'0')
+	}
+	return n, nil
+}
+
+// -----------------------------------------------------------------------------
 // Admin endpoints (read-only views for UI/MSPGuild)
 // -----------------------------------------------------------------------------
 
 // AdminListAgents returns a lightweight view of known agents.
 //
-// Expects GET.
-// Returns agent_id, hostname, OS, arch, tags, last_seen.
-// Intended for UI/MSPGuild to show inventory/health lists.
+// Expects GET (HEAD is accepted too).
+// Returns agent_id, hostname, OS, arch, tags, last_seen, approval_status.
+// Intended for UI/MSPGuild to show inventory/health lists.
+//
+// Must be protected with RequireServiceKey in real deployments.
+
+func (api *API) AdminListAgents(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	agents, err := api.Store.ListAgents(200)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{"agents": agentRows(agents)})
+}
+
+// agentRow is the JSON shape for agent list endpoints.
+type agentRow struct {
+	AgentID        string   `json:"agent_id"`
+	Hostname       string   `json:"hostname"`
+	OS             string   `json:"os"`
+	Arch           string   `json:"arch"`
+	Tags           []string `json:"tags"`
+	LastSeen       int64    `json:"last_seen"`
+	ApprovalStatus string   `json:"approval_status"`
+	TagsSource     string   `json:"tags_source"`
+	EnrollTags     []string `json:"enroll_tags,omitempty"`
+	Capabilities   []string `json:"capabilities"`
+
+	ProtocolVersion int `json:"protocol_version"`
+
+	InventoryParseError   string `json:"inventory_parse_error,omitempty"`
+	InventoryParseErrorAt int64  `json:"inventory_parse_error_at,omitempty"`
+	InventoryError        string `json:"inventory_error,omitempty"`
+	InventoryErrorAt      int64  `json:"inventory_error_at,omitempty"`
+
+	// Jobs is the agent's job counts as of last_seen (omitted for agents
+	// that don't report them).
+	Jobs *shared.AgentJobState `json:"jobs,omitempty"`
+
+	DiskPressure  bool  `json:"disk_pressure"`
+	DiskFreeBytes int64 `json:"disk_free_bytes,omitempty"`
+}
+
+func agentRows(agents []AgentRecord) []agentRow {
+	out := make([]agentRow, 0, len(agents))
+	for _, a := range agents {
+		out = append(out, agentRow{
+			AgentID:        a.AgentID,
+			Hostname:       a.Info.Hostname,
+			OS:             a.Info.OS,
+			Arch:           a.Info.Arch,
+			Tags:           a.Tags,
+			LastSeen:       a.LastSeen,
+			ApprovalStatus: a.ApprovalStatus,
+			TagsSource:     a.TagsSource,
+			EnrollTags:     a.EnrollTags,
+			Capabilities:   a.Capabilities,
+
+			ProtocolVersion: a.ProtocolVersion,
+
+			InventoryParseError:   a.InventoryParseError,
+			InventoryParseErrorAt: a.InventoryParseErrorAt,
+			InventoryError:        a.InventoryError,
+			InventoryErrorAt:      a.InventoryErrorAt,
+
+			Jobs: a.JobState,
+
+			DiskPressure:  a.DiskPressure,
+			DiskFreeBytes: a.DiskFreeBytes,
+		})
+	}
+	return out
+}
+
+// AdminPendingAgents lists agents waiting for approval (oldest first).
+//
+// Route:
+//   GET /v1/admin/agents/pending
+
+func (api *API) AdminPendingAgents(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	agents, err := api.Store.ListAgentsByApproval(ApprovalPending, 200)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{"agents": agentRows(agents)})
+}
+
+// AdminAgentRoutes dispatches the per-agent admin sub-routes.
+//
+// This handler is mounted on the "/v1/admin/agents/" prefix and performs
+// its own path parsing:
+//   GET|DELETE /v1/admin/agents/{agent_id}
+//   GET  /v1/admin/agents/{agent_id}/events
+//   GET  /v1/admin/agents/{agent_id}/results?limit=N
+//   GET  /v1/admin/agents/{agent_id}/job-counts
+//   GET  /v1/admin/agents/{agent_id}/inventory/latest
+//   GET  /v1/admin/agents/{agent_id}/inventory/diff?from=<ts>&to=<ts>
+//   POST /v1/admin/agents/{agent_id}/approve
+//   POST /v1/admin/agents/{agent_id}/disable|enable
+//   PUT|DELETE /v1/admin/agents/{agent_id}/tags
+
+func (api *API) AdminAgentRoutes(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/admin/agents/")
+	parts := strings.Split(path, "/")
+
+	agentID := parts[0]
+	if agentID == "" {
+		writeJSON(w, 400, map[string]any{"error": "missing agent_id"})
+		return
+	}
+	sub := strings.Join(parts[1:], "/")
+
+	switch sub {
+	case "":
+		if r.Method == http.MethodDelete {
+			api.AdminDeleteAgent(w, r, agentID)
+			return
+		}
+		api.AdminAgentDetail(w, r, agentID)
+	case "disable":
+		api.AdminSetAgentDisabled(w, r, agentID, true)
+	case "enable":
+		api.AdminSetAgentDisabled(w, r, agentID, false)
+	case "events":
+		api.AdminAgentEvents(w, r, agentID)
+	case "results":
+		api.AdminAgentResults(w, r, agentID)
+	case "job-counts":
+		api.AdminAgentJobCounts(w, r, agentID)
+	case "inventory/latest":
+		api.AdminLatestInventory(w, r, agentID)
+	case "inventory/diff":
+		api.AdminInventoryDiff(w, r, agentID)
+	case "approve":
+		api.AdminApproveAgent(w, r, agentID)
+	case "tags":
+		api.AdminAgentTags(w, r, agentID)
+	default:
+		writeJSON(w, 404, map[string]any{"error": "unknown agent route", "path": r.URL.Path})
+	}
+}
+
+// AdminApproveAgent moves a pending agent to approved so it can poll jobs
+// and have its inventory ingested. Approving an approved agent is a no-op;
+// a disabled agent is refused with 409 (re-enable it instead).
+//
+// Route:
+//   POST /v1/admin/agents/{agent_id}/approve
+
+func (api *API) AdminApproveAgent(w http.ResponseWriter, r *http.Request, agentID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	changed, err := api.Store.ApproveAgent(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !changed {
+		rec, err := api.Store.GetAgentByID(agentID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		switch {
+		case rec == nil:
+			writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		case rec.ApprovalStatus == ApprovalApproved:
+			writeJSON(w, 200, map[string]any{"ok": true, "agent_id": agentID, "approval_status": ApprovalApproved})
+		default:
+			writeJSON(w, 409, map[string]any{"error": "agent is disabled", "approval_status": rec.ApprovalStatus})
+		}
+		return
+	}
+
+	log.Printf("admin: approved agent_id=%s", agentID)
+	writeJSON(w, 200, map[string]any{"ok": true, "agent_id": agentID, "approval_status": ApprovalApproved})
+}
+
+// AdminAgentDetail returns one agent's record, current facts and a reference
+// (id, size, sha256) to its latest inventory snapshot. The snapshot itself is
+// at .../inventory/latest.
+//
+// Route:
+//   GET /v1/admin/agents/{agent_id}
+
+func (api *API) AdminAgentDetail(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	d, err := api.Store.GetAgentDetail(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if d == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"agent":            agentRows([]AgentRecord{d.Agent})[0],
+		"facts":            d.Facts,
+		"latest_inventory": d.LatestInventory,
+	})
+}
+
+// AdminStaleAgents lists agents that haven't checked in for N days
+// (default 30), oldest first. Typical follow-ups are disable or delete.
+//
+// Route:
+//   GET /v1/admin/agents/stale?days=N
+
+func (api *API) AdminStaleAgents(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	days := queryInt(r, "days", 30, 3650)
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Unix()
+
+	agents, err := api.Store.ListStaleAgents(cutoff, 500)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{"days": days, "cutoff": cutoff, "agents": agentRows(agents)})
+}
+
+// AdminAgentsNoInventory lists agents that are online (seen within the
+// online window) but whose latest inventory is older than older_than
+// (default 24h; "7d" works too) or missing: the collector is failing while
+// heartbeats still get through. Agents that never sent one come first.
 //
-// Must be protected with RequireServiceKey in real deployments.
+// Route:
+//   GET /v1/admin/agents/no-inventory?older_than=24h&limit=N
 
-func (api *API) AdminListAgents(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func (api *API) AdminAgentsNoInventory(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
 
-	agents, err := api.Store.ListAgents(200)
+	olderThan := 24 * time.Hour
+	if v := r.URL.Query().Get("older_than"); v != "" {
+		d, err := parseRetentionAge(v)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "older_than must be a positive duration (e.g. 24h, 7d)"})
+			return
+		}
+		olderThan = d
+	}
+	limit := queryInt(r, "limit", 200, 1000)
+
+	now := time.Now()
+	seenAfter := now.Unix() - api.onlineWindow()
+	cutoff := now.Add(-olderThan).Unix()
+	gaps, err := api.Store.ListAgentsMissingInventory(seenAfter, cutoff, limit)
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+		writeDBError(w, err)
 		return
 	}
 
 	type row struct {
-		AgentID  string   `json:"agent_id"`
-		Hostname string   `json:"hostname"`
-		OS       string   `json:"os"`
-		Arch     string   `json:"arch"`
-		Tags     []string `json:"tags"`
-		LastSeen int64    `json:"last_seen"`
-	}
-
-	out := make([]row, 0, len(agents))
-	for _, api := range agents {
-		out = append(out, row{
-			AgentID:  api.AgentID,
-			Hostname: api.Info.Hostname,
-			OS:       api.Info.OS,
-			Arch:     api.Info.Arch,
-			Tags:     api.Tags,
-			LastSeen: api.LastSeen,
-		})
+		agentRow
+		LastInventoryAt int64 `json:"last_inventory_at"` // 0 = never
+	}
+	out := make([]row, 0, len(gaps))
+	for _, g := range gaps {
+		out = append(out, row{agentRow: agentRows([]AgentRecord{g.Agent})[0], LastInventoryAt: g.LastInventoryAt})
+	}
+	writeJSON(w, 200, map[string]any{
+		"older_than": olderThan.String(),
+		"cutoff":     cutoff,
+		"seen_after": seenAfter,
+		"agents":     out,
+	})
+}
+
+// AdminQueueDepths lists agents with jobs waiting to be polled, deepest queue
+// first, with the configured per-agent limit (0 = unlimited). A deep queue
+// with an old oldest_queued_at is an agent that stopped polling.
+//
+// Route:
+//   GET /v1/admin/agents/queues?limit=N
+
+func (api *API) AdminQueueDepths(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	limit := queryInt(r, "limit", 100, 1000)
+	depths, err := api.Store.ListQueueDepths(limit)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"agents": depths, "max_queued_per_agent": api.MaxQueuedJobsPerAgent, "limit": limit})
+}
+
+// AdminSetAgentDisabled disables an agent (its signed requests are refused
+// and it gets no jobs) or re-enables it.
+//
+// Routes:
+//   POST /v1/admin/agents/{agent_id}/disable
+//   POST /v1/admin/agents/{agent_id}/enable
+
+func (api *API) AdminSetAgentDisabled(w http.ResponseWriter, r *http.Request, agentID string, disabled bool) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	found, err := api.Store.SetAgentDisabled(agentID, disabled)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	rec, err := api.Store.GetAgentByID(agentID)
+	if err != nil || rec == nil {
+		writeDBError(w, err)
+		return
+	}
+	log.Printf("admin: agent_id=%s disabled=%v status=%s", agentID, disabled, rec.ApprovalStatus)
+	writeJSON(w, 200, map[string]any{"ok": true, "agent_id": agentID, "approval_status": rec.ApprovalStatus})
+}
+
+// AdminDeleteAgent removes an agent with its jobs, results, inventory and
+// facts. A deleted agent that is still running must re-enroll.
+//
+// Route:
+//   DELETE /v1/admin/agents/{agent_id}
+
+func (api *API) AdminDeleteAgent(w http.ResponseWriter, r *http.Request, agentID string) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	found, err := api.Store.DeleteAgent(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	log.Printf("admin: deleted agent_id=%s", agentID)
+	writeJSON(w, 200, map[string]any{"ok": true, "agent_id": agentID})
+}
+
+// AdminAgentTags lets an admin re-tag an agent without touching its config.
+//
+// Routes:
+//   PUT    /v1/admin/agents/{agent_id}/tags   body: {"tags": ["prod", ...]}
+//   DELETE /v1/admin/agents/{agent_id}/tags
+//
+// PUT stores the tags and marks them server-owned, so later heartbeats no
+// longer overwrite them. DELETE releases the override and the agent's own
+// tags take over again on its next heartbeat.
+
+func (api *API) AdminAgentTags(w http.ResponseWriter, r *http.Request, agentID string) {
+	var found bool
+	var err error
+	var tags []string
+
+	switch r.Method {
+	case http.MethodPut:
+		body, rerr := readBody(r)
+		if rerr != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var req struct {
+			Tags *[]string `json:"tags"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		if req.Tags == nil {
+			writeJSON(w, 400, map[string]any{"error": "missing tags"})
+			return
+		}
+		tags = normalizeTags(*req.Tags)
+		found, err = api.Store.SetAgentTags(agentID, tags)
+	case http.MethodDelete:
+		found, err = api.Store.ReleaseAgentTags(agentID)
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		writeJSON(w, 200, map[string]any{"ok": true, "agent_id": agentID, "tags_source": TagsSourceAgent})
+		return
+	}
+	log.Printf("admin: set tags agent_id=%s tags=%v", agentID, tags)
+	writeJSON(w, 200, map[string]any{"ok": true, "agent_id": agentID, "tags": tags, "tags_source": TagsSourceServer})
+}
+
+// normalizeTags trims tags and drops empties and duplicates, keeping order.
+// AdminBulkAgentTags adds and removes tags on every agent a selector
+// matches, in one transaction. The selector is exactly one of agent_ids, tag
+// (agents carrying it) or selector (a fact query, as for job runs). Agents
+// whose tags change become server-owned, as with PUT .../tags. The answer
+// counts the agents matched (for agent_ids, the ids given) and changed.
+//
+// Route:
+//   POST /v1/admin/agents/tags/bulk
+//     body: {"agent_ids"|"tag"|"selector": ..., "add": ["site-b"], "remove": ["site-a"]}
+
+func (api *API) AdminBulkAgentTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var req struct {
+		AgentIDs []string             `json:"agent_ids"`
+		Tag      string               `json:"tag"`
+		Selector *shared.FactSelector `json:"selector"`
+		Add      []string             `json:"add"`
+		Remove   []string             `json:"remove"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+	n := 0
+	for _, set := range []bool{req.AgentIDs != nil, req.Tag != "", req.Selector != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		writeJSON(w, 400, map[string]any{"error": "exactly one of agent_ids, tag or selector is required"})
+		return
+	}
+	add, remove := normalizeTags(req.Add), normalizeTags(req.Remove)
+	if len(add) == 0 && len(remove) == 0 {
+		writeJSON(w, 400, map[string]any{"error": "nothing to add or remove"})
+		return
+	}
+
+	var matched []string
+	switch {
+	case req.AgentIDs != nil:
+		matched = normalizeTags(req.AgentIDs) // same trim and dedupe
+	case req.Tag != "":
+		matched, err = api.Store.ListAgentIDsByTag(strings.TrimSpace(req.Tag))
+	default:
+		if verr := validateFactSelector(req.Selector); verr != nil {
+			writeJSON(w, 400, map[string]any{"error": verr.Error()})
+			return
+		}
+		matched, err = api.Store.FindAgentsByFacts(req.Selector.Where)
+	}
+	if err != nil {
+		writeDBError(w, err)
+		return
 	}
 
-	writeJSON(w, 200, map[string]any{"agents": out})
+	changed, err := api.Store.EditAgentTags(matched, add, remove)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	log.Printf("admin: bulk tags matched=%d changed=%d add=%v remove=%v by=%q",
+		len(matched), len(changed), add, remove, r.Header.Get(keyLabelHeader))
+	writeJSON(w, 200, map[string]any{"ok": true, "matched": len(matched), "changed": len(changed), "changed_agent_ids": changed})
+}
+
+// editTags applies add then remove to tags; ok is false if nothing changed.
+func editTags(tags, add, remove []string) (edited []string, ok bool) {
+	drop := make(map[string]bool, len(remove))
+	for _, t := range remove {
+		drop[t] = true
+	}
+	edited = []string{}
+	for _, t := range normalizeTags(append(append([]string{}, tags...), add...)) {
+		if !drop[t] {
+			edited = append(edited, t)
+		}
+	}
+	return edited, !slices.Equal(edited, normalizeTags(tags))
+}
+
+func normalizeTags(in []string) []string {
+	out := make([]string, 0, len(in))
+	seen := make(map[string]bool, len(in))
+	for _, t := range in {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+	}
+	return out
 }
 
 // AdminLatestInventory returns the most recent inventory snapshot for a single agent.
 //
 // Route:
-//   GET /v1/admin/agents/{agent_id}/inventory/latest
+//   GET /v1/admin/agents/{agent_id}/inventory/latest[?view=raw|summary]
+//   GET /v1/admin/agents/{agent_id}/inventory/latest?download=1
 //
-// This handler is mounted on the "/v1/admin/agents/" prefix and performs
-// its own path parsing to extract the agent ID and expected sub-path.
+// Dispatched by AdminAgentRoutes, which extracts the agent ID.
 //
 // Behavior:
-//   - Validates the request path structure
 //   - Looks up the latest inventory snapshot for the agent
-//   - Returns the snapshot as raw JSON (no re-encoding)
+//   - view=raw (default): returns the snapshot as raw JSON (no re-encoding)
+//   - view=summary: returns only the facts derived from that snapshot (the
+//     same extraction heartbeats use), for UIs that want headline numbers
+//   - With download=1 the raw snapshot is sent as an attachment named
+//     <hostname>-inventory-<snapshot time>.json, for saving to a ticket
 //
 // Notes:
 //   - Inventory payloads are stored as opaque JSON blobs generated by agents.
 //   - This endpoint is intended for internal/admin use (UI, MSPGuild).
 //   - Must be protected with RequireServiceKey before exposing publicly.
 
-func (api *API) AdminLatestInventory(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func (api *API) AdminLatestInventory(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !isRead(r) {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
-	// ServeMux prefix handler:
-	// We manually parse the remainder of the path to support sub-routes
-	// under /v1/admin/agents/{agent_id}/...
-
-	path := strings.TrimPrefix(r.URL.Path, "/v1/admin/agents/")
-	parts := strings.Split(path, "/")
 
-	if len(parts) != 3 || parts[1] != "inventory" || parts[2] != "latest" {
-		writeJSON(w, 400, map[string]any{
-			"error":    "invalid path",
-			"expected": "/v1/admin/agents/{agent_id}/inventory/latest",
-		})
+	download := r.URL.Query().Get("download")
+	download1 := download == "1" || download == "true"
+	switch r.URL.Query().Get("view") {
+	case "", "raw":
+	case "summary":
+		if download1 {
+			writeJSON(w, 400, map[string]any{"error": "download is only available for view=raw"})
+			return
+		}
+		api.latestInventorySummary(w, agentID)
+		return
+	default:
+		writeJSON(w, 400, map[string]any{"error": "view must be raw or summary"})
 		return
 	}
 
-	agentID := parts[0]
-	if agentID == "" {
-		writeJSON(w, 400, map[string]any{"error": "missing agent_id"})
+	if download1 {
+		api.downloadLatestInventory(w, agentID)
 		return
 	}
 
 	payload, err := api.Store.GetLatestInventorySnapshot(agentID)
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+		writeDBError(w, err)
 		return
 	}
 	if payload == "" {
@@ -511,32 +2072,234 @@ func (api *API) AdminLatestInventory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// payload is already JSON — return it raw
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	_, _ = w.Write([]byte(payload))
+	writeRaw(w, 200, []byte(payload))
+}
+
+func (api *API) downloadLatestInventory(w http.ResponseWriter, agentID string) {
+	rec, err := api.Store.GetAgentByID(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rec == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+	ref, payload, err := api.Store.GetInventorySnapshotAt(agentID, time.Now().Unix())
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if ref == nil {
+		writeJSON(w, 404, map[string]any{"error": "no inventory"})
+		return
+	}
+
+	name := inventoryFilename(rec.Info.Hostname, agentID, ref.CreatedAt)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	writeRaw(w, 200, []byte(payload))
+}
+
+// latestInventorySummary re-derives facts from the latest stored snapshot
+// rather than reading agent_facts, so it always matches the snapshot it names.
+func (api *API) latestInventorySummary(w http.ResponseWriter, agentID string) {
+	rec, err := api.Store.GetAgentByID(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rec == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+	ref, payload, err := api.Store.GetInventorySnapshotAt(agentID, time.Now().Unix())
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if ref == nil {
+		writeJSON(w, 404, map[string]any{"error": "no inventory"})
+		return
+	}
+
+	inv, schema, err := normalizeInventory([]byte(payload), rec.Info.OS)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "stored inventory doesn't match the " + schema + " shape", "snapshot_id": ref.SnapshotID})
+		return
+	}
+	facts := factsView(factsFromInventory(agentID, inv, ref.CreatedAt), rec)
+	facts.CustomFacts = api.CustomFacts.Extract([]byte(payload))
+	writeJSON(w, 200, map[string]any{
+		"agent_id": agentID,
+		"view":     "summary",
+		"snapshot": ref,
+		"schema":   schema,
+		"facts":    facts,
+	})
+}
+
+// inventoryFilename builds "<hostname>-inventory-<UTC time>.json". The
+// hostname is reported by the agent, so anything outside a safe filename
+// alphabet is replaced; an empty one falls back to the agent ID.
+func inventoryFilename(hostname, agentID string, at int64) string {
+	host := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.', r == '_':
+			return r
+		}
+		return '_'
+	}, hostname)
+	if strings.Trim(host, "._") == "" {
+		host = agentID
+	}
+	return host + "-inventory-" + time.Unix(at, 0).UTC().Format("20060102T150405Z") + ".json"
 }
 
+// maxFactsListLimit caps AdminAgentsFacts' limit.
+const maxFactsListLimit = 100000
+
 // AdminAgentsFacts returns the derived "facts" summary for agents.
 //
-// Expects GET.
+// Expects GET (HEAD is accepted too).
 // Facts are extracted during Heartbeat inventory ingestion.
 // Intended for dashboards and quick asset overview.
 //
+// Rows are encoded one at a time as they come off the database, so a large
+// limit doesn't buffer the whole fleet in memory. A failure after the first
+// row has gone out can't become an error status any more; the connection is
+// cut instead so the client sees a truncated body, not a short list.
+//
+// Route:
+//   GET /v1/admin/agents/facts?limit=N   (default 200, max 100000)
+//
 // Must be protected with RequireServiceKey in real deployments.
 
 func (api *API) AdminAgentsFacts(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	limit := queryInt(r, "limit", 200, maxFactsListLimit)
+
+	enc := json.NewEncoder(w)
+	started := false
+	err := api.Store.EachAgentFacts(limit, func(f AgentFacts) error {
+		sep := ","
+		if !started {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			sep = `{"facts":[`
+			started = true
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		return enc.Encode(f)
+	})
+	switch {
+	case err != nil && !started:
+		writeDBError(w, err)
+	case err != nil:
+		log.Printf("admin: facts listing aborted mid-stream: %v", err)
+		panic(http.ErrAbortHandler)
+	case !started:
+		writeJSON(w, 200, map[string]any{"facts": []AgentFacts{}})
+	default:
+		_, _ = io.WriteString(w, "]}\n")
+	}
+}
+
+// AdminAgentsNeedingUpdates lists agents whose latest inventory reported at
+// least min (default 1) pending OS updates, most first. Only agents running
+// with inventory_updates report the count; the update list itself is in
+// their latest inventory snapshot.
+//
+// Route:
+//   GET /v1/admin/agents/needing-updates?min=1&limit=N
+
+func (api *API) AdminAgentsNeedingUpdates(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	minPending := int64(queryInt(r, "min", 1, 0))
+	if minPending < 1 {
+		minPending = 1
+	}
+	limit := queryInt(r, "limit", 200, 1000)
+
+	agents, err := api.Store.ListAgentsNeedingUpdates(minPending, limit)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"min": minPending, "agents": agents})
+}
+
+// AdminFactsDistribution counts agents per value of one fact, e.g. how many
+// machines are on each OS build, without shipping every facts row.
+//
+// Route:
+//   GET /v1/admin/facts/distribution?field=os_build
+//   field: os_caption | os_version | os_build | cpu_name
+
+func (api *API) AdminFactsDistribution(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
 		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
 		return
 	}
 
-	facts, err := api.Store.ListAgentFacts(200)
+	field := r.URL.Query().Get("field")
+	if !factsGroupableFields[field] {
+		writeJSON(w, 400, map[string]any{"error": "invalid field", "allowed": []string{"os_caption", "os_version", "os_build", "cpu_name"}})
+		return
+	}
+
+	dist, err := api.Store.FactsDistribution(field)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	var total int64
+	for _, fc := range dist {
+		total += fc.Count
+	}
+	writeJSON(w, 200, map[string]any{"field": field, "total": total, "distribution": dist})
+}
+
+// AdminFactsQuery lists the agents a fact selector matches right now, to
+// preview what a selector job would target.
+//
+// Route:
+//   POST /v1/admin/facts/query   body: shared.FactSelector
+
+func (api *API) AdminFactsQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	body, err := readBody(r)
 	if err != nil {
-		writeJSON(w, 500, map[string]any{"error": "db error"})
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var sel shared.FactSelector
+	if err := json.Unmarshal(body, &sel); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+	if err := validateFactSelector(&sel); err != nil {
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
 		return
 	}
 
-	writeJSON(w, 200, map[string]any{"facts": facts})
+	ids, err := api.Store.FindAgentsByFacts(sel.Where)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"count": len(ids), "agent_ids": ids})
 }
 
 // -----------------------------------------------------------------------------
@@ -545,23 +2308,37 @@ func (api *API) AdminAgentsFacts(w http.ResponseWriter, r *http.Request) {
 
 // RequireServiceKey protects internal endpoints intended for server-to-server use.
 //
-// The service key is provided via env RR_API_KEY and compared against the request
-// header X-RR-Key.
+// The request header X-RR-Key must carry either the env key RR_API_KEY or a
+// live named key (see servicekeys.go). A valid operator session cookie (see
+// Login) is accepted instead, so the bundled web UI works without embedding
+// the key. The matched label is passed on in X-RR-Key-Label, and mutating
+// requests are logged with it.
 //
 // This is used to lock down /v1/admin/* and any debug endpoints.
 // It's not meant for agent auth (agents use signed requests via RequireAgentAuth).
 
 func (api *API) RequireServiceKey(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		want := os.Getenv("RR_API_KEY")
-		if want == "" {
-			http.Error(w, "RR_API_KEY not set", http.StatusUnauthorized)
-			return
+		// Server-side only; never trust a client-supplied label.
+		r.Header.Del(keyLabelHeader)
+
+		label := keyLabelSession
+		if !api.validSession(r) {
+			var err error
+			label, err = api.serviceKeyLabel(r.Header.Get("X-RR-Key"))
+			if err != nil {
+				writeDBError(w, err)
+				return
+			}
+			if label == "" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
 		}
-		got := r.Header.Get("X-RR-Key")
-		if got == "" || got != want {
-			http.Error(w, "unauthorized", http.StatusUnauthorized)
-			return
+
+		r.Header.Set(keyLabelHeader, label)
+		if !isRead(r) {
+			log.Printf("audit: key=%s %s %s", label, r.Method, r.URL.Path)
 		}
 		next(w, r)
 	}
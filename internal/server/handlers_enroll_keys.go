@@ -0,0 +1,212 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Key enrollment (pre-authorized public keys)
+// -----------------------------------------------------------------------------
+//
+// Anyone holding an enroll token can register an agent. For sites where that
+// is too weak, an admin pre-authorizes the agent's public key instead (shown
+// by rr-agent -print-config) and the agent proves it holds the private key:
+//
+//   1. POST /v1/enroll/challenge {"public_key": ...}   -> single-use challenge
+//   2. POST /v1/enroll with public_key, challenge and the challenge signed
+//      with the private key (shared.SignEnrollChallenge), no enroll_token
+//
+// A key authorizes one agent: once used, it only lets that same agent enroll
+// again (enroll is idempotent by key). RR_REQUIRE_ENROLL_KEY=1 turns token
+// enrollment off entirely.
+
+const (
+	defaultEnrollKeyTTL = 24 * time.Hour
+	maxEnrollKeyTTL     = 30 * 24 * time.Hour
+
+	enrollChallengeTTL = 5 * time.Minute
+)
+
+// AdminEnrollKeys lists or pre-authorizes enroll keys.
+//
+// Routes:
+//   GET  /v1/admin/enroll-keys
+//   POST /v1/admin/enroll-keys   body: {"public_key": "<base64>", "note": "web-01", "ttl": "24h"}
+//                                (ttl default 24h, max 720h)
+
+func (api *API) AdminEnrollKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		keys, err := api.Store.ListEnrollKeys()
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"keys": keys})
+
+	case http.MethodPost:
+		body, err := readBody(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var req struct {
+			PublicKey string `json:"public_key"`
+			Note      string `json:"note"`
+			TTL       string `json:"ttl"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		req.PublicKey = strings.TrimSpace(req.PublicKey)
+		if _, err := shared.DecodePubKey(req.PublicKey); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "invalid public_key"})
+			return
+		}
+		ttl := defaultEnrollKeyTTL
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > maxEnrollKeyTTL {
+				writeJSON(w, 400, map[string]any{"error": "ttl must be a positive duration up to " + maxEnrollKeyTTL.String()})
+				return
+			}
+			ttl = d
+		}
+
+		now := time.Now()
+		k := EnrollKey{
+			ID:        newUUID(),
+			PublicKey: req.PublicKey,
+			Note:      req.Note,
+			CreatedAt: now.Unix(),
+			CreatedBy: r.Header.Get(keyLabelHeader),
+			ExpiresAt: now.Add(ttl).Unix(),
+		}
+		if err := api.Store.CreateEnrollKey(k); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				writeJSON(w, 409, map[string]any{"error": "public key already pre-authorized"})
+				return
+			}
+			writeDBError(w, err)
+			return
+		}
+
+		log.Printf("admin: enroll key pre-authorized id=%s pubkey=%s expires_at=%d by=%s",
+			k.ID, firstN(k.PublicKey, 12), k.ExpiresAt, k.CreatedBy)
+		writeJSON(w, 200, map[string]any{"ok": true, "key": k})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminEnrollKeyRoutes handles a single pre-authorized key.
+//
+// Mounted on the "/v1/admin/enroll-keys/" prefix:
+//   DELETE /v1/admin/enroll-keys/{id}   withdraw (an enrolled agent is unaffected)
+
+func (api *API) AdminEnrollKeyRoutes(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/admin/enroll-keys/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSON(w, 404, map[string]any{"error": "unknown enroll key route", "path": r.URL.Path})
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	found, err := api.Store.DeleteEnrollKey(id)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "enroll key not found"})
+		return
+	}
+
+	log.Printf("admin: enroll key deleted id=%s by=%s", id, r.Header.Get(keyLabelHeader))
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// EnrollChallenge issues the challenge a pre-authorized key signs to enroll.
+// Asking again replaces the previous challenge.
+//
+// Route:
+//   POST /v1/enroll/challenge   body: shared.EnrollChallengeRequest
+
+func (api *API) EnrollChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var req shared.EnrollChallengeRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+	if _, err := shared.DecodePubKey(req.PublicKey); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "invalid public_key"})
+		return
+	}
+
+	challenge, err := newEnrollChallenge()
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "challenge error"})
+		return
+	}
+	now := time.Now()
+	expiresAt := now.Add(enrollChallengeTTL).Unix()
+	ok, err := api.Store.SetEnrollChallenge(req.PublicKey, challenge, expiresAt, now.Unix())
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !ok {
+		log.Printf("enroll: challenge refused, key not pre-authorized pubkey=%s remote=%s",
+			firstN(req.PublicKey, 12), api.clientIP(r))
+		writeJSON(w, 403, map[string]any{"error": "public key not pre-authorized"})
+		return
+	}
+
+	writeJSON(w, 200, shared.EnrollChallengeResponse{Challenge: challenge, ExpiresAt: expiresAt})
+}
+
+func newEnrollChallenge() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// validEnrollSignature checks that req's signature over its challenge is by
+// req.PublicKey, then spends the challenge.
+func (api *API) validEnrollSignature(req shared.EnrollRequest) (bool, error) {
+	if req.Challenge == "" {
+		return false, nil
+	}
+	pub, err := shared.DecodePubKey(req.PublicKey)
+	if err != nil {
+		return false, nil
+	}
+	if !shared.VerifyEnrollChallenge(pub, req.Signature, req.Challenge) {
+		return false, nil
+	}
+	return api.Store.ConsumeEnrollChallenge(req.PublicKey, req.Challenge, time.Now().Unix())
+}
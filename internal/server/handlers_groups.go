@@ -0,0 +1,314 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Admin agent groups (curated membership, group-targeted jobs)
+// -----------------------------------------------------------------------------
+
+// AdminGroups lists or creates agent groups.
+//
+// Routes:
+//   GET  /v1/admin/groups
+//   POST /v1/admin/groups   body: {"name","description"}
+
+func (api *API) AdminGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		groups, err := api.Store.ListGroups()
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"groups": groups})
+
+	case http.MethodPost:
+		body, err := readBody(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var g AgentGroup
+		if err := json.Unmarshal(body, &g); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		// Same naming rules as templates: safe in URLs, logs and the UI.
+		if !templateNameRe.MatchString(g.Name) {
+			writeJSON(w, 400, map[string]any{"error": "invalid name"})
+			return
+		}
+
+		g.ID = newUUID()
+		g.CreatedAt = time.Now().Unix()
+		g.MemberCount = 0
+		if err := api.Store.CreateGroup(g); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				writeJSON(w, 409, map[string]any{"error": "group exists"})
+				return
+			}
+			writeDBError(w, err)
+			return
+		}
+		log.Printf("admin: group created id=%s name=%q by=%s", g.ID, g.Name, r.Header.Get(keyLabelHeader))
+		writeJSON(w, 200, map[string]any{"ok": true, "group": g})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminGroupRoutes dispatches the per-group admin sub-routes.
+//
+// Mounted on the "/v1/admin/groups/" prefix:
+//   GET    /v1/admin/groups/{id}
+//   DELETE /v1/admin/groups/{id}
+//   GET    /v1/admin/groups/{id}/members
+//   POST   /v1/admin/groups/{id}/members              body: {"agent_ids": [...]}
+//   DELETE /v1/admin/groups/{id}/members/{agent_id}
+
+func (api *API) AdminGroupRoutes(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/admin/groups/")
+	parts := strings.Split(path, "/")
+
+	groupID := parts[0]
+	if groupID == "" {
+		writeJSON(w, 400, map[string]any{"error": "missing group id"})
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		api.AdminGroup(w, r, groupID)
+	case len(parts) == 2 && parts[1] == "members":
+		api.AdminGroupMembers(w, r, groupID)
+	case len(parts) == 3 && parts[1] == "members" && parts[2] != "":
+		api.AdminRemoveGroupMember(w, r, groupID, parts[2])
+	default:
+		writeJSON(w, 404, map[string]any{"error": "unknown group route", "path": r.URL.Path})
+	}
+}
+
+func (api *API) AdminGroup(w http.ResponseWriter, r *http.Request, groupID string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		g, err := api.Store.GetGroup(groupID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if g == nil {
+			writeJSON(w, 404, map[string]any{"error": "unknown group"})
+			return
+		}
+		members, err := api.Store.ListGroupMembers(groupID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"group": g, "agent_ids": members})
+
+	case http.MethodDelete:
+		found, err := api.Store.DeleteGroup(groupID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if !found {
+			writeJSON(w, 404, map[string]any{"error": "unknown group"})
+			return
+		}
+		log.Printf("admin: group deleted id=%s by=%s", groupID, r.Header.Get(keyLabelHeader))
+		writeJSON(w, 200, map[string]any{"ok": true})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminGroupMembers lists a group's members or adds agents to it. Adding is
+// all-or-nothing: one unknown agent id rejects the whole request.
+func (api *API) AdminGroupMembers(w http.ResponseWriter, r *http.Request, groupID string) {
+	g, err := api.Store.GetGroup(groupID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if g == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown group"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		members, err := api.Store.ListGroupMembers(groupID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"group_id": groupID, "agent_ids": members})
+
+	case http.MethodPost:
+		body, err := readBody(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var req struct {
+			AgentIDs []string `json:"agent_ids"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		if len(req.AgentIDs) == 0 {
+			writeJSON(w, 400, map[string]any{"error": "missing agent_ids"})
+			return
+		}
+
+		var unknown []string
+		for _, id := range req.AgentIDs {
+			rec, err := api.Store.GetAgentByID(id)
+			if err != nil {
+				writeDBError(w, err)
+				return
+			}
+			if rec == nil {
+				unknown = append(unknown, id)
+			}
+		}
+		if len(unknown) > 0 {
+			writeJSON(w, 400, map[string]any{"error": "unknown agent", "agent_ids": unknown})
+			return
+		}
+
+		added, err := api.Store.AddGroupMembers(groupID, req.AgentIDs)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		log.Printf("admin: group id=%s added %d member(s) by=%s", groupID, added, r.Header.Get(keyLabelHeader))
+		writeJSON(w, 200, map[string]any{"ok": true, "added": added})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+func (api *API) AdminRemoveGroupMember(w http.ResponseWriter, r *http.Request, groupID, agentID string) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	found, err := api.Store.RemoveGroupMember(groupID, agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "not a member"})
+		return
+	}
+	log.Printf("admin: group id=%s removed agent_id=%s by=%s", groupID, agentID, r.Header.Get(keyLabelHeader))
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// submitGroupJob queues a copy of proto for every member of the group, all
+// under one batch id. Like template tag runs, members that can't run the job
+// or that the command policy refuses are skipped instead of failing the batch.
+func (api *API) submitGroupJob(w http.ResponseWriter, r *http.Request, groupID string, proto shared.Job) {
+	g, err := api.Store.GetGroup(groupID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if g == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown group"})
+		return
+	}
+	members, err := api.Store.ListGroupMembers(groupID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	batchID := newUUID()
+	out, err := api.fanOutBatch(r, batchID, members, proto)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "db error", "batch_id": batchID, "job_ids": out.jobIDs})
+		return
+	}
+
+	log.Printf("jobs: group run group=%q batch_id=%s queued=%d skipped=%d denied=%d queue_full=%d",
+		g.Name, batchID, len(out.jobIDs), len(out.skipped), len(out.denied), len(out.full))
+	writeJSON(w, 200, out.response(map[string]any{"ok": true, "group_id": groupID, "batch_id": batchID}))
+}
+
+// batchFanOut is what fanOutBatch did per agent.
+type batchFanOut struct {
+	jobIDs                []string
+	skipped, denied, full []string
+}
+
+// fanOutBatch queues a copy of proto under batchID for each of agentIDs.
+// Agents that are gone or can't run the job, that the command policy
+// refuses, or whose queue is full are collected instead of failing the
+// batch. On a store error the jobs queued so far are in the result.
+func (api *API) fanOutBatch(r *http.Request, batchID string, agentIDs []string, proto shared.Job) (batchFanOut, error) {
+	out := batchFanOut{jobIDs: make([]string, 0, len(agentIDs))}
+	for _, agentID := range agentIDs {
+		rec, err := api.Store.GetAgentByID(agentID)
+		if err != nil {
+			return out, err
+		}
+		if rec == nil || len(missingCapabilities(rec, proto)) > 0 {
+			out.skipped = append(out.skipped, agentID)
+			continue
+		}
+		verdict, err := api.enforceJobPolicy(r, rec, proto)
+		if err != nil {
+			return out, err
+		}
+		if verdict != nil {
+			out.denied = append(out.denied, agentID)
+			continue
+		}
+
+		job := proto
+		job.JobID = newUUID()
+		job.BatchID = batchID
+		if err := api.Store.QueueJob(agentID, job, api.MaxQueuedJobsPerAgent); err != nil {
+			if errors.Is(err, ErrQueueFull) {
+				out.full = append(out.full, agentID)
+				continue
+			}
+			return out, err
+		}
+		out.jobIDs = append(out.jobIDs, job.JobID)
+	}
+	return out, nil
+}
+
+// response adds the queued job ids and any non-empty agent lists to resp.
+func (f batchFanOut) response(resp map[string]any) map[string]any {
+	resp["job_ids"] = f.jobIDs
+	if len(f.skipped) > 0 {
+		resp["skipped_agent_ids"] = f.skipped
+	}
+	if len(f.denied) > 0 {
+		resp["policy_denied_agent_ids"] = f.denied
+	}
+	if len(f.full) > 0 {
+		resp["queue_full_agent_ids"] = f.full
+	}
+	return resp
+}
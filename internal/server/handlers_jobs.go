@@ -0,0 +1,357 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Admin job endpoints (job list + detail, batch retries)
+// -----------------------------------------------------------------------------
+
+// AdminListJobs returns job summaries, newest first, one page at a time.
+//
+// Route:
+//   GET /v1/admin/jobs?agent_id=&status=&batch_id=&limit=50&offset=0
+//
+// Summaries carry exit code, status, output sizes and timestamps only.
+// Full stdout/stderr is fetched per job via AdminJobDetail so list responses
+// stay small no matter how chatty the commands were.
+
+func (api *API) AdminListJobs(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	f := JobListFilter{
+		AgentID: q.Get("agent_id"),
+		Status:  q.Get("status"),
+		BatchID: q.Get("batch_id"),
+		Limit:   queryInt(r, "limit", 50, 500),
+		Offset:  queryInt(r, "offset", 0, 0),
+	}
+
+	jobs, err := api.Store.ListJobSummaries(f)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	resp := map[string]any{"jobs": jobs, "limit": f.Limit, "offset": f.Offset}
+	if len(jobs) == f.Limit {
+		resp["next_offset"] = f.Offset + f.Limit
+	}
+	writeJSON(w, 200, resp)
+}
+
+// AdminAgentResults lists what one agent has executed: the newest results
+// first, as summaries (exit code, timed_out, output sizes, timings) with
+// the line counts and last few lines of stdout/stderr (see ResultSummary).
+// Full output stays behind AdminJobDetail.
+//
+// Route:
+//   GET /v1/admin/agents/{agent_id}/results?limit=50
+
+func (api *API) AdminAgentResults(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	rec, err := api.Store.GetAgentByID(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rec == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	limit := queryInt(r, "limit", 50, 500)
+	results, err := api.Store.ListAgentResults(agentID, limit)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"agent_id": agentID, "results": results, "limit": limit})
+}
+
+// AdminAgentJobCounts returns how many of one agent's jobs are in each status,
+// plus when the oldest still-queued job was submitted. It's the cheap
+// aggregate for spotting backlogs and failure rates; the job list has the rows.
+//
+// Route:
+//   GET /v1/admin/agents/{agent_id}/job-counts
+
+func (api *API) AdminAgentJobCounts(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	rec, err := api.Store.GetAgentByID(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if rec == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+		return
+	}
+
+	counts, err := api.Store.AgentJobCounts(agentID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, counts)
+}
+
+// AdminJobRoutes dispatches the per-job admin sub-routes.
+//
+// Mounted on the "/v1/admin/jobs/" prefix:
+//   GET /v1/admin/jobs/{job_id}
+//   GET /v1/admin/jobs/{job_id}/file   (get_file jobs)
+
+func (api *API) AdminJobRoutes(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/admin/jobs/")
+	parts := strings.Split(path, "/")
+
+	jobID := parts[0]
+	if jobID == "" {
+		writeJSON(w, 400, map[string]any{"error": "missing job_id"})
+		return
+	}
+
+	switch strings.Join(parts[1:], "/") {
+	case "":
+		api.AdminJobDetail(w, r, jobID)
+	case "file":
+		api.AdminJobFile(w, r, jobID)
+	default:
+		writeJSON(w, 404, map[string]any{"error": "unknown job route", "path": r.URL.Path})
+	}
+}
+
+// AdminJobDetail returns a single job including its full stdout/stderr and
+// its status history (events).
+
+func (api *API) AdminJobDetail(w http.ResponseWriter, r *http.Request, jobID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	job, err := api.Store.GetJobDetail(jobID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if job == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown job"})
+		return
+	}
+
+	writeJSON(w, 200, job)
+}
+
+// AdminJobBatchRoutes dispatches the per-batch admin sub-routes.
+//
+// Mounted on the "/v1/admin/jobs/batch/" prefix:
+//   GET  /v1/admin/jobs/batch/{batch_id}                 selector + resolved agents
+//   POST /v1/admin/jobs/batch/{batch_id}/retry-failed
+
+func (api *API) AdminJobBatchRoutes(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/admin/jobs/batch/")
+	parts := strings.Split(path, "/")
+
+	batchID := parts[0]
+	if batchID == "" {
+		writeJSON(w, 400, map[string]any{"error": "missing batch_id"})
+		return
+	}
+
+	switch strings.Join(parts[1:], "/") {
+	case "":
+		api.AdminJobBatch(w, r, batchID)
+	case "retry-failed":
+		api.AdminRetryFailedBatch(w, r, batchID)
+	default:
+		writeJSON(w, 404, map[string]any{"error": "unknown batch route", "path": r.URL.Path})
+	}
+}
+
+// AdminJobBatch returns the recorded resolution of a selector batch: the
+// selector as submitted and the agent ids it matched at submit time. Batches
+// queued another way (group runs) have no record.
+//
+// Route:
+//   GET /v1/admin/jobs/batch/{batch_id}
+
+func (api *API) AdminJobBatch(w http.ResponseWriter, r *http.Request, batchID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	b, err := api.Store.GetJobBatch(batchID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if b == nil {
+		writeJSON(w, 404, map[string]any{"error": "no recorded selector for batch"})
+		return
+	}
+	writeJSON(w, 200, b)
+}
+
+// submitSelectorJob resolves sel to the agents whose facts match it now,
+// records that set under a new batch id, and queues a copy of proto for each
+// like a group run. The recorded set, not a re-evaluated selector, is what
+// the batch stands for later.
+func (api *API) submitSelectorJob(w http.ResponseWriter, r *http.Request, sel *shared.FactSelector, proto shared.Job) {
+	if err := validateFactSelector(sel); err != nil {
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	matched, err := api.Store.FindAgentsByFacts(sel.Where)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	batchID := newUUID()
+	if err := api.Store.CreateJobBatch(JobBatch{
+		ID:        batchID,
+		CreatedAt: time.Now().Unix(),
+		CreatedBy: r.Header.Get(keyLabelHeader),
+		Selector:  *sel,
+		AgentIDs:  matched,
+	}); err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	out, err := api.fanOutBatch(r, batchID, matched, proto)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "db error", "batch_id": batchID, "job_ids": out.jobIDs})
+		return
+	}
+
+	log.Printf("jobs: selector run batch_id=%s matched=%d queued=%d skipped=%d denied=%d queue_full=%d",
+		batchID, len(matched), len(out.jobIDs), len(out.skipped), len(out.denied), len(out.full))
+	writeJSON(w, 200, out.response(map[string]any{"ok": true, "batch_id": batchID, "matched_agent_ids": matched}))
+}
+
+// AdminRetryFailedBatch queues a fresh copy of every job in the batch whose
+// latest attempt failed or timed out. The copies join the same batch, so a
+// second call only retries what failed again. Agents that are gone, no longer
+// capable, now denied by command policy, or whose queue is full are reported
+// instead of queued.
+//
+// Route:
+//   POST /v1/admin/jobs/batch/{batch_id}/retry-failed
+
+func (api *API) AdminRetryFailedBatch(w http.ResponseWriter, r *http.Request, batchID string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	latest, err := api.Store.LatestBatchJobs(batchID)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if len(latest) == 0 {
+		writeJSON(w, 404, map[string]any{"error": "unknown batch"})
+		return
+	}
+
+	retried := map[string]string{} // old job id -> new job id
+	jobIDs := []string{}
+	var skipped, denied, full []string
+	for _, bj := range latest {
+		if bj.Status != "failed" && bj.Status != "timed_out" && bj.Status != "interrupted" {
+			continue
+		}
+		job, reason, err := api.rerunJob(r, bj.AgentID, bj.Job)
+		if err != nil {
+			writeJSON(w, 500, map[string]any{"error": "db error", "batch_id": batchID, "job_ids": jobIDs})
+			return
+		}
+		switch reason {
+		case rerunSkipped:
+			skipped = append(skipped, bj.AgentID)
+			continue
+		case rerunDenied:
+			denied = append(denied, bj.AgentID)
+			continue
+		case rerunQueueFull:
+			full = append(full, bj.AgentID)
+			continue
+		}
+		retried[bj.Job.JobID] = job.JobID
+		jobIDs = append(jobIDs, job.JobID)
+	}
+
+	log.Printf("jobs: batch retry batch_id=%s queued=%d skipped=%d denied=%d queue_full=%d by=%s",
+		batchID, len(jobIDs), len(skipped), len(denied), len(full), r.Header.Get(keyLabelHeader))
+	resp := map[string]any{"ok": true, "batch_id": batchID, "job_ids": jobIDs, "retried": retried}
+	if len(skipped) > 0 {
+		resp["skipped_agent_ids"] = skipped
+	}
+	if len(denied) > 0 {
+		resp["policy_denied_agent_ids"] = denied
+	}
+	if len(full) > 0 {
+		resp["queue_full_agent_ids"] = full
+	}
+	writeJSON(w, 200, resp)
+}
+
+// Why rerunJob didn't queue a copy.
+const (
+	rerunQueued    = ""
+	rerunSkipped   = "skipped"    // agent gone or can't run it any more
+	rerunDenied    = "denied"     // command policy now refuses it
+	rerunQueueFull = "queue_full" // agent's queue is at MaxQueuedJobsPerAgent
+)
+
+// rerunJob queues a fresh copy of src (new id, same definition, same batch)
+// for agentID, re-checking the agent's capabilities and the command policy
+// since either may have changed since the original was submitted.
+func (api *API) rerunJob(r *http.Request, agentID string, src shared.Job) (shared.Job, string, error) {
+	rec, err := api.Store.GetAgentByID(agentID)
+	if err != nil {
+		return shared.Job{}, "", err
+	}
+	if rec == nil || src.Kind == shared.JobKindUninstall || len(missingCapabilities(rec, src)) > 0 {
+		return shared.Job{}, rerunSkipped, nil
+	}
+	verdict, err := api.enforceJobPolicy(r, rec, src)
+	if err != nil {
+		return shared.Job{}, "", err
+	}
+	if verdict != nil {
+		return shared.Job{}, rerunDenied, nil
+	}
+
+	job := src
+	job.JobID = newUUID()
+	if err := api.Store.QueueJob(agentID, job, api.MaxQueuedJobsPerAgent); err != nil {
+		if errors.Is(err, ErrQueueFull) {
+			return shared.Job{}, rerunQueueFull, nil
+		}
+		return shared.Job{}, "", err
+	}
+	return job, rerunQueued, nil
+}
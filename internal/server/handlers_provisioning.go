@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Provisioning (what automated rollout needs to write agent.json)
+// -----------------------------------------------------------------------------
+//
+// Provisioning scripts ask the server for its public URL and protocol version
+// instead of hand-templating them, and can have it mint a short-lived enroll
+// token so the long-lived RR_ENROLL_TOKEN never ends up in rollout tooling.
+// Minted tokens are stored by sha256 only and are returned exactly once.
+
+const (
+	enrollTokenPrefix = "et_"
+
+	defaultEnrollTokenTTL = time.Hour
+	maxEnrollTokenTTL     = 7 * 24 * time.Hour
+)
+
+// AdminProvisioning returns the settings a new agent needs.
+//
+// Route:
+//   GET /v1/admin/provisioning
+//   GET /v1/admin/provisioning?enroll_token=1&ttl=2h   also mints an enroll token
+//                                                      (ttl default 1h, max 168h)
+
+func (api *API) AdminProvisioning(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	resp := map[string]any{
+		"server_url":           api.publicURL(r),
+		"protocol_version":     shared.ProtocolVersion,
+		"min_protocol_version": api.minProtocolVersion(),
+		"require_approval":     api.RequireApproval,
+	}
+
+	q := r.URL.Query()
+	if v := q.Get("enroll_token"); v == "1" || v == "true" {
+		ttl := defaultEnrollTokenTTL
+		if v := q.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > maxEnrollTokenTTL {
+				writeJSON(w, 400, map[string]any{"error": "ttl must be a positive duration up to " + maxEnrollTokenTTL.String()})
+				return
+			}
+			ttl = d
+		}
+
+		token, err := newEnrollToken()
+		if err != nil {
+			writeJSON(w, 500, map[string]any{"error": "token error"})
+			return
+		}
+		now := time.Now()
+		expiresAt := now.Add(ttl).Unix()
+		by := r.Header.Get(keyLabelHeader)
+		if err := api.Store.CreateEnrollToken(enrollTokenHash(token), now.Unix(), expiresAt, by); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		// Minting happens on a GET, which RequireServiceKey doesn't audit.
+		log.Printf("admin: minted enroll token expires_at=%d by=%s", expiresAt, by)
+
+		resp["enroll_token"] = token
+		resp["enroll_token_expires_at"] = expiresAt
+	}
+
+	writeJSON(w, 200, resp)
+}
+
+// publicURL is PublicURL if configured, else the scheme and host the caller
+// used; https when requestTLS says so, including behind a trusted proxy.
+func (api *API) publicURL(r *http.Request) string {
+	if api.PublicURL != "" {
+		return strings.TrimRight(api.PublicURL, "/")
+	}
+	scheme := "http"
+	if api.requestTLS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func newEnrollToken() (string, error) {
+	var b [24]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return enrollTokenPrefix + base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// validEnrollToken accepts the configured EnrollToken or a live minted one.
+func (api *API) validEnrollToken(token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	if token == api.EnrollToken {
+		return true, nil
+	}
+	if !strings.HasPrefix(token, enrollTokenPrefix) {
+		return false, nil
+	}
+	return api.Store.EnrollTokenValid(enrollTokenHash(token), time.Now().Unix())
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Admin stats (dashboard summary)
+// -----------------------------------------------------------------------------
+
+// statsTTL is how long a computed Stats is served before the DB is queried
+// again. Dashboards poll this; a few seconds of staleness is fine.
+const statsTTL = 10 * time.Second
+
+type statsCache struct {
+	mu    sync.Mutex
+	value *Stats
+	at    time.Time
+}
+
+// AdminStats returns aggregate counts for the dashboard landing page.
+//
+// Route:
+//   GET /v1/admin/stats
+
+func (api *API) AdminStats(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	// Holding the lock while querying also collapses concurrent refreshes
+	// into a single set of queries.
+	api.stats.mu.Lock()
+	defer api.stats.mu.Unlock()
+
+	if api.stats.value == nil || time.Since(api.stats.at) >= statsTTL {
+		st, err := api.Store.GetStats(time.Now().Unix() - api.onlineWindow())
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		api.stats.value = st
+		api.stats.at = time.Now()
+	}
+
+	writeJSON(w, 200, api.stats.value)
+}
+
+// AdminSchema reports which schema migrations the database has run, when,
+// and any this build knows of that it hasn't.
+//
+// Route:
+//   GET /v1/admin/schema
+
+func (api *API) AdminSchema(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	st, err := api.Store.SchemaStatus()
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, st)
+}
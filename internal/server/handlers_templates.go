@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Admin command templates (saved commands, one-click runs)
+// -----------------------------------------------------------------------------
+
+var (
+	templateNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	templateVarRe  = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+	// Substituted values can't carry shell metacharacters (quotes, $, ;, |,
+	// &, backticks, redirects, newlines), so a variable can't break out of
+	// the command the template author wrote.
+	templateValueRe = regexp.MustCompile(`^[A-Za-z0-9 _.,:/@=+\\-]{0,256}$`)
+)
+
+// templateVars returns the distinct placeholder names used in command.
+func templateVars(command string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, m := range templateVarRe.FindAllStringSubmatch(command, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			out = append(out, m[1])
+		}
+	}
+	return out
+}
+
+// renderTemplate substitutes vars into command. Every placeholder must be
+// supplied, no unknown vars are accepted, and values must pass templateValueRe.
+func renderTemplate(command string, vars map[string]string) (string, error) {
+	want := map[string]bool{}
+	for _, name := range templateVars(command) {
+		want[name] = true
+		v, ok := vars[name]
+		if !ok {
+			return "", errors.New("missing var: " + name)
+		}
+		if !templateValueRe.MatchString(v) {
+			return "", errors.New("invalid value for var: " + name)
+		}
+	}
+	for name := range vars {
+		if !want[name] {
+			return "", errors.New("unknown var: " + name)
+		}
+	}
+
+	out := templateVarRe.ReplaceAllStringFunc(command, func(m string) string {
+		return vars[templateVarRe.FindStringSubmatch(m)[1]]
+	})
+	return out, nil
+}
+
+// AdminTemplates lists or creates command templates.
+//
+// Routes:
+//   GET  /v1/admin/templates
+//   POST /v1/admin/templates   body: {"name","description","kind","shell","command","timeout_seconds"}
+
+func (api *API) AdminTemplates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		templates, err := api.Store.ListTemplates()
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"templates": templates})
+
+	case http.MethodPost:
+		body, err := readBody(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var t CommandTemplate
+		if err := json.Unmarshal(body, &t); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		if !templateNameRe.MatchString(t.Name) {
+			writeJSON(w, 400, map[string]any{"error": "invalid name"})
+			return
+		}
+		if strings.TrimSpace(t.Command) == "" {
+			writeJSON(w, 400, map[string]any{"error": "missing command"})
+			return
+		}
+
+		// Reuse the job defaults so a template runs exactly like a submitted job.
+		defaults := newJob(t.Kind, t.Shell, t.Command, t.TimeoutSeconds)
+		if defaults.Kind == shared.JobKindUninstall {
+			writeJSON(w, 400, map[string]any{"error": "uninstall jobs can't be templated; submit them per agent"})
+			return
+		}
+		if defaults.Kind == shared.JobKindGetFile {
+			if err := prepareGetFile(&defaults); err != nil {
+				writeJSON(w, 400, map[string]any{"error": err.Error()})
+				return
+			}
+			t.Shell = defaults.Shell
+		}
+		t.ID = newUUID()
+		t.Kind = defaults.Kind
+		t.TimeoutSeconds = defaults.TimeoutSeconds
+		t.CreatedAt = time.Now().Unix()
+
+		if err := api.Store.CreateTemplate(t); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				writeJSON(w, 409, map[string]any{"error": "template exists"})
+				return
+			}
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"ok": true, "template": t, "vars": templateVars(t.Command)})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminTemplateRoutes dispatches the per-template admin sub-routes.
+//
+// Mounted on the "/v1/admin/templates/" prefix:
+//   GET    /v1/admin/templates/{name}
+//   DELETE /v1/admin/templates/{name}
+//   POST   /v1/admin/templates/{name}/run
+
+func (api *API) AdminTemplateRoutes(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/admin/templates/")
+	parts := strings.Split(path, "/")
+
+	name := parts[0]
+	if name == "" {
+		writeJSON(w, 400, map[string]any{"error": "missing template name"})
+		return
+	}
+
+	switch strings.Join(parts[1:], "/") {
+	case "":
+		api.AdminTemplate(w, r, name)
+	case "run":
+		api.AdminRunTemplate(w, r, name)
+	default:
+		writeJSON(w, 404, map[string]any{"error": "unknown template route", "path": r.URL.Path})
+	}
+}
+
+func (api *API) AdminTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		t, err := api.Store.GetTemplateByName(name)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if t == nil {
+			writeJSON(w, 404, map[string]any{"error": "unknown template"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"template": t, "vars": templateVars(t.Command)})
+
+	case http.MethodDelete:
+		found, err := api.Store.DeleteTemplate(name)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if !found {
+			writeJSON(w, 404, map[string]any{"error": "unknown template"})
+			return
+		}
+		writeJSON(w, 200, map[string]any{"ok": true})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminRunTemplate queues a job from a template for one agent or every agent
+// carrying a tag.
+//
+// Route:
+//   POST /v1/admin/templates/{name}/run
+//   body: {"target_agent_id": "..."} or {"target_tag": "..."}, plus "vars": {"name": "value"}
+//         and optionally "priority"
+
+func (api *API) AdminRunTemplate(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var req struct {
+		TargetAgentID string            `json:"target_agent_id"`
+		TargetTag     string            `json:"target_tag"`
+		Vars          map[string]string `json:"vars"`
+		Priority      int               `json:"priority"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+	if (req.TargetAgentID == "") == (req.TargetTag == "") {
+		writeJSON(w, 400, map[string]any{"error": "exactly one of target_agent_id or target_tag is required"})
+		return
+	}
+	if err := validatePriority(req.Priority); err != nil {
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+
+	t, err := api.Store.GetTemplateByName(name)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if t == nil {
+		writeJSON(w, 404, map[string]any{"error": "unknown template"})
+		return
+	}
+
+	command, err := renderTemplate(t.Command, req.Vars)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": err.Error()})
+		return
+	}
+	if t.Kind == shared.JobKindGetFile {
+		// The rendered path has to pass the same checks as a submitted one.
+		probe := newJob(t.Kind, t.Shell, command, t.TimeoutSeconds)
+		if err := prepareGetFile(&probe); err != nil {
+			writeJSON(w, 400, map[string]any{"error": err.Error()})
+			return
+		}
+		command = probe.Command
+	}
+
+	var targets []string
+	if req.TargetAgentID != "" {
+		rec, err := api.Store.GetAgentByID(req.TargetAgentID)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if rec == nil {
+			writeJSON(w, 404, map[string]any{"error": "unknown agent"})
+			return
+		}
+		if missing := missingCapabilities(rec, newJob(t.Kind, t.Shell, command, t.TimeoutSeconds)); len(missing) > 0 {
+			writeJSON(w, 400, map[string]any{
+				"error":   "target agent cannot run this job",
+				"missing": missing,
+			})
+			return
+		}
+		verdict, err := api.enforceCommandPolicy(r, rec, command)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		if verdict != nil {
+			writePolicyRejection(w, verdict)
+			return
+		}
+		targets = []string{rec.AgentID}
+	} else {
+		targets, err = api.Store.ListAgentIDsByTag(req.TargetTag)
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+	}
+
+	jobIDs := make([]string, 0, len(targets))
+	var skipped, denied, full []string
+	for _, agentID := range targets {
+		job := newJob(t.Kind, t.Shell, command, t.TimeoutSeconds)
+		job.Priority = req.Priority
+
+		// Tag runs skip agents that can't handle the job, or that the command
+		// policy doesn't permit it on, instead of failing the batch.
+		if req.TargetTag != "" {
+			rec, err := api.Store.GetAgentByID(agentID)
+			if err != nil {
+				writeJSON(w, 500, map[string]any{"error": "db error", "job_ids": jobIDs})
+				return
+			}
+			if rec == nil || len(missingCapabilities(rec, job)) > 0 {
+				skipped = append(skipped, agentID)
+				continue
+			}
+			verdict, err := api.enforceCommandPolicy(r, rec, command)
+			if err != nil {
+				writeJSON(w, 500, map[string]any{"error": "db error", "job_ids": jobIDs})
+				return
+			}
+			if verdict != nil {
+				denied = append(denied, agentID)
+				continue
+			}
+		}
+
+		if err := api.Store.QueueJob(agentID, job, api.MaxQueuedJobsPerAgent); err != nil {
+			if errors.Is(err, ErrQueueFull) {
+				if req.TargetAgentID != "" {
+					writeQueueFull(w, agentID, api.MaxQueuedJobsPerAgent)
+					return
+				}
+				full = append(full, agentID)
+				continue
+			}
+			writeJSON(w, 500, map[string]any{"error": "db error", "job_ids": jobIDs})
+			return
+		}
+		jobIDs = append(jobIDs, job.JobID)
+	}
+
+	log.Printf("admin: ran template %q on %d agent(s)", t.Name, len(jobIDs))
+	resp := map[string]any{"ok": true, "template": t.Name, "job_ids": jobIDs}
+	if len(skipped) > 0 {
+		resp["skipped_agent_ids"] = skipped
+	}
+	if len(denied) > 0 {
+		resp["policy_denied_agent_ids"] = denied
+	}
+	if len(full) > 0 {
+		resp["queue_full_agent_ids"] = full
+	}
+	writeJSON(w, 200, resp)
+}
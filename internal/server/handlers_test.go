@@ -0,0 +1,293 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// newTestAPI returns an API over a fresh, migrated SQLite database.
+func newTestAPI(t *testing.T) (*API, *sql.DB) {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "rr.db"))
+	if err != nil {
+		t.Fatalf("OpenDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := RunMigrations(db); err != nil {
+		t.Fatalf("RunMigrations: %v", err)
+	}
+	return &API{Store: NewSQLiteStore(db)}, db
+}
+
+// signAgentRequest returns the headers of a request signed by an agent's
+// ed25519 key.
+func signAgentRequest(priv ed25519.PrivateKey, agentID, method, path, query string, body []byte) http.Header {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sha := shared.BodySHA256(body)
+	h := http.Header{}
+	h.Set("X-PubKey", base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)))
+	h.Set("X-Agent-Id", agentID)
+	h.Set("X-Timestamp", ts)
+	h.Set("X-Body-Sha256", sha)
+	h.Set("X-Signature", shared.Sign(priv, ts, method, path, query, sha))
+	return h
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatalf("count %s: %v", table, err)
+	}
+	return n
+}
+
+func TestJobResultUnknownJob(t *testing.T) {
+	api, db := newTestAPI(t)
+
+	agentID, err := api.Store.CreateAgent("pubkey", shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}, nil, ApprovalApproved)
+	if err != nil {
+		t.Fatalf("CreateAgent: %v", err)
+	}
+	job := shared.Job{JobID: newUUID(), Shell: "bash", Command: "true", TimeoutSeconds: 60}
+	if err := api.Store.QueueJob(agentID, job, 0); err != nil {
+		t.Fatalf("QueueJob: %v", err)
+	}
+	jobsBefore, resultsBefore := countRows(t, db, "jobs"), countRows(t, db, "job_results")
+
+	body, _ := json.Marshal(shared.JobResult{JobID: newUUID(), AgentID: agentID, ExitCode: 0, Stdout: "ok"})
+	req := httptest.NewRequest(http.MethodPost, "/v1/job_result", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Canonical-Agent-Id", agentID)
+	rec := httptest.NewRecorder()
+	api.JobResult(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404 (body %s)", rec.Code, rec.Body)
+	}
+	var resp map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %s", rec.Body)
+	}
+	if resp["error"] != "unknown job" {
+		t.Errorf("error = %v, want \"unknown job\"", resp["error"])
+	}
+
+	if n := countRows(t, db, "jobs"); n != jobsBefore {
+		t.Errorf("jobs rows = %d, want %d", n, jobsBefore)
+	}
+	if n := countRows(t, db, "job_results"); n != resultsBefore {
+		t.Errorf("job_results rows = %d, want %d", n, resultsBefore)
+	}
+	detail, err := api.Store.GetJobDetail(job.JobID)
+	if err != nil || detail == nil {
+		t.Fatalf("GetJobDetail: %v", err)
+	}
+	if detail.Status != "queued" {
+		t.Errorf("queued job status = %q, want queued", detail.Status)
+	}
+}
+
+func TestStrictIdentityUnknownAgent(t *testing.T) {
+	api, _ := newTestAPI(t)
+	api.StrictAgentIdentity = true
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubB64 := base64.StdEncoding.EncodeToString(pub)
+	agentID, err := api.Store.CreateAgent(pubB64, shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}, nil, ApprovalApproved)
+	if err != nil {
+		t.Fatalf("CreateAgent: %v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+
+	for _, tc := range []struct {
+		name, agentID, pubKey string
+		want                  string
+	}{
+		{"deleted agent", newUUID(), pubB64, "unknown agent"},
+		{"key of another agent", agentID, base64.StdEncoding.EncodeToString(otherPub), "agent identity mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/ping", nil)
+			req.Header = signAgentRequest(priv, tc.agentID, http.MethodGet, "/v1/ping", "", nil)
+			req.Header.Set("X-PubKey", tc.pubKey)
+			rec := httptest.NewRecorder()
+			api.RequireAgentAuth(api.Ping)(rec, req)
+
+			var resp map[string]any
+			_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != http.StatusUnauthorized || resp["error"] != tc.want {
+				t.Errorf("got %d %s, want 401 %q", rec.Code, rec.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestAgentHMACSecretRequiresTLS(t *testing.T) {
+	api, _ := newTestAPI(t)
+	tp, err := ParseTrustedProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.TrustedProxies = tp
+	agentID, err := api.Store.CreateAgent("pubkey", shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}, nil, ApprovalApproved)
+	if err != nil {
+		t.Fatalf("CreateAgent: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		peer     string
+		tls      bool
+		proto    string
+		insecure bool
+		want     int
+	}{
+		{"plain http", "192.0.2.7:5000", false, "", false, 403},
+		{"direct tls", "192.0.2.7:5000", true, "", false, 200},
+		{"trusted proxy https", "10.0.0.1:5000", false, "https", false, 200},
+		{"trusted proxy http", "10.0.0.1:5000", false, "https, http", false, 403},
+		{"untrusted peer claiming https", "192.0.2.7:5000", false, "https", false, 403},
+		{"plain http, opted out", "192.0.2.7:5000", false, "", true, 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api.AllowInsecureHMACSecret = tc.insecure
+			req := httptest.NewRequest(http.MethodPost, "/v1/hmac-secret", nil)
+			req.RemoteAddr = tc.peer
+			if tc.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if tc.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tc.proto)
+			}
+			req.Header.Set("X-Canonical-Agent-Id", agentID)
+			rec := httptest.NewRecorder()
+			api.AgentHMACSecret(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAdminApproveAgentStates(t *testing.T) {
+	api, _ := newTestAPI(t)
+	info := shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}
+	pending, _ := api.Store.CreateAgent("pk-pending", info, nil, ApprovalPending)
+	disabled, _ := api.Store.CreateAgent("pk-disabled", info, nil, ApprovalPending)
+	if _, err := api.Store.SetAgentDisabled(disabled, true); err != nil {
+		t.Fatalf("SetAgentDisabled: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, agentID string
+		want          int
+	}{
+		{"pending", pending, 200},
+		{"already approved", pending, 200},
+		{"disabled", disabled, 409},
+		{"unknown", newUUID(), 404},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			api.AdminApproveAgent(rec, httptest.NewRequest(http.MethodPost, "/v1/admin/agents/"+tc.agentID+"/approve", nil), tc.agentID)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d (body %s)", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+	if got, _ := api.Store.GetAgentByID(disabled); got == nil || got.ApprovalStatus != ApprovalDisabled {
+		t.Errorf("disabled agent was re-enabled by approve: %+v", got)
+	}
+}
+
+func TestHeartbeatRecordsInventoryError(t *testing.T) {
+	api, _ := newTestAPI(t)
+	agentID, err := api.Store.CreateAgent("pubkey", shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}, nil, ApprovalApproved)
+	if err != nil {
+		t.Fatalf("CreateAgent: %v", err)
+	}
+
+	for _, msg := range []string{"collector timed out after 30s", ""} {
+		body, _ := json.Marshal(shared.HeartbeatRequest{AgentID: agentID, Info: shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}, InventoryError: msg})
+		req := httptest.NewRequest(http.MethodPost, "/v1/heartbeat", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		api.Heartbeat(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body)
+		}
+		got, err := api.Store.GetAgentByID(agentID)
+		if err != nil || got == nil {
+			t.Fatalf("GetAgentByID: %v", err)
+		}
+		if got.InventoryError != msg || (msg != "") != (got.InventoryErrorAt != 0) {
+			t.Errorf("inventory error = %q at %d, want %q", got.InventoryError, got.InventoryErrorAt, msg)
+		}
+	}
+}
+
+func TestJobResultOtherAgentsJob(t *testing.T) {
+	api, db := newTestAPI(t)
+	info := shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}
+	owner, _ := api.Store.CreateAgent("pk-owner", info, nil, ApprovalApproved)
+	other, _ := api.Store.CreateAgent("pk-other", info, nil, ApprovalApproved)
+	job := shared.Job{JobID: newUUID(), Shell: "bash", Command: "true", TimeoutSeconds: 60}
+	if err := api.Store.QueueJob(owner, job, 0); err != nil {
+		t.Fatalf("QueueJob: %v", err)
+	}
+
+	body, _ := json.Marshal(shared.JobResult{JobID: job.JobID, AgentID: owner, ExitCode: 0, Stdout: "forged"})
+	req := httptest.NewRequest(http.MethodPost, "/v1/job_result", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Canonical-Agent-Id", other)
+	rec := httptest.NewRecorder()
+	api.JobResult(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403 (body %s)", rec.Code, rec.Body)
+	}
+	if n := countRows(t, db, "job_results"); n != 0 {
+		t.Errorf("job_results rows = %d, want 0", n)
+	}
+	if n := countRows(t, db, "dead_letter_results"); n != 1 {
+		t.Errorf("dead_letter_results rows = %d, want 1", n)
+	}
+}
+
+func TestPublicURLBehindTrustedProxy(t *testing.T) {
+	api, _ := newTestAPI(t)
+	tp, err := ParseTrustedProxies("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.TrustedProxies = tp
+
+	for peer, want := range map[string]string{
+		"10.0.0.1:5000":  "https://rr.example.com",
+		"192.0.2.7:5000": "http://rr.example.com",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/admin/provisioning", nil)
+		req.Host = "rr.example.com"
+		req.RemoteAddr = peer
+		req.Header.Set("X-Forwarded-Proto", "https")
+		if got := api.publicURL(req); got != want {
+			t.Errorf("peer %s: publicURL = %q, want %q", peer, got, want)
+		}
+	}
+}
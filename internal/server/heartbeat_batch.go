@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Batched heartbeats (from rr-relay)
+// -----------------------------------------------------------------------------
+//
+// At an edge site many agents can share one relay, which collects their
+// heartbeats and forwards them in a single POST /v1/heartbeat/batch instead
+// of one WAN connection per agent. The relay is not trusted: it signs
+// nothing, and every entry is the agent's own signed request, run through
+// RequireAgentAuth and Heartbeat exactly as if the agent had sent it
+// directly (after checking the body against its X-Body-Sha256, which the
+// single endpoint leaves to the signature). The batch is processed in one
+// store transaction, each entry in a savepoint of it: an entry refused, or
+// failing on the database, is undone alone and doesn't cost the others
+// their heartbeat. If the commit fails the whole batch is answered with the
+// database error, and the relay passes that on to every agent in it. The
+// heartbeat stream sees entries as they are applied; the facts webhook is
+// only notified once the batch has committed, and only of entries it kept.
+
+// HeartbeatBatch applies each entry as an agent heartbeat and returns the
+// per-entry answers. The request itself needs no auth; its entries do.
+//
+// Route:
+//   POST /v1/heartbeat/batch   body: shared.HeartbeatBatchRequest
+
+func (api *API) HeartbeatBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if !requireJSON(w, r) {
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad body"})
+		return
+	}
+	var req shared.HeartbeatBatchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, 400, map[string]any{"error": "bad json"})
+		return
+	}
+	if len(req.Entries) == 0 {
+		writeJSON(w, 400, map[string]any{"error": "no entries"})
+		return
+	}
+	if len(req.Entries) > shared.MaxHeartbeatBatchEntries {
+		writeJSON(w, 400, map[string]any{"error": "more than " + strconv.Itoa(shared.MaxHeartbeatBatchEntries) + " entries"})
+		return
+	}
+
+	resp := shared.HeartbeatBatchResponse{Results: make([]shared.HeartbeatBatchResult, len(req.Entries))}
+	failed := 0
+	var events, entryEvents []FactsChangedEvent
+	notify := func(ev FactsChangedEvent) { entryEvents = append(entryEvents, ev) }
+	err = api.Store.InTx(func(st Store) error {
+		heartbeat := api.agentAuth(st, func(w http.ResponseWriter, r *http.Request) { api.heartbeat(st, notify, w, r) }, false)
+		for i, e := range req.Entries {
+			var res shared.HeartbeatBatchResult
+			entryEvents = nil
+			err := st.InTx(func(Store) error {
+				res = api.batchHeartbeat(r, heartbeat, e)
+				if res.Status != 200 {
+					return errBatchEntryRefused
+				}
+				return nil
+			})
+			if err != nil && !errors.Is(err, errBatchEntryRefused) {
+				// The entry's savepoint couldn't be kept (or undone).
+				res = dbErrorResult(err)
+			}
+			if err == nil {
+				events = append(events, entryEvents...)
+			}
+			resp.Results[i] = res
+			if res.Status != 200 {
+				failed++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("heartbeat: batch of %d failed to commit remote=%s: %v", len(req.Entries), api.clientIP(r), err)
+		writeDBError(w, err)
+		return
+	}
+	for _, ev := range events {
+		api.notifyFactsChanged(ev)
+	}
+	log.Printf("heartbeat: batch of %d (%d refused) remote=%s", len(req.Entries), failed, api.clientIP(r))
+	writeJSON(w, 200, resp)
+}
+
+// batchHeartbeat runs one entry through heartbeat as a request of its own,
+// from the relay's address.
+func (api *API) batchHeartbeat(r *http.Request, heartbeat http.HandlerFunc, e shared.HeartbeatBatchEntry) shared.HeartbeatBatchResult {
+	sent := http.Header{}
+	for k, v := range e.Headers {
+		sent.Set(k, v)
+	}
+	body := []byte(e.Body)
+	if sent.Get("X-Body-Sha256") != shared.BodySHA256(body) {
+		return shared.HeartbeatBatchResult{Status: 401, Body: json.RawMessage(`{"error":"body does not match X-Body-Sha256"}`)}
+	}
+
+	sub, err := http.NewRequestWithContext(r.Context(), http.MethodPost, "/v1/heartbeat", bytes.NewReader(body))
+	if err != nil {
+		return shared.HeartbeatBatchResult{Status: 400, Body: json.RawMessage(`{"error":"bad entry"}`)}
+	}
+	sub.RemoteAddr = r.RemoteAddr
+	sub.Header.Set("Content-Type", "application/json")
+	for _, h := range shared.HeartbeatBatchHeaders {
+		if v := sent.Get(h); v != "" {
+			sub.Header.Set(h, v)
+		}
+	}
+
+	rec := &batchRecorder{header: http.Header{}}
+	heartbeat(rec, sub)
+	return rec.result()
+}
+
+// errBatchEntryRefused rolls back the savepoint of an entry that wasn't
+// answered 200, keeping its answer.
+var errBatchEntryRefused = errors.New("batch entry refused")
+
+// dbErrorResult is writeDBError's answer, as a batch entry's.
+func dbErrorResult(err error) shared.HeartbeatBatchResult {
+	rec := &batchRecorder{header: http.Header{}}
+	writeDBError(rec, err)
+	return rec.result()
+}
+
+// batchRecorder captures what a handler writes for one batch entry.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *batchRecorder) result() shared.HeartbeatBatchResult {
+	status := b.status
+	if status == 0 {
+		status = 200
+	}
+	out := bytes.TrimSpace(b.body.Bytes())
+	if !json.Valid(out) {
+		out = []byte(`{}`)
+	}
+	return shared.HeartbeatBatchResult{Status: status, Body: json.RawMessage(out)}
+}
+
+func (b *batchRecorder) Header() http.Header { return b.header }
+
+func (b *batchRecorder) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *batchRecorder) Write(p []byte) (int, error) {
+	b.WriteHeader(200)
+	return b.body.Write(p)
+}
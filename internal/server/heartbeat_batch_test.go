@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rackroom/internal/shared"
+)
+
+func TestHeartbeatBatchRefusedEntry(t *testing.T) {
+	api, _ := newTestAPI(t)
+
+	type testAgent struct {
+		id   string
+		priv ed25519.PrivateKey
+	}
+	var agents []testAgent
+	for _, host := range []string{"a", "b"} {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		id, err := api.Store.CreateAgent(base64.StdEncoding.EncodeToString(pub), shared.AgentInfo{Hostname: host, OS: "linux", Arch: "amd64"}, nil, ApprovalApproved)
+		if err != nil {
+			t.Fatalf("CreateAgent: %v", err)
+		}
+		agents = append(agents, testAgent{id: id, priv: priv})
+	}
+	_, stranger, _ := ed25519.GenerateKey(nil)
+
+	entry := func(a testAgent, key ed25519.PrivateKey, host string) shared.HeartbeatBatchEntry {
+		body, _ := json.Marshal(shared.HeartbeatRequest{AgentID: a.id, Info: shared.AgentInfo{Hostname: host, OS: "linux", Arch: "amd64"}})
+		h := signAgentRequest(key, a.id, http.MethodPost, "/v1/heartbeat", "", body)
+		h.Del("X-PubKey")
+		e := shared.HeartbeatBatchEntry{Headers: map[string]string{}, Body: string(body)}
+		for k := range h {
+			e.Headers[k] = h.Get(k)
+		}
+		return e
+	}
+	batch, _ := json.Marshal(shared.HeartbeatBatchRequest{Entries: []shared.HeartbeatBatchEntry{
+		entry(agents[0], agents[0].priv, "a-renamed"),
+		entry(agents[1], stranger, "b-forged"),
+	}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/heartbeat/batch", strings.NewReader(string(batch)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	api.HeartbeatBatch(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body)
+	}
+	var resp shared.HeartbeatBatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("bad response %s: %v", rec.Body, err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Status != 200 || resp.Results[1].Status != 401 {
+		t.Fatalf("results = %+v, want 200 then 401", resp.Results)
+	}
+
+	for i, want := range []string{"a-renamed", "b"} {
+		got, err := api.Store.GetAgentByID(agents[i].id)
+		if err != nil || got == nil {
+			t.Fatalf("GetAgentByID: %v", err)
+		}
+		if got.Info.Hostname != want {
+			t.Errorf("agent %d hostname = %q, want %q", i, got.Info.Hostname, want)
+		}
+	}
+}
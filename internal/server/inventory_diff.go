@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Inventory diff ("what changed on this box")
+// -----------------------------------------------------------------------------
+
+// JSONChange is one difference between two JSON documents. Path uses dots for
+// object keys and [i] for array indexes, e.g. "disks[0].Free".
+type JSONChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old,omitempty"`
+	New  any    `json:"new,omitempty"`
+}
+
+// JSONDiff groups changes the way techs read them.
+type JSONDiff struct {
+	Added   []JSONChange `json:"added"`
+	Removed []JSONChange `json:"removed"`
+	Changed []JSONChange `json:"changed"`
+}
+
+// diffJSONDocs parses both documents (numbers kept exact) and diffs them.
+func diffJSONDocs(from, to string) (JSONDiff, error) {
+	a, err := decodeJSONValue(from)
+	if err != nil {
+		return JSONDiff{}, err
+	}
+	b, err := decodeJSONValue(to)
+	if err != nil {
+		return JSONDiff{}, err
+	}
+	d := JSONDiff{Added: []JSONChange{}, Removed: []JSONChange{}, Changed: []JSONChange{}}
+	diffJSONValues("", a, b, &d)
+	return d, nil
+}
+
+func decodeJSONValue(s string) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	var v any
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// diffJSONValues walks objects key by key and arrays index by index; any
+// other difference (including a type change) is reported at that path.
+func diffJSONValues(path string, a, b any, d *JSONDiff) {
+	switch av := a.(type) {
+	case map[string]any:
+		if bv, ok := b.(map[string]any); ok {
+			keys := make([]string, 0, len(av)+len(bv))
+			for k := range av {
+				keys = append(keys, k)
+			}
+			for k := range bv {
+				if _, ok := av[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				p := k
+				if path != "" {
+					p = path + "." + k
+				}
+				x, inA := av[k]
+				y, inB := bv[k]
+				switch {
+				case !inA:
+					d.Added = append(d.Added, JSONChange{Path: p, New: y})
+				case !inB:
+					d.Removed = append(d.Removed, JSONChange{Path: p, Old: x})
+				default:
+					diffJSONValues(p, x, y, d)
+				}
+			}
+			return
+		}
+	case []any:
+		if bv, ok := b.([]any); ok {
+			for i := 0; i < len(av) || i < len(bv); i++ {
+				p := path + "[" + strconv.Itoa(i) + "]"
+				switch {
+				case i >= len(av):
+					d.Added = append(d.Added, JSONChange{Path: p, New: bv[i]})
+				case i >= len(bv):
+					d.Removed = append(d.Removed, JSONChange{Path: p, Old: av[i]})
+				default:
+					diffJSONValues(p, av[i], bv[i], d)
+				}
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		d.Changed = append(d.Changed, JSONChange{Path: path, Old: a, New: b})
+	}
+}
+
+// AdminInventoryDiff compares the snapshots in effect at two points in time:
+// for each of from/to, the newest snapshot taken at or before it.
+//
+// Route:
+//   GET /v1/admin/agents/{agent_id}/inventory/diff?from=<unix>&to=<unix>
+//
+// to defaults to now. 404 if either side has no snapshot.
+
+func (api *API) AdminInventoryDiff(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	q := r.URL.Query()
+	from, _ := parseInt64(q.Get("from"))
+	if from <= 0 {
+		writeJSON(w, 400, map[string]any{"error": "missing or invalid from"})
+		return
+	}
+	to := time.Now().Unix()
+	if v := q.Get("to"); v != "" {
+		to, _ = parseInt64(v)
+		if to <= 0 {
+			writeJSON(w, 400, map[string]any{"error": "invalid to"})
+			return
+		}
+	}
+	if from > to {
+		writeJSON(w, 400, map[string]any{"error": "from is after to"})
+		return
+	}
+
+	fromRef, fromPayload, err := api.Store.GetInventorySnapshotAt(agentID, from)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	toRef, toPayload, err := api.Store.GetInventorySnapshotAt(agentID, to)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if fromRef == nil || toRef == nil {
+		writeJSON(w, 404, map[string]any{"error": "no inventory snapshot for requested time"})
+		return
+	}
+
+	diff, err := diffJSONDocs(fromPayload, toPayload)
+	if err != nil {
+		writeJSON(w, 500, map[string]any{"error": "stored inventory is not valid json"})
+		return
+	}
+
+	writeJSON(w, 200, map[string]any{
+		"agent_id": agentID,
+		"from":     fromRef,
+		"to":       toRef,
+		"added":    diff.Added,
+		"removed":  diff.Removed,
+		"changed":  diff.Changed,
+	})
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Inventory normalization (raw per-OS payloads -> Inventory)
+// -----------------------------------------------------------------------------
+//
+// Each collector reports in its own shape. An adapter per source turns that
+// into the shared Inventory model, and facts are derived from the model only,
+// so supporting another OS means adding an adapter rather than bending one
+// struct to fit every platform.
+//
+// The adapter is picked by the payload's "schema" marker if it has one, else
+// by the agent's reported OS. Payloads that match neither are parsed with the
+// Windows adapter, which is what every payload was parsed as before adapters
+// existed.
+
+type inventoryAdapter func(raw []byte) (*Inventory, error)
+
+var inventoryAdapters = map[string]inventoryAdapter{
+	"windows": normalizeWindowsInventory,
+	"linux":   normalizeLinuxInventory,
+}
+
+const defaultInventorySchema = "windows"
+
+// normalizeInventory parses raw with the adapter for its schema (or agentOS).
+// It returns the schema used alongside the model.
+func normalizeInventory(raw []byte, agentOS string) (*Inventory, string, error) {
+	var marker struct {
+		Schema string `json:"schema"`
+	}
+	_ = json.Unmarshal(raw, &marker)
+
+	schema := defaultInventorySchema
+	for _, s := range []string{marker.Schema, agentOS} {
+		if _, ok := inventoryAdapters[strings.ToLower(s)]; ok {
+			schema = strings.ToLower(s)
+			break
+		}
+	}
+	inv, err := inventoryAdapters[schema](raw)
+	return inv, schema, err
+}
+
+func normalizeWindowsInventory(raw []byte) (*Inventory, error) {
+	var w WinInventory
+	if err := json.Unmarshal(raw, &w); err != nil {
+		return nil, err
+	}
+	inv := &Inventory{
+		CollectedAt:      w.CollectedAt,
+		Hostname:         w.Hostname,
+		OSCaption:        w.OS.Caption,
+		OSVersion:        w.OS.Version,
+		OSBuild:          w.OS.Build,
+		CPUName:          w.CPU.Name,
+		CPUCores:         w.CPU.Cores,
+		CPULogical:       w.CPU.Logical,
+		MemoryTotalBytes: w.Memory.TotalBytes,
+		MemoryFreeBytes:  w.Memory.FreeBytes,
+		UptimeSeconds:    w.UptimeSeconds,
+		BootTime:         w.BootTime,
+		IPv4:             w.IPv4,
+		Gateways:         w.Gateways,
+		DNSServers:       w.DNSServers,
+		Timezone:         w.Timezone.Name,
+		UTCOffsetMinutes: w.Timezone.UTCOffsetMinutes,
+		Locale:           w.Locale,
+		PendingUpdates:   w.PendingUpdates,
+	}
+	for _, d := range w.Disks {
+		inv.Disks = append(inv.Disks, InventoryDisk{Name: d.DeviceID, SizeBytes: d.Size, FreeBytes: d.Free, FileSystem: d.FileSystem})
+	}
+	return inv, nil
+}
+
+func normalizeLinuxInventory(raw []byte) (*Inventory, error) {
+	var l LinuxInventory
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return nil, err
+	}
+	inv := &Inventory{
+		CollectedAt:      l.CollectedAt,
+		Hostname:         l.Hostname,
+		OSCaption:        l.OS.Caption,
+		OSVersion:        l.OS.Version,
+		OSBuild:          l.OS.Build,
+		CPUName:          l.CPU.Name,
+		CPUCores:         l.CPU.Cores,
+		CPULogical:       l.CPU.Logical,
+		MemoryTotalBytes: l.Memory.TotalBytes,
+		MemoryFreeBytes:  l.Memory.FreeBytes,
+		UptimeSeconds:    l.UptimeSeconds,
+		BootTime:         l.BootTime,
+		IPv4:             l.IPv4,
+		Gateways:         l.Gateways,
+		DNSServers:       l.DNSServers,
+		Timezone:         l.Timezone.Name,
+		UTCOffsetMinutes: l.Timezone.UTCOffsetMinutes,
+		Locale:           l.Locale,
+		PendingUpdates:   l.PendingUpdates,
+	}
+	for _, d := range l.Disks {
+		inv.Disks = append(inv.Disks, InventoryDisk{Name: d.Mount, SizeBytes: d.SizeBytes, FreeBytes: d.FreeBytes, FileSystem: d.FileSystem})
+	}
+	return inv, nil
+}
+
+// factsFromInventory derives the v0 facts row from a normalized inventory.
+func factsFromInventory(agentID string, inv *Inventory, now int64) AgentFacts {
+	var diskTotal, diskFree int64
+	for _, d := range inv.Disks {
+		diskTotal += d.SizeBytes
+		diskFree += d.FreeBytes
+	}
+	ip := ""
+	if len(inv.IPv4) > 0 {
+		ip = inv.IPv4[0]
+	}
+	// Agents that predate boot_time only report uptime; pinning it to the
+	// collection time gives the same boot time every heartbeat.
+	boot := inv.BootTime
+	if boot == 0 && inv.UptimeSeconds > 0 {
+		at := inv.CollectedAt
+		if at == 0 {
+			at = now
+		}
+		boot = at - inv.UptimeSeconds
+	}
+	var updates *int64
+	if inv.PendingUpdates != nil {
+		n := inv.PendingUpdates.Count
+		updates = &n
+	}
+
+	return AgentFacts{
+		AgentID:        agentID,
+		UpdatedAt:      now,
+		OSCaption:      inv.OSCaption,
+		OSVersion:      inv.OSVersion,
+		OSBuild:        inv.OSBuild,
+		CPUName:        inv.CPUName,
+		CPUCores:       inv.CPUCores,
+		CPULogical:     inv.CPULogical,
+		RAMTotalBytes:  inv.MemoryTotalBytes,
+		RAMFreeBytes:   inv.MemoryFreeBytes,
+		UptimeSeconds:  inv.UptimeSeconds,
+		BootTime:       boot,
+		IPv4Primary:    ip,
+		DiskTotalBytes: diskTotal,
+		DiskFreeBytes:  diskFree,
+
+		Timezone:         inv.Timezone,
+		UTCOffsetMinutes: inv.UTCOffsetMinutes,
+		Locale:           inv.Locale,
+
+		Gateways:   inv.Gateways,
+		DNSServers: inv.DNSServers,
+
+		UpdatesPending: updates,
+	}
+}
+
+// withQuickFacts overlays a heartbeat's quick facts (nil = none) on facts
+// derived from its inventory, which the agent may have cached for hours, so
+// the facts written and compared for the webhook are the fresh ones.
+func withQuickFacts(f AgentFacts, q *shared.QuickFacts) AgentFacts {
+	if q == nil {
+		return f
+	}
+	if q.RAMTotalBytes > 0 {
+		f.RAMTotalBytes = q.RAMTotalBytes
+	}
+	if q.RAMFreeBytes > 0 {
+		f.RAMFreeBytes = q.RAMFreeBytes
+	}
+	if q.DiskTotalBytes > 0 {
+		f.DiskTotalBytes = q.DiskTotalBytes
+	}
+	if q.DiskFreeBytes > 0 {
+		f.DiskFreeBytes = q.DiskFreeBytes
+	}
+	if q.UptimeSeconds > 0 {
+		f.UptimeSeconds = q.UptimeSeconds
+	}
+	if q.BootTime > 0 {
+		f.BootTime = q.BootTime
+	}
+	return f
+}
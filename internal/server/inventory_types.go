@@ -1,6 +1,72 @@
 package server
 
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Inventory is the OS-independent model raw inventory payloads are
+// normalized into (see normalizeInventory) before facts are extracted.
+// Fields a collector doesn't report stay zero.
+type Inventory struct {
+	CollectedAt int64
+	Hostname    string
+
+	OSCaption string
+	OSVersion string
+	OSBuild   string
+
+	CPUName    string
+	CPUCores   int64
+	CPULogical int64
+
+	MemoryTotalBytes int64
+	MemoryFreeBytes  int64
+
+	UptimeSeconds int64
+	BootTime      int64 // unix seconds; 0 = not reported
+
+	Disks      []InventoryDisk
+	IPv4       []string
+	Gateways   []string // default gateways, nil = not reported
+	DNSServers []string
+
+	Timezone         string
+	UTCOffsetMinutes int64
+	Locale           string
+
+	PendingUpdates *PendingUpdates // nil = agent doesn't check for updates
+}
+
+// PendingUpdates is the optional "pending_updates" key of both collectors'
+// payloads. Count is the full number; Updates may be capped by the agent.
+type PendingUpdates struct {
+	Source  string          `json:"source"` // windows_update | apt | dnf | yum
+	Count   int64           `json:"count"`
+	Updates []PendingUpdate `json:"updates"`
+}
+
+// PendingUpdate is one available OS update.
+type PendingUpdate struct {
+	Title    string `json:"title"`
+	Version  string `json:"version,omitempty"`
+	KB       string `json:"kb,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Security bool   `json:"security,omitempty"`
+}
+
+// InventoryDisk is one fixed disk or mounted filesystem.
+type InventoryDisk struct {
+	Name       string // drive letter on Windows, mount point elsewhere
+	SizeBytes  int64
+	FreeBytes  int64
+	FileSystem string
+}
+
+// WinInventory is the payload of the Windows collector (PowerShell/CIM, so
+// disk fields keep their CIM names). Schema is "windows"; older agents omit it.
 type WinInventory struct {
+	Schema      string `json:"schema"`
 	CollectedAt int64  `json:"collected_at"`
 	Hostname    string `json:"hostname"`
 
@@ -22,6 +88,7 @@ type WinInventory struct {
 	} `json:"memory"`
 
 	UptimeSeconds int64 `json:"uptime_seconds"`
+	BootTime      int64 `json:"boot_time"`
 
 	Disks []struct {
 		DeviceID   string `json:"DeviceID"`
@@ -30,5 +97,85 @@ type WinInventory struct {
 		FileSystem string `json:"FileSystem"`
 	} `json:"disks"`
 
-	IPv4 []string `json:"ipv4"`
+	IPv4       []string `json:"ipv4"`
+	Gateways   []string `json:"gateways"`
+	DNSServers []string `json:"dns_servers"`
+
+	Timezone struct {
+		Name             string `json:"name"`
+		UTCOffsetMinutes int64  `json:"utc_offset_minutes"`
+	} `json:"timezone"`
+	Locale string `json:"locale"`
+
+	PendingUpdates *PendingUpdates `json:"pending_updates"`
+}
+
+// LinuxInventory is the payload of the Linux collector. It follows the
+// Windows top-level layout, but disks are snake_case and keyed by mount point.
+type LinuxInventory struct {
+	Schema      string `json:"schema"` // "linux"
+	CollectedAt int64  `json:"collected_at"`
+	Hostname    string `json:"hostname"`
+
+	OS struct {
+		Caption string `json:"caption"` // PRETTY_NAME
+		Version string `json:"version"` // VERSION_ID
+		Build   string `json:"build"`   // kernel release
+	} `json:"os"`
+
+	CPU struct {
+		Name    string `json:"name"`
+		Cores   int64  `json:"cores"`
+		Logical int64  `json:"logical"`
+	} `json:"cpu"`
+
+	Memory struct {
+		TotalBytes int64 `json:"total_bytes"`
+		FreeBytes  int64 `json:"free_bytes"`
+	} `json:"memory"`
+
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	BootTime      int64 `json:"boot_time"`
+
+	Disks []struct {
+		Mount      string `json:"mount"`
+		SizeBytes  int64  `json:"size_bytes"`
+		FreeBytes  int64  `json:"free_bytes"`
+		FileSystem string `json:"fs_type"`
+	} `json:"disks"`
+
+	IPv4       []string `json:"ipv4"`
+	Gateways   []string `json:"gateways"`
+	DNSServers []string `json:"dns_servers"`
+
+	Timezone struct {
+		Name             string `json:"name"`
+		UTCOffsetMinutes int64  `json:"utc_offset_minutes"`
+	} `json:"timezone"`
+	Locale string `json:"locale"`
+
+	PendingUpdates *PendingUpdates `json:"pending_updates"`
+}
+
+// inventoryKind classifies the heartbeat's inventory field (see inventoryPresence).
+type inventoryKind int
+
+const (
+	inventoryNotSent inventoryKind = iota
+	inventoryEmpty
+	inventoryPayload
+)
+
+// inventoryPresence tells an omitted or null field (the agent had nothing to
+// send this time) apart from "{}", "[]" or "" (it sent something with no
+// data). Neither is stored as a snapshot.
+func inventoryPresence(raw json.RawMessage) inventoryKind {
+	s := strings.TrimSpace(string(raw))
+	switch s {
+	case "", "null":
+		return inventoryNotSent
+	case "{}", "[]", `""`:
+		return inventoryEmpty
+	}
+	return inventoryPayload
 }
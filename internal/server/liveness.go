@@ -0,0 +1,108 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Agent liveness (online/offline transitions)
+// -----------------------------------------------------------------------------
+//
+// Heartbeat marks an agent online (MarkAgentOnline). Going offline is the
+// absence of heartbeats, so a timer (RunLivenessMonitor) flips agents that
+// haven't been seen within OnlineWindowSeconds. Before that, an agent that
+// reports its heartbeat interval is marked late once it has missed
+// MissedHeartbeats of them, which catches fast-heartbeating agents well
+// before the fleet-wide window runs out. Each flip is one row in
+// agent_status_events, which the events endpoints expose as a feed.
+
+func (api *API) onlineWindow() int64 {
+	if api.OnlineWindowSeconds <= 0 {
+		return 300
+	}
+	return api.OnlineWindowSeconds
+}
+
+func (api *API) missedHeartbeats() int {
+	if api.MissedHeartbeats == 0 {
+		return 3
+	}
+	return api.MissedHeartbeats
+}
+
+// RunLivenessMonitor checks for newly offline agents every interval until
+// stop is closed.
+func (api *API) RunLivenessMonitor(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		now := time.Now().Unix()
+		ids, err := api.Store.MarkStaleAgentsOffline(now-api.onlineWindow(), now)
+		if err != nil {
+			log.Printf("liveness: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			log.Printf("liveness: agent_id=%s offline", id)
+		}
+
+		if missed := api.missedHeartbeats(); missed > 0 {
+			ids, err := api.Store.MarkLateAgents(missed, now)
+			if err != nil {
+				log.Printf("liveness: %v", err)
+				continue
+			}
+			for _, id := range ids {
+				log.Printf("liveness: agent_id=%s late (missed %d heartbeats)", id, missed)
+			}
+		}
+	}
+}
+
+// AdminAgentEvents is one agent's liveness history.
+//
+// Route:
+//   GET /v1/admin/agents/{agent_id}/events?after=<id>&limit=N
+
+func (api *API) AdminAgentEvents(w http.ResponseWriter, r *http.Request, agentID string) {
+	api.writeStatusEvents(w, r, agentID)
+}
+
+// AdminFleetEvents is the liveness feed for all agents. Poll it with
+// after=<next_after from the previous response> to get only new events.
+//
+// Route:
+//   GET /v1/admin/agents/events?after=<id>&limit=N
+
+func (api *API) AdminFleetEvents(w http.ResponseWriter, r *http.Request) {
+	api.writeStatusEvents(w, r, "")
+}
+
+func (api *API) writeStatusEvents(w http.ResponseWriter, r *http.Request, agentID string) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	after, _ := parseInt64(r.URL.Query().Get("after"))
+	limit := queryInt(r, "limit", 100, 1000)
+
+	events, err := api.Store.ListAgentStatusEvents(agentID, after, limit)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+
+	next := after
+	if len(events) > 0 {
+		next = events[len(events)-1].ID
+	}
+	writeJSON(w, 200, map[string]any{"events": events, "next_after": next})
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Request timing (latency histograms per route)
+// -----------------------------------------------------------------------------
+//
+// RequestMetrics wraps the mux and records how long every request took into a
+// fixed-bucket histogram per route, keyed by the ServeMux pattern that matched
+// (so "/v1/admin/agents/" covers every per-agent sub-route and cardinality
+// stays bounded). Recording is a map read plus a few atomic adds; the map
+// only grows the first time a route is hit.
+//
+// Route (service key protected, Prometheus text format):
+//   GET /metrics
+//
+// Requests slower than the slow threshold are also logged with their request
+// id, so a spike in a bucket can be traced back to individual requests.
+
+// latencyBuckets are histogram upper bounds in seconds; a final +Inf bucket
+// is implicit.
+var latencyBuckets = [...]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type routeHistogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64 // non-cumulative; last is +Inf
+	sumNano atomic.Int64
+}
+
+func (h *routeHistogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && s > latencyBuckets[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.sumNano.Add(int64(d))
+}
+
+// RequestMetrics collects per-route request durations.
+type RequestMetrics struct {
+	// SlowRequest logs requests that take at least this long; 0 disables.
+	SlowRequest time.Duration
+
+	mu     sync.RWMutex
+	routes map[string]*routeHistogram
+}
+
+func NewRequestMetrics(slow time.Duration) *RequestMetrics {
+	return &RequestMetrics{SlowRequest: slow, routes: make(map[string]*routeHistogram)}
+}
+
+// Wrap times every request that goes through next (normally the mux).
+func (m *RequestMetrics) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		d := time.Since(start)
+
+		// ServeMux fills in the matched pattern on the way through.
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		m.route(route).observe(d)
+
+		if m.SlowRequest > 0 && d >= m.SlowRequest {
+			log.Printf("slow: request_id=%s %s %s route=%s took %s",
+				r.Header.Get(requestIDHeader), r.Method, r.URL.Path, route, d.Round(time.Millisecond))
+		}
+	})
+}
+
+func (m *RequestMetrics) route(name string) *routeHistogram {
+	m.mu.RLock()
+	h := m.routes[name]
+	m.mu.RUnlock()
+	if h != nil {
+		return h
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h = m.routes[name]; h == nil {
+		h = &routeHistogram{}
+		m.routes[name] = h
+	}
+	return h
+}
+
+// ServeHTTP writes the histograms in the Prometheus text exposition format.
+func (m *RequestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+
+	m.mu.RLock()
+	names := make([]string, 0, len(m.routes))
+	for name := range m.routes {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP rr_http_request_duration_seconds Time spent serving HTTP requests, by route.")
+	fmt.Fprintln(w, "# TYPE rr_http_request_duration_seconds histogram")
+	for _, name := range names {
+		h := m.route(name)
+		route := strconv.Quote(name)
+
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.buckets[i].Load()
+			fmt.Fprintf(w, "rr_http_request_duration_seconds_bucket{route=%s,le=\"%g\"} %d\n", route, le, cum)
+		}
+		cum += h.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(w, "rr_http_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", route, cum)
+		fmt.Fprintf(w, "rr_http_request_duration_seconds_sum{route=%s} %g\n", route, time.Duration(h.sumNano.Load()).Seconds())
+		fmt.Fprintf(w, "rr_http_request_duration_seconds_count{route=%s} %d\n", route, cum)
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+)
+
+// -----------------------------------------------------------------------------
+// Server-wide middleware (wraps the whole mux in main.go)
+// -----------------------------------------------------------------------------
+
+const requestIDHeader = "X-Request-Id"
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// WithRequestID tags every request with an id, echoed in the X-Request-Id
+// response header. A well-formed id from the client (or a proxy in front) is
+// kept so logs on both sides line up; otherwise a random one is generated.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			var b [8]byte
+			_, _ = rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Recover turns a handler panic into a logged stack trace and a 500 JSON
+// error instead of a dropped connection. http.ErrAbortHandler is re-raised
+// since it's net/http's own way of aborting a response.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Printf("panic: request_id=%s %s %s: %v\n%s",
+				r.Header.Get(requestIDHeader), r.Method, r.URL.Path, v, debug.Stack())
+			writeJSON(w, 500, map[string]any{
+				"error":      "internal error",
+				"request_id": r.Header.Get(requestIDHeader),
+			})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
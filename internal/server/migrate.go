@@ -5,35 +5,264 @@ import (
 	"embed"
 	"log"
 	"sort"
+	"strings"
+	"time"
 )
 
 //go:embed migrations/*.sql
 var migrationsFS embed.FS
 
+// RunMigrations is the only place schema is created or changed. Every step
+// has a version; applied versions are recorded in schema_migrations and each
+// step runs exactly once, in version order, inside its own transaction.
+//
+// Steps come from two places that share one sequence:
+//   - migrations/NNNN_name.sql (version = file name without .sql)
+//   - goMigrations below, for changes SQL alone can't express safely
+//
+// New schema changes should just be a new numbered SQL file; since steps run
+// once, plain ALTER TABLE is fine there.
+
+type migration struct {
+	version string
+	sql     string
+	apply   func(tx *sql.Tx) error
+}
+
+// goMigrations add the columns that predate version tracking. Older databases
+// already have some of them (untracked), so they go through ensureColumn
+// rather than a bare ALTER TABLE.
+var goMigrations = []migration{
+	{version: "0005_agents_approval", apply: addColumns(
+		columnDef{"agents", "approval_status", "TEXT NOT NULL DEFAULT 'approved'"},
+		columnDef{"agents", "approved_at", "INTEGER"},
+	)},
+	{version: "0006_agents_tags_source", apply: addColumns(
+		columnDef{"agents", "tags_source", "TEXT NOT NULL DEFAULT 'agent'"},
+	)},
+	{version: "0007_agents_capabilities", apply: addColumns(
+		columnDef{"agents", "capabilities_json", "TEXT NOT NULL DEFAULT '[]'"},
+	)},
+	{version: "0008_agent_facts_timezone", apply: addColumns(
+		columnDef{"agent_facts", "timezone", "TEXT"},
+		columnDef{"agent_facts", "utc_offset_minutes", "INTEGER"},
+		columnDef{"agent_facts", "locale", "TEXT"},
+	)},
+}
+
 func RunMigrations(db *sql.DB) error {
-	entries, err := migrationsFS.ReadDir("migrations")
+	steps, err := sqliteMigrations()
 	if err != nil {
 		return err
 	}
+	return applyMigrations(db, steps, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`)
+}
 
-	var files []string
-	for _, e := range entries {
-		if !e.IsDir() {
-			files = append(files, e.Name())
+// sqliteMigrations is every SQLite step, SQL files and goMigrations, in
+// version order.
+func sqliteMigrations() ([]migration, error) {
+	steps, err := loadMigrations(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, goMigrations...)
+	sort.Slice(steps, func(i, j int) bool { return steps[i].version < steps[j].version })
+	return steps, nil
+}
+
+// AppliedMigration is one row of schema_migrations.
+type AppliedMigration struct {
+	Version   string `json:"version"`
+	AppliedAt int64  `json:"applied_at"`
+}
+
+// SchemaStatus is what /v1/admin/schema and rr-dbcheck report: the newest
+// applied version, every applied step, and the steps this build knows that
+// the database hasn't run (only until the next start, normally).
+type SchemaStatus struct {
+	Version string             `json:"version"`
+	Applied []AppliedMigration `json:"applied"`
+	Pending []string           `json:"pending"`
+}
+
+// SQLiteSchemaStatus reports the migrations of a SQLite database.
+func SQLiteSchemaStatus(db *sql.DB) (*SchemaStatus, error) {
+	steps, err := sqliteMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return schemaStatus(db, steps)
+}
+
+func schemaStatus(db *sql.DB, steps []migration) (*SchemaStatus, error) {
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	st := &SchemaStatus{Applied: []AppliedMigration{}, Pending: []string{}}
+	applied := map[string]bool{}
+	for rows.Next() {
+		var m AppliedMigration
+		if err := rows.Scan(&m.Version, &m.AppliedAt); err != nil {
+			return nil, err
+		}
+		st.Applied = append(st.Applied, m)
+		applied[m.Version] = true
+		st.Version = m.Version
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, m := range steps {
+		if !applied[m.version] {
+			st.Pending = append(st.Pending, m.version)
+		}
+	}
+	return st, nil
+}
+
+// applyMigrations runs the steps not yet recorded in schema_migrations, in
+// order; record is the dialect's INSERT for one version and its time.
+func applyMigrations(db *sql.DB, steps []migration, record string) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version TEXT PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	);`); err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range steps {
+		if applied[m.version] {
+			continue
 		}
+		log.Printf("migration: %s", m.version)
+		if err := runMigration(db, m, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMigrations reads the SQL files in dir of fsys, sorted by version.
+func loadMigrations(fsys embed.FS, dir string) ([]migration, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
 	}
-	sort.Strings(files)
 
-	for _, name := range files {
-		log.Printf("migration: %s", name)
-		sqlBytes, err := migrationsFS.ReadFile("migrations/" + name)
+	var steps []migration
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		sqlBytes, err := fsys.ReadFile(dir + "/" + e.Name())
 		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, migration{
+			version: strings.TrimSuffix(e.Name(), ".sql"),
+			sql:     string(sqlBytes),
+		})
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i].version < steps[j].version })
+	return steps, nil
+}
+
+func appliedMigrations(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]bool{}
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out[v] = true
+	}
+	return out, rows.Err()
+}
+
+func runMigration(db *sql.DB, m migration, record string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.sql != "" {
+		if _, err := tx.Exec(m.sql); err != nil {
 			return err
 		}
-		if _, err := db.Exec(string(sqlBytes)); err != nil {
+	}
+	if m.apply != nil {
+		if err := m.apply(tx); err != nil {
 			return err
 		}
 	}
+	if _, err := tx.Exec(record, m.version, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	return nil
+type columnDef struct {
+	table  string
+	column string
+	ddl    string
+}
+
+func addColumns(cols ...columnDef) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range cols {
+			if err := ensureColumn(tx, c.table, c.column, c.ddl); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ensureColumn adds table.column with the given DDL if it doesn't exist yet.
+func ensureColumn(tx *sql.Tx, table, column, ddl string) error {
+	rows, err := tx.Query(`PRAGMA table_info(` + table + `);`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			typ     string
+			notNull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	log.Printf("migration: add column %s.%s", table, column)
+	_, err = tx.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + ddl + `;`)
+	return err
 }
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"database/sql"
+	"embed"
+)
+
+//go:embed migrations_postgres/*.sql
+var postgresMigrationsFS embed.FS
+
+// RunPostgresMigrations is RunMigrations for PostgresStore. Its steps live
+// in migrations_postgres/ and are numbered on their own: 0001 is the whole
+// schema as SQLite had it when the Postgres backend was added, and a schema
+// change after that needs a file in both directories.
+func RunPostgresMigrations(db *sql.DB) error {
+	steps, err := loadMigrations(postgresMigrationsFS, "migrations_postgres")
+	if err != nil {
+		return err
+	}
+	return applyMigrations(db, steps, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`)
+}
+
+// PostgresSchemaStatus is SQLiteSchemaStatus for PostgresStore.
+func PostgresSchemaStatus(db *sql.DB) (*SchemaStatus, error) {
+	steps, err := loadMigrations(postgresMigrationsFS, "migrations_postgres")
+	if err != nil {
+		return nil, err
+	}
+	return schemaStatus(db, steps)
+}
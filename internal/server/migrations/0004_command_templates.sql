@@ -0,0 +1,12 @@
+-- 0004_command_templates.sql
+-- Saved, named commands operators can run against an agent or a tag.
+CREATE TABLE IF NOT EXISTS command_templates (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    kind TEXT NOT NULL DEFAULT 'command',
+    shell TEXT NOT NULL DEFAULT '',
+    command TEXT NOT NULL,
+    timeout_seconds INTEGER NOT NULL,
+    created_at INTEGER NOT NULL
+);
@@ -0,0 +1,4 @@
+-- 0009_inventory_payload_sha256.sql
+-- Lets clients tell whether the latest inventory changed without fetching it.
+-- Snapshots stored before this column existed keep a NULL hash.
+ALTER TABLE agent_inventory_snapshots ADD COLUMN payload_sha256 TEXT;
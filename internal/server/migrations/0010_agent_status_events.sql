@@ -0,0 +1,15 @@
+-- 0010_agent_status_events.sql
+-- Liveness transitions (online/offline) for alerting. agents.liveness holds
+-- the current state so a transition is recorded exactly once.
+ALTER TABLE agents ADD COLUMN liveness TEXT NOT NULL DEFAULT 'unknown';
+
+CREATE TABLE IF NOT EXISTS agent_status_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    agent_id TEXT NOT NULL,
+    status TEXT NOT NULL,
+    at INTEGER NOT NULL,
+    FOREIGN KEY(agent_id) REFERENCES agents(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_agent_status_events_agent
+    ON agent_status_events(agent_id, id);
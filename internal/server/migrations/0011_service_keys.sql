@@ -0,0 +1,14 @@
+-- 0011_service_keys.sql
+-- Named admin API keys (bcrypt hashed). The RR_API_KEY env key stays valid as
+-- the bootstrap key used to create these.
+CREATE TABLE IF NOT EXISTS service_keys (
+    id TEXT PRIMARY KEY,
+    label TEXT NOT NULL,
+    key_hash TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    revoked_at INTEGER
+);
+
+-- A label names one live key; revoked keys keep their label for the audit trail.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_service_keys_active_label
+    ON service_keys(label) WHERE revoked_at IS NULL;
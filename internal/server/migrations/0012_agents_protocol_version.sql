@@ -0,0 +1,3 @@
+-- 0012_agents_protocol_version.sql
+-- Protocol version the agent reported at enroll; 0 = predates negotiation.
+ALTER TABLE agents ADD COLUMN protocol_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- 0013_jobs_run_as.sql
+-- Optional user to run a job as (and, on Windows, the agent-side credential
+-- reference used to log that user on). NULL = the agent's own account.
+ALTER TABLE jobs ADD COLUMN run_as_user TEXT;
+ALTER TABLE jobs ADD COLUMN run_as_credential TEXT;
@@ -0,0 +1,25 @@
+-- 0014_command_policies.sql
+-- Server-side command policy. Rules apply to agents carrying tag ('*' = every
+-- agent); pattern is a Go regexp that must match the whole command. A matching
+-- deny rule rejects; if any allow rule applies, one of them must match.
+CREATE TABLE IF NOT EXISTS command_policies (
+    id TEXT PRIMARY KEY,
+    tag TEXT NOT NULL,
+    action TEXT NOT NULL,
+    pattern TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+-- Audit trail of submissions the policy refused.
+CREATE TABLE IF NOT EXISTS command_policy_rejections (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    at INTEGER NOT NULL,
+    agent_id TEXT NOT NULL,
+    command TEXT NOT NULL,
+    policy_id TEXT,
+    reason TEXT NOT NULL,
+    key_label TEXT NOT NULL DEFAULT '',
+    remote TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_command_policy_rejections_at ON command_policy_rejections(at);
@@ -0,0 +1,4 @@
+-- 0015_jobs_confirm.sql
+-- Confirmation token for destructive job kinds (uninstall must carry the
+-- target agent id here).
+ALTER TABLE jobs ADD COLUMN confirm TEXT;
@@ -0,0 +1,4 @@
+-- 0016_job_results_timed_out.sql
+-- Set when the agent killed the job at its timeout; stdout/stderr then hold
+-- only what was captured before the kill.
+ALTER TABLE job_results ADD COLUMN timed_out INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- 0017_jobs_priority.sql
+-- Queue priority: higher runs first, ties in submission order. The dequeue
+-- index leads with priority so ORDER BY priority DESC, created_at stays cheap.
+ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+
+DROP INDEX IF EXISTS idx_jobs_target_status;
+CREATE INDEX IF NOT EXISTS idx_jobs_target_status
+  ON jobs(target_agent_id, status, priority DESC, created_at);
@@ -0,0 +1,8 @@
+-- 0018_enroll_token_uses.sql
+-- New-agent registrations per enroll token (keyed by sha256 so the token
+-- itself isn't stored), for the optional registration cap.
+CREATE TABLE IF NOT EXISTS enroll_token_uses (
+    token_hash TEXT PRIMARY KEY,
+    registrations INTEGER NOT NULL DEFAULT 0,
+    last_used_at INTEGER NOT NULL
+);
@@ -0,0 +1,5 @@
+-- 0019_agents_inventory_parse_error.sql
+-- Why the agent's latest inventory couldn't be turned into facts (NULL =
+-- it could), so admins can find agents with broken collectors.
+ALTER TABLE agents ADD COLUMN inventory_parse_error TEXT;
+ALTER TABLE agents ADD COLUMN inventory_parse_error_at INTEGER;
@@ -0,0 +1,20 @@
+-- 0020_agent_groups.sql
+-- Curated agent groups (membership managed via the admin API, unlike tags).
+CREATE TABLE IF NOT EXISTS agent_groups (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS agent_group_members (
+    group_id TEXT NOT NULL,
+    agent_id TEXT NOT NULL,
+    added_at INTEGER NOT NULL,
+    PRIMARY KEY (group_id, agent_id)
+);
+CREATE INDEX IF NOT EXISTS idx_agent_group_members_agent ON agent_group_members(agent_id);
+
+-- Jobs queued together (e.g. one per group member) share a batch id.
+ALTER TABLE jobs ADD COLUMN batch_id TEXT;
+CREATE INDEX IF NOT EXISTS idx_jobs_batch ON jobs(batch_id);
@@ -0,0 +1,12 @@
+-- 0021_job_events.sql
+-- Every job status transition, in order: who moved it (submit, dequeue,
+-- result, reaper) and why. from_status is '' for the initial "queued".
+CREATE TABLE IF NOT EXISTS job_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_id TEXT NOT NULL,
+    at INTEGER NOT NULL,
+    from_status TEXT NOT NULL,
+    to_status TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_job_events_job ON job_events(job_id, id);
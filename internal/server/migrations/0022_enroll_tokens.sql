@@ -0,0 +1,10 @@
+-- Short-lived enroll tokens minted through /v1/admin/provisioning. Only the
+-- sha256 of the token is kept, like enroll_token_uses.
+CREATE TABLE IF NOT EXISTS enroll_tokens (
+    token_hash TEXT PRIMARY KEY,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL,
+    created_by TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS idx_enroll_tokens_expires ON enroll_tokens(expires_at);
@@ -0,0 +1,4 @@
+-- 0023_inventory_last_seen_identical.sql
+-- A heartbeat whose inventory hashes the same as the agent's latest snapshot
+-- bumps this instead of storing another copy.
+ALTER TABLE agent_inventory_snapshots ADD COLUMN last_seen_identical_at INTEGER;
@@ -0,0 +1,4 @@
+-- 0024_agents_heartbeat_interval.sql
+-- The heartbeat interval the agent reports (0 = agent doesn't say), so the
+-- liveness monitor can mark it late after a number of missed heartbeats.
+ALTER TABLE agents ADD COLUMN heartbeat_interval_seconds INTEGER NOT NULL DEFAULT 0;
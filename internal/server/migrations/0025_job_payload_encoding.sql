@@ -0,0 +1,6 @@
+-- 0025_job_payload_encoding.sql
+-- Base64 payloads: jobs whose command was submitted base64-encoded, and
+-- results whose stdout/stderr the agent sent as base64 of raw bytes.
+-- NULL = plain UTF-8 text (everything before this migration).
+ALTER TABLE jobs ADD COLUMN command_encoding TEXT;
+ALTER TABLE job_results ADD COLUMN output_encoding TEXT;
@@ -0,0 +1,14 @@
+-- Public keys an admin pre-authorized to enroll without an enroll token.
+-- challenge is the outstanding single-use challenge for the key, if any.
+CREATE TABLE IF NOT EXISTS enroll_keys (
+    id TEXT PRIMARY KEY,
+    public_key TEXT NOT NULL UNIQUE,
+    note TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    created_by TEXT NOT NULL DEFAULT '',
+    expires_at INTEGER NOT NULL,
+    used_at INTEGER,
+    agent_id TEXT NOT NULL DEFAULT '',
+    challenge TEXT NOT NULL DEFAULT '',
+    challenge_expires_at INTEGER NOT NULL DEFAULT 0
+);
@@ -0,0 +1,10 @@
+-- 0027_job_batches.sql
+-- Batches queued from a fact selector keep the selector and the agent ids it
+-- resolved to at submit time, so the run can be audited and reproduced.
+CREATE TABLE IF NOT EXISTS job_batches (
+    id TEXT PRIMARY KEY,
+    created_at INTEGER NOT NULL,
+    created_by TEXT NOT NULL DEFAULT '',
+    selector_json TEXT NOT NULL,
+    agent_ids_json TEXT NOT NULL
+);
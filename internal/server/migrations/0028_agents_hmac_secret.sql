@@ -0,0 +1,4 @@
+-- 0028_agents_hmac_secret.sql
+-- Shared secret for agents that opted into HMAC request signing. HMAC needs
+-- the secret on both ends, so unlike the public key it is sensitive.
+ALTER TABLE agents ADD COLUMN hmac_secret TEXT;
@@ -0,0 +1,7 @@
+-- 0029_agent_facts_updates_pending.sql
+-- Pending OS update count from agents with inventory_updates on. NULL means
+-- the agent doesn't report it, which is not the same as 0.
+ALTER TABLE agent_facts ADD COLUMN updates_pending INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_agent_facts_updates_pending
+  ON agent_facts(updates_pending);
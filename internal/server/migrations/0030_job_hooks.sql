@@ -0,0 +1,5 @@
+-- 0030_job_hooks.sql
+-- Optional setup/teardown commands run around a job's command by the agent.
+-- NULL = no hook.
+ALTER TABLE jobs ADD COLUMN pre_command TEXT;
+ALTER TABLE jobs ADD COLUMN post_command TEXT;
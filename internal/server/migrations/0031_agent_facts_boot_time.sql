@@ -0,0 +1,6 @@
+-- 0031_agent_facts_boot_time.sql
+-- Boot time (unix seconds) as reported by the agent, or derived from the
+-- reported uptime and collection time. Uptime is computed from it on read,
+-- so a facts row that hasn't been refreshed in a while doesn't show the
+-- uptime as of its last inventory. NULL for rows written before this.
+ALTER TABLE agent_facts ADD COLUMN boot_time INTEGER;
@@ -0,0 +1,4 @@
+-- 0032_job_results_interrupted.sql
+-- Set when the agent was shut down while the job ran and killed it; like
+-- timed_out, stdout/stderr then hold only what was captured before the kill.
+ALTER TABLE job_results ADD COLUMN interrupted INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- 0033_agents_enroll_tags.sql
+-- Tags the server assigned when the agent enrolled (RR_ENROLL_TAG_RULES_FILE).
+-- While tags_source is 'agent' they are merged into tags_json on every
+-- heartbeat, so the agent's own tags can't drop them.
+ALTER TABLE agents ADD COLUMN enroll_tags_json TEXT NOT NULL DEFAULT '[]';
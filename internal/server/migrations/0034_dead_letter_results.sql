@@ -0,0 +1,13 @@
+-- 0034_dead_letter_results.sql
+-- Job results the server refused (unknown job, bad output encoding,
+-- unparseable body), kept with the reason so the output an agent tried to
+-- report isn't lost. payload is the request body as received.
+CREATE TABLE IF NOT EXISTS dead_letter_results (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    received_at INTEGER NOT NULL,
+    agent_id TEXT NOT NULL,
+    job_id TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL,
+    payload TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_dead_letter_results_received ON dead_letter_results(received_at);
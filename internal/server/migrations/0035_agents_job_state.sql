@@ -0,0 +1,4 @@
+-- 0035_agents_job_state.sql
+-- The job counts the agent sent with its last heartbeat (shared.AgentJobState
+-- as JSON); NULL when the agent doesn't report them.
+ALTER TABLE agents ADD COLUMN job_state_json TEXT;
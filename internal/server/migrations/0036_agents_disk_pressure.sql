@@ -0,0 +1,5 @@
+-- 0036_agents_disk_pressure.sql
+-- Free space on the agent's own volume as of its last heartbeat (NULL = not
+-- reported) and whether that is below the agent's disk_min_free_mb.
+ALTER TABLE agents ADD COLUMN disk_free_bytes INTEGER;
+ALTER TABLE agents ADD COLUMN disk_pressure INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,10 @@
+-- 0037_agent_custom_facts.sql
+-- Site-defined facts (RR_CUSTOM_FACTS_FILE) from each agent's latest
+-- inventory, one row per fact found; replaced as a whole on every inventory.
+CREATE TABLE IF NOT EXISTS agent_custom_facts (
+    agent_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (agent_id, name)
+);
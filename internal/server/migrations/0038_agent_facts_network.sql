@@ -0,0 +1,6 @@
+-- 0038_agent_facts_network.sql
+-- IPv4 default gateways and DNS servers across the agent's interfaces, as
+-- JSON string lists. NULL means the agent doesn't report them, which is not
+-- the same as [].
+ALTER TABLE agent_facts ADD COLUMN gateways_json TEXT;
+ALTER TABLE agent_facts ADD COLUMN dns_servers_json TEXT;
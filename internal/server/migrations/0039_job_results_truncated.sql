@@ -0,0 +1,4 @@
+-- 0039_job_results_truncated.sql
+-- Set when stdout or stderr was longer than the server's result size cap
+-- (RR_MAX_RESULT_OUTPUT_BYTES) and stored cut short.
+ALTER TABLE job_results ADD COLUMN truncated INTEGER NOT NULL DEFAULT 0;
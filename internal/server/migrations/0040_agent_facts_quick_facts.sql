@@ -0,0 +1,4 @@
+-- 0040_agent_facts_quick_facts.sql
+-- When the agent's last heartbeat quick facts (RAM, disk, uptime, measured
+-- on every heartbeat) were applied over its inventory facts; NULL = never.
+ALTER TABLE agent_facts ADD COLUMN quick_facts_at INTEGER;
@@ -0,0 +1,6 @@
+-- 0041_agents_inventory_error.sql
+-- Why the agent's last inventory collection failed, as it reported (NULL =
+-- it didn't), so a collector that times out or crashes on the host shows up
+-- next to inventory_parse_error.
+ALTER TABLE agents ADD COLUMN inventory_error TEXT;
+ALTER TABLE agents ADD COLUMN inventory_error_at INTEGER;
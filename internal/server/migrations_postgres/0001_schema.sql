@@ -0,0 +1,207 @@
+-- 0001_schema.sql
+-- The schema as of SQLite migration 0031, in one step. Timestamps and sizes
+-- are BIGINT (INTEGER is 32-bit here); everything else mirrors the SQLite
+-- tables so the two stores read the same rows the same way.
+
+CREATE TABLE agents (
+  id TEXT PRIMARY KEY,
+  public_key TEXT NOT NULL UNIQUE,
+  hostname TEXT NOT NULL,
+  os TEXT NOT NULL,
+  arch TEXT NOT NULL,
+  tags_json TEXT NOT NULL DEFAULT '[]',
+  created_at BIGINT NOT NULL,
+  last_seen BIGINT NOT NULL,
+  approval_status TEXT NOT NULL DEFAULT 'approved',
+  approved_at BIGINT,
+  tags_source TEXT NOT NULL DEFAULT 'agent',
+  capabilities_json TEXT NOT NULL DEFAULT '[]',
+  liveness TEXT NOT NULL DEFAULT 'unknown',
+  protocol_version INTEGER NOT NULL DEFAULT 0,
+  inventory_parse_error TEXT,
+  inventory_parse_error_at BIGINT,
+  heartbeat_interval_seconds INTEGER NOT NULL DEFAULT 0,
+  hmac_secret TEXT
+);
+
+CREATE TABLE agent_status_events (
+  id BIGSERIAL PRIMARY KEY,
+  agent_id TEXT NOT NULL REFERENCES agents(id),
+  status TEXT NOT NULL,
+  at BIGINT NOT NULL
+);
+CREATE INDEX idx_agent_status_events_agent ON agent_status_events(agent_id, id);
+
+CREATE TABLE agent_inventory_snapshots (
+  id TEXT PRIMARY KEY,
+  agent_id TEXT NOT NULL REFERENCES agents(id),
+  created_at BIGINT NOT NULL,
+  payload_json TEXT NOT NULL,
+  payload_sha256 TEXT,
+  last_seen_identical_at BIGINT
+);
+CREATE INDEX idx_inventory_agent_created ON agent_inventory_snapshots(agent_id, created_at DESC);
+
+CREATE TABLE agent_facts (
+  agent_id TEXT PRIMARY KEY REFERENCES agents(id),
+  updated_at BIGINT NOT NULL,
+  os_caption TEXT,
+  os_version TEXT,
+  os_build TEXT,
+  cpu_name TEXT,
+  cpu_cores BIGINT,
+  cpu_logical BIGINT,
+  ram_total_bytes BIGINT,
+  ram_free_bytes BIGINT,
+  uptime_seconds BIGINT,
+  boot_time BIGINT,
+  ipv4_primary TEXT,
+  disk_total_bytes BIGINT,
+  disk_free_bytes BIGINT,
+  timezone TEXT,
+  utc_offset_minutes BIGINT,
+  locale TEXT,
+  updates_pending BIGINT
+);
+CREATE INDEX idx_agent_facts_updated ON agent_facts(updated_at DESC);
+CREATE INDEX idx_agent_facts_updates_pending ON agent_facts(updates_pending);
+
+CREATE TABLE jobs (
+  id TEXT PRIMARY KEY,
+  seq BIGSERIAL NOT NULL, -- insertion order (SQLite's rowid)
+  target_agent_id TEXT NOT NULL REFERENCES agents(id),
+  kind TEXT NOT NULL,
+  shell TEXT NOT NULL,
+  command TEXT NOT NULL,
+  timeout_seconds INTEGER NOT NULL,
+  status TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  started_at BIGINT,
+  finished_at BIGINT,
+  run_as_user TEXT,
+  run_as_credential TEXT,
+  confirm TEXT,
+  priority INTEGER NOT NULL DEFAULT 0,
+  batch_id TEXT,
+  command_encoding TEXT,
+  pre_command TEXT,
+  post_command TEXT
+);
+CREATE INDEX idx_jobs_target_status ON jobs(target_agent_id, status, priority DESC, created_at);
+CREATE INDEX idx_jobs_batch ON jobs(batch_id);
+
+CREATE TABLE job_results (
+  job_id TEXT PRIMARY KEY REFERENCES jobs(id),
+  agent_id TEXT NOT NULL REFERENCES agents(id),
+  exit_code INTEGER NOT NULL,
+  stdout TEXT NOT NULL,
+  stderr TEXT NOT NULL,
+  started_at BIGINT NOT NULL,
+  finished_at BIGINT NOT NULL,
+  timed_out BOOLEAN NOT NULL DEFAULT FALSE,
+  output_encoding TEXT
+);
+
+CREATE TABLE job_events (
+  id BIGSERIAL PRIMARY KEY,
+  job_id TEXT NOT NULL,
+  at BIGINT NOT NULL,
+  from_status TEXT NOT NULL,
+  to_status TEXT NOT NULL,
+  reason TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_job_events_job ON job_events(job_id, id);
+
+CREATE TABLE job_batches (
+  id TEXT PRIMARY KEY,
+  created_at BIGINT NOT NULL,
+  created_by TEXT NOT NULL DEFAULT '',
+  selector_json TEXT NOT NULL,
+  agent_ids_json TEXT NOT NULL
+);
+
+CREATE TABLE command_policies (
+  id TEXT PRIMARY KEY,
+  tag TEXT NOT NULL,
+  action TEXT NOT NULL,
+  pattern TEXT NOT NULL,
+  description TEXT NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL
+);
+
+CREATE TABLE command_policy_rejections (
+  id BIGSERIAL PRIMARY KEY,
+  at BIGINT NOT NULL,
+  agent_id TEXT NOT NULL,
+  command TEXT NOT NULL,
+  policy_id TEXT,
+  reason TEXT NOT NULL,
+  key_label TEXT NOT NULL DEFAULT '',
+  remote TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_command_policy_rejections_at ON command_policy_rejections(at);
+
+-- Admin-only tables. PostgresStore doesn't use them yet; they are here so
+-- adding those methods needs no schema step.
+
+CREATE TABLE command_templates (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  description TEXT NOT NULL DEFAULT '',
+  kind TEXT NOT NULL DEFAULT 'command',
+  shell TEXT NOT NULL DEFAULT '',
+  command TEXT NOT NULL,
+  timeout_seconds INTEGER NOT NULL,
+  created_at BIGINT NOT NULL
+);
+
+CREATE TABLE service_keys (
+  id TEXT PRIMARY KEY,
+  label TEXT NOT NULL,
+  key_hash TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  revoked_at BIGINT
+);
+CREATE UNIQUE INDEX idx_service_keys_active_label ON service_keys(label) WHERE revoked_at IS NULL;
+
+CREATE TABLE enroll_token_uses (
+  token_hash TEXT PRIMARY KEY,
+  registrations INTEGER NOT NULL DEFAULT 0,
+  last_used_at BIGINT NOT NULL
+);
+
+CREATE TABLE enroll_tokens (
+  token_hash TEXT PRIMARY KEY,
+  created_at BIGINT NOT NULL,
+  expires_at BIGINT NOT NULL,
+  created_by TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_enroll_tokens_expires ON enroll_tokens(expires_at);
+
+CREATE TABLE enroll_keys (
+  id TEXT PRIMARY KEY,
+  public_key TEXT NOT NULL UNIQUE,
+  note TEXT NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL,
+  created_by TEXT NOT NULL DEFAULT '',
+  expires_at BIGINT NOT NULL,
+  used_at BIGINT,
+  agent_id TEXT NOT NULL DEFAULT '',
+  challenge TEXT NOT NULL DEFAULT '',
+  challenge_expires_at BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE agent_groups (
+  id TEXT PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  description TEXT NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL
+);
+
+CREATE TABLE agent_group_members (
+  group_id TEXT NOT NULL,
+  agent_id TEXT NOT NULL,
+  added_at BIGINT NOT NULL,
+  PRIMARY KEY (group_id, agent_id)
+);
+CREATE INDEX idx_agent_group_members_agent ON agent_group_members(agent_id);
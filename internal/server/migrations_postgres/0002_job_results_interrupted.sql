@@ -0,0 +1,3 @@
+-- 0002_job_results_interrupted.sql
+-- SQLite migration 0032.
+ALTER TABLE job_results ADD COLUMN interrupted BOOLEAN NOT NULL DEFAULT FALSE;
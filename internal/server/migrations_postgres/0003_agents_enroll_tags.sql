@@ -0,0 +1,3 @@
+-- 0003_agents_enroll_tags.sql
+-- SQLite migration 0033.
+ALTER TABLE agents ADD COLUMN enroll_tags_json TEXT NOT NULL DEFAULT '[]';
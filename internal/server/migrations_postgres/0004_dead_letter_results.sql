@@ -0,0 +1,11 @@
+-- 0004_dead_letter_results.sql
+-- SQLite migration 0034.
+CREATE TABLE dead_letter_results (
+  id BIGSERIAL PRIMARY KEY,
+  received_at BIGINT NOT NULL,
+  agent_id TEXT NOT NULL,
+  job_id TEXT NOT NULL DEFAULT '',
+  reason TEXT NOT NULL,
+  payload TEXT NOT NULL
+);
+CREATE INDEX idx_dead_letter_results_received ON dead_letter_results(received_at);
@@ -0,0 +1,3 @@
+-- 0005_agents_job_state.sql
+-- SQLite migration 0035.
+ALTER TABLE agents ADD COLUMN job_state_json TEXT;
@@ -0,0 +1,4 @@
+-- 0006_agents_disk_pressure.sql
+-- SQLite migration 0036.
+ALTER TABLE agents ADD COLUMN disk_free_bytes BIGINT;
+ALTER TABLE agents ADD COLUMN disk_pressure BOOLEAN NOT NULL DEFAULT FALSE;
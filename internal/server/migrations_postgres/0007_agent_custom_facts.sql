@@ -0,0 +1,9 @@
+-- 0007_agent_custom_facts.sql
+-- SQLite migration 0037.
+CREATE TABLE IF NOT EXISTS agent_custom_facts (
+    agent_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    value TEXT NOT NULL,
+    updated_at BIGINT NOT NULL,
+    PRIMARY KEY (agent_id, name)
+);
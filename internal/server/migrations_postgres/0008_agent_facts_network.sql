@@ -0,0 +1,4 @@
+-- 0008_agent_facts_network.sql
+-- SQLite migration 0038.
+ALTER TABLE agent_facts ADD COLUMN gateways_json TEXT;
+ALTER TABLE agent_facts ADD COLUMN dns_servers_json TEXT;
@@ -0,0 +1,3 @@
+-- 0009_job_results_truncated.sql
+-- SQLite migration 0039.
+ALTER TABLE job_results ADD COLUMN truncated BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,3 @@
+-- 0010_agent_facts_quick_facts.sql
+-- SQLite migration 0040.
+ALTER TABLE agent_facts ADD COLUMN quick_facts_at BIGINT;
@@ -0,0 +1,4 @@
+-- 0011_agents_inventory_error.sql
+-- SQLite migration 0041.
+ALTER TABLE agents ADD COLUMN inventory_error TEXT;
+ALTER TABLE agents ADD COLUMN inventory_error_at BIGINT;
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// -----------------------------------------------------------------------------
+// Command policy (server-side allow/deny rules)
+// -----------------------------------------------------------------------------
+//
+// Defense in depth for the admin surface: even a valid admin key can only
+// queue commands the policy permits. Rules apply per agent tag ("*" = every
+// agent) and match the whole command with a Go regexp. For a given agent:
+//   - any matching deny rule rejects the command
+//   - if any allow rules apply, at least one must match
+//   - with no applicable rules the command is allowed (the default, so an
+//     install without policies behaves as before)
+//
+// Rejections are answered with 403 and recorded in command_policy_rejections.
+// Only RR_API_KEY or an operator session may create or delete rules, so a
+// leaked named service key can't lift a deny rule and then queue the command.
+
+// policyVerdict explains a rejection. Rule is the deny rule that matched, or
+// nil when no allow rule did.
+type policyVerdict struct {
+	Rule   *CommandPolicy `json:"policy,omitempty"`
+	Reason string         `json:"reason"`
+}
+
+// compilePolicyPattern anchors pattern to the whole command. (?s) lets "."
+// cross newlines, so a deny rule can't be dodged with a multi-line command.
+func compilePolicyPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`(?s)^(?:` + pattern + `)$`)
+}
+
+func policyApplies(p CommandPolicy, rec *AgentRecord) bool {
+	if p.Tag == "*" {
+		return true
+	}
+	for _, t := range rec.Tags {
+		if t == p.Tag {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateCommandPolicy returns nil if command may be queued on rec.
+// Patterns are validated on create; one that no longer compiles fails closed.
+func evaluateCommandPolicy(policies []CommandPolicy, rec *AgentRecord, command string) *policyVerdict {
+	command = strings.TrimSpace(command)
+
+	var allows []CommandPolicy
+	for i := range policies {
+		p := policies[i]
+		if !policyApplies(p, rec) {
+			continue
+		}
+		if p.Action == PolicyAllow {
+			allows = append(allows, p)
+			continue
+		}
+		re, err := compilePolicyPattern(p.Pattern)
+		if err != nil || re.MatchString(command) {
+			return &policyVerdict{Rule: &p, Reason: "matched deny rule"}
+		}
+	}
+
+	if len(allows) == 0 {
+		return nil
+	}
+	for _, p := range allows {
+		if re, err := compilePolicyPattern(p.Pattern); err == nil && re.MatchString(command) {
+			return nil
+		}
+	}
+	return &policyVerdict{Reason: "no allow rule matched"}
+}
+
+// enforceCommandPolicy checks command for rec and records an audit row when
+// it's rejected. A nil verdict means the job may be queued.
+func (api *API) enforceCommandPolicy(r *http.Request, rec *AgentRecord, command string) (*policyVerdict, error) {
+	policies, err := api.Store.ListCommandPolicies()
+	if err != nil {
+		return nil, err
+	}
+	v := evaluateCommandPolicy(policies, rec, command)
+	if v == nil {
+		return nil, nil
+	}
+
+	rej := PolicyRejection{
+		At:       time.Now().Unix(),
+		AgentID:  rec.AgentID,
+		Command:  command,
+		Reason:   v.Reason,
+		KeyLabel: r.Header.Get(keyLabelHeader),
+		Remote:   api.clientIP(r),
+	}
+	if v.Rule != nil {
+		rej.PolicyID = v.Rule.ID
+	}
+	log.Printf("policy: rejected agent_id=%s policy=%q reason=%q key=%q remote=%s",
+		rej.AgentID, rej.PolicyID, rej.Reason, rej.KeyLabel, rej.Remote)
+	if err := api.Store.AddPolicyRejection(rej); err != nil {
+		log.Printf("policy: audit write failed: %v", err)
+	}
+	return v, nil
+}
+
+func writePolicyRejection(w http.ResponseWriter, v *policyVerdict) {
+	resp := map[string]any{"error": "command not permitted by policy", "reason": v.Reason}
+	if v.Rule != nil {
+		resp["policy"] = v.Rule
+	}
+	writeJSON(w, 403, resp)
+}
+
+// AdminPolicies lists or creates command policy rules.
+//
+// Routes:
+//   GET  /v1/admin/policies
+//   POST /v1/admin/policies   body: {"tag","action","pattern","description"}
+
+func (api *API) AdminPolicies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		policies, err := api.Store.ListCommandPolicies()
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"policies": policies})
+
+	case http.MethodPost:
+		if !requireKeyAdmin(w, r, "policy changes") {
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var p CommandPolicy
+		if err := json.Unmarshal(body, &p); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		p.Tag = strings.TrimSpace(p.Tag)
+		if p.Tag == "" {
+			writeJSON(w, 400, map[string]any{"error": "missing tag (use * for all agents)"})
+			return
+		}
+		if p.Action != PolicyAllow && p.Action != PolicyDeny {
+			writeJSON(w, 400, map[string]any{"error": "action must be allow or deny"})
+			return
+		}
+		if p.Pattern == "" {
+			writeJSON(w, 400, map[string]any{"error": "missing pattern"})
+			return
+		}
+		if _, err := compilePolicyPattern(p.Pattern); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "invalid pattern: " + err.Error()})
+			return
+		}
+
+		p.ID = newUUID()
+		p.CreatedAt = time.Now().Unix()
+		if err := api.Store.CreateCommandPolicy(p); err != nil {
+			writeDBError(w, err)
+			return
+		}
+		log.Printf("admin: command policy created id=%s tag=%s action=%s by=%s", p.ID, p.Tag, p.Action, r.Header.Get(keyLabelHeader))
+		writeJSON(w, 200, map[string]any{"ok": true, "policy": p})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminPolicyRoutes handles a single rule and the rejection audit log.
+//
+// Mounted on the "/v1/admin/policies/" prefix:
+//   GET    /v1/admin/policies/rejections?limit=N
+//   DELETE /v1/admin/policies/{id}
+
+func (api *API) AdminPolicyRoutes(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/admin/policies/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSON(w, 404, map[string]any{"error": "unknown policy route", "path": r.URL.Path})
+		return
+	}
+	if id == "rejections" {
+		api.AdminPolicyRejections(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if !requireKeyAdmin(w, r, "policy changes") {
+		return
+	}
+
+	found, err := api.Store.DeleteCommandPolicy(id)
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "unknown policy"})
+		return
+	}
+	log.Printf("admin: command policy deleted id=%s by=%s", id, r.Header.Get(keyLabelHeader))
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+func (api *API) AdminPolicyRejections(w http.ResponseWriter, r *http.Request) {
+	if !isRead(r) {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	rejections, err := api.Store.ListPolicyRejections(queryInt(r, "limit", 100, 1000))
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"rejections": rejections})
+}
+
+// enforceJobPolicy runs enforceCommandPolicy on each of policyCommands(job),
+// stopping at the first rejection.
+func (api *API) enforceJobPolicy(r *http.Request, rec *AgentRecord, job shared.Job) (*policyVerdict, error) {
+	for _, cmd := range policyCommands(job) {
+		if v, err := api.enforceCommandPolicy(r, rec, cmd); v != nil || err != nil {
+			return v, err
+		}
+	}
+	return nil, nil
+}
+
+// -----------------------------------------------------------------------------
+// Command blocklist (last-resort, enforced at dispatch)
+// -----------------------------------------------------------------------------
+//
+// Policies are checked when a job is submitted; a job queued before a policy
+// was tightened would still run. The blocklist comes from server config
+// (RR_COMMAND_BLOCKLIST_FILE) and is checked in DequeueJobs, as the job is
+// handed out: a match marks the job "blocked" with a job event instead. It
+// applies to every agent and has no API, so a leaked admin key can't lift it.
+
+// CommandBlocklist is a set of case-insensitive Go regexps, each matched
+// anywhere in the (decoded) command. A nil *CommandBlocklist blocks nothing.
+type CommandBlocklist struct {
+	patterns []string
+	res      []*regexp.Regexp
+}
+
+// ParseCommandBlocklist reads one pattern per line; blank lines and lines
+// starting with # are skipped.
+func ParseCommandBlocklist(text string) (*CommandBlocklist, error) {
+	bl := &CommandBlocklist{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(`(?is)` + line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		bl.patterns = append(bl.patterns, line)
+		bl.res = append(bl.res, re)
+	}
+	return bl, nil
+}
+
+// Len is the number of patterns.
+func (bl *CommandBlocklist) Len() int {
+	if bl == nil {
+		return 0
+	}
+	return len(bl.res)
+}
+
+// MatchAny returns the first pattern any of commands matches, or "".
+func (bl *CommandBlocklist) MatchAny(commands []string) string {
+	for _, cmd := range commands {
+		if p := bl.Match(cmd); p != "" {
+			return p
+		}
+	}
+	return ""
+}
+
+// Match returns the first pattern command matches, or "".
+func (bl *CommandBlocklist) Match(command string) string {
+	if bl == nil {
+		return ""
+	}
+	for i, re := range bl.res {
+		if re.MatchString(command) {
+			return bl.patterns[i]
+		}
+	}
+	return ""
+}
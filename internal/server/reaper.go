@@ -0,0 +1,30 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// RunJobReaper fails running jobs whose result is overdue (see
+// Store.ReapStaleJobs) every interval until stop is closed. grace is how long
+// past its own timeout a job may stay running, to absorb slow uploads and
+// agents that were briefly offline.
+func (api *API) RunJobReaper(interval, grace time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		ids, err := api.Store.ReapStaleJobs(time.Now().Unix(), int64(grace/time.Second))
+		if err != nil {
+			log.Printf("jobs: reaper: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			log.Printf("jobs: reaped job_id=%s (no result within timeout + %s)", id, grace)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Retention (bounded DB growth)
+// -----------------------------------------------------------------------------
+//
+// Append-only tables (inventory snapshots, finished jobs + results) grow
+// forever on a long-lived install. PruneRetention deletes rows that are older
+// than a max age and/or beyond the newest N rows per agent, one transaction
+// per table. The server runs it on a timer; rr-dbcheck -prune runs it by hand
+// (with -dry-run to only count).
+//
+// Config (per table, both optional; unset = keep forever):
+//   RR_RETAIN_<TABLE>_MAX_AGE    e.g. "90d", "720h"
+//   RR_RETAIN_<TABLE>_MAX_ROWS   newest rows kept per agent
+// where <TABLE> is the upper-cased retention target name (INVENTORY, JOBS, EVENTS,
+// DEAD_LETTERS).
+
+// RetentionRule bounds one table. Zero values disable that limit.
+type RetentionRule struct {
+	MaxAge          time.Duration
+	MaxRowsPerAgent int
+}
+
+func (r RetentionRule) enabled() bool {
+	return r.MaxAge > 0 || r.MaxRowsPerAgent > 0
+}
+
+// RetentionPolicy maps retention target names (see retentionTargets) to rules.
+type RetentionPolicy map[string]RetentionRule
+
+// Enabled reports whether any rule would delete anything.
+func (p RetentionPolicy) Enabled() bool {
+	for _, r := range p {
+		if r.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// RetentionResult is what one target pruned (or would prune, in dry-run).
+type RetentionResult struct {
+	Target  string `json:"target"`
+	Table   string `json:"table"`
+	Deleted int64  `json:"deleted"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// retentionTarget describes how to age out rows of one table. children are
+// deleted first (by foreign key) so the parent delete doesn't violate FKs.
+type retentionTarget struct {
+	name     string
+	table    string
+	key      string
+	agentCol string
+	timeCol  string
+	where    string // which rows are eligible at all
+	children []retentionChild
+}
+
+type retentionChild struct {
+	table string
+	fk    string
+}
+
+var retentionTargets = []retentionTarget{
+	{
+		name:     "inventory",
+		table:    "agent_inventory_snapshots",
+		key:      "id",
+		agentCol: "agent_id",
+		timeCol:  "created_at",
+		where:    "1=1",
+	},
+	{
+		// Only finished jobs; queued/running work is never pruned.
+		name:     "jobs",
+		table:    "jobs",
+		key:      "id",
+		agentCol: "target_agent_id",
+		timeCol:  "finished_at",
+		where:    "finished_at IS NOT NULL",
+		children: []retentionChild{{table: "job_results", fk: "job_id"}, {table: "job_events", fk: "job_id"}},
+	},
+	{
+		name:     "events",
+		table:    "agent_status_events",
+		key:      "id",
+		agentCol: "agent_id",
+		timeCol:  "at",
+		where:    "1=1",
+	},
+	{
+		name:     "dead_letters",
+		table:    "dead_letter_results",
+		key:      "id",
+		agentCol: "agent_id",
+		timeCol:  "received_at",
+		where:    "1=1",
+	},
+}
+
+// RetentionPolicyFromEnv reads RR_RETAIN_* for every known target.
+func RetentionPolicyFromEnv() RetentionPolicy {
+	p := RetentionPolicy{}
+	for _, t := range retentionTargets {
+		prefix := "RR_RETAIN_" + strings.ToUpper(t.name)
+		var rule RetentionRule
+
+		if v := strings.TrimSpace(os.Getenv(prefix + "_MAX_AGE")); v != "" {
+			d, err := parseRetentionAge(v)
+			if err != nil {
+				log.Printf("config: ignoring invalid %s_MAX_AGE=%q: %v", prefix, v, err)
+			} else {
+				rule.MaxAge = d
+			}
+		}
+		if v := strings.TrimSpace(os.Getenv(prefix + "_MAX_ROWS")); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Printf("config: ignoring invalid %s_MAX_ROWS=%q", prefix, v)
+			} else {
+				rule.MaxRowsPerAgent = n
+			}
+		}
+		if rule.enabled() {
+			p[t.name] = rule
+		}
+	}
+	return p
+}
+
+// parseRetentionAge accepts Go durations plus a whole-days form ("90d"),
+// since retention windows are usually thought of in days.
+func parseRetentionAge(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bad day count")
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+// PruneRetention applies policy to every configured target. With dryRun set
+// it only counts the rows that would be deleted.
+func PruneRetention(db *sql.DB, policy RetentionPolicy, now time.Time, dryRun bool) ([]RetentionResult, error) {
+	var out []RetentionResult
+	for _, t := range retentionTargets {
+		rule, ok := policy[t.name]
+		if !ok || !rule.enabled() {
+			continue
+		}
+		n, err := pruneTarget(db, t, rule, now, dryRun)
+		if err != nil {
+			return out, fmt.Errorf("retention %s: %w", t.name, err)
+		}
+		out = append(out, RetentionResult{Target: t.name, Table: t.table, Deleted: n, DryRun: dryRun})
+	}
+	return out, nil
+}
+
+func pruneTarget(db *sql.DB, t retentionTarget, rule RetentionRule, now time.Time, dryRun bool) (int64, error) {
+	// Build the set of doomed keys once; it's reused for the count, the child
+	// deletes and the parent delete, all inside the same transaction.
+	var (
+		parts []string
+		args  []any
+	)
+	if rule.MaxAge > 0 {
+		parts = append(parts, fmt.Sprintf(`SELECT %s FROM %s WHERE %s AND %s < ?`,
+			t.key, t.table, t.where, t.timeCol))
+		args = append(args, now.Add(-rule.MaxAge).Unix())
+	}
+	if rule.MaxRowsPerAgent > 0 {
+		parts = append(parts, fmt.Sprintf(
+			`SELECT %s FROM (
+			   SELECT %s, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY %s DESC, %s DESC) AS rn
+			     FROM %s WHERE %s
+			 ) WHERE rn > ?`,
+			t.key, t.key, t.agentCol, t.timeCol, t.key, t.table, t.where))
+		args = append(args, rule.MaxRowsPerAgent)
+	}
+	doomed := strings.Join(parts, " UNION ")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int64
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM (`+doomed+`)`, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	if dryRun || n == 0 {
+		return n, nil
+	}
+
+	// Materialize the keys first so every delete sees the same set.
+	if _, err := tx.Exec(`CREATE TEMP TABLE IF NOT EXISTS retention_doomed (k PRIMARY KEY)`); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM retention_doomed`); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO retention_doomed (k) `+doomed, args...); err != nil {
+		return 0, err
+	}
+	for _, c := range t.children {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s IN (SELECT k FROM retention_doomed)`, c.table, c.fk)); err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s IN (SELECT k FROM retention_doomed)`, t.table, t.key))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM retention_doomed`); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	n, _ = res.RowsAffected()
+	return n, nil
+}
+
+// RunRetention prunes on a fixed interval until stop is closed. Errors are
+// logged and retried on the next tick.
+func RunRetention(db *sql.DB, policy RetentionPolicy, interval time.Duration, stop <-chan struct{}) {
+	if !policy.Enabled() {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		results, err := PruneRetention(db, policy, time.Now(), false)
+		if err != nil {
+			log.Printf("retention: %v", err)
+		}
+		for _, r := range results {
+			if r.Deleted > 0 {
+				log.Printf("retention: pruned %d row(s) from %s", r.Deleted, r.Table)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
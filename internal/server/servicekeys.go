@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// -----------------------------------------------------------------------------
+// Service keys (named admin API credentials)
+// -----------------------------------------------------------------------------
+//
+// Each integration (UI, MSPGuild, CI, ...) gets its own labelled key so one
+// can be revoked without rotating the others. Keys look like
+//
+//   rk_<id>_<secret>
+//
+// The id selects the row; only a bcrypt hash of the whole key is stored. The
+// RR_API_KEY env key keeps working (label "env") and is the only key, besides
+// an operator session, allowed to create or revoke named keys.
+//
+// RequireServiceKey puts the matched label in the X-RR-Key-Label request
+// header for handlers and the audit log.
+
+const (
+	keyLabelHeader  = "X-RR-Key-Label"
+	keyLabelEnv     = "env"
+	keyLabelSession = "session"
+
+	serviceKeyPrefix = "rk_"
+
+	// bcrypt is deliberately slow, so verified keys are remembered briefly.
+	// Revoking through this server drops the cache at once; the TTL bounds
+	// how long a key revoked elsewhere stays usable.
+	serviceKeyCacheTTL = time.Minute
+)
+
+var serviceKeyLabelRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+type serviceKeyCache struct {
+	mu sync.Mutex
+	m  map[string]cachedServiceKey // sha256(key) -> match
+}
+
+type cachedServiceKey struct {
+	label     string
+	expiresAt time.Time
+}
+
+func (c *serviceKeyCache) get(digest string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[digest]
+	if !ok || time.Now().After(e.expiresAt) {
+		delete(c.m, digest)
+		return "", false
+	}
+	return e.label, true
+}
+
+func (c *serviceKeyCache) put(digest, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[string]cachedServiceKey{}
+	}
+	c.m[digest] = cachedServiceKey{label: label, expiresAt: time.Now().Add(serviceKeyCacheTTL)}
+}
+
+func (c *serviceKeyCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = nil
+}
+
+// newServiceKey returns a fresh key id and the full plaintext key.
+func newServiceKey() (id, key string, err error) {
+	var idb [8]byte
+	var secret [32]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(idb[:])
+	return id, serviceKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret[:]), nil
+}
+
+// parseServiceKeyID extracts the id from "rk_<id>_<secret>".
+func parseServiceKeyID(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, serviceKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// serviceKeyLabel returns the label of the key presented in X-RR-Key, or ""
+// if it matches neither RR_API_KEY nor a live named key.
+func (api *API) serviceKeyLabel(got string) (string, error) {
+	if got == "" {
+		return "", nil
+	}
+	if want := os.Getenv("RR_API_KEY"); want != "" &&
+		subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1 {
+		return keyLabelEnv, nil
+	}
+
+	id, ok := parseServiceKeyID(got)
+	if !ok {
+		return "", nil
+	}
+	sum := sha256.Sum256([]byte(got))
+	digest := hex.EncodeToString(sum[:])
+	if label, ok := api.serviceKeys.get(digest); ok {
+		return label, nil
+	}
+
+	k, err := api.Store.GetServiceKey(id)
+	if err != nil {
+		return "", err
+	}
+	if k == nil || k.RevokedAt != nil {
+		return "", nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(k.Hash), []byte(got)) != nil {
+		return "", nil
+	}
+	api.serviceKeys.put(digest, k.Label)
+	return k.Label, nil
+}
+
+// requireKeyAdmin allows only the bootstrap env key or an operator session,
+// for changes a named service key must not make (what names them in the
+// error).
+func requireKeyAdmin(w http.ResponseWriter, r *http.Request, what string) bool {
+	switch r.Header.Get(keyLabelHeader) {
+	case keyLabelEnv, keyLabelSession:
+		return true
+	}
+	writeJSON(w, 403, map[string]any{"error": what + " requires RR_API_KEY or an operator session"})
+	return false
+}
+
+// AdminServiceKeys lists or creates named service keys. The plaintext key is
+// only ever returned by the create call.
+//
+// Routes:
+//   GET  /v1/admin/keys
+//   POST /v1/admin/keys   body: {"label": "ci"}
+
+func (api *API) AdminServiceKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		keys, err := api.Store.ListServiceKeys()
+		if err != nil {
+			writeDBError(w, err)
+			return
+		}
+		writeJSON(w, 200, map[string]any{"keys": keys})
+
+	case http.MethodPost:
+		if !requireKeyAdmin(w, r, "key management") {
+			return
+		}
+		body, err := readBody(r)
+		if err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad body"})
+			return
+		}
+		var req struct {
+			Label string `json:"label"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeJSON(w, 400, map[string]any{"error": "bad json"})
+			return
+		}
+		if !serviceKeyLabelRe.MatchString(req.Label) || req.Label == keyLabelEnv || req.Label == keyLabelSession {
+			writeJSON(w, 400, map[string]any{"error": "invalid label"})
+			return
+		}
+
+		id, key, err := newServiceKey()
+		if err != nil {
+			writeJSON(w, 500, map[string]any{"error": "key generation failed"})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+		if err != nil {
+			writeJSON(w, 500, map[string]any{"error": "key generation failed"})
+			return
+		}
+		k := ServiceKey{ID: id, Label: req.Label, Hash: string(hash), CreatedAt: time.Now().Unix()}
+		if err := api.Store.CreateServiceKey(k); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				writeJSON(w, 409, map[string]any{"error": "an active key with this label exists"})
+				return
+			}
+			writeDBError(w, err)
+			return
+		}
+
+		log.Printf("admin: service key created id=%s label=%s by=%s", k.ID, k.Label, r.Header.Get(keyLabelHeader))
+		writeJSON(w, 200, map[string]any{"ok": true, "key": k, "secret": key})
+
+	default:
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+	}
+}
+
+// AdminServiceKeyRoutes handles a single named key.
+//
+// Mounted on the "/v1/admin/keys/" prefix:
+//   DELETE /v1/admin/keys/{id}   revoke
+
+func (api *API) AdminServiceKeyRoutes(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/admin/keys/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJSON(w, 404, map[string]any{"error": "unknown key route", "path": r.URL.Path})
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	if !requireKeyAdmin(w, r, "key management") {
+		return
+	}
+
+	found, err := api.Store.RevokeServiceKey(id, time.Now().Unix())
+	if err != nil {
+		writeDBError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, 404, map[string]any{"error": "unknown or already revoked key"})
+		return
+	}
+	api.serviceKeys.clear()
+
+	log.Printf("admin: service key revoked id=%s by=%s", id, r.Header.Get(keyLabelHeader))
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
@@ -1,6 +1,15 @@
 package server
 
-import "rackroom/internal/shared"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"rackroom/internal/shared"
+)
 
 type AgentFacts struct {
 	AgentID   string
@@ -17,36 +26,644 @@ type AgentFacts struct {
 	RAMTotalBytes int64
 	RAMFreeBytes  int64
 
+	// UptimeSeconds is as of now when read back from the store (computed
+	// from BootTime when it's known), as of UpdatedAt when just derived.
 	UptimeSeconds int64
+	BootTime      int64 // unix seconds; 0 = unknown
 	IPv4Primary   string
 
 	DiskTotalBytes int64
 	DiskFreeBytes  int64
+
+	Timezone         string // IANA or Windows zone id, as reported
+	UTCOffsetMinutes int64  // offset at collection time (includes DST)
+	Locale           string
+
+	// IPv4 default gateways and DNS servers across all interfaces; nil =
+	// not reported.
+	Gateways   []string
+	DNSServers []string
+
+	UpdatesPending *int64 // nil = the agent doesn't report pending updates
 }
+
+// Store is everything the API persists. It is split by area so a backend
+// can be brought up piece by piece: CoreStore is what agents need to enroll,
+// check in and run jobs; AdminStore is the rest of the admin API.
 type Store interface {
-	// CreateAgent Agents
-	CreateAgent(publicKey string, info shared.AgentInfo, tags []string) (agentID string, err error)
+	CoreStore
+	AdminStore
+
+	// InTx runs fn on a Store whose calls all belong to one transaction,
+	// committed if fn returns nil and rolled back otherwise. On such a
+	// Store, InTx runs fn in a savepoint of the same transaction.
+	InTx(fn func(Store) error) error
+}
+
+// CoreStore is agents, inventory and facts, jobs and results, and the
+// command policy those jobs are checked against.
+type CoreStore interface {
+	AgentStore
+	InventoryStore
+	JobStore
+	PolicyStore
+}
+
+type AgentStore interface {
+	CreateAgent(publicKey string, info shared.AgentInfo, tags []string, approvalStatus string) (agentID string, err error)
 	GetAgentByID(agentID string) (*AgentRecord, error)
+	// AgentExists reports whether agentID has a record, without loading it.
+	AgentExists(agentID string) (bool, error)
 	GetAgentByPubKey(publicKey string) (*AgentRecord, error)
 	UpdateAgentSeen(agentID string, info shared.AgentInfo, tags []string) error
+	SetAgentTags(agentID string, tags []string) (found bool, err error)
+	ReleaseAgentTags(agentID string) (found bool, err error)
+	// EditAgentTags adds and removes tags on each of agentIDs in one
+	// transaction, marking changed agents' tags server-owned like
+	// SetAgentTags. It returns the agents whose tags changed; unknown ids
+	// are skipped.
+	EditAgentTags(agentIDs, add, remove []string) (changed []string, err error)
+	// SetAgentEnrollTags records tags the server assigned at enroll (see
+	// EnrollTagRules): merged into the agent's tags, or with override as
+	// its server-set tags.
+	SetAgentEnrollTags(agentID string, tags []string, override bool) error
+	SetAgentCapabilities(agentID string, capabilities []string) error
+	SetAgentProtocolVersion(agentID string, version int) error
+	SetAgentInventoryParseError(agentID, msg string) error
+	SetAgentInventoryError(agentID, msg string) error
+	// SetAgentHMACSecret replaces the agent's HMAC signing secret; ""
+	// turns HMAC off. GetAgentHMACSecret returns "" when none is set. The
+	// secret is kept out of AgentRecord so it can't leak into listings.
+	SetAgentHMACSecret(agentID, secret string) error
+	GetAgentHMACSecret(agentID string) (string, error)
+	ListAgents(limit int) ([]AgentRecord, error)
+	ListAgentsByApproval(status string, limit int) ([]AgentRecord, error)
+	// ApproveAgent approves a pending agent; changed is false when there is
+	// no pending agent agentID (unknown, already approved or disabled).
+	ApproveAgent(agentID string) (changed bool, err error)
+	SetAgentDisabled(agentID string, disabled bool) (found bool, err error)
+	DeleteAgent(agentID string) (found bool, err error)
+	ListStaleAgents(seenBefore int64, limit int) ([]AgentRecord, error)
+	MarkAgentOnline(agentID string, at int64) (changed bool, err error)
+	MarkStaleAgentsOffline(seenBefore, at int64) (agentIDs []string, err error)
+	SetAgentHeartbeatInterval(agentID string, seconds int) error
+	// SetAgentDiskState stores the free space the agent last reported (0 =
+	// not reported) and its disk pressure flag; changed reports whether the
+	// flag flipped.
+	SetAgentDiskState(agentID string, freeBytes int64, pressure bool) (changed bool, err error)
+	// SetAgentJobState stores the job counts of the agent's last heartbeat;
+	// nil (an agent that doesn't send them) clears them.
+	SetAgentJobState(agentID string, st *shared.AgentJobState) error
+	MarkLateAgents(missed int, at int64) (agentIDs []string, err error)
+	ListAgentStatusEvents(agentID string, afterID int64, limit int) ([]AgentStatusEvent, error)
+	ListAgentIDsByTag(tag string) ([]string, error)
+	GetAgentDetail(agentID string) (*AgentDetail, error)
+}
+
+// InventoryStore holds inventory snapshots and the facts derived from them.
+type InventoryStore interface {
+	// AddInventorySnapshot stores payloadJSON unless it hashes the same as
+	// the agent's latest snapshot, in which case only that snapshot's
+	// last_seen_identical_at moves.
 	AddInventorySnapshot(agentID string, payloadJSON string) error
+	// GetLatestInventorySnapshot and GetInventorySnapshotAt verify the
+	// payload against its stored sha256 and return an
+	// *InventoryChecksumError if it doesn't match.
 	GetLatestInventorySnapshot(agentID string) (string, error)
-	ListAgents(limit int) ([]AgentRecord, error)
+	GetInventorySnapshotAt(agentID string, at int64) (*InventoryRef, string, error)
+	// ListAgentsMissingInventory returns agents seen at or after seenAfter
+	// whose latest inventory (counting identical re-sends) is older than
+	// inventoryBefore or absent, never-sent first.
+	ListAgentsMissingInventory(seenAfter, inventoryBefore int64, limit int) ([]InventoryGap, error)
 	UpsertAgentFacts(f AgentFacts) error
-	// QueueJob Jobs
-	QueueJob(agentID string, job shared.Job) error
-	DequeueJobs(agentID string, max int) ([]shared.Job, error)
-	ListAgentFacts(limit int) ([]AgentFacts, error)
+	// UpdateAgentQuickFacts refreshes the facts q measured (its nonzero
+	// fields) on the agent's facts row, if it has one yet.
+	UpdateAgentQuickFacts(agentID string, q shared.QuickFacts) error
+	// SetAgentCustomFacts replaces the agent's custom facts (see
+	// CustomFacts) with facts, as of at.
+	SetAgentCustomFacts(agentID string, facts map[string]string, at int64) error
+	GetAgentFacts(agentID string) (*AgentFacts, error)
+	// EachAgentFacts calls fn for up to limit facts rows, most recently
+	// updated first, without loading them all; an error from fn stops the
+	// walk and is returned.
+	EachAgentFacts(limit int, fn func(AgentFacts) error) error
+	// ListAgentsNeedingUpdates returns agents reporting at least minPending
+	// pending OS updates, most first.
+	ListAgentsNeedingUpdates(minPending int64, limit int) ([]AgentFactsView, error)
 	ListAgentFactsView(limit int) ([]AgentFactsView, error)
+	FactsDistribution(field string) ([]FactCount, error)
+	// FindAgentsByFacts returns the ids of agents whose facts match every
+	// condition (already checked by validateFactSelector), sorted.
+	FindAgentsByFacts(where []shared.FactCondition) ([]string, error)
+}
+
+// JobStore is the job queue, results and job history.
+type JobStore interface {
+	// QueueJob fails with ErrQueueFull if agentID already has maxQueued
+	// (> 0) jobs waiting.
+	QueueJob(agentID string, job shared.Job, maxQueued int) error
+	// DequeueJobs hands out up to max queued jobs and marks them running.
+	// Jobs matching blocklist (nil = none) are marked blocked instead and
+	// returned separately.
+	DequeueJobs(agentID string, max int, blocklist *CommandBlocklist) ([]shared.Job, []BlockedJob, error)
+	ListJobSummaries(f JobListFilter) ([]JobSummary, error)
+	ListAgentResults(agentID string, limit int) ([]ResultSummary, error)
+	GetJobDetail(jobID string) (*JobDetail, error)
+	// JobTarget returns the agent a job was queued for; found is false
+	// for an unknown job.
+	JobTarget(jobID string) (agentID string, found bool, err error)
+	// LatestBatchJobs returns, per agent, the most recent job queued under
+	// batchID (retries share the batch id), oldest agent first.
+	LatestBatchJobs(batchID string) ([]BatchJob, error)
+	// CreateJobBatch records how a selector batch was resolved; GetJobBatch
+	// returns nil for batches without a record (e.g. group runs).
+	CreateJobBatch(b JobBatch) error
+	GetJobBatch(id string) (*JobBatch, error)
+	// AgentJobCounts aggregates agentID's jobs by status (every status is
+	// present, zero if none).
+	AgentJobCounts(agentID string) (*AgentJobCounts, error)
+	// ListQueueDepths lists agents with queued jobs, deepest queue first.
+	ListQueueDepths(limit int) ([]QueueDepth, error)
+
+	// AddResult records res and the job's resulting status. Only the first
+	// result for a job is kept: a repeat (an agent retrying a post whose
+	// answer it never saw) changes nothing and returns recorded=false.
+	AddResult(res shared.JobResult) (recorded bool, err error)
+	ReapStaleJobs(now, graceSeconds int64) (jobIDs []string, err error)
+	ListJobEvents(jobID string) ([]JobEvent, error)
+	// AddDeadLetterResult keeps a job result JobResult refused;
+	// ListDeadLetterResults returns them newest first without payloads.
+	AddDeadLetterResult(d DeadLetterResult) error
+	ListDeadLetterResults(limit int) ([]DeadLetterResult, error)
+	GetDeadLetterResult(id int64) (*DeadLetterResult, error)
+}
+
+// PolicyStore is the server-side command policy and its rejection audit.
+type PolicyStore interface {
+	CreateCommandPolicy(p CommandPolicy) error
+	ListCommandPolicies() ([]CommandPolicy, error)
+	DeleteCommandPolicy(id string) (found bool, err error)
+	AddPolicyRejection(rej PolicyRejection) error
+	ListPolicyRejections(limit int) ([]PolicyRejection, error)
+}
+
+// AdminStore is what only the admin API and enrollment extras use.
+type AdminStore interface {
+	// CreateTemplate Command templates
+	CreateTemplate(t CommandTemplate) error
+	GetTemplateByName(name string) (*CommandTemplate, error)
+	ListTemplates() ([]CommandTemplate, error)
+	DeleteTemplate(name string) (found bool, err error)
+
+	// CreateServiceKey Service keys (admin API credentials)
+	CreateServiceKey(k ServiceKey) error
+	GetServiceKey(id string) (*ServiceKey, error)
+	ListServiceKeys() ([]ServiceKey, error)
+	RevokeServiceKey(id string, at int64) (found bool, err error)
+
+	// ReserveEnrollRegistration counts a new registration against the
+	// enroll token tokenHash, unless max (> 0) registrations already
+	// happened.
+	ReserveEnrollRegistration(tokenHash string, max int) (ok bool, err error)
+	// CreateEnrollToken stores a minted short-lived token (by hash) and
+	// drops ones that already expired; EnrollTokenValid reports whether
+	// tokenHash is a minted token still live at now.
+	CreateEnrollToken(tokenHash string, createdAt, expiresAt int64, createdBy string) error
+	EnrollTokenValid(tokenHash string, now int64) (bool, error)
+
+	// CreateEnrollKey Pre-authorized enroll keys (token-less enrollment)
+	CreateEnrollKey(k EnrollKey) error
+	ListEnrollKeys() ([]EnrollKey, error)
+	DeleteEnrollKey(id string) (found bool, err error)
+	// SetEnrollChallenge replaces the outstanding challenge of publicKey if it
+	// may still enroll at now; ok is false for unknown, expired or used keys.
+	SetEnrollChallenge(publicKey, challenge string, expiresAt, now int64) (ok bool, err error)
+	// ConsumeEnrollChallenge clears the challenge if it is publicKey's live
+	// one, so it verifies at most once.
+	ConsumeEnrollChallenge(publicKey, challenge string, now int64) (ok bool, err error)
+	// MarkEnrollKeyUsed records the agent that enrolled with publicKey.
+	MarkEnrollKeyUsed(publicKey, agentID string, at int64) error
+
+	// CreateGroup Agent groups (curated membership)
+	CreateGroup(g AgentGroup) error
+	GetGroup(id string) (*AgentGroup, error)
+	ListGroups() ([]AgentGroup, error)
+	DeleteGroup(id string) (found bool, err error)
+	AddGroupMembers(groupID string, agentIDs []string) (added int, err error)
+	RemoveGroupMember(groupID, agentID string) (found bool, err error)
+	ListGroupMembers(groupID string) ([]string, error)
+
+	// GetStats Dashboard aggregates; agents seen at or after onlineSince are online.
+	GetStats(onlineSince int64) (*Stats, error)
+
+	// SchemaStatus Applied and pending schema migrations.
+	SchemaStatus() (*SchemaStatus, error)
+}
+
+// Stats is the dashboard summary returned by /v1/admin/stats.
+type Stats struct {
+	AgentsTotal        int64            `json:"agents_total"`
+	AgentsOnline       int64            `json:"agents_online"`
+	AgentsOffline      int64            `json:"agents_offline"`
+	AgentsByOS         map[string]int64 `json:"agents_by_os"`
+	JobsByStatus       map[string]int64 `json:"jobs_by_status"`
+	InventorySnapshots int64            `json:"inventory_snapshots"`
+	StorageBytes       int64            `json:"storage_bytes"`
+	GeneratedAt        int64            `json:"generated_at"`
+}
+
+// AgentDetail is everything the UI's agent page needs in one read.
+// Facts and LatestInventory are nil until the agent has sent inventory.
+type AgentDetail struct {
+	Agent           AgentRecord
+	Facts           *AgentFactsView
+	LatestInventory *InventoryRef
+}
+
+// InventoryRef identifies a stored inventory snapshot without its payload.
+// SHA256 (hex, of the stored JSON) is empty for snapshots stored before
+// hashes were recorded. LastSeenIdenticalAt is the last time the agent sent
+// the same inventory again (0 if it never has).
+type InventoryRef struct {
+	SnapshotID          string `json:"snapshot_id"`
+	CreatedAt           int64  `json:"created_at"`
+	SizeBytes           int64  `json:"size_bytes"`
+	SHA256              string `json:"sha256"`
+	LastSeenIdenticalAt int64  `json:"last_seen_identical_at,omitempty"`
+}
+
+// CommandTemplate is a saved command; Command may contain {{var}} placeholders
+// that are filled in (and validated) when the template is run.
+type CommandTemplate struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Description    string `json:"description"`
+	Kind           string `json:"kind"`
+	Shell          string `json:"shell"`
+	Command        string `json:"command"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+	CreatedAt      int64  `json:"created_at"`
+}
+
+// ServiceKey is a named admin API key. Only the bcrypt hash of the secret is
+// stored; the plaintext is shown once, at creation.
+type ServiceKey struct {
+	ID        string `json:"id"`
+	Label     string `json:"label"`
+	Hash      string `json:"-"`
+	CreatedAt int64  `json:"created_at"`
+	RevokedAt *int64 `json:"revoked_at"`
+}
+
+// EnrollKey is a public key an admin pre-authorized to enroll without the
+// enroll token, until ExpiresAt. Once an agent enrolled with it, only that
+// agent (same key, still registered) can enroll with it again.
+type EnrollKey struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"public_key"`
+	Note      string `json:"note"`
+	CreatedAt int64  `json:"created_at"`
+	CreatedBy string `json:"created_by"`
+	ExpiresAt int64  `json:"expires_at"`
+	UsedAt    *int64 `json:"used_at"`
+	AgentID   string `json:"agent_id,omitempty"`
+}
+
+// AgentGroup is a named set of agents whose membership is curated through
+// the admin API, unlike tags (which agents declare themselves).
+type AgentGroup struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	CreatedAt   int64  `json:"created_at"`
+	MemberCount int    `json:"member_count"`
+}
+
+// CommandPolicy is one server-side rule checked before a job is queued.
+type CommandPolicy struct {
+	ID          string `json:"id"`
+	Tag         string `json:"tag"`    // agents it applies to; "*" = all
+	Action      string `json:"action"` // PolicyAllow | PolicyDeny
+	Pattern     string `json:"pattern"`
+	Description string `json:"description"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+)
+
+// PolicyRejection records a submission the command policy refused.
+type PolicyRejection struct {
+	ID       int64  `json:"id"`
+	At       int64  `json:"at"`
+	AgentID  string `json:"agent_id"`
+	Command  string `json:"command"`
+	PolicyID string `json:"policy_id,omitempty"`
+	Reason   string `json:"reason"`
+	KeyLabel string `json:"key_label"`
+	Remote   string `json:"remote"`
+}
+
+// Agent approval states. Agents that enroll while the server requires
+// approval start out pending and cannot receive jobs until approved.
+const (
+	ApprovalApproved = "approved"
+	ApprovalPending  = "pending"
+	ApprovalDisabled = "disabled" // set by an admin; agent auth is refused
+)
+
+// Agent liveness, derived from heartbeats. Transitions between online, late
+// (missed several of its own heartbeat intervals) and offline are recorded
+// as AgentStatusEvents.
+const (
+	LivenessOnline  = "online"
+	LivenessLate    = "late"
+	LivenessOffline = "offline"
+)
+
+// AgentStatusEvent is one liveness transition. IDs increase monotonically,
+// so clients page with after=<last id seen>.
+type AgentStatusEvent struct {
+	ID       int64  `json:"id"`
+	AgentID  string `json:"agent_id"`
+	Hostname string `json:"hostname"`
+	Status   string `json:"status"`
+	At       int64  `json:"at"`
+}
+
+// Tag sources. Agent-declared tags come from heartbeats; once an admin sets
+// tags on the server they win and heartbeats stop overwriting them until the
+// override is released.
+const (
+	TagsSourceAgent  = "agent"
+	TagsSourceServer = "server"
+)
+
+// JobListFilter narrows ListJobSummaries. Empty fields match everything.
+type JobListFilter struct {
+	AgentID string
+	Status  string
+	BatchID string
+	Limit   int
+	Offset  int
+}
+
+// JobSummary is a job plus result metadata, without stdout/stderr.
+// List endpoints return these; the full output is only in JobDetail.
+type JobSummary struct {
+	JobID       string `json:"job_id"`
+	AgentID     string `json:"agent_id"`
+	Kind        string `json:"kind"`
+	Shell       string `json:"shell"`
+	Status      string `json:"status"`
+	ExitCode    *int   `json:"exit_code"` // nil until a result arrives
+	StdoutBytes int64  `json:"stdout_bytes"`
+	StderrBytes int64  `json:"stderr_bytes"`
+	CreatedAt   int64  `json:"created_at"`
+	StartedAt   int64  `json:"started_at"`
+	FinishedAt  int64  `json:"finished_at"`
+	TimedOut    bool   `json:"timed_out"`   // output is partial (status "timed_out")
+	Interrupted bool   `json:"interrupted"` // output is partial (status "interrupted")
+	Truncated   bool   `json:"truncated"`   // output was cut to the server's size cap
+	Priority    int    `json:"priority"`
+	BatchID     string `json:"batch_id,omitempty"` // set when queued as part of a group run
+}
+
+// ResultSummary is a JobSummary for a job with a result, plus the line
+// counts and last lines of its output, for triage without the full blobs.
+// Base64 (binary) output has neither: the counts stay 0 and the tails empty.
+type ResultSummary struct {
+	JobSummary
+	OutputEncoding string `json:"output_encoding"`
+	StdoutLines    int64  `json:"stdout_lines"`
+	StderrLines    int64  `json:"stderr_lines"`
+	StdoutTail     string `json:"stdout_tail"`
+	StderrTail     string `json:"stderr_tail"`
+}
+
+// Result summary tails are at most resultTailLines lines and resultTailBytes
+// bytes, cut from the last resultTailChars characters the query returns.
+const (
+	resultTailLines = 20
+	resultTailBytes = 4 << 10
+	resultTailChars = 8 << 10
+)
+
+// finishResultSummary turns the newline counts and output suffixes a
+// backend's query returned into rs's line counts and tails.
+func finishResultSummary(rs *ResultSummary, stdoutNewlines, stderrNewlines int64, stdoutEnd, stderrEnd string) {
+	if rs.OutputEncoding == "" {
+		rs.OutputEncoding = shared.PayloadEncodingUTF8
+	}
+	if rs.OutputEncoding != shared.PayloadEncodingUTF8 {
+		return
+	}
+	rs.StdoutLines, rs.StdoutTail = outputLines(stdoutNewlines, stdoutEnd), outputTail(stdoutEnd)
+	rs.StderrLines, rs.StderrTail = outputLines(stderrNewlines, stderrEnd), outputTail(stderrEnd)
+}
+
+// outputLines counts a final line without a trailing newline as a line.
+func outputLines(newlines int64, end string) int64 {
+	if end != "" && !strings.HasSuffix(end, "\n") {
+		newlines++
+	}
+	return newlines
+}
+
+// outputTail is the last resultTailLines lines of end, trimmed from the
+// front to resultTailBytes without splitting a UTF-8 sequence.
+func outputTail(end string) string {
+	end = strings.TrimSuffix(end, "\n")
+	i := len(end)
+	for n := 0; n < resultTailLines && i >= 0; n++ {
+		i = strings.LastIndexByte(end[:i], '\n')
+	}
+	end = end[i+1:]
+	if len(end) > resultTailBytes {
+		end = end[len(end)-resultTailBytes:]
+		for len(end) > 0 && !utf8.RuneStart(end[0]) {
+			end = end[1:]
+		}
+	}
+	return end
+}
+
+// InventoryGap is an agent that checks in but whose inventory is stale.
+// LastInventoryAt is 0 if it never sent one.
+type InventoryGap struct {
+	Agent           AgentRecord
+	LastInventoryAt int64
+}
+
+// JobBatch is the recorded resolution of a selector batch: the selector as
+// submitted and the agents it matched then, whether or not each got a job.
+type JobBatch struct {
+	ID        string              `json:"batch_id"`
+	CreatedAt int64               `json:"created_at"`
+	CreatedBy string              `json:"created_by"`
+	Selector  shared.FactSelector `json:"selector"`
+	AgentIDs  []string            `json:"agent_ids"`
+}
+
+// BatchJob is one agent's latest attempt in a batch, with the definition
+// needed to queue it again.
+type BatchJob struct {
+	AgentID string
+	Status  string
+	Job     shared.Job
+}
+
+type JobDetail struct {
+	JobSummary
+	Command        string        `json:"command"`
+	PreCommand     string        `json:"pre_command,omitempty"`
+	PostCommand    string        `json:"post_command,omitempty"`
+	TimeoutSeconds int           `json:"timeout_seconds"`
+	RunAs          *shared.RunAs `json:"run_as,omitempty"`
+	Stdout         string        `json:"stdout"`
+	Stderr         string        `json:"stderr"`
+	Events         []JobEvent    `json:"events"`
+
+	// Encodings of Command and of Stdout/Stderr: "utf8" or "base64". Always
+	// set so clients know whether to decode.
+	CommandEncoding string `json:"command_encoding"`
+	OutputEncoding  string `json:"output_encoding"`
+}
+
+// BlockedJob is a queued job DequeueJobs refused to hand out because its
+// command matched the blocklist.
+type BlockedJob struct {
+	JobID   string
+	Pattern string
+}
+
+// jobStatuses are the statuses a job can be in, in lifecycle order.
+var jobStatuses = []string{"queued", "running", "done", "failed", "timed_out", "interrupted", "blocked"}
+
+// resultStatus is the job status AddResult records for res, and the reason
+// logged with the transition.
+func resultStatus(res shared.JobResult) (status, reason string) {
+	switch {
+	case res.TimedOut:
+		return "timed_out", "result: timed out on agent"
+	case res.Interrupted:
+		return "interrupted", "result: interrupted by agent shutdown"
+	case res.ExitCode != 0:
+		return "failed", fmt.Sprintf("result: exit %d", res.ExitCode)
+	}
+	return "done", "result: exit 0"
+}
+
+// AgentJobCounts is the per-agent job aggregate behind
+// /v1/admin/agents/{id}/job-counts. OldestQueuedAt is 0 when nothing is
+// queued; a growing queue with an old OldestQueuedAt means the agent isn't
+// polling.
+type AgentJobCounts struct {
+	AgentID        string           `json:"agent_id"`
+	Counts         map[string]int64 `json:"counts"`
+	Total          int64            `json:"total"`
+	OldestQueuedAt int64            `json:"oldest_queued_at,omitempty"`
+}
+
+// ErrQueueFull is returned by QueueJob when the agent's queue is at its limit.
+var ErrQueueFull = errors.New("queue full")
+
+// ErrInventoryChecksum is wrapped by the *InventoryChecksumError that
+// inventory reads return when a stored payload no longer hashes to the
+// payload_sha256 recorded when it was written.
+var ErrInventoryChecksum = errors.New("inventory snapshot does not match its checksum")
+
+// InventoryChecksumError names the snapshot that failed verification.
+type InventoryChecksumError struct {
+	AgentID    string
+	SnapshotID string
+}
+
+func (e *InventoryChecksumError) Error() string {
+	return "inventory snapshot " + e.SnapshotID + " of agent " + e.AgentID + " does not match its checksum"
+}
+
+func (e *InventoryChecksumError) Unwrap() error { return ErrInventoryChecksum }
 
-	// AddResult Results
-	AddResult(res shared.JobResult) error
+// verifyInventoryPayload checks a snapshot read back against the sha256
+// stored with it. Snapshots from before payload_sha256 existed have none and
+// pass unchecked.
+func verifyInventoryPayload(agentID, snapshotID, wantSHA256, payload string) error {
+	if wantSHA256 == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(payload))
+	if hex.EncodeToString(sum[:]) != wantSHA256 {
+		return &InventoryChecksumError{AgentID: agentID, SnapshotID: snapshotID}
+	}
+	return nil
+}
+
+// ErrNotSupported is returned by store methods a backend doesn't implement
+// (yet); see PostgresStore.
+var ErrNotSupported = errors.New("not supported by this store")
+
+// QueueDepth is one agent's backlog of queued (not yet polled) jobs.
+type QueueDepth struct {
+	AgentID        string `json:"agent_id"`
+	Hostname       string `json:"hostname"`
+	Queued         int64  `json:"queued"`
+	OldestQueuedAt int64  `json:"oldest_queued_at"`
+}
+
+// JobEvent is one status transition of a job, oldest first.
+type JobEvent struct {
+	ID     int64  `json:"id"`
+	At     int64  `json:"at"`
+	From   string `json:"from"` // "" for the initial queued event
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+// DeadLetterResult is a job result post the server refused, kept so the
+// output the agent tried to report isn't lost. Payload is the request body
+// as received; lists leave it out.
+type DeadLetterResult struct {
+	ID           int64  `json:"id"`
+	ReceivedAt   int64  `json:"received_at"`
+	AgentID      string `json:"agent_id"`
+	JobID        string `json:"job_id"`
+	Reason       string `json:"reason"`
+	PayloadBytes int64  `json:"payload_bytes"`
+	Payload      string `json:"payload,omitempty"`
 }
 
 type AgentRecord struct {
-	AgentID   string
-	PublicKey string
-	Info      shared.AgentInfo
-	Tags      []string
-	LastSeen  int64
+	AgentID         string
+	PublicKey       string
+	Info            shared.AgentInfo
+	Tags            []string
+	LastSeen        int64
+	ApprovalStatus  string
+	ApprovedAt      int64
+	TagsSource      string
+	EnrollTags      []string // assigned by enroll tag rules; also in Tags
+	Capabilities    []string // empty = legacy agent (see shared.LegacyCapabilities)
+	ProtocolVersion int      // 0 = enrolled before version negotiation
+
+	// InventoryParseError is set while the latest inventory couldn't be
+	// turned into facts.
+	InventoryParseError   string
+	InventoryParseErrorAt int64
+
+	// InventoryError is set while the agent reports that its last
+	// inventory collection failed (timed out, collector crashed, ...).
+	InventoryError   string
+	InventoryErrorAt int64
+
+	// JobState is what the agent said its job workers were doing at
+	// LastSeen; nil if it doesn't report that.
+	JobState *shared.AgentJobState
+
+	// DiskFreeBytes (0 = not reported) and DiskPressure are from the
+	// agent's last heartbeat.
+	DiskFreeBytes int64
+	DiskPressure  bool
 }
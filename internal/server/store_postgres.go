@@ -0,0 +1,1704 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"rackroom/internal/shared"
+)
+
+// PostgresStore is the Store for running several rr-server instances on one
+// PostgreSQL database. It implements CoreStore; the AdminStore methods
+// return ErrNotSupported for now.
+//
+// Queries follow SQLiteStore's one for one (same columns, same scan
+// helpers), except where the dialects differ or where SQLite's single writer
+// made something safe that isn't once several servers write at the same
+// time: handing out and reaping jobs skips rows another server has locked,
+// and per-agent checks that were check-then-write take an advisory lock.
+type PostgresStore struct {
+	DB *sql.DB
+
+	scope *txScope // set on the store InTx hands out
+}
+
+func (s *PostgresStore) conn() sqlConn { return storeConn(s.DB, s.scope) }
+
+func (s *PostgresStore) begin() (storeTx, error) { return storeBegin(s.DB, s.scope, nil) }
+
+func (s *PostgresStore) beginTx(opts *sql.TxOptions) (storeTx, error) {
+	return storeBegin(s.DB, s.scope, opts)
+}
+
+// InTx runs fn on a store whose calls all share one transaction (see
+// store_tx.go), committed if fn returns nil.
+func (s *PostgresStore) InTx(fn func(Store) error) error {
+	return runInTx(s.DB, s.scope, func(sc *txScope) Store { return &PostgresStore{DB: s.DB, scope: sc} }, fn)
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{DB: db}
+}
+
+// pgFactsUptimeColumn is factsUptimeColumn in PostgreSQL.
+const pgFactsUptimeColumn = `CASE WHEN f.boot_time > 0
+	THEN GREATEST(EXTRACT(EPOCH FROM now())::bigint - f.boot_time, 0)
+	ELSE COALESCE(f.uptime_seconds, 0) END`
+
+// pgCustomFactsColumn is customFactsColumn for Postgres.
+const pgCustomFactsColumn = `(SELECT json_object_agg(c.name, c.value)::text
+	FROM agent_custom_facts c WHERE c.agent_id = a.id)`
+
+// pgColumn translates the SQLite-only expressions shared column lists and
+// factsQueryFields may contain.
+func pgColumn(col string) string {
+	return strings.NewReplacer(
+		factsUptimeColumn, pgFactsUptimeColumn,
+		customFactsColumn, pgCustomFactsColumn,
+	).Replace(col)
+}
+
+var pgAgentFactsViewColumns = pgColumn(agentFactsViewColumns)
+
+// pgJobSummaryColumns is jobSummaryColumns; timed_out, interrupted and
+// truncated are real booleans here.
+const pgJobSummaryColumns = `j.id, j.target_agent_id, j.kind, j.shell, j.status,
+	r.exit_code,
+	COALESCE(octet_length(r.stdout), 0),
+	COALESCE(octet_length(r.stderr), 0),
+	j.created_at, COALESCE(j.started_at, 0), COALESCE(j.finished_at, 0),
+	COALESCE(r.timed_out, FALSE), COALESCE(r.interrupted, FALSE), COALESCE(r.truncated, FALSE), j.priority, COALESCE(j.batch_id, '')`
+
+// pgResultSummaryColumns is resultSummaryColumns.
+var pgResultSummaryColumns = pgJobSummaryColumns + `,
+	COALESCE(r.output_encoding, ''),
+	length(r.stdout) - length(replace(r.stdout, chr(10), '')),
+	length(r.stderr) - length(replace(r.stderr, chr(10), '')),
+	right(r.stdout, ` + strconv.Itoa(resultTailChars) + `), right(r.stderr, ` + strconv.Itoa(resultTailChars) + `)`
+
+// lockAgentKey takes a transaction-scoped advisory lock on (scope, agentID),
+// serializing the servers' transactions that check and then write state of
+// one agent.
+func lockAgentKey(tx sqlConn, scope, agentID string) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, scope+":"+agentID)
+	return err
+}
+
+func (s *PostgresStore) CreateAgent(publicKey string, info shared.AgentInfo, tags []string, approvalStatus string) (string, error) {
+	// If pubkey already exists, return existing agent id (idempotent enroll)
+	if rec, _ := s.GetAgentByPubKey(publicKey); rec != nil {
+		_ = s.UpdateAgentSeen(rec.AgentID, info, tags)
+		return rec.AgentID, nil
+	}
+
+	if approvalStatus == "" {
+		approvalStatus = ApprovalApproved
+	}
+
+	agentID := newUUID()
+	now := time.Now().Unix()
+	tagsJSON, _ := json.Marshal(tags)
+
+	var approvedAt any
+	if approvalStatus == ApprovalApproved {
+		approvedAt = now
+	}
+
+	_, err := s.conn().Exec(
+		`INSERT INTO agents (id, public_key, hostname, os, arch, tags_json, created_at, last_seen, approval_status, approved_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		agentID, publicKey, info.Hostname, info.OS, info.Arch, string(tagsJSON), now, now, approvalStatus, approvedAt,
+	)
+	return agentID, err
+}
+
+func (s *PostgresStore) GetAgentByID(agentID string) (*AgentRecord, error) {
+	rec, err := scanAgent(s.conn().QueryRow(
+		`SELECT `+agentColumns+`
+		 FROM agents WHERE id = $1`, agentID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rec, err
+}
+
+func (s *PostgresStore) AgentExists(agentID string) (bool, error) {
+	var one int
+	err := s.conn().QueryRow(`SELECT 1 FROM agents WHERE id = $1`, agentID).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *PostgresStore) GetAgentByPubKey(publicKey string) (*AgentRecord, error) {
+	rec, err := scanAgent(s.conn().QueryRow(
+		`SELECT `+agentColumns+`
+		 FROM agents WHERE public_key = $1`, publicKey,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rec, err
+}
+
+func (s *PostgresStore) ListAgentIDsByTag(tag string) ([]string, error) {
+	// tags_json is "null" for an agent that never sent tags; @> is simply
+	// false for it.
+	rows, err := s.conn().Query(
+		`SELECT id FROM agents
+		  WHERE tags_json::jsonb @> jsonb_build_array($1::text)
+		  ORDER BY id`, tag,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) UpdateAgentSeen(agentID string, info shared.AgentInfo, tags []string) error {
+	now := time.Now().Unix()
+
+	// Tags assigned at enroll stay next to the agent's own.
+	var enrollTagsJSON string
+	if err := s.conn().QueryRow(`SELECT enroll_tags_json FROM agents WHERE id=$1`, agentID).Scan(&enrollTagsJSON); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	tagsJSON, _ := json.Marshal(withEnrollTags(tags, enrollTagsJSON))
+
+	// Server-set tags take precedence over what the agent declares.
+	_, err := s.conn().Exec(
+		`UPDATE agents
+		 SET hostname=$1, os=$2, arch=$3,
+		     tags_json=CASE WHEN tags_source='server' THEN tags_json ELSE $4 END,
+		     last_seen=$5
+		 WHERE id=$6`,
+		info.Hostname, info.OS, info.Arch, string(tagsJSON), now, agentID,
+	)
+	return err
+}
+
+func (s *PostgresStore) SetAgentCapabilities(agentID string, capabilities []string) error {
+	if capabilities == nil {
+		capabilities = []string{}
+	}
+	capsJSON, _ := json.Marshal(capabilities)
+	_, err := s.conn().Exec(`UPDATE agents SET capabilities_json=$1 WHERE id=$2`, string(capsJSON), agentID)
+	return err
+}
+
+func (s *PostgresStore) SetAgentProtocolVersion(agentID string, version int) error {
+	_, err := s.conn().Exec(`UPDATE agents SET protocol_version=$1 WHERE id=$2`, version, agentID)
+	return err
+}
+
+func (s *PostgresStore) SetAgentHMACSecret(agentID, secret string) error {
+	_, err := s.conn().Exec(`UPDATE agents SET hmac_secret=$1 WHERE id=$2`,
+		sql.NullString{String: secret, Valid: secret != ""}, agentID)
+	return err
+}
+
+func (s *PostgresStore) GetAgentHMACSecret(agentID string) (string, error) {
+	var secret string
+	err := s.conn().QueryRow(`SELECT COALESCE(hmac_secret, '') FROM agents WHERE id=$1`, agentID).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return secret, err
+}
+
+func (s *PostgresStore) SetAgentInventoryParseError(agentID, msg string) error {
+	if msg == "" {
+		_, err := s.conn().Exec(`UPDATE agents SET inventory_parse_error=NULL, inventory_parse_error_at=NULL
+		                      WHERE id=$1 AND inventory_parse_error IS NOT NULL`, agentID)
+		return err
+	}
+	_, err := s.conn().Exec(`UPDATE agents SET inventory_parse_error=$1, inventory_parse_error_at=$2 WHERE id=$3`,
+		msg, time.Now().Unix(), agentID)
+	return err
+}
+
+func (s *PostgresStore) SetAgentInventoryError(agentID, msg string) error {
+	if msg == "" {
+		_, err := s.conn().Exec(`UPDATE agents SET inventory_error=NULL, inventory_error_at=NULL
+		                      WHERE id=$1 AND inventory_error IS NOT NULL`, agentID)
+		return err
+	}
+	_, err := s.conn().Exec(`UPDATE agents SET inventory_error=$1, inventory_error_at=$2
+	                      WHERE id=$3 AND inventory_error IS DISTINCT FROM $1`,
+		msg, time.Now().Unix(), agentID)
+	return err
+}
+
+func (s *PostgresStore) SetAgentTags(agentID string, tags []string) (bool, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, _ := json.Marshal(tags)
+
+	res, err := s.conn().Exec(
+		`UPDATE agents SET tags_json=$1, tags_source=$2 WHERE id=$3`,
+		string(tagsJSON), TagsSourceServer, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *PostgresStore) EditAgentTags(agentIDs, add, remove []string) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changed := []string{}
+	for _, id := range agentIDs {
+		var tagsJSON string
+		err := tx.QueryRow(`SELECT tags_json FROM agents WHERE id=$1 FOR UPDATE`, id).Scan(&tagsJSON)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		_ = json.Unmarshal([]byte(tagsJSON), &tags)
+		edited, ok := editTags(tags, add, remove)
+		if !ok {
+			continue
+		}
+		editedJSON, _ := json.Marshal(edited)
+		if _, err := tx.Exec(`UPDATE agents SET tags_json=$1, tags_source=$2 WHERE id=$3`,
+			string(editedJSON), TagsSourceServer, id); err != nil {
+			return nil, err
+		}
+		changed = append(changed, id)
+	}
+	return changed, tx.Commit()
+}
+
+func (s *PostgresStore) SetAgentEnrollTags(agentID string, tags []string, override bool) error {
+	enrollTagsJSON, _ := json.Marshal(normalizeTags(tags))
+	if override {
+		_, err := s.conn().Exec(
+			`UPDATE agents SET enroll_tags_json=$1, tags_json=$2, tags_source=$3 WHERE id=$4`,
+			string(enrollTagsJSON), string(enrollTagsJSON), TagsSourceServer, agentID,
+		)
+		return err
+	}
+
+	var tagsJSON string
+	if err := s.conn().QueryRow(`SELECT tags_json FROM agents WHERE id=$1`, agentID).Scan(&tagsJSON); err != nil {
+		return err
+	}
+	var current []string
+	_ = json.Unmarshal([]byte(tagsJSON), &current)
+	merged, _ := json.Marshal(withEnrollTags(current, string(enrollTagsJSON)))
+	_, err := s.conn().Exec(
+		`UPDATE agents
+		 SET enroll_tags_json=$1, tags_json=CASE WHEN tags_source='server' THEN tags_json ELSE $2 END
+		 WHERE id=$3`,
+		string(enrollTagsJSON), string(merged), agentID,
+	)
+	return err
+}
+
+func (s *PostgresStore) ReleaseAgentTags(agentID string) (bool, error) {
+	res, err := s.conn().Exec(`UPDATE agents SET tags_source=$1 WHERE id=$2`, TagsSourceAgent, agentID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *PostgresStore) QueueJob(agentID string, job shared.Job, maxQueued int) error {
+	now := time.Now().Unix()
+
+	var runAsUser, runAsCred sql.NullString
+	if job.RunAs != nil {
+		runAsUser = sql.NullString{String: job.RunAs.User, Valid: true}
+		runAsCred = sql.NullString{String: job.RunAs.Credential, Valid: job.RunAs.Credential != ""}
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Under READ COMMITTED two submits would both count the same queue, so
+	// the count and the insert are serialized per agent.
+	if maxQueued > 0 {
+		if err := lockAgentKey(tx, "queue", agentID); err != nil {
+			return err
+		}
+		var queued int
+		if err := tx.QueryRow(
+			`SELECT COUNT(*) FROM jobs WHERE target_agent_id = $1 AND status = 'queued'`, agentID,
+		).Scan(&queued); err != nil {
+			return err
+		}
+		if queued >= maxQueued {
+			return ErrQueueFull
+		}
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO jobs (id, target_agent_id, kind, shell, command, timeout_seconds, status, created_at,
+		                   run_as_user, run_as_credential, confirm, priority, batch_id, command_encoding,
+		                   pre_command, post_command)
+		 VALUES ($1, $2, $3, $4, $5, $6, 'queued', $7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		job.JobID, agentID, job.Kind, job.Shell, job.Command, job.TimeoutSeconds, now,
+		runAsUser, runAsCred, sql.NullString{String: job.Confirm, Valid: job.Confirm != ""}, job.Priority,
+		sql.NullString{String: job.BatchID, Valid: job.BatchID != ""},
+		sql.NullString{String: job.CommandEncoding, Valid: job.CommandEncoding != ""},
+		sql.NullString{String: job.PreCommand, Valid: job.PreCommand != ""},
+		sql.NullString{String: job.PostCommand, Valid: job.PostCommand != ""},
+	); err != nil {
+		return err
+	}
+	if err := pgAddJobEvent(tx, job.JobID, now, "", "queued", "submitted"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pgAddJobEvent is addJobEvent in PostgreSQL.
+func pgAddJobEvent(tx sqlConn, jobID string, at int64, from, to, reason string) error {
+	_, err := tx.Exec(
+		`INSERT INTO job_events (job_id, at, from_status, to_status, reason) VALUES ($1, $2, $3, $4, $5)`,
+		jobID, at, from, to, reason,
+	)
+	return err
+}
+
+// DequeueJobs selects and marks jobs in one transaction, skipping rows
+// another server is handing out right now, so a job can't go out twice.
+// Unlike SQLiteStore, jobs are only returned once marking them committed.
+func (s *PostgresStore) DequeueJobs(agentID string, max int, blocklist *CommandBlocklist) ([]shared.Job, []BlockedJob, error) {
+	if max <= 0 {
+		max = 5
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Grab queued jobs, most urgent first; agents still pending approval get nothing
+	rows, err := tx.Query(
+		`SELECT id, kind, shell, command, timeout_seconds, run_as_user, run_as_credential, COALESCE(confirm, ''), priority, COALESCE(batch_id, ''),
+		        COALESCE(command_encoding, ''), COALESCE(pre_command, ''), COALESCE(post_command, '')
+		 FROM jobs
+		 WHERE target_agent_id = $1 AND status = 'queued'
+		   AND EXISTS (SELECT 1 FROM agents a WHERE a.id = jobs.target_agent_id AND a.approval_status = 'approved')
+		 ORDER BY priority DESC, created_at
+		 LIMIT $2
+		 FOR UPDATE SKIP LOCKED`, agentID, max,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var jobs []shared.Job
+	var blocked []BlockedJob
+	for rows.Next() {
+		var j shared.Job
+		var runAsUser, runAsCred sql.NullString
+		if err := rows.Scan(&j.JobID, &j.Kind, &j.Shell, &j.Command, &j.TimeoutSeconds, &runAsUser, &runAsCred, &j.Confirm, &j.Priority, &j.BatchID, &j.CommandEncoding,
+			&j.PreCommand, &j.PostCommand); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		j.RunAs = scanRunAs(runAsUser, runAsCred)
+		if pattern := blocklist.MatchAny(policyCommands(j)); pattern != "" {
+			blocked = append(blocked, BlockedJob{JobID: j.JobID, Pattern: pattern})
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || (len(jobs) == 0 && len(blocked) == 0) {
+		return jobs, nil, err
+	}
+
+	now := time.Now().Unix()
+	for _, b := range blocked {
+		if _, err := tx.Exec(`UPDATE jobs SET status='blocked', finished_at=$1 WHERE id=$2`, now, b.JobID); err != nil {
+			return nil, nil, err
+		}
+		if err := pgAddJobEvent(tx, b.JobID, now, "queued", "blocked", "matched command blocklist: "+b.Pattern); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, j := range jobs {
+		if _, err := tx.Exec(`UPDATE jobs SET status='running', started_at=$1 WHERE id=$2`, now, j.JobID); err != nil {
+			return nil, nil, err
+		}
+		if err := pgAddJobEvent(tx, j.JobID, now, "queued", "running", "dequeued by agent"); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return jobs, blocked, nil
+}
+
+func (s *PostgresStore) JobTarget(jobID string) (string, bool, error) {
+	var agentID string
+	err := s.conn().QueryRow(`SELECT target_agent_id FROM jobs WHERE id = $1`, jobID).Scan(&agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return agentID, err == nil, err
+}
+
+func (s *PostgresStore) AddResult(res shared.JobResult) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Store result; the first one recorded for a job stands
+	ins, err := tx.Exec(
+		`INSERT INTO job_results (job_id, agent_id, exit_code, stdout, stderr, started_at, finished_at, timed_out, interrupted, truncated, output_encoding)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		 ON CONFLICT (job_id) DO NOTHING`,
+		res.JobID, res.AgentID, res.ExitCode, res.Stdout, res.Stderr, res.StartedAt, res.FinishedAt, res.TimedOut, res.Interrupted, res.Truncated,
+		sql.NullString{String: res.OutputEncoding, Valid: res.OutputEncoding != ""},
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, err := ins.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	// Update job status
+	status, reason := resultStatus(res)
+	var prev string
+	if err := tx.QueryRow(`SELECT status FROM jobs WHERE id=$1 FOR UPDATE`, res.JobID).Scan(&prev); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE jobs SET status=$1, finished_at=$2 WHERE id=$3`, status, res.FinishedAt, res.JobID); err != nil {
+		return false, err
+	}
+	if err := pgAddJobEvent(tx, res.JobID, time.Now().Unix(), prev, status, reason); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ReapStaleJobs is SQLiteStore.ReapStaleJobs; every server runs the reaper,
+// and rows one of them is reaping are skipped by the others.
+func (s *PostgresStore) ReapStaleJobs(now, graceSeconds int64) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		// Each hook runs with its own timeout_seconds on top of the command's.
+		`SELECT id FROM jobs
+		  WHERE status = 'running' AND started_at IS NOT NULL
+		    AND started_at + timeout_seconds * (1 + (pre_command IS NOT NULL)::int + (post_command IS NOT NULL)::int) + $1 < $2
+		  FOR UPDATE SKIP LOCKED`,
+		graceSeconds, now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	reason := fmt.Sprintf("reaped: no result within timeout + %ds", graceSeconds)
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE jobs SET status='failed', finished_at=$1 WHERE id=$2`, now, id); err != nil {
+			return nil, err
+		}
+		if err := pgAddJobEvent(tx, id, now, "running", "failed", reason); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// scanIDs reads a single string column and closes rows.
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *PostgresStore) ListJobEvents(jobID string) ([]JobEvent, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, at, from_status, to_status, reason FROM job_events WHERE job_id = $1 ORDER BY id`, jobID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []JobEvent{}
+	for rows.Next() {
+		var e JobEvent
+		if err := rows.Scan(&e.ID, &e.At, &e.From, &e.To, &e.Reason); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) AddDeadLetterResult(d DeadLetterResult) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO dead_letter_results (received_at, agent_id, job_id, reason, payload) VALUES ($1, $2, $3, $4, $5)`,
+		d.ReceivedAt, d.AgentID, d.JobID, d.Reason, d.Payload,
+	)
+	return err
+}
+
+func (s *PostgresStore) ListDeadLetterResults(limit int) ([]DeadLetterResult, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT id, received_at, agent_id, job_id, reason, octet_length(payload)
+		   FROM dead_letter_results ORDER BY id DESC LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DeadLetterResult{}
+	for rows.Next() {
+		var d DeadLetterResult
+		if err := rows.Scan(&d.ID, &d.ReceivedAt, &d.AgentID, &d.JobID, &d.Reason, &d.PayloadBytes); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) GetDeadLetterResult(id int64) (*DeadLetterResult, error) {
+	var d DeadLetterResult
+	err := s.conn().QueryRow(
+		`SELECT id, received_at, agent_id, job_id, reason, octet_length(payload), payload
+		   FROM dead_letter_results WHERE id = $1`, id,
+	).Scan(&d.ID, &d.ReceivedAt, &d.AgentID, &d.JobID, &d.Reason, &d.PayloadBytes, &d.Payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *PostgresStore) ListJobSummaries(f JobListFilter) ([]JobSummary, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Offset < 0 {
+		f.Offset = 0
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT `+pgJobSummaryColumns+`
+		   FROM jobs j
+		   LEFT JOIN job_results r ON r.job_id = j.id
+		  WHERE ($1 = '' OR j.target_agent_id = $1)
+		    AND ($2 = '' OR j.status = $2)
+		    AND ($3 = '' OR j.batch_id = $3)
+		  ORDER BY j.created_at DESC, j.id
+		  LIMIT $4 OFFSET $5`,
+		f.AgentID, f.Status, f.BatchID, f.Limit, f.Offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanJobSummaries(rows)
+}
+
+// scanJobSummaries reads pgJobSummaryColumns rows and closes rows.
+func scanJobSummaries(rows *sql.Rows) ([]JobSummary, error) {
+	defer rows.Close()
+	out := []JobSummary{}
+	for rows.Next() {
+		js, err := scanJobSummary(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *js)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) ListAgentResults(agentID string, limit int) ([]ResultSummary, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+pgResultSummaryColumns+`
+		   FROM jobs j
+		   JOIN job_results r ON r.job_id = j.id
+		  WHERE j.target_agent_id = $1
+		  ORDER BY r.finished_at DESC, j.id
+		  LIMIT $2`,
+		agentID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanResultSummaries(rows)
+}
+
+func (s *PostgresStore) GetJobDetail(jobID string) (*JobDetail, error) {
+	var d JobDetail
+	var runAsUser, runAsCred sql.NullString
+	js, err := scanJobSummary(s.conn().QueryRow(
+		`SELECT `+pgJobSummaryColumns+`,
+		        j.command, COALESCE(j.command_encoding, ''), j.timeout_seconds, j.run_as_user, j.run_as_credential,
+		        COALESCE(j.pre_command, ''), COALESCE(j.post_command, ''),
+		        COALESCE(r.stdout, ''), COALESCE(r.stderr, ''), COALESCE(r.output_encoding, '')
+		   FROM jobs j
+		   LEFT JOIN job_results r ON r.job_id = j.id
+		  WHERE j.id = $1`, jobID,
+	), &d.Command, &d.CommandEncoding, &d.TimeoutSeconds, &runAsUser, &runAsCred, &d.PreCommand, &d.PostCommand,
+		&d.Stdout, &d.Stderr, &d.OutputEncoding)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	d.JobSummary = *js
+	d.RunAs = scanRunAs(runAsUser, runAsCred)
+	if d.CommandEncoding == "" {
+		d.CommandEncoding = shared.PayloadEncodingUTF8
+	}
+	if d.OutputEncoding == "" {
+		d.OutputEncoding = shared.PayloadEncodingUTF8
+	}
+	if d.Events, err = s.ListJobEvents(jobID); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *PostgresStore) LatestBatchJobs(batchID string) ([]BatchJob, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, target_agent_id, status, kind, shell, command, timeout_seconds,
+		        run_as_user, run_as_credential, priority, COALESCE(command_encoding, ''),
+		        COALESCE(pre_command, ''), COALESCE(post_command, '')
+		   FROM (
+		     SELECT j.*,
+		            ROW_NUMBER() OVER (PARTITION BY target_agent_id ORDER BY created_at DESC, seq DESC) AS rn
+		       FROM jobs j WHERE batch_id = $1
+		   ) latest
+		  WHERE rn = 1
+		  ORDER BY created_at, seq`, batchID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []BatchJob
+	for rows.Next() {
+		var (
+			bj                   BatchJob
+			runAsUser, runAsCred sql.NullString
+		)
+		if err := rows.Scan(&bj.Job.JobID, &bj.AgentID, &bj.Status, &bj.Job.Kind, &bj.Job.Shell, &bj.Job.Command,
+			&bj.Job.TimeoutSeconds, &runAsUser, &runAsCred, &bj.Job.Priority, &bj.Job.CommandEncoding,
+			&bj.Job.PreCommand, &bj.Job.PostCommand); err != nil {
+			return nil, err
+		}
+		bj.Job.RunAs = scanRunAs(runAsUser, runAsCred)
+		bj.Job.BatchID = batchID
+		out = append(out, bj)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) CreateJobBatch(b JobBatch) error {
+	selJSON, err := json.Marshal(b.Selector)
+	if err != nil {
+		return err
+	}
+	idsJSON, err := json.Marshal(b.AgentIDs)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn().Exec(
+		`INSERT INTO job_batches (id, created_at, created_by, selector_json, agent_ids_json) VALUES ($1, $2, $3, $4, $5)`,
+		b.ID, b.CreatedAt, b.CreatedBy, string(selJSON), string(idsJSON),
+	)
+	return err
+}
+
+func (s *PostgresStore) GetJobBatch(id string) (*JobBatch, error) {
+	var (
+		b                JobBatch
+		selJSON, idsJSON string
+	)
+	err := s.conn().QueryRow(
+		`SELECT id, created_at, created_by, selector_json, agent_ids_json FROM job_batches WHERE id = $1`, id,
+	).Scan(&b.ID, &b.CreatedAt, &b.CreatedBy, &selJSON, &idsJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(selJSON), &b.Selector); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(idsJSON), &b.AgentIDs); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *PostgresStore) ListQueueDepths(limit int) ([]QueueDepth, error) {
+	rows, err := s.conn().Query(
+		`SELECT j.target_agent_id, COALESCE(a.hostname, ''), COUNT(*), MIN(j.created_at)
+		   FROM jobs j
+		   LEFT JOIN agents a ON a.id = j.target_agent_id
+		  WHERE j.status = 'queued'
+		  GROUP BY j.target_agent_id, a.hostname
+		  ORDER BY COUNT(*) DESC, MIN(j.created_at)
+		  LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []QueueDepth{}
+	for rows.Next() {
+		var q QueueDepth
+		if err := rows.Scan(&q.AgentID, &q.Hostname, &q.Queued, &q.OldestQueuedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) AgentJobCounts(agentID string) (*AgentJobCounts, error) {
+	out := &AgentJobCounts{AgentID: agentID, Counts: map[string]int64{}}
+	for _, st := range jobStatuses {
+		out.Counts[st] = 0
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT status, COUNT(*), MIN(created_at) FROM jobs WHERE target_agent_id = $1 GROUP BY status`,
+		agentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			status string
+			n      int64
+			oldest int64
+		)
+		if err := rows.Scan(&status, &n, &oldest); err != nil {
+			return nil, err
+		}
+		out.Counts[status] = n
+		out.Total += n
+		if status == "queued" {
+			out.OldestQueuedAt = oldest
+		}
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) AddInventorySnapshot(agentID string, payloadJSON string) error {
+	now := time.Now().Unix()
+	sum := sha256.Sum256([]byte(payloadJSON))
+	hash := hex.EncodeToString(sum[:])
+
+	// As in SQLiteStore, two heartbeats resending the same inventory must
+	// not both store it; here that takes a lock, not just the transaction.
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := lockAgentKey(tx, "inventory", agentID); err != nil {
+		return err
+	}
+
+	var latestID, latestHash string
+	err = tx.QueryRow(
+		`SELECT id, COALESCE(payload_sha256, '')
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id = $1
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`, agentID,
+	).Scan(&latestID, &latestHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if latestHash == hash {
+		_, err = tx.Exec(
+			`UPDATE agent_inventory_snapshots SET last_seen_identical_at = $1 WHERE id = $2`,
+			now, latestID,
+		)
+	} else {
+		_, err = tx.Exec(
+			`INSERT INTO agent_inventory_snapshots (id, agent_id, created_at, payload_json, payload_sha256)
+			 VALUES ($1, $2, $3, $4, $5)`,
+			newUUID(), agentID, now, payloadJSON, hash,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAgentDetail reads in one REPEATABLE READ transaction; under PostgreSQL's
+// default READ COMMITTED each statement would see its own snapshot.
+func (s *PostgresStore) GetAgentDetail(agentID string) (*AgentDetail, error) {
+	tx, err := s.beginTx(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rec, err := scanAgent(tx.QueryRow(
+		`SELECT `+agentColumns+`
+		 FROM agents WHERE id = $1`, agentID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &AgentDetail{Agent: *rec}
+
+	v, err := scanAgentFactsView(tx.QueryRow(
+		`SELECT `+pgAgentFactsViewColumns+`
+		 FROM agents a
+		 JOIN agent_facts f ON f.agent_id = a.id
+		 WHERE a.id = $1`, agentID,
+	))
+	switch {
+	case err == nil:
+		d.Facts = v
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	var ref InventoryRef
+	err = tx.QueryRow(
+		`SELECT id, created_at, octet_length(payload_json), COALESCE(payload_sha256, ''),
+		        COALESCE(last_seen_identical_at, 0)
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id = $1
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`, agentID,
+	).Scan(&ref.SnapshotID, &ref.CreatedAt, &ref.SizeBytes, &ref.SHA256, &ref.LastSeenIdenticalAt)
+	switch {
+	case err == nil:
+		d.LatestInventory = &ref
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (s *PostgresStore) GetLatestInventorySnapshot(agentID string) (string, error) {
+	var id, sum, payload string
+	err := s.conn().QueryRow(
+		`SELECT id, COALESCE(payload_sha256, ''), payload_json
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id=$1
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`,
+		agentID,
+	).Scan(&id, &sum, &payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := verifyInventoryPayload(agentID, id, sum, payload); err != nil {
+		return "", err
+	}
+	return payload, nil
+}
+
+func (s *PostgresStore) GetInventorySnapshotAt(agentID string, at int64) (*InventoryRef, string, error) {
+	var (
+		ref     InventoryRef
+		payload string
+	)
+	err := s.conn().QueryRow(
+		`SELECT id, created_at, octet_length(payload_json), COALESCE(payload_sha256, ''),
+		        COALESCE(last_seen_identical_at, 0), payload_json
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id = $1 AND created_at <= $2
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`, agentID, at,
+	).Scan(&ref.SnapshotID, &ref.CreatedAt, &ref.SizeBytes, &ref.SHA256, &ref.LastSeenIdenticalAt, &payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verifyInventoryPayload(agentID, ref.SnapshotID, ref.SHA256, payload); err != nil {
+		return nil, "", err
+	}
+	return &ref, payload, nil
+}
+
+// scanAgents reads agentColumns rows and closes rows.
+func scanAgents(rows *sql.Rows) ([]AgentRecord, error) {
+	defer rows.Close()
+	var out []AgentRecord
+	for rows.Next() {
+		rec, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *rec)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) ListAgents(limit int) ([]AgentRecord, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`
+		 FROM agents
+		 ORDER BY last_seen DESC
+		 LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgents(rows)
+}
+
+func (s *PostgresStore) ListAgentsByApproval(status string, limit int) ([]AgentRecord, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`
+		 FROM agents
+		 WHERE approval_status = $1
+		 ORDER BY created_at
+		 LIMIT $2`, status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgents(rows)
+}
+
+func (s *PostgresStore) ApproveAgent(agentID string) (bool, error) {
+	res, err := s.conn().Exec(
+		`UPDATE agents
+		 SET approval_status=$1, approved_at=COALESCE(approved_at, $2)
+		 WHERE id=$3 AND approval_status=$4`,
+		ApprovalApproved, time.Now().Unix(), agentID, ApprovalPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *PostgresStore) SetAgentDisabled(agentID string, disabled bool) (bool, error) {
+	q := `UPDATE agents SET approval_status=$1 WHERE id=$2`
+	args := []any{ApprovalDisabled, agentID}
+	if !disabled {
+		q = `UPDATE agents
+		     SET approval_status=CASE WHEN approved_at IS NULL THEN $1 ELSE $2 END
+		     WHERE id=$3 AND approval_status=$4`
+		args = []any{ApprovalPending, ApprovalApproved, agentID, ApprovalDisabled}
+	}
+	res, err := s.conn().Exec(q, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+	// Enabling an agent that isn't disabled matches no rows; still "found".
+	rec, err := s.GetAgentByID(agentID)
+	return rec != nil, err
+}
+
+func (s *PostgresStore) DeleteAgent(agentID string) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		`DELETE FROM job_results
+		 WHERE agent_id = $1 OR job_id IN (SELECT id FROM jobs WHERE target_agent_id = $1)`,
+		`DELETE FROM job_events WHERE job_id IN (SELECT id FROM jobs WHERE target_agent_id = $1)`,
+		`DELETE FROM jobs WHERE target_agent_id = $1`,
+		`DELETE FROM agent_inventory_snapshots WHERE agent_id = $1`,
+		`DELETE FROM agent_facts WHERE agent_id = $1`,
+		`DELETE FROM agent_custom_facts WHERE agent_id = $1`,
+		`DELETE FROM agent_status_events WHERE agent_id = $1`,
+		`DELETE FROM agent_group_members WHERE agent_id = $1`,
+	} {
+		if _, err := tx.Exec(q, agentID); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM agents WHERE id = $1`, agentID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, tx.Commit()
+}
+
+func (s *PostgresStore) MarkAgentOnline(agentID string, at int64) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// A concurrent UPDATE of the row waits for ours and then re-checks
+	// liveness, so only one server records the transition.
+	res, err := tx.Exec(
+		`UPDATE agents SET liveness=$1 WHERE id=$2 AND liveness != $1`,
+		LivenessOnline, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO agent_status_events (agent_id, status, at) VALUES ($1, $2, $3)`,
+		agentID, LivenessOnline, at,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (s *PostgresStore) MarkStaleAgentsOffline(seenBefore, at int64) ([]string, error) {
+	return s.transitionAgents(
+		`SELECT id FROM agents WHERE liveness IN ($1, $2) AND last_seen < $3`,
+		[]any{LivenessOnline, LivenessLate, seenBefore},
+		LivenessOffline, at,
+	)
+}
+
+func (s *PostgresStore) SetAgentHeartbeatInterval(agentID string, seconds int) error {
+	_, err := s.conn().Exec(`UPDATE agents SET heartbeat_interval_seconds=$1 WHERE id=$2`, seconds, agentID)
+	return err
+}
+
+func (s *PostgresStore) SetAgentDiskState(agentID string, freeBytes int64, pressure bool) (bool, error) {
+	res, err := s.conn().Exec(`UPDATE agents SET disk_pressure=$1 WHERE id=$2 AND disk_pressure != $1`, pressure, agentID)
+	if err != nil {
+		return false, err
+	}
+	changed, _ := res.RowsAffected()
+	free := sql.NullInt64{Int64: freeBytes, Valid: freeBytes > 0}
+	if _, err := s.conn().Exec(`UPDATE agents SET disk_free_bytes=$1 WHERE id=$2`, free, agentID); err != nil {
+		return false, err
+	}
+	return changed > 0, nil
+}
+
+func (s *PostgresStore) SetAgentJobState(agentID string, st *shared.AgentJobState) error {
+	_, err := s.conn().Exec(`UPDATE agents SET job_state_json=$1 WHERE id=$2`, jobStateJSON(st), agentID)
+	return err
+}
+
+func (s *PostgresStore) MarkLateAgents(missed int, at int64) ([]string, error) {
+	return s.transitionAgents(
+		`SELECT id FROM agents
+		  WHERE liveness = $1 AND heartbeat_interval_seconds > 0
+		    AND last_seen < $2 - heartbeat_interval_seconds * $3`,
+		[]any{LivenessOnline, at, missed},
+		LivenessLate, at,
+	)
+}
+
+// transitionAgents is SQLiteStore.transitionAgents; every server runs the
+// liveness monitor, so rows another server is transitioning are skipped.
+func (s *PostgresStore) transitionAgents(query string, args []any, to string, at int64) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query+` FOR UPDATE SKIP LOCKED`, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE agents SET liveness=$1 WHERE id=$2`, to, id); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO agent_status_events (agent_id, status, at) VALUES ($1, $2, $3)`,
+			id, to, at,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+func (s *PostgresStore) ListAgentStatusEvents(agentID string, afterID int64, limit int) ([]AgentStatusEvent, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT e.id, e.agent_id, COALESCE(a.hostname, ''), e.status, e.at
+		   FROM agent_status_events e
+		   LEFT JOIN agents a ON a.id = e.agent_id
+		  WHERE ($1 = '' OR e.agent_id = $1) AND e.id > $2
+		  ORDER BY e.id
+		  LIMIT $3`, agentID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AgentStatusEvent{}
+	for rows.Next() {
+		var ev AgentStatusEvent
+		if err := rows.Scan(&ev.ID, &ev.AgentID, &ev.Hostname, &ev.Status, &ev.At); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) ListStaleAgents(seenBefore int64, limit int) ([]AgentRecord, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`
+		 FROM agents
+		 WHERE last_seen < $1
+		 ORDER BY last_seen
+		 LIMIT $2`, seenBefore, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgents(rows)
+}
+
+func (s *PostgresStore) ListAgentsMissingInventory(seenAfter, inventoryBefore int64, limit int) ([]InventoryGap, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`, COALESCE(inv.at, 0)
+		   FROM agents
+		   LEFT JOIN (
+		     SELECT agent_id, MAX(COALESCE(last_seen_identical_at, created_at)) AS at
+		       FROM agent_inventory_snapshots
+		      GROUP BY agent_id
+		   ) inv ON inv.agent_id = agents.id
+		  WHERE agents.last_seen >= $1 AND (inv.at IS NULL OR inv.at < $2)
+		  ORDER BY COALESCE(inv.at, 0), agents.last_seen DESC
+		  LIMIT $3`, seenAfter, inventoryBefore, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []InventoryGap{}
+	for rows.Next() {
+		var g InventoryGap
+		rec, err := scanAgent(rows, &g.LastInventoryAt)
+		if err != nil {
+			return nil, err
+		}
+		g.Agent = *rec
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) UpsertAgentFacts(f AgentFacts) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO agent_facts (
+			agent_id, updated_at,
+			os_caption, os_version, os_build,
+			cpu_name, cpu_cores, cpu_logical,
+			ram_total_bytes, ram_free_bytes,
+			uptime_seconds, boot_time, ipv4_primary,
+			disk_total_bytes, disk_free_bytes,
+			timezone, utc_offset_minutes, locale,
+			updates_pending, gateways_json, dns_servers_json
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+		ON CONFLICT (agent_id) DO UPDATE SET
+			updated_at=excluded.updated_at,
+			os_caption=excluded.os_caption,
+			os_version=excluded.os_version,
+			os_build=excluded.os_build,
+			cpu_name=excluded.cpu_name,
+			cpu_cores=excluded.cpu_cores,
+			cpu_logical=excluded.cpu_logical,
+			ram_total_bytes=excluded.ram_total_bytes,
+			ram_free_bytes=excluded.ram_free_bytes,
+			uptime_seconds=excluded.uptime_seconds,
+			boot_time=excluded.boot_time,
+			ipv4_primary=excluded.ipv4_primary,
+			disk_total_bytes=excluded.disk_total_bytes,
+			disk_free_bytes=excluded.disk_free_bytes,
+			timezone=excluded.timezone,
+			utc_offset_minutes=excluded.utc_offset_minutes,
+			locale=excluded.locale,
+			updates_pending=excluded.updates_pending,
+			gateways_json=excluded.gateways_json,
+			dns_servers_json=excluded.dns_servers_json
+		`,
+		f.AgentID, f.UpdatedAt,
+		f.OSCaption, f.OSVersion, f.OSBuild,
+		f.CPUName, f.CPUCores, f.CPULogical,
+		f.RAMTotalBytes, f.RAMFreeBytes,
+		f.UptimeSeconds, f.BootTime, f.IPv4Primary,
+		f.DiskTotalBytes, f.DiskFreeBytes,
+		f.Timezone, f.UTCOffsetMinutes, f.Locale,
+		f.UpdatesPending, stringListJSON(f.Gateways), stringListJSON(f.DNSServers),
+	)
+	return err
+}
+
+func (s *PostgresStore) UpdateAgentQuickFacts(agentID string, q shared.QuickFacts) error {
+	_, err := s.conn().Exec(
+		`UPDATE agent_facts SET
+			ram_total_bytes=COALESCE(NULLIF($1::bigint, 0), ram_total_bytes),
+			ram_free_bytes=COALESCE(NULLIF($2::bigint, 0), ram_free_bytes),
+			disk_total_bytes=COALESCE(NULLIF($3::bigint, 0), disk_total_bytes),
+			disk_free_bytes=COALESCE(NULLIF($4::bigint, 0), disk_free_bytes),
+			uptime_seconds=COALESCE(NULLIF($5::bigint, 0), uptime_seconds),
+			boot_time=COALESCE(NULLIF($6::bigint, 0), boot_time),
+			quick_facts_at=$7
+		WHERE agent_id=$8`,
+		q.RAMTotalBytes, q.RAMFreeBytes, q.DiskTotalBytes, q.DiskFreeBytes,
+		q.UptimeSeconds, q.BootTime, q.CollectedAt, agentID,
+	)
+	return err
+}
+
+func (s *PostgresStore) SetAgentCustomFacts(agentID string, facts map[string]string, at int64) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM agent_custom_facts WHERE agent_id = $1`, agentID); err != nil {
+		return err
+	}
+	for name, value := range facts {
+		if _, err := tx.Exec(
+			`INSERT INTO agent_custom_facts (agent_id, name, value, updated_at) VALUES ($1, $2, $3, $4)`,
+			agentID, name, value, at,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// pgAgentFactsColumns is the column list scanned by scanAgentFacts (from
+// agent_facts f).
+var pgAgentFactsColumns = `agent_id, updated_at,
+	COALESCE(os_caption, ''), COALESCE(os_version, ''), COALESCE(os_build, ''),
+	COALESCE(cpu_name, ''), COALESCE(cpu_cores, 0), COALESCE(cpu_logical, 0),
+	COALESCE(ram_total_bytes, 0), COALESCE(ram_free_bytes, 0),
+	` + pgFactsUptimeColumn + `, COALESCE(boot_time, 0), COALESCE(ipv4_primary, ''),
+	COALESCE(disk_total_bytes, 0), COALESCE(disk_free_bytes, 0),
+	COALESCE(timezone, ''), COALESCE(utc_offset_minutes, 0), COALESCE(locale, ''),
+	updates_pending, gateways_json, dns_servers_json`
+
+func scanAgentFacts(row rowScanner) (*AgentFacts, error) {
+	var f AgentFacts
+	var updates sql.NullInt64
+	var gateways, dns sql.NullString
+	if err := row.Scan(
+		&f.AgentID, &f.UpdatedAt,
+		&f.OSCaption, &f.OSVersion, &f.OSBuild,
+		&f.CPUName, &f.CPUCores, &f.CPULogical,
+		&f.RAMTotalBytes, &f.RAMFreeBytes,
+		&f.UptimeSeconds, &f.BootTime, &f.IPv4Primary,
+		&f.DiskTotalBytes, &f.DiskFreeBytes,
+		&f.Timezone, &f.UTCOffsetMinutes, &f.Locale,
+		&updates, &gateways, &dns,
+	); err != nil {
+		return nil, err
+	}
+	f.UpdatesPending = nullInt64Ptr(updates)
+	f.Gateways, f.DNSServers = stringListFromJSON(gateways), stringListFromJSON(dns)
+	return &f, nil
+}
+
+func (s *PostgresStore) GetAgentFacts(agentID string) (*AgentFacts, error) {
+	f, err := scanAgentFacts(s.conn().QueryRow(
+		`SELECT `+pgAgentFactsColumns+`
+		   FROM agent_facts f
+		  WHERE agent_id = $1`, agentID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return f, err
+}
+
+func (s *PostgresStore) EachAgentFacts(limit int, fn func(AgentFacts) error) error {
+	if limit <= 0 {
+		limit = 200
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+pgAgentFactsColumns+`
+		   FROM agent_facts f
+		   ORDER BY updated_at DESC
+		   LIMIT $1`, limit,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanAgentFacts(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(*f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanAgentFactsViews reads pgAgentFactsViewColumns rows and closes rows.
+func scanAgentFactsViews(rows *sql.Rows) ([]AgentFactsView, error) {
+	defer rows.Close()
+	out := []AgentFactsView{}
+	for rows.Next() {
+		v, err := scanAgentFactsView(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *v)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) ListAgentFactsView(limit int) ([]AgentFactsView, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+pgAgentFactsViewColumns+`
+		FROM agents a
+		LEFT JOIN agent_facts f ON f.agent_id = a.id
+		ORDER BY a.last_seen DESC
+		LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgentFactsViews(rows)
+}
+
+func (s *PostgresStore) ListAgentsNeedingUpdates(minPending int64, limit int) ([]AgentFactsView, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+pgAgentFactsViewColumns+`
+		FROM agents a
+		JOIN agent_facts f ON f.agent_id = a.id
+		WHERE f.updates_pending >= $1
+		ORDER BY f.updates_pending DESC, a.hostname
+		LIMIT $2`, minPending, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanAgentFactsViews(rows)
+}
+
+func (s *PostgresStore) FactsDistribution(field string) ([]FactCount, error) {
+	if !factsGroupableFields[field] {
+		return nil, fmt.Errorf("field %q is not groupable", field)
+	}
+	rows, err := s.conn().Query(
+		`SELECT COALESCE(` + field + `, '') AS v, COUNT(*) AS n
+		   FROM agent_facts
+		  GROUP BY v
+		  ORDER BY n DESC, v`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []FactCount{}
+	for rows.Next() {
+		var fc FactCount
+		if err := rows.Scan(&fc.Value, &fc.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, fc)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) FindAgentsByFacts(where []shared.FactCondition) ([]string, error) {
+	var (
+		conds []string
+		args  []any
+	)
+	for _, c := range where {
+		f, ok := factsQueryFields[c.Field]
+		if !ok {
+			return nil, fmt.Errorf("field %q is not queryable", c.Field)
+		}
+		col := "COALESCE(" + pgColumn(f.column) + ", '')"
+		if f.numeric {
+			col = "COALESCE(" + pgColumn(f.column) + ", 0)"
+		}
+		switch c.Op {
+		case "=", "!=", "<", "<=", ">", ">=":
+			args = append(args, c.Value)
+			param := "$" + strconv.Itoa(len(args))
+			if _, ok := c.Value.(float64); ok {
+				// Not a whole number: compare as one, not as a BIGINT.
+				param += "::double precision"
+			}
+			conds = append(conds, col+" "+c.Op+" "+param)
+		case "prefix", "contains":
+			v, _ := c.Value.(string)
+			pattern := likeEscaper.Replace(v) + "%"
+			if c.Op == "contains" {
+				pattern = "%" + pattern
+			}
+			args = append(args, pattern)
+			conds = append(conds, col+" LIKE $"+strconv.Itoa(len(args))+` ESCAPE '\'`)
+		default:
+			return nil, fmt.Errorf("op %q is not supported", c.Op)
+		}
+	}
+	if len(conds) == 0 {
+		return nil, errors.New("no conditions")
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT a.id FROM agents a JOIN agent_facts f ON f.agent_id = a.id
+		  WHERE `+strings.Join(conds, " AND ")+`
+		  ORDER BY a.id`, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if ids == nil && err == nil {
+		ids = []string{}
+	}
+	return ids, err
+}
+
+func (s *PostgresStore) CreateCommandPolicy(p CommandPolicy) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO command_policies (id, tag, action, pattern, description, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		p.ID, p.Tag, p.Action, p.Pattern, p.Description, p.CreatedAt,
+	)
+	return err
+}
+
+func (s *PostgresStore) ListCommandPolicies() ([]CommandPolicy, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, tag, action, pattern, description, created_at
+		   FROM command_policies ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []CommandPolicy{}
+	for rows.Next() {
+		var p CommandPolicy
+		if err := rows.Scan(&p.ID, &p.Tag, &p.Action, &p.Pattern, &p.Description, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresStore) DeleteCommandPolicy(id string) (bool, error) {
+	res, err := s.conn().Exec(`DELETE FROM command_policies WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *PostgresStore) AddPolicyRejection(rej PolicyRejection) error {
+	var policyID sql.NullString
+	if rej.PolicyID != "" {
+		policyID = sql.NullString{String: rej.PolicyID, Valid: true}
+	}
+	_, err := s.conn().Exec(
+		`INSERT INTO command_policy_rejections (at, agent_id, command, policy_id, reason, key_label, remote)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		rej.At, rej.AgentID, rej.Command, policyID, rej.Reason, rej.KeyLabel, rej.Remote,
+	)
+	return err
+}
+
+func (s *PostgresStore) ListPolicyRejections(limit int) ([]PolicyRejection, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT id, at, agent_id, command, COALESCE(policy_id, ''), reason, key_label, remote
+		   FROM command_policy_rejections ORDER BY id DESC LIMIT $1`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []PolicyRejection{}
+	for rows.Next() {
+		var r PolicyRejection
+		if err := rows.Scan(&r.ID, &r.At, &r.AgentID, &r.Command, &r.PolicyID, &r.Reason, &r.KeyLabel, &r.Remote); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// AdminStore: not implemented for PostgreSQL yet. The tables exist (see
+// migrations_postgres/0001_schema.sql).
+
+func (s *PostgresStore) CreateTemplate(CommandTemplate) error { return ErrNotSupported }
+func (s *PostgresStore) GetTemplateByName(string) (*CommandTemplate, error) {
+	return nil, ErrNotSupported
+}
+func (s *PostgresStore) ListTemplates() ([]CommandTemplate, error) { return nil, ErrNotSupported }
+func (s *PostgresStore) DeleteTemplate(string) (bool, error)       { return false, ErrNotSupported }
+
+func (s *PostgresStore) CreateServiceKey(ServiceKey) error            { return ErrNotSupported }
+func (s *PostgresStore) GetServiceKey(string) (*ServiceKey, error)    { return nil, ErrNotSupported }
+func (s *PostgresStore) ListServiceKeys() ([]ServiceKey, error)       { return nil, ErrNotSupported }
+func (s *PostgresStore) RevokeServiceKey(string, int64) (bool, error) { return false, ErrNotSupported }
+
+func (s *PostgresStore) ReserveEnrollRegistration(string, int) (bool, error) {
+	return false, ErrNotSupported
+}
+func (s *PostgresStore) CreateEnrollToken(string, int64, int64, string) error {
+	return ErrNotSupported
+}
+func (s *PostgresStore) EnrollTokenValid(string, int64) (bool, error) { return false, ErrNotSupported }
+
+func (s *PostgresStore) CreateEnrollKey(EnrollKey) error               { return ErrNotSupported }
+func (s *PostgresStore) ListEnrollKeys() ([]EnrollKey, error)          { return nil, ErrNotSupported }
+func (s *PostgresStore) DeleteEnrollKey(string) (bool, error)          { return false, ErrNotSupported }
+func (s *PostgresStore) MarkEnrollKeyUsed(string, string, int64) error { return ErrNotSupported }
+func (s *PostgresStore) SetEnrollChallenge(string, string, int64, int64) (bool, error) {
+	return false, ErrNotSupported
+}
+func (s *PostgresStore) ConsumeEnrollChallenge(string, string, int64) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (s *PostgresStore) CreateGroup(AgentGroup) error                  { return ErrNotSupported }
+func (s *PostgresStore) GetGroup(string) (*AgentGroup, error)          { return nil, ErrNotSupported }
+func (s *PostgresStore) ListGroups() ([]AgentGroup, error)             { return nil, ErrNotSupported }
+func (s *PostgresStore) DeleteGroup(string) (bool, error)              { return false, ErrNotSupported }
+func (s *PostgresStore) AddGroupMembers(string, []string) (int, error) { return 0, ErrNotSupported }
+func (s *PostgresStore) RemoveGroupMember(string, string) (bool, error) {
+	return false, ErrNotSupported
+}
+func (s *PostgresStore) ListGroupMembers(string) ([]string, error) { return nil, ErrNotSupported }
+
+func (s *PostgresStore) GetStats(int64) (*Stats, error) { return nil, ErrNotSupported }
+
+// SchemaStatus needs nothing PostgreSQL doesn't have yet, unlike the rest of
+// AdminStore.
+func (s *PostgresStore) SchemaStatus() (*SchemaStatus, error) { return PostgresSchemaStatus(s.DB) }
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"rackroom/internal/shared"
@@ -11,357 +16,2341 @@ import (
 
 type SQLiteStore struct {
 	DB *sql.DB
+
+	scope *txScope // set on the store InTx hands out
+}
+
+func (s *SQLiteStore) conn() sqlConn { return storeConn(s.DB, s.scope) }
+
+func (s *SQLiteStore) begin() (storeTx, error) { return storeBegin(s.DB, s.scope, nil) }
+
+func (s *SQLiteStore) beginTx(opts *sql.TxOptions) (storeTx, error) {
+	return storeBegin(s.DB, s.scope, opts)
+}
+
+// InTx runs fn on a store whose calls all share one transaction (see
+// store_tx.go), committed if fn returns nil.
+func (s *SQLiteStore) InTx(fn func(Store) error) error {
+	return runInTx(s.DB, s.scope, func(sc *txScope) Store { return &SQLiteStore{DB: s.DB, scope: sc} }, fn)
 }
 
 func NewSQLiteStore(db *sql.DB) *SQLiteStore {
 	return &SQLiteStore{DB: db}
 }
 
-func (s *SQLiteStore) CreateAgent(publicKey string, info shared.AgentInfo, tags []string) (string, error) {
+func (s *SQLiteStore) CreateAgent(publicKey string, info shared.AgentInfo, tags []string, approvalStatus string) (string, error) {
 	// If pubkey already exists, return existing agent id (idempotent enroll)
 	if rec, _ := s.GetAgentByPubKey(publicKey); rec != nil {
 		_ = s.UpdateAgentSeen(rec.AgentID, info, tags)
 		return rec.AgentID, nil
 	}
 
+	if approvalStatus == "" {
+		approvalStatus = ApprovalApproved
+	}
+
 	agentID := newUUID()
 	now := time.Now().Unix()
 	tagsJSON, _ := json.Marshal(tags)
 
-	_, err := s.DB.Exec(
-		`INSERT INTO agents (id, public_key, hostname, os, arch, tags_json, created_at, last_seen)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		agentID, publicKey, info.Hostname, info.OS, info.Arch, string(tagsJSON), now, now,
+	var approvedAt any
+	if approvalStatus == ApprovalApproved {
+		approvedAt = now
+	}
+
+	_, err := s.conn().Exec(
+		`INSERT INTO agents (id, public_key, hostname, os, arch, tags_json, created_at, last_seen, approval_status, approved_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		agentID, publicKey, info.Hostname, info.OS, info.Arch, string(tagsJSON), now, now, approvalStatus, approvedAt,
 	)
 	return agentID, err
 }
 
-func (s *SQLiteStore) GetAgentByID(agentID string) (*AgentRecord, error) {
-	row := s.DB.QueryRow(
-		`SELECT id, public_key, hostname, os, arch, tags_json, last_seen
-		 FROM agents WHERE id = ?`, agentID,
-	)
+// agentColumns is the column list scanned by scanAgent.
+const agentColumns = `id, public_key, hostname, os, arch, tags_json, last_seen,
+	approval_status, COALESCE(approved_at, 0), tags_source, capabilities_json, protocol_version,
+	COALESCE(inventory_parse_error, ''), COALESCE(inventory_parse_error_at, 0), enroll_tags_json,
+	COALESCE(job_state_json, ''), COALESCE(disk_free_bytes, 0), disk_pressure,
+	COALESCE(inventory_error, ''), COALESCE(inventory_error_at, 0)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
+// scanAgent scans agentColumns, then extra for any columns selected after them.
+func scanAgent(row rowScanner, extra ...any) (*AgentRecord, error) {
 	var rec AgentRecord
-	var tagsJSON string
-	if err := row.Scan(&rec.AgentID, &rec.PublicKey, &rec.Info.Hostname, &rec.Info.OS, &rec.Info.Arch, &tagsJSON, &rec.LastSeen); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
+	var tagsJSON, capsJSON, enrollTagsJSON, jobStateJSON string
+	dest := []any{
+		&rec.AgentID, &rec.PublicKey, &rec.Info.Hostname, &rec.Info.OS, &rec.Info.Arch, &tagsJSON, &rec.LastSeen,
+		&rec.ApprovalStatus, &rec.ApprovedAt, &rec.TagsSource, &capsJSON, &rec.ProtocolVersion,
+		&rec.InventoryParseError, &rec.InventoryParseErrorAt, &enrollTagsJSON, &jobStateJSON,
+		&rec.DiskFreeBytes, &rec.DiskPressure,
+		&rec.InventoryError, &rec.InventoryErrorAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
 		return nil, err
 	}
-
 	_ = json.Unmarshal([]byte(tagsJSON), &rec.Tags)
+	_ = json.Unmarshal([]byte(enrollTagsJSON), &rec.EnrollTags)
+	_ = json.Unmarshal([]byte(capsJSON), &rec.Capabilities)
+	if jobStateJSON != "" {
+		rec.JobState = &shared.AgentJobState{}
+		if json.Unmarshal([]byte(jobStateJSON), rec.JobState) != nil {
+			rec.JobState = nil
+		}
+	}
 	return &rec, nil
 }
 
+// stringListJSON is the value of a nullable JSON list column
+// (gateways_json, dns_servers_json): NULL for nil, so "not reported" and
+// "none" stay apart.
+func stringListJSON(list []string) sql.NullString {
+	if list == nil {
+		return sql.NullString{}
+	}
+	b, _ := json.Marshal(list)
+	return sql.NullString{String: string(b), Valid: true}
+}
+
+// stringListFromJSON reads a stringListJSON column back; NULL is nil.
+func stringListFromJSON(ns sql.NullString) []string {
+	if !ns.Valid {
+		return nil
+	}
+	list := []string{}
+	if json.Unmarshal([]byte(ns.String), &list) != nil {
+		return nil
+	}
+	return list
+}
+
+// jobStateJSON is the job_state_json value for st: NULL for nil.
+func jobStateJSON(st *shared.AgentJobState) sql.NullString {
+	if st == nil {
+		return sql.NullString{}
+	}
+	b, _ := json.Marshal(st)
+	return sql.NullString{String: string(b), Valid: true}
+}
+
+func (s *SQLiteStore) GetAgentByID(agentID string) (*AgentRecord, error) {
+	rec, err := scanAgent(s.conn().QueryRow(
+		`SELECT `+agentColumns+`
+		 FROM agents WHERE id = ?`, agentID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rec, err
+}
+
+func (s *SQLiteStore) AgentExists(agentID string) (bool, error) {
+	var one int
+	err := s.conn().QueryRow(`SELECT 1 FROM agents WHERE id = ?`, agentID).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (s *SQLiteStore) GetAgentByPubKey(publicKey string) (*AgentRecord, error) {
-	row := s.DB.QueryRow(
-		`SELECT id, public_key, hostname, os, arch, tags_json, last_seen
+	rec, err := scanAgent(s.conn().QueryRow(
+		`SELECT `+agentColumns+`
 		 FROM agents WHERE public_key = ?`, publicKey,
-	)
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rec, err
+}
 
-	var rec AgentRecord
-	var tagsJSON string
-	if err := row.Scan(&rec.AgentID, &rec.PublicKey, &rec.Info.Hostname, &rec.Info.OS, &rec.Info.Arch, &tagsJSON, &rec.LastSeen); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
+func (s *SQLiteStore) ListAgentIDsByTag(tag string) ([]string, error) {
+	rows, err := s.conn().Query(
+		`SELECT DISTINCT a.id
+		   FROM agents a, json_each(a.tags_json) t
+		  WHERE t.value = ?
+		  ORDER BY a.id`, tag,
+	)
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	_ = json.Unmarshal([]byte(tagsJSON), &rec.Tags)
-	return &rec, nil
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
 }
 
 func (s *SQLiteStore) UpdateAgentSeen(agentID string, info shared.AgentInfo, tags []string) error {
 	now := time.Now().Unix()
-	tagsJSON, _ := json.Marshal(tags)
 
-	_, err := s.DB.Exec(
+	// Tags assigned at enroll stay next to the agent's own.
+	var enrollTagsJSON string
+	if err := s.conn().QueryRow(`SELECT enroll_tags_json FROM agents WHERE id=?`, agentID).Scan(&enrollTagsJSON); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	tagsJSON, _ := json.Marshal(withEnrollTags(tags, enrollTagsJSON))
+
+	// Server-set tags take precedence over what the agent declares.
+	_, err := s.conn().Exec(
 		`UPDATE agents
-		 SET hostname=?, os=?, arch=?, tags_json=?, last_seen=?
+		 SET hostname=?, os=?, arch=?,
+		     tags_json=CASE WHEN tags_source='server' THEN tags_json ELSE ? END,
+		     last_seen=?
 		 WHERE id=?`,
 		info.Hostname, info.OS, info.Arch, string(tagsJSON), now, agentID,
 	)
 	return err
 }
 
-func (s *SQLiteStore) QueueJob(agentID string, job shared.Job) error {
+func (s *SQLiteStore) SetAgentCapabilities(agentID string, capabilities []string) error {
+	if capabilities == nil {
+		capabilities = []string{}
+	}
+	capsJSON, _ := json.Marshal(capabilities)
+	_, err := s.conn().Exec(`UPDATE agents SET capabilities_json=? WHERE id=?`, string(capsJSON), agentID)
+	return err
+}
+
+func (s *SQLiteStore) SetAgentProtocolVersion(agentID string, version int) error {
+	_, err := s.conn().Exec(`UPDATE agents SET protocol_version=? WHERE id=?`, version, agentID)
+	return err
+}
+
+func (s *SQLiteStore) SetAgentHMACSecret(agentID, secret string) error {
+	_, err := s.conn().Exec(`UPDATE agents SET hmac_secret=? WHERE id=?`,
+		sql.NullString{String: secret, Valid: secret != ""}, agentID)
+	return err
+}
+
+func (s *SQLiteStore) GetAgentHMACSecret(agentID string) (string, error) {
+	var secret string
+	err := s.conn().QueryRow(`SELECT COALESCE(hmac_secret, '') FROM agents WHERE id=?`, agentID).Scan(&secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return secret, err
+}
+
+// SetAgentInventoryParseError records why the latest inventory yielded no
+// facts; an empty msg clears the marker (a no-op when none is set).
+func (s *SQLiteStore) SetAgentInventoryParseError(agentID, msg string) error {
+	if msg == "" {
+		_, err := s.conn().Exec(`UPDATE agents SET inventory_parse_error=NULL, inventory_parse_error_at=NULL
+		                      WHERE id=? AND inventory_parse_error IS NOT NULL`, agentID)
+		return err
+	}
+	_, err := s.conn().Exec(`UPDATE agents SET inventory_parse_error=?, inventory_parse_error_at=? WHERE id=?`,
+		msg, time.Now().Unix(), agentID)
+	return err
+}
+
+// SetAgentInventoryError records why the agent says its last inventory
+// collection failed; an empty msg clears the marker (a no-op when none is
+// set). The time is kept from the first report of the same failure.
+func (s *SQLiteStore) SetAgentInventoryError(agentID, msg string) error {
+	if msg == "" {
+		_, err := s.conn().Exec(`UPDATE agents SET inventory_error=NULL, inventory_error_at=NULL
+		                      WHERE id=? AND inventory_error IS NOT NULL`, agentID)
+		return err
+	}
+	_, err := s.conn().Exec(`UPDATE agents SET inventory_error=?, inventory_error_at=?
+	                      WHERE id=? AND inventory_error IS NOT ?`,
+		msg, time.Now().Unix(), agentID, msg)
+	return err
+}
+
+func (s *SQLiteStore) SetAgentTags(agentID string, tags []string) (bool, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJSON, _ := json.Marshal(tags)
+
+	res, err := s.conn().Exec(
+		`UPDATE agents SET tags_json=?, tags_source=? WHERE id=?`,
+		string(tagsJSON), TagsSourceServer, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) EditAgentTags(agentIDs, add, remove []string) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changed := []string{}
+	for _, id := range agentIDs {
+		var tagsJSON string
+		err := tx.QueryRow(`SELECT tags_json FROM agents WHERE id=?`, id).Scan(&tagsJSON)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		_ = json.Unmarshal([]byte(tagsJSON), &tags)
+		edited, ok := editTags(tags, add, remove)
+		if !ok {
+			continue
+		}
+		editedJSON, _ := json.Marshal(edited)
+		if _, err := tx.Exec(`UPDATE agents SET tags_json=?, tags_source=? WHERE id=?`,
+			string(editedJSON), TagsSourceServer, id); err != nil {
+			return nil, err
+		}
+		changed = append(changed, id)
+	}
+	return changed, tx.Commit()
+}
+
+func (s *SQLiteStore) SetAgentEnrollTags(agentID string, tags []string, override bool) error {
+	enrollTagsJSON, _ := json.Marshal(normalizeTags(tags))
+	if override {
+		_, err := s.conn().Exec(
+			`UPDATE agents SET enroll_tags_json=?, tags_json=?, tags_source=? WHERE id=?`,
+			string(enrollTagsJSON), string(enrollTagsJSON), TagsSourceServer, agentID,
+		)
+		return err
+	}
+
+	var tagsJSON string
+	if err := s.conn().QueryRow(`SELECT tags_json FROM agents WHERE id=?`, agentID).Scan(&tagsJSON); err != nil {
+		return err
+	}
+	var current []string
+	_ = json.Unmarshal([]byte(tagsJSON), &current)
+	merged, _ := json.Marshal(withEnrollTags(current, string(enrollTagsJSON)))
+	_, err := s.conn().Exec(
+		`UPDATE agents
+		 SET enroll_tags_json=?, tags_json=CASE WHEN tags_source='server' THEN tags_json ELSE ? END
+		 WHERE id=?`,
+		string(enrollTagsJSON), string(merged), agentID,
+	)
+	return err
+}
+
+// ReleaseAgentTags hands tag ownership back to the agent. The current tags
+// stay until the next heartbeat replaces them.
+func (s *SQLiteStore) ReleaseAgentTags(agentID string) (bool, error) {
+	res, err := s.conn().Exec(
+		`UPDATE agents SET tags_source=? WHERE id=?`,
+		TagsSourceAgent, agentID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) QueueJob(agentID string, job shared.Job, maxQueued int) error {
 	now := time.Now().Unix()
 
-	_, err := s.DB.Exec(
-		`INSERT INTO jobs (id, target_agent_id, kind, shell, command, timeout_seconds, status, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?, 'queued', ?)`,
+	var runAsUser, runAsCred sql.NullString
+	if job.RunAs != nil {
+		runAsUser = sql.NullString{String: job.RunAs.User, Valid: true}
+		runAsCred = sql.NullString{String: job.RunAs.Credential, Valid: job.RunAs.Credential != ""}
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The depth check is part of the INSERT so concurrent submits can't both
+	// take the last slot.
+	res, err := tx.Exec(
+		`INSERT INTO jobs (id, target_agent_id, kind, shell, command, timeout_seconds, status, created_at,
+		                   run_as_user, run_as_credential, confirm, priority, batch_id, command_encoding,
+		                   pre_command, post_command)
+		 SELECT ?, ?, ?, ?, ?, ?, 'queued', ?, ?, ?, ?, ?, ?, ?, ?, ?
+		  WHERE ? <= 0 OR (SELECT COUNT(*) FROM jobs WHERE target_agent_id = ? AND status = 'queued') < ?`,
 		job.JobID, agentID, job.Kind, job.Shell, job.Command, job.TimeoutSeconds, now,
+		runAsUser, runAsCred, sql.NullString{String: job.Confirm, Valid: job.Confirm != ""}, job.Priority,
+		sql.NullString{String: job.BatchID, Valid: job.BatchID != ""},
+		sql.NullString{String: job.CommandEncoding, Valid: job.CommandEncoding != ""},
+		sql.NullString{String: job.PreCommand, Valid: job.PreCommand != ""},
+		sql.NullString{String: job.PostCommand, Valid: job.PostCommand != ""},
+		maxQueued, agentID, maxQueued,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrQueueFull
+	}
+	if err := addJobEvent(tx, job.JobID, now, "", "queued", "submitted"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// addJobEvent records one status transition of a job.
+func addJobEvent(tx sqlConn, jobID string, at int64, from, to, reason string) error {
+	_, err := tx.Exec(
+		`INSERT INTO job_events (job_id, at, from_status, to_status, reason) VALUES (?, ?, ?, ?, ?)`,
+		jobID, at, from, to, reason,
 	)
 	return err
 }
 
-func (s *SQLiteStore) DequeueJobs(agentID string, max int) ([]shared.Job, error) {
+func (s *SQLiteStore) DequeueJobs(agentID string, max int, blocklist *CommandBlocklist) ([]shared.Job, []BlockedJob, error) {
 	if max <= 0 {
 		max = 5
 	}
 
-	// Grab queued jobs
-	rows, err := s.DB.Query(
-		`SELECT id, kind, shell, command, timeout_seconds
+	tx, err := s.begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Grab queued jobs, most urgent first; agents still pending approval get nothing
+	rows, err := tx.Query(
+		`SELECT id, kind, shell, command, timeout_seconds, run_as_user, run_as_credential, COALESCE(confirm, ''), priority, COALESCE(batch_id, ''),
+		        COALESCE(command_encoding, ''), COALESCE(pre_command, ''), COALESCE(post_command, '')
 		 FROM jobs
 		 WHERE target_agent_id = ? AND status = 'queued'
-		 ORDER BY created_at
+		   AND EXISTS (SELECT 1 FROM agents a WHERE a.id = jobs.target_agent_id AND a.approval_status = 'approved')
+		 ORDER BY priority DESC, created_at
 		 LIMIT ?`, agentID, max,
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer rows.Close()
 
-	var jobs []shared.Job
+	var candidates []shared.Job
+	var blockedCandidates []BlockedJob
 	for rows.Next() {
 		var j shared.Job
-		if err := rows.Scan(&j.JobID, &j.Kind, &j.Shell, &j.Command, &j.TimeoutSeconds); err != nil {
-			return nil, err
+		var runAsUser, runAsCred sql.NullString
+		if err := rows.Scan(&j.JobID, &j.Kind, &j.Shell, &j.Command, &j.TimeoutSeconds, &runAsUser, &runAsCred, &j.Confirm, &j.Priority, &j.BatchID, &j.CommandEncoding,
+			&j.PreCommand, &j.PostCommand); err != nil {
+			rows.Close()
+			return nil, nil, err
 		}
-		jobs = append(jobs, j)
+		j.RunAs = scanRunAs(runAsUser, runAsCred)
+		if pattern := blocklist.MatchAny(policyCommands(j)); pattern != "" {
+			blockedCandidates = append(blockedCandidates, BlockedJob{JobID: j.JobID, Pattern: pattern})
+			continue
+		}
+		candidates = append(candidates, j)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || (len(candidates) == 0 && len(blockedCandidates) == 0) {
+		return nil, nil, err
 	}
 
-	// Mark as running (simple; v0 doesn’t track per-agent concurrency)
+	// Mark as running (simple; v0 doesn’t track per-agent concurrency) and
+	// finish blocked jobs, in the transaction that selected them. A job
+	// another poll already took (status no longer queued) is skipped; jobs
+	// are handed out only once the commit succeeded.
 	now := time.Now().Unix()
-	for _, j := range jobs {
-		_, _ = s.DB.Exec(`UPDATE jobs SET status='running', started_at=? WHERE id=?`, now, j.JobID)
+	var jobs []shared.Job
+	var blocked []BlockedJob
+	for _, b := range blockedCandidates {
+		res, err := tx.Exec(`UPDATE jobs SET status='blocked', finished_at=? WHERE id=? AND status='queued'`, now, b.JobID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, nil, err
+		} else if n == 0 {
+			continue
+		}
+		if err := addJobEvent(tx, b.JobID, now, "queued", "blocked", "matched command blocklist: "+b.Pattern); err != nil {
+			return nil, nil, err
+		}
+		blocked = append(blocked, b)
+	}
+	for _, j := range candidates {
+		res, err := tx.Exec(`UPDATE jobs SET status='running', started_at=? WHERE id=? AND status='queued'`, now, j.JobID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, nil, err
+		} else if n == 0 {
+			continue
+		}
+		if err := addJobEvent(tx, j.JobID, now, "queued", "running", "dequeued by agent"); err != nil {
+			return nil, nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
 	}
 
-	return jobs, nil
+	return jobs, blocked, nil
 }
 
-func (s *SQLiteStore) AddResult(res shared.JobResult) error {
-	// Store result
-	_, err := s.DB.Exec(
-		`INSERT OR REPLACE INTO job_results (job_id, agent_id, exit_code, stdout, stderr, started_at, finished_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		res.JobID, res.AgentID, res.ExitCode, res.Stdout, res.Stderr, res.StartedAt, res.FinishedAt,
+func (s *SQLiteStore) JobTarget(jobID string) (string, bool, error) {
+	var agentID string
+	err := s.conn().QueryRow(`SELECT target_agent_id FROM jobs WHERE id = ?`, jobID).Scan(&agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return agentID, err == nil, err
+}
+
+func (s *SQLiteStore) AddResult(res shared.JobResult) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Store result; the first one recorded for a job stands
+	ins, err := tx.Exec(
+		`INSERT INTO job_results (job_id, agent_id, exit_code, stdout, stderr, started_at, finished_at, timed_out, interrupted, truncated, output_encoding)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (job_id) DO NOTHING`,
+		res.JobID, res.AgentID, res.ExitCode, res.Stdout, res.Stderr, res.StartedAt, res.FinishedAt, res.TimedOut, res.Interrupted, res.Truncated,
+		sql.NullString{String: res.OutputEncoding, Valid: res.OutputEncoding != ""},
 	)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if n, err := ins.RowsAffected(); err != nil || n == 0 {
+		return false, err
 	}
 
 	// Update job status
-	status := "done"
-	if res.ExitCode != 0 {
-		status = "failed"
+	status, reason := resultStatus(res)
+	var prev string
+	if err := tx.QueryRow(`SELECT status FROM jobs WHERE id=?`, res.JobID).Scan(&prev); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
 	}
-	_, _ = s.DB.Exec(`UPDATE jobs SET status=?, finished_at=? WHERE id=?`, status, res.FinishedAt, res.JobID)
-	return nil
+	if _, err := tx.Exec(`UPDATE jobs SET status=?, finished_at=? WHERE id=?`, status, res.FinishedAt, res.JobID); err != nil {
+		return false, err
+	}
+	if err := addJobEvent(tx, res.JobID, time.Now().Unix(), prev, status, reason); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
 }
-func (s *SQLiteStore) AddInventorySnapshot(agentID string, payloadJSON string) error {
-	now := time.Now().Unix()
-	id := newUUID()
 
-	_, err := s.DB.Exec(
-		`INSERT INTO agent_inventory_snapshots (id, agent_id, created_at, payload_json)
-		 VALUES (?, ?, ?, ?)`,
-		id, agentID, now, payloadJSON,
-	)
-	return err
-}
+// ReapStaleJobs fails running jobs whose result is overdue: started longer
+// than their timeout plus graceSeconds ago, so the agent will never report (it
+// crashed, was reinstalled, lost the result). A result that does arrive later
+// still overwrites the status.
+func (s *SQLiteStore) ReapStaleJobs(now, graceSeconds int64) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-func (s *SQLiteStore) GetLatestInventorySnapshot(agentID string) (string, error) {
-	row := s.DB.QueryRow(
-		`SELECT payload_json
-		 FROM agent_inventory_snapshots
-		 WHERE agent_id=?
-		 ORDER BY created_at DESC
-		 LIMIT 1`,
-		agentID,
+	rows, err := tx.Query(
+		// Each hook runs with its own timeout_seconds on top of the command's.
+		`SELECT id FROM jobs
+		  WHERE status = 'running' AND started_at IS NOT NULL
+		    AND started_at + timeout_seconds * (1 + (pre_command IS NOT NULL) + (post_command IS NOT NULL)) + ? < ?`,
+		graceSeconds, now,
 	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	var payload string
-	if err := row.Scan(&payload); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", nil
+	reason := fmt.Sprintf("reaped: no result within timeout + %ds", graceSeconds)
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE jobs SET status='failed', finished_at=? WHERE id=?`, now, id); err != nil {
+			return nil, err
+		}
+		if err := addJobEvent(tx, id, now, "running", "failed", reason); err != nil {
+			return nil, err
 		}
-		return "", err
 	}
-	return payload, nil
+	return ids, tx.Commit()
 }
 
-func (s *SQLiteStore) ListAgents(limit int) ([]AgentRecord, error) {
-	if limit <= 0 {
-		limit = 100
-	}
-	rows, err := s.DB.Query(
-		`SELECT id, public_key, hostname, os, arch, tags_json, last_seen
-		 FROM agents
-		 ORDER BY last_seen DESC
-		 LIMIT ?`, limit,
+func (s *SQLiteStore) ListJobEvents(jobID string) ([]JobEvent, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, at, from_status, to_status, reason FROM job_events WHERE job_id = ? ORDER BY id`, jobID,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var out []AgentRecord
+	out := []JobEvent{}
 	for rows.Next() {
-		var rec AgentRecord
-		var tagsJSON string
-		if err := rows.Scan(&rec.AgentID, &rec.PublicKey, &rec.Info.Hostname, &rec.Info.OS, &rec.Info.Arch, &tagsJSON, &rec.LastSeen); err != nil {
+		var e JobEvent
+		if err := rows.Scan(&e.ID, &e.At, &e.From, &e.To, &e.Reason); err != nil {
 			return nil, err
 		}
-		_ = json.Unmarshal([]byte(tagsJSON), &rec.Tags)
-		out = append(out, rec)
+		out = append(out, e)
 	}
-	return out, nil
+	return out, rows.Err()
 }
 
-func (s *SQLiteStore) UpsertAgentFacts(f AgentFacts) error {
-	_, err := s.DB.Exec(
-		`INSERT INTO agent_facts (
-			agent_id, updated_at,
-			os_caption, os_version, os_build,
-			cpu_name, cpu_cores, cpu_logical,
-			ram_total_bytes, ram_free_bytes,
-			uptime_seconds, ipv4_primary,
-			disk_total_bytes, disk_free_bytes
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(agent_id) DO UPDATE SET
-			updated_at=excluded.updated_at,
-			os_caption=excluded.os_caption,
-			os_version=excluded.os_version,
-			os_build=excluded.os_build,
-			cpu_name=excluded.cpu_name,
-			cpu_cores=excluded.cpu_cores,
-			cpu_logical=excluded.cpu_logical,
-			ram_total_bytes=excluded.ram_total_bytes,
-			ram_free_bytes=excluded.ram_free_bytes,
-			uptime_seconds=excluded.uptime_seconds,
-			ipv4_primary=excluded.ipv4_primary,
-			disk_total_bytes=excluded.disk_total_bytes,
-			disk_free_bytes=excluded.disk_free_bytes
-		`,
-		f.AgentID, f.UpdatedAt,
-		f.OSCaption, f.OSVersion, f.OSBuild,
-		f.CPUName, f.CPUCores, f.CPULogical,
-		f.RAMTotalBytes, f.RAMFreeBytes,
-		f.UptimeSeconds, f.IPv4Primary,
-		f.DiskTotalBytes, f.DiskFreeBytes,
+func (s *SQLiteStore) AddDeadLetterResult(d DeadLetterResult) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO dead_letter_results (received_at, agent_id, job_id, reason, payload) VALUES (?, ?, ?, ?, ?)`,
+		d.ReceivedAt, d.AgentID, d.JobID, d.Reason, d.Payload,
 	)
 	return err
 }
-func (s *SQLiteStore) ListAgentFacts(limit int) ([]AgentFacts, error) {
+
+func (s *SQLiteStore) ListDeadLetterResults(limit int) ([]DeadLetterResult, error) {
 	if limit <= 0 {
-		limit = 200
+		limit = 100
 	}
-
-	rows, err := s.DB.Query(
-		`SELECT agent_id, updated_at,
-		        os_caption, os_version, os_build,
-		        cpu_name, cpu_cores, cpu_logical,
-		        ram_total_bytes, ram_free_bytes,
-		        uptime_seconds, ipv4_primary,
-		        disk_total_bytes, disk_free_bytes
-		   FROM agent_facts
-		   ORDER BY updated_at DESC
-		   LIMIT ?`, limit,
+	rows, err := s.conn().Query(
+		`SELECT id, received_at, agent_id, job_id, reason, length(CAST(payload AS BLOB))
+		   FROM dead_letter_results ORDER BY id DESC LIMIT ?`, limit,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var out []AgentFacts
+	out := []DeadLetterResult{}
 	for rows.Next() {
-		var f AgentFacts
-		if err := rows.Scan(
-			&f.AgentID, &f.UpdatedAt,
-			&f.OSCaption, &f.OSVersion, &f.OSBuild,
-			&f.CPUName, &f.CPUCores, &f.CPULogical,
-			&f.RAMTotalBytes, &f.RAMFreeBytes,
-			&f.UptimeSeconds, &f.IPv4Primary,
-			&f.DiskTotalBytes, &f.DiskFreeBytes,
-		); err != nil {
+		var d DeadLetterResult
+		if err := rows.Scan(&d.ID, &d.ReceivedAt, &d.AgentID, &d.JobID, &d.Reason, &d.PayloadBytes); err != nil {
 			return nil, err
 		}
-		out = append(out, f)
+		out = append(out, d)
 	}
-
-	return out, nil
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) GetDeadLetterResult(id int64) (*DeadLetterResult, error) {
+	var d DeadLetterResult
+	err := s.conn().QueryRow(
+		`SELECT id, received_at, agent_id, job_id, reason, length(CAST(payload AS BLOB)), payload
+		   FROM dead_letter_results WHERE id = ?`, id,
+	).Scan(&d.ID, &d.ReceivedAt, &d.AgentID, &d.JobID, &d.Reason, &d.PayloadBytes, &d.Payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// jobSummaryColumns must match scanJobSummary. Output sizes are computed in
+// SQL so the TEXT columns never leave the database for list views.
+const jobSummaryColumns = `j.id, j.target_agent_id, j.kind, j.shell, j.status,
+	r.exit_code,
+	COALESCE(length(CAST(r.stdout AS BLOB)), 0),
+	COALESCE(length(CAST(r.stderr AS BLOB)), 0),
+	j.created_at, COALESCE(j.started_at, 0), COALESCE(j.finished_at, 0),
+	COALESCE(r.timed_out, 0), COALESCE(r.interrupted, 0), COALESCE(r.truncated, 0), j.priority, COALESCE(j.batch_id, '')`
+
+func scanJobSummary(row rowScanner, extra ...any) (*JobSummary, error) {
+	var js JobSummary
+	var exitCode sql.NullInt64
+	dest := []any{
+		&js.JobID, &js.AgentID, &js.Kind, &js.Shell, &js.Status,
+		&exitCode, &js.StdoutBytes, &js.StderrBytes,
+		&js.CreatedAt, &js.StartedAt, &js.FinishedAt,
+		&js.TimedOut, &js.Interrupted, &js.Truncated, &js.Priority, &js.BatchID,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		js.ExitCode = &code
+	}
+	return &js, nil
+}
+
+func (s *SQLiteStore) ListJobSummaries(f JobListFilter) ([]JobSummary, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	if f.Offset < 0 {
+		f.Offset = 0
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT `+jobSummaryColumns+`
+		   FROM jobs j
+		   LEFT JOIN job_results r ON r.job_id = j.id
+		  WHERE (? = '' OR j.target_agent_id = ?)
+		    AND (? = '' OR j.status = ?)
+		    AND (? = '' OR j.batch_id = ?)
+		  ORDER BY j.created_at DESC, j.id
+		  LIMIT ? OFFSET ?`,
+		f.AgentID, f.AgentID, f.Status, f.Status, f.BatchID, f.BatchID, f.Limit, f.Offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []JobSummary{}
+	for rows.Next() {
+		js, err := scanJobSummary(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *js)
+	}
+	return out, rows.Err()
+}
+
+// resultSummaryColumns are jobSummaryColumns plus what finishResultSummary
+// needs; scanResultSummary reads them.
+var resultSummaryColumns = jobSummaryColumns + `,
+	COALESCE(r.output_encoding, ''),
+	length(r.stdout) - length(replace(r.stdout, char(10), '')),
+	length(r.stderr) - length(replace(r.stderr, char(10), '')),
+	substr(r.stdout, -` + strconv.Itoa(resultTailChars) + `), substr(r.stderr, -` + strconv.Itoa(resultTailChars) + `)`
+
+func scanResultSummaries(rows *sql.Rows) ([]ResultSummary, error) {
+	defer rows.Close()
+	out := []ResultSummary{}
+	for rows.Next() {
+		var (
+			rs                             ResultSummary
+			stdoutNewlines, stderrNewlines int64
+			stdoutEnd, stderrEnd           string
+		)
+		js, err := scanJobSummary(rows, &rs.OutputEncoding, &stdoutNewlines, &stderrNewlines, &stdoutEnd, &stderrEnd)
+		if err != nil {
+			return nil, err
+		}
+		rs.JobSummary = *js
+		finishResultSummary(&rs, stdoutNewlines, stderrNewlines, stdoutEnd, stderrEnd)
+		out = append(out, rs)
+	}
+	return out, rows.Err()
+}
+
+// ListAgentResults returns the agent's finished jobs (those with a result),
+// most recently finished first.
+func (s *SQLiteStore) ListAgentResults(agentID string, limit int) ([]ResultSummary, error) {
+	if limit <= 0 {
+		limit = 50
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+resultSummaryColumns+`
+		   FROM jobs j
+		   JOIN job_results r ON r.job_id = j.id
+		  WHERE j.target_agent_id = ?
+		  ORDER BY r.finished_at DESC, j.id
+		  LIMIT ?`,
+		agentID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanResultSummaries(rows)
+}
+
+func (s *SQLiteStore) GetJobDetail(jobID string) (*JobDetail, error) {
+	var d JobDetail
+	var runAsUser, runAsCred sql.NullString
+	js, err := scanJobSummary(s.conn().QueryRow(
+		`SELECT `+jobSummaryColumns+`,
+		        j.command, COALESCE(j.command_encoding, ''), j.timeout_seconds, j.run_as_user, j.run_as_credential,
+		        COALESCE(j.pre_command, ''), COALESCE(j.post_command, ''),
+		        COALESCE(r.stdout, ''), COALESCE(r.stderr, ''), COALESCE(r.output_encoding, '')
+		   FROM jobs j
+		   LEFT JOIN job_results r ON r.job_id = j.id
+		  WHERE j.id = ?`, jobID,
+	), &d.Command, &d.CommandEncoding, &d.TimeoutSeconds, &runAsUser, &runAsCred, &d.PreCommand, &d.PostCommand,
+		&d.Stdout, &d.Stderr, &d.OutputEncoding)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	d.JobSummary = *js
+	d.RunAs = scanRunAs(runAsUser, runAsCred)
+	if d.CommandEncoding == "" {
+		d.CommandEncoding = shared.PayloadEncodingUTF8
+	}
+	if d.OutputEncoding == "" {
+		d.OutputEncoding = shared.PayloadEncodingUTF8
+	}
+	if d.Events, err = s.ListJobEvents(jobID); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *SQLiteStore) LatestBatchJobs(batchID string) ([]BatchJob, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, target_agent_id, status, kind, shell, command, timeout_seconds,
+		        run_as_user, run_as_credential, priority, COALESCE(command_encoding, ''),
+		        COALESCE(pre_command, ''), COALESCE(post_command, '')
+		   FROM (
+		     SELECT j.*, j.rowid AS seq,
+		            ROW_NUMBER() OVER (PARTITION BY target_agent_id ORDER BY created_at DESC, j.rowid DESC) AS rn
+		       FROM jobs j WHERE batch_id = ?
+		   )
+		  WHERE rn = 1
+		  ORDER BY created_at, seq`, batchID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []BatchJob
+	for rows.Next() {
+		var (
+			bj                   BatchJob
+			runAsUser, runAsCred sql.NullString
+		)
+		if err := rows.Scan(&bj.Job.JobID, &bj.AgentID, &bj.Status, &bj.Job.Kind, &bj.Job.Shell, &bj.Job.Command,
+			&bj.Job.TimeoutSeconds, &runAsUser, &runAsCred, &bj.Job.Priority, &bj.Job.CommandEncoding,
+			&bj.Job.PreCommand, &bj.Job.PostCommand); err != nil {
+			return nil, err
+		}
+		bj.Job.RunAs = scanRunAs(runAsUser, runAsCred)
+		bj.Job.BatchID = batchID
+		out = append(out, bj)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) CreateJobBatch(b JobBatch) error {
+	selJSON, err := json.Marshal(b.Selector)
+	if err != nil {
+		return err
+	}
+	idsJSON, err := json.Marshal(b.AgentIDs)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn().Exec(
+		`INSERT INTO job_batches (id, created_at, created_by, selector_json, agent_ids_json) VALUES (?, ?, ?, ?, ?)`,
+		b.ID, b.CreatedAt, b.CreatedBy, string(selJSON), string(idsJSON),
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetJobBatch(id string) (*JobBatch, error) {
+	var (
+		b                JobBatch
+		selJSON, idsJSON string
+	)
+	err := s.conn().QueryRow(
+		`SELECT id, created_at, created_by, selector_json, agent_ids_json FROM job_batches WHERE id = ?`, id,
+	).Scan(&b.ID, &b.CreatedAt, &b.CreatedBy, &selJSON, &idsJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(selJSON), &b.Selector); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(idsJSON), &b.AgentIDs); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (s *SQLiteStore) ListQueueDepths(limit int) ([]QueueDepth, error) {
+	rows, err := s.conn().Query(
+		`SELECT j.target_agent_id, COALESCE(a.hostname, ''), COUNT(*), MIN(j.created_at)
+		   FROM jobs j
+		   LEFT JOIN agents a ON a.id = j.target_agent_id
+		  WHERE j.status = 'queued'
+		  GROUP BY j.target_agent_id
+		  ORDER BY COUNT(*) DESC, MIN(j.created_at)
+		  LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []QueueDepth{}
+	for rows.Next() {
+		var q QueueDepth
+		if err := rows.Scan(&q.AgentID, &q.Hostname, &q.Queued, &q.OldestQueuedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, q)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) AgentJobCounts(agentID string) (*AgentJobCounts, error) {
+	out := &AgentJobCounts{AgentID: agentID, Counts: map[string]int64{}}
+	for _, st := range jobStatuses {
+		out.Counts[st] = 0
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT status, COUNT(*), MIN(created_at) FROM jobs WHERE target_agent_id = ? GROUP BY status`,
+		agentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			status string
+			n      int64
+			oldest int64
+		)
+		if err := rows.Scan(&status, &n, &oldest); err != nil {
+			return nil, err
+		}
+		out.Counts[status] = n
+		out.Total += n
+		if status == "queued" {
+			out.OldestQueuedAt = oldest
+		}
+	}
+	return out, rows.Err()
+}
+
+// scanRunAs rebuilds a job's run_as from its nullable columns.
+func scanRunAs(user, credential sql.NullString) *shared.RunAs {
+	if !user.Valid && !credential.Valid {
+		return nil
+	}
+	return &shared.RunAs{User: user.String, Credential: credential.String}
+}
+
+func (s *SQLiteStore) AddInventorySnapshot(agentID string, payloadJSON string) error {
+	now := time.Now().Unix()
+	sum := sha256.Sum256([]byte(payloadJSON))
+	hash := hex.EncodeToString(sum[:])
+
+	// Back-to-back heartbeats often resend a cached inventory; the check and
+	// the insert share a transaction so two of them can't both store it.
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var latestID, latestHash string
+	err = tx.QueryRow(
+		`SELECT id, COALESCE(payload_sha256, '')
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id = ?
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`, agentID,
+	).Scan(&latestID, &latestHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if latestHash == hash {
+		_, err = tx.Exec(
+			`UPDATE agent_inventory_snapshots SET last_seen_identical_at = ? WHERE id = ?`,
+			now, latestID,
+		)
+	} else {
+		_, err = tx.Exec(
+			`INSERT INTO agent_inventory_snapshots (id, agent_id, created_at, payload_json, payload_sha256)
+			 VALUES (?, ?, ?, ?, ?)`,
+			newUUID(), agentID, now, payloadJSON, hash,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAgentDetail gathers the agent row, its facts and a reference to the
+// latest inventory snapshot in one read transaction so the parts agree.
+func (s *SQLiteStore) GetAgentDetail(agentID string) (*AgentDetail, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rec, err := scanAgent(tx.QueryRow(
+		`SELECT `+agentColumns+`
+		 FROM agents WHERE id = ?`, agentID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &AgentDetail{Agent: *rec}
+
+	v, err := scanAgentFactsView(tx.QueryRow(
+		`SELECT `+agentFactsViewColumns+`
+		 FROM agents a
+		 JOIN agent_facts f ON f.agent_id = a.id
+		 WHERE a.id = ?`, agentID,
+	))
+	switch {
+	case err == nil:
+		d.Facts = v
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	var ref InventoryRef
+	err = tx.QueryRow(
+		`SELECT id, created_at, length(CAST(payload_json AS BLOB)), COALESCE(payload_sha256, ''),
+		        COALESCE(last_seen_identical_at, 0)
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id = ?
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`, agentID,
+	).Scan(&ref.SnapshotID, &ref.CreatedAt, &ref.SizeBytes, &ref.SHA256, &ref.LastSeenIdenticalAt)
+	switch {
+	case err == nil:
+		d.LatestInventory = &ref
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (s *SQLiteStore) GetLatestInventorySnapshot(agentID string) (string, error) {
+	row := s.conn().QueryRow(
+		`SELECT id, COALESCE(payload_sha256, ''), payload_json
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id=?
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`,
+		agentID,
+	)
+
+	var id, sum, payload string
+	if err := row.Scan(&id, &sum, &payload); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	if err := verifyInventoryPayload(agentID, id, sum, payload); err != nil {
+		return "", err
+	}
+	return payload, nil
+}
+
+// GetInventorySnapshotAt returns the newest snapshot taken at or before at
+// (unix seconds), or nil if the agent had none by then.
+func (s *SQLiteStore) GetInventorySnapshotAt(agentID string, at int64) (*InventoryRef, string, error) {
+	var (
+		ref     InventoryRef
+		payload string
+	)
+	err := s.conn().QueryRow(
+		`SELECT id, created_at, length(CAST(payload_json AS BLOB)), COALESCE(payload_sha256, ''),
+		        COALESCE(last_seen_identical_at, 0), payload_json
+		 FROM agent_inventory_snapshots
+		 WHERE agent_id = ? AND created_at <= ?
+		 ORDER BY created_at DESC, id DESC
+		 LIMIT 1`, agentID, at,
+	).Scan(&ref.SnapshotID, &ref.CreatedAt, &ref.SizeBytes, &ref.SHA256, &ref.LastSeenIdenticalAt, &payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verifyInventoryPayload(agentID, ref.SnapshotID, ref.SHA256, payload); err != nil {
+		return nil, "", err
+	}
+	return &ref, payload, nil
+}
+
+func (s *SQLiteStore) ListAgents(limit int) ([]AgentRecord, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`
+		 FROM agents
+		 ORDER BY last_seen DESC
+		 LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AgentRecord
+	for rows.Next() {
+		rec, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *rec)
+	}
+	return out, nil
+}
+
+func (s *SQLiteStore) ListAgentsByApproval(status string, limit int) ([]AgentRecord, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`
+		 FROM agents
+		 WHERE approval_status = ?
+		 ORDER BY created_at
+		 LIMIT ?`, status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AgentRecord
+	for rows.Next() {
+		rec, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *rec)
+	}
+	return out, nil
+}
+
+func (s *SQLiteStore) ApproveAgent(agentID string) (bool, error) {
+	res, err := s.conn().Exec(
+		`UPDATE agents
+		 SET approval_status=?, approved_at=COALESCE(approved_at, ?)
+		 WHERE id=? AND approval_status=?`,
+		ApprovalApproved, time.Now().Unix(), agentID, ApprovalPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// SetAgentDisabled disables an agent, or re-enables it to whatever it was
+// before: approved if it was ever approved, otherwise pending again.
+func (s *SQLiteStore) SetAgentDisabled(agentID string, disabled bool) (bool, error) {
+	q := `UPDATE agents SET approval_status=? WHERE id=?`
+	args := []any{ApprovalDisabled, agentID}
+	if !disabled {
+		q = `UPDATE agents
+		     SET approval_status=CASE WHEN approved_at IS NULL THEN ? ELSE ? END
+		     WHERE id=? AND approval_status=?`
+		args = []any{ApprovalPending, ApprovalApproved, agentID, ApprovalDisabled}
+	}
+	res, err := s.conn().Exec(q, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+	// Enabling an agent that isn't disabled matches no rows; still "found".
+	rec, err := s.GetAgentByID(agentID)
+	return rec != nil, err
+}
+
+// DeleteAgent removes an agent and everything keyed on it (jobs, results,
+// inventory, facts) in one transaction.
+func (s *SQLiteStore) DeleteAgent(agentID string) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`DELETE FROM job_results
+		 WHERE agent_id = ? OR job_id IN (SELECT id FROM jobs WHERE target_agent_id = ?)`,
+		agentID, agentID,
+	); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(
+		`DELETE FROM job_events WHERE job_id IN (SELECT id FROM jobs WHERE target_agent_id = ?)`, agentID,
+	); err != nil {
+		return false, err
+	}
+	for _, q := range []string{
+		`DELETE FROM jobs WHERE target_agent_id = ?`,
+		`DELETE FROM agent_inventory_snapshots WHERE agent_id = ?`,
+		`DELETE FROM agent_facts WHERE agent_id = ?`,
+		`DELETE FROM agent_custom_facts WHERE agent_id = ?`,
+		`DELETE FROM agent_status_events WHERE agent_id = ?`,
+		`DELETE FROM agent_group_members WHERE agent_id = ?`,
+	} {
+		if _, err := tx.Exec(q, agentID); err != nil {
+			return false, err
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM agents WHERE id = ?`, agentID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, tx.Commit()
+}
+
+// MarkAgentOnline records an online transition if the agent wasn't already
+// online. Cheap when nothing changes: one UPDATE that matches no rows.
+func (s *SQLiteStore) MarkAgentOnline(agentID string, at int64) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE agents SET liveness=? WHERE id=? AND liveness != ?`,
+		LivenessOnline, agentID, LivenessOnline,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO agent_status_events (agent_id, status, at) VALUES (?, ?, ?)`,
+		agentID, LivenessOnline, at,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// MarkStaleAgentsOffline flips online (or late) agents last seen before
+// seenBefore to offline and records one event each. Returns the affected
+// agent ids.
+func (s *SQLiteStore) MarkStaleAgentsOffline(seenBefore, at int64) ([]string, error) {
+	return s.transitionAgents(
+		`SELECT id FROM agents WHERE liveness IN (?, ?) AND last_seen < ?`,
+		[]any{LivenessOnline, LivenessLate, seenBefore},
+		LivenessOffline, at,
+	)
+}
+
+func (s *SQLiteStore) SetAgentHeartbeatInterval(agentID string, seconds int) error {
+	_, err := s.conn().Exec(`UPDATE agents SET heartbeat_interval_seconds=? WHERE id=?`, seconds, agentID)
+	return err
+}
+
+func (s *SQLiteStore) SetAgentDiskState(agentID string, freeBytes int64, pressure bool) (bool, error) {
+	res, err := s.conn().Exec(`UPDATE agents SET disk_pressure=? WHERE id=? AND disk_pressure != ?`, pressure, agentID, pressure)
+	if err != nil {
+		return false, err
+	}
+	changed, _ := res.RowsAffected()
+	free := sql.NullInt64{Int64: freeBytes, Valid: freeBytes > 0}
+	if _, err := s.conn().Exec(`UPDATE agents SET disk_free_bytes=? WHERE id=?`, free, agentID); err != nil {
+		return false, err
+	}
+	return changed > 0, nil
+}
+
+func (s *SQLiteStore) SetAgentJobState(agentID string, st *shared.AgentJobState) error {
+	_, err := s.conn().Exec(`UPDATE agents SET job_state_json=? WHERE id=?`, jobStateJSON(st), agentID)
+	return err
+}
+
+// MarkLateAgents flips online agents that have gone at least missed of their
+// reported heartbeat intervals without checking in to late, recording one
+// event each. Agents that don't report an interval are never late.
+func (s *SQLiteStore) MarkLateAgents(missed int, at int64) ([]string, error) {
+	return s.transitionAgents(
+		`SELECT id FROM agents
+		  WHERE liveness = ? AND heartbeat_interval_seconds > 0
+		    AND last_seen < ? - heartbeat_interval_seconds * ?`,
+		[]any{LivenessOnline, at, missed},
+		LivenessLate, at,
+	)
+}
+
+// transitionAgents moves every agent selected by query to liveness status to
+// and records the events, in one transaction.
+func (s *SQLiteStore) transitionAgents(query string, args []any, to string, at int64) ([]string, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE agents SET liveness=? WHERE id=?`, to, id); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO agent_status_events (agent_id, status, at) VALUES (?, ?, ?)`,
+			id, to, at,
+		); err != nil {
+			return nil, err
+		}
+	}
+	return ids, tx.Commit()
+}
+
+// ListAgentStatusEvents returns events with id > afterID, oldest first.
+// An empty agentID lists the whole fleet.
+func (s *SQLiteStore) ListAgentStatusEvents(agentID string, afterID int64, limit int) ([]AgentStatusEvent, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT e.id, e.agent_id, COALESCE(a.hostname, ''), e.status, e.at
+		   FROM agent_status_events e
+		   LEFT JOIN agents a ON a.id = e.agent_id
+		  WHERE (? = '' OR e.agent_id = ?) AND e.id > ?
+		  ORDER BY e.id
+		  LIMIT ?`, agentID, agentID, afterID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AgentStatusEvent{}
+	for rows.Next() {
+		var ev AgentStatusEvent
+		if err := rows.Scan(&ev.ID, &ev.AgentID, &ev.Hostname, &ev.Status, &ev.At); err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
+
+// ListStaleAgents returns agents last seen before seenBefore, oldest first.
+func (s *SQLiteStore) ListStaleAgents(seenBefore int64, limit int) ([]AgentRecord, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`
+		 FROM agents
+		 WHERE last_seen < ?
+		 ORDER BY last_seen
+		 LIMIT ?`, seenBefore, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AgentRecord
+	for rows.Next() {
+		rec, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *rec)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) ListAgentsMissingInventory(seenAfter, inventoryBefore int64, limit int) ([]InventoryGap, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT `+agentColumns+`, COALESCE(inv.at, 0)
+		   FROM agents
+		   LEFT JOIN (
+		     SELECT agent_id, MAX(COALESCE(last_seen_identical_at, created_at)) AS at
+		       FROM agent_inventory_snapshots
+		      GROUP BY agent_id
+		   ) inv ON inv.agent_id = agents.id
+		  WHERE agents.last_seen >= ? AND (inv.at IS NULL OR inv.at < ?)
+		  ORDER BY COALESCE(inv.at, 0), agents.last_seen DESC
+		  LIMIT ?`, seenAfter, inventoryBefore, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []InventoryGap{}
+	for rows.Next() {
+		var g InventoryGap
+		rec, err := scanAgent(rows, &g.LastInventoryAt)
+		if err != nil {
+			return nil, err
+		}
+		g.Agent = *rec
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) UpsertAgentFacts(f AgentFacts) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO agent_facts (
+			agent_id, updated_at,
+			os_caption, os_version, os_build,
+			cpu_name, cpu_cores, cpu_logical,
+			ram_total_bytes, ram_free_bytes,
+			uptime_seconds, boot_time, ipv4_primary,
+			disk_total_bytes, disk_free_bytes,
+			timezone, utc_offset_minutes, locale,
+			updates_pending, gateways_json, dns_servers_json
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(agent_id) DO UPDATE SET
+			updated_at=excluded.updated_at,
+			os_caption=excluded.os_caption,
+			os_version=excluded.os_version,
+			os_build=excluded.os_build,
+			cpu_name=excluded.cpu_name,
+			cpu_cores=excluded.cpu_cores,
+			cpu_logical=excluded.cpu_logical,
+			ram_total_bytes=excluded.ram_total_bytes,
+			ram_free_bytes=excluded.ram_free_bytes,
+			uptime_seconds=excluded.uptime_seconds,
+			boot_time=excluded.boot_time,
+			ipv4_primary=excluded.ipv4_primary,
+			disk_total_bytes=excluded.disk_total_bytes,
+			disk_free_bytes=excluded.disk_free_bytes,
+			timezone=excluded.timezone,
+			utc_offset_minutes=excluded.utc_offset_minutes,
+			locale=excluded.locale,
+			updates_pending=excluded.updates_pending,
+			gateways_json=excluded.gateways_json,
+			dns_servers_json=excluded.dns_servers_json
+		`,
+		f.AgentID, f.UpdatedAt,
+		f.OSCaption, f.OSVersion, f.OSBuild,
+		f.CPUName, f.CPUCores, f.CPULogical,
+		f.RAMTotalBytes, f.RAMFreeBytes,
+		f.UptimeSeconds, f.BootTime, f.IPv4Primary,
+		f.DiskTotalBytes, f.DiskFreeBytes,
+		f.Timezone, f.UTCOffsetMinutes, f.Locale,
+		f.UpdatesPending, stringListJSON(f.Gateways), stringListJSON(f.DNSServers),
+	)
+	return err
+}
+
+func (s *SQLiteStore) UpdateAgentQuickFacts(agentID string, q shared.QuickFacts) error {
+	_, err := s.conn().Exec(
+		`UPDATE agent_facts SET
+			ram_total_bytes=COALESCE(NULLIF(?, 0), ram_total_bytes),
+			ram_free_bytes=COALESCE(NULLIF(?, 0), ram_free_bytes),
+			disk_total_bytes=COALESCE(NULLIF(?, 0), disk_total_bytes),
+			disk_free_bytes=COALESCE(NULLIF(?, 0), disk_free_bytes),
+			uptime_seconds=COALESCE(NULLIF(?, 0), uptime_seconds),
+			boot_time=COALESCE(NULLIF(?, 0), boot_time),
+			quick_facts_at=?
+		WHERE agent_id=?`,
+		q.RAMTotalBytes, q.RAMFreeBytes, q.DiskTotalBytes, q.DiskFreeBytes,
+		q.UptimeSeconds, q.BootTime, q.CollectedAt, agentID,
+	)
+	return err
+}
+
+func (s *SQLiteStore) SetAgentCustomFacts(agentID string, facts map[string]string, at int64) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM agent_custom_facts WHERE agent_id = ?`, agentID); err != nil {
+		return err
+	}
+	for name, value := range facts {
+		if _, err := tx.Exec(
+			`INSERT INTO agent_custom_facts (agent_id, name, value, updated_at) VALUES (?, ?, ?, ?)`,
+			agentID, name, value, at,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) GetAgentFacts(agentID string) (*AgentFacts, error) {
+	row := s.conn().QueryRow(
+		`SELECT agent_id, updated_at,
+		        COALESCE(os_caption, ''), COALESCE(os_version, ''), COALESCE(os_build, ''),
+		        COALESCE(cpu_name, ''), COALESCE(cpu_cores, 0), COALESCE(cpu_logical, 0),
+		        COALESCE(ram_total_bytes, 0), COALESCE(ram_free_bytes, 0),
+		        `+factsUptimeColumn+`, COALESCE(boot_time, 0), COALESCE(ipv4_primary, ''),
+		        COALESCE(disk_total_bytes, 0), COALESCE(disk_free_bytes, 0),
+		        COALESCE(timezone, ''), COALESCE(utc_offset_minutes, 0), COALESCE(locale, ''),
+		        updates_pending, gateways_json, dns_servers_json
+		   FROM agent_facts f
+		  WHERE agent_id = ?`, agentID,
+	)
+
+	var f AgentFacts
+	var updates sql.NullInt64
+	var gateways, dns sql.NullString
+	if err := row.Scan(
+		&f.AgentID, &f.UpdatedAt,
+		&f.OSCaption, &f.OSVersion, &f.OSBuild,
+		&f.CPUName, &f.CPUCores, &f.CPULogical,
+		&f.RAMTotalBytes, &f.RAMFreeBytes,
+		&f.UptimeSeconds, &f.BootTime, &f.IPv4Primary,
+		&f.DiskTotalBytes, &f.DiskFreeBytes,
+		&f.Timezone, &f.UTCOffsetMinutes, &f.Locale,
+		&updates, &gateways, &dns,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	f.UpdatesPending = nullInt64Ptr(updates)
+	f.Gateways, f.DNSServers = stringListFromJSON(gateways), stringListFromJSON(dns)
+	return &f, nil
+}
+
+func (s *SQLiteStore) EachAgentFacts(limit int, fn func(AgentFacts) error) error {
+	if limit <= 0 {
+		limit = 200
+	}
+
+	// Every fact is COALESCEd (or scanned as nullable), as in GetAgentFacts
+	// and agentFactsViewColumns: a row written by a path that only fills some
+	// facts must not fail the whole list.
+	rows, err := s.conn().Query(
+		`SELECT agent_id, updated_at,
+		        COALESCE(os_caption, ''), COALESCE(os_version, ''), COALESCE(os_build, ''),
+		        COALESCE(cpu_name, ''), COALESCE(cpu_cores, 0), COALESCE(cpu_logical, 0),
+		        COALESCE(ram_total_bytes, 0), COALESCE(ram_free_bytes, 0),
+		        `+factsUptimeColumn+`, COALESCE(boot_time, 0), COALESCE(ipv4_primary, ''),
+		        COALESCE(disk_total_bytes, 0), COALESCE(disk_free_bytes, 0),
+		        COALESCE(timezone, ''), COALESCE(utc_offset_minutes, 0), COALESCE(locale, ''),
+		        updates_pending, gateways_json, dns_servers_json
+		   FROM agent_facts f
+		   ORDER BY updated_at DESC
+		   LIMIT ?`, limit,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f AgentFacts
+		var updates sql.NullInt64
+		var gateways, dns sql.NullString
+		if err := rows.Scan(
+			&f.AgentID, &f.UpdatedAt,
+			&f.OSCaption, &f.OSVersion, &f.OSBuild,
+			&f.CPUName, &f.CPUCores, &f.CPULogical,
+			&f.RAMTotalBytes, &f.RAMFreeBytes,
+			&f.UptimeSeconds, &f.BootTime, &f.IPv4Primary,
+			&f.DiskTotalBytes, &f.DiskFreeBytes,
+			&f.Timezone, &f.UTCOffsetMinutes, &f.Locale,
+			&updates, &gateways, &dns,
+		); err != nil {
+			return err
+		}
+		f.UpdatesPending = nullInt64Ptr(updates)
+		f.Gateways, f.DNSServers = stringListFromJSON(gateways), stringListFromJSON(dns)
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// factsUptimeColumn is the uptime of agent_facts f as of now: counted from
+// boot_time when that's known, else the uptime its last inventory reported.
+const factsUptimeColumn = `CASE WHEN f.boot_time > 0
+	THEN MAX(CAST(strftime('%s', 'now') AS INTEGER) - f.boot_time, 0)
+	ELSE COALESCE(f.uptime_seconds, 0) END`
+
+// customFactsColumn is agent a's custom facts as a JSON object.
+const customFactsColumn = `(SELECT json_group_object(c.name, c.value)
+	FROM agent_custom_facts c WHERE c.agent_id = a.id)`
+
+// agentFactsViewColumns is the column list scanned by scanAgentFactsView
+// (agents a joined with agent_facts f).
+const agentFactsViewColumns = `
+	a.id,
+	a.hostname,
+	a.tags_json,
+	a.last_seen,
+
+	COALESCE(f.os_caption, ''),
+	COALESCE(f.os_version, ''),
+	COALESCE(f.os_build, ''),
+
+	COALESCE(f.cpu_name, ''),
+	COALESCE(f.cpu_cores, 0),
+	COALESCE(f.cpu_logical, 0),
+
+	COALESCE(f.ram_total_bytes, 0),
+	COALESCE(f.ram_free_bytes, 0),
+
+	` + factsUptimeColumn + `,
+	COALESCE(f.boot_time, 0),
+	COALESCE(f.ipv4_primary, ''),
+
+	COALESCE(f.disk_total_bytes, 0),
+	COALESCE(f.disk_free_bytes, 0),
+
+	COALESCE(f.timezone, ''),
+	COALESCE(f.utc_offset_minutes, 0),
+	COALESCE(f.locale, ''),
+
+	f.updates_pending,
+	f.gateways_json,
+	f.dns_servers_json,
+
+	COALESCE(f.updated_at, 0),
+	COALESCE(f.quick_facts_at, 0),
+
+	` + customFactsColumn
+
+func scanAgentFactsView(row rowScanner) (*AgentFactsView, error) {
+	var v AgentFactsView
+	var tagsJSON string
+	var updates sql.NullInt64
+	var gateways, dns, customJSON sql.NullString
+	if err := row.Scan(
+		&v.AgentID,
+		&v.Hostname,
+		&tagsJSON,
+		&v.LastSeen,
+
+		&v.OSCaption,
+		&v.OSVersion,
+		&v.OSBuild,
+
+		&v.CPUName,
+		&v.CPUCores,
+		&v.CPULogical,
+
+		&v.RAMTotalBytes,
+		&v.RAMFreeBytes,
+
+		&v.UptimeSeconds,
+		&v.BootTime,
+		&v.IPv4Primary,
+
+		&v.DiskTotalBytes,
+		&v.DiskFreeBytes,
+
+		&v.Timezone,
+		&v.UTCOffsetMinutes,
+		&v.Locale,
+
+		&updates,
+		&gateways,
+		&dns,
+
+		&v.UpdatedAt,
+		&v.QuickFactsAt,
+
+		&customJSON,
+	); err != nil {
+		return nil, err
+	}
+	v.UpdatesPending = nullInt64Ptr(updates)
+	v.Gateways, v.DNSServers = stringListFromJSON(gateways), stringListFromJSON(dns)
+	_ = json.Unmarshal([]byte(tagsJSON), &v.Tags)
+	if customJSON.Valid {
+		_ = json.Unmarshal([]byte(customJSON.String), &v.CustomFacts)
+	}
+	return &v, nil
 }
 
 func (s *SQLiteStore) ListAgentFactsView(limit int) ([]AgentFactsView, error) {
 	if limit <= 0 {
-		limit = 200
+		limit = 200
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT `+agentFactsViewColumns+`
+		FROM agents a
+		LEFT JOIN agent_facts f ON f.agent_id = a.id
+		ORDER BY a.last_seen DESC
+		LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AgentFactsView
+	for rows.Next() {
+		v, err := scanAgentFactsView(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *v)
+	}
+
+	return out, nil
+}
+
+func (s *SQLiteStore) ListAgentsNeedingUpdates(minPending int64, limit int) ([]AgentFactsView, error) {
+	if limit <= 0 {
+		limit = 200
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT `+agentFactsViewColumns+`
+		FROM agents a
+		JOIN agent_facts f ON f.agent_id = a.id
+		WHERE f.updates_pending >= ?
+		ORDER BY f.updates_pending DESC, a.hostname
+		LIMIT ?`, minPending, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AgentFactsView{}
+	for rows.Next() {
+		v, err := scanAgentFactsView(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *v)
+	}
+	return out, rows.Err()
+}
+
+// nullInt64Ptr maps NULL to nil.
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+func (s *SQLiteStore) CreateTemplate(t CommandTemplate) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO command_templates (id, name, description, kind, shell, command, timeout_seconds, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.Name, t.Description, t.Kind, t.Shell, t.Command, t.TimeoutSeconds, t.CreatedAt,
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetTemplateByName(name string) (*CommandTemplate, error) {
+	row := s.conn().QueryRow(
+		`SELECT id, name, description, kind, shell, command, timeout_seconds, created_at
+		   FROM command_templates WHERE name = ?`, name,
+	)
+	var t CommandTemplate
+	if err := row.Scan(&t.ID, &t.Name, &t.Description, &t.Kind, &t.Shell, &t.Command, &t.TimeoutSeconds, &t.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *SQLiteStore) ListTemplates() ([]CommandTemplate, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, name, description, kind, shell, command, timeout_seconds, created_at
+		   FROM command_templates ORDER BY name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []CommandTemplate{}
+	for rows.Next() {
+		var t CommandTemplate
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.Kind, &t.Shell, &t.Command, &t.TimeoutSeconds, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteTemplate(name string) (bool, error) {
+	res, err := s.conn().Exec(`DELETE FROM command_templates WHERE name = ?`, name)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) CreateServiceKey(k ServiceKey) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO service_keys (id, label, key_hash, created_at) VALUES (?, ?, ?, ?)`,
+		k.ID, k.Label, k.Hash, k.CreatedAt,
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetServiceKey(id string) (*ServiceKey, error) {
+	row := s.conn().QueryRow(
+		`SELECT id, label, key_hash, created_at, revoked_at FROM service_keys WHERE id = ?`, id,
+	)
+	var (
+		k       ServiceKey
+		revoked sql.NullInt64
+	)
+	if err := row.Scan(&k.ID, &k.Label, &k.Hash, &k.CreatedAt, &revoked); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if revoked.Valid {
+		k.RevokedAt = &revoked.Int64
+	}
+	return &k, nil
+}
+
+func (s *SQLiteStore) ListServiceKeys() ([]ServiceKey, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, label, created_at, revoked_at FROM service_keys ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []ServiceKey{}
+	for rows.Next() {
+		var (
+			k       ServiceKey
+			revoked sql.NullInt64
+		)
+		if err := rows.Scan(&k.ID, &k.Label, &k.CreatedAt, &revoked); err != nil {
+			return nil, err
+		}
+		if revoked.Valid {
+			k.RevokedAt = &revoked.Int64
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+// RevokeServiceKey marks a live key revoked. Revoking twice reports not found.
+func (s *SQLiteStore) RevokeServiceKey(id string, at int64) (bool, error) {
+	res, err := s.conn().Exec(
+		`UPDATE service_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, at, id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) CreateCommandPolicy(p CommandPolicy) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO command_policies (id, tag, action, pattern, description, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		p.ID, p.Tag, p.Action, p.Pattern, p.Description, p.CreatedAt,
+	)
+	return err
+}
+
+func (s *SQLiteStore) ListCommandPolicies() ([]CommandPolicy, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, tag, action, pattern, description, created_at
+		   FROM command_policies ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []CommandPolicy{}
+	for rows.Next() {
+		var p CommandPolicy
+		if err := rows.Scan(&p.ID, &p.Tag, &p.Action, &p.Pattern, &p.Description, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteCommandPolicy(id string) (bool, error) {
+	res, err := s.conn().Exec(`DELETE FROM command_policies WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) AddPolicyRejection(rej PolicyRejection) error {
+	var policyID sql.NullString
+	if rej.PolicyID != "" {
+		policyID = sql.NullString{String: rej.PolicyID, Valid: true}
+	}
+	_, err := s.conn().Exec(
+		`INSERT INTO command_policy_rejections (at, agent_id, command, policy_id, reason, key_label, remote)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rej.At, rej.AgentID, rej.Command, policyID, rej.Reason, rej.KeyLabel, rej.Remote,
+	)
+	return err
+}
+
+// ListPolicyRejections returns the most recent rejections first.
+func (s *SQLiteStore) ListPolicyRejections(limit int) ([]PolicyRejection, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	rows, err := s.conn().Query(
+		`SELECT id, at, agent_id, command, COALESCE(policy_id, ''), reason, key_label, remote
+		   FROM command_policy_rejections ORDER BY id DESC LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	rows, err := s.DB.Query(
-		`SELECT
-			a.id,
-			a.hostname,
-			a.tags_json,
-			a.last_seen,
+	out := []PolicyRejection{}
+	for rows.Next() {
+		var r PolicyRejection
+		if err := rows.Scan(&r.ID, &r.At, &r.AgentID, &r.Command, &r.PolicyID, &r.Reason, &r.KeyLabel, &r.Remote); err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
 
-			COALESCE(f.os_caption, ''),
-			COALESCE(f.os_version, ''),
-			COALESCE(f.os_build, ''),
+func (s *SQLiteStore) GetStats(onlineSince int64) (*Stats, error) {
+	st := &Stats{
+		AgentsByOS:   map[string]int64{},
+		JobsByStatus: map[string]int64{},
+		GeneratedAt:  time.Now().Unix(),
+	}
 
-			COALESCE(f.cpu_name, ''),
-			COALESCE(f.cpu_cores, 0),
-			COALESCE(f.cpu_logical, 0),
+	if err := s.conn().QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(CASE WHEN last_seen >= ? THEN 1 ELSE 0 END), 0) FROM agents`,
+		onlineSince,
+	).Scan(&st.AgentsTotal, &st.AgentsOnline); err != nil {
+		return nil, err
+	}
+	st.AgentsOffline = st.AgentsTotal - st.AgentsOnline
 
-			COALESCE(f.ram_total_bytes, 0),
-			COALESCE(f.ram_free_bytes, 0),
+	if err := s.countGroups(`SELECT os, COUNT(*) FROM agents GROUP BY os`, st.AgentsByOS); err != nil {
+		return nil, err
+	}
+	if err := s.countGroups(`SELECT status, COUNT(*) FROM jobs GROUP BY status`, st.JobsByStatus); err != nil {
+		return nil, err
+	}
 
-			COALESCE(f.uptime_seconds, 0),
-			COALESCE(f.ipv4_primary, ''),
+	if err := s.conn().QueryRow(`SELECT COUNT(*) FROM agent_inventory_snapshots`).Scan(&st.InventorySnapshots); err != nil {
+		return nil, err
+	}
 
-			COALESCE(f.disk_total_bytes, 0),
-			COALESCE(f.disk_free_bytes, 0),
+	// Main DB file size; the WAL file isn't included.
+	if err := s.conn().QueryRow(
+		`SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`,
+	).Scan(&st.StorageBytes); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
 
-			COALESCE(f.updated_at, 0)
-		FROM agents a
-		LEFT JOIN agent_facts f ON f.agent_id = a.id
-		ORDER BY a.last_seen DESC
-		LIMIT ?`, limit,
+// FactsDistribution counts agents per value of one groupable facts column
+// (see factsGroupableFields), most common first. Missing values count as "".
+func (s *SQLiteStore) FactsDistribution(field string) ([]FactCount, error) {
+	if !factsGroupableFields[field] {
+		return nil, fmt.Errorf("field %q is not groupable", field)
+	}
+	rows, err := s.conn().Query(
+		`SELECT COALESCE(` + field + `, '') AS v, COUNT(*) AS n
+		   FROM agent_facts
+		  GROUP BY v
+		  ORDER BY n DESC, v`,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var out []AgentFactsView
+	out := []FactCount{}
 	for rows.Next() {
-		var v AgentFactsView
-		var tagsJSON string
-		if err := rows.Scan(
-			&v.AgentID,
-			&v.Hostname,
-			&tagsJSON,
-			&v.LastSeen,
+		var fc FactCount
+		if err := rows.Scan(&fc.Value, &fc.Count); err != nil {
+			return nil, err
+		}
+		out = append(out, fc)
+	}
+	return out, rows.Err()
+}
 
-			&v.OSCaption,
-			&v.OSVersion,
-			&v.OSBuild,
+func (s *SQLiteStore) FindAgentsByFacts(where []shared.FactCondition) ([]string, error) {
+	var (
+		conds []string
+		args  []any
+	)
+	for _, c := range where {
+		f, ok := factsQueryFields[c.Field]
+		if !ok {
+			return nil, fmt.Errorf("field %q is not queryable", c.Field)
+		}
+		col := "COALESCE(" + f.column + ", '')"
+		if f.numeric {
+			col = "COALESCE(" + f.column + ", 0)"
+		}
+		switch c.Op {
+		case "=", "!=", "<", "<=", ">", ">=":
+			conds = append(conds, col+" "+c.Op+" ?")
+			args = append(args, c.Value)
+		case "prefix", "contains":
+			v, _ := c.Value.(string)
+			pattern := likeEscaper.Replace(v) + "%"
+			if c.Op == "contains" {
+				pattern = "%" + pattern
+			}
+			conds = append(conds, col+` LIKE ? ESCAPE '\'`)
+			args = append(args, pattern)
+		default:
+			return nil, fmt.Errorf("op %q is not supported", c.Op)
+		}
+	}
+	if len(conds) == 0 {
+		return nil, errors.New("no conditions")
+	}
+
+	rows, err := s.conn().Query(
+		`SELECT a.id FROM agents a JOIN agent_facts f ON f.agent_id = a.id
+		  WHERE `+strings.Join(conds, " AND ")+`
+		  ORDER BY a.id`, args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-			&v.CPUName,
-			&v.CPUCores,
-			&v.CPULogical,
+	out := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
 
-			&v.RAMTotalBytes,
-			&v.RAMFreeBytes,
+// likeEscaper escapes LIKE wildcards for use with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
 
-			&v.UptimeSeconds,
-			&v.IPv4Primary,
+// countGroups runs a "SELECT key, COUNT(*) ... GROUP BY key" query into out.
+func (s *SQLiteStore) countGroups(query string, out map[string]int64) error {
+	rows, err := s.conn().Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			key string
+			n   int64
+		)
+		if err := rows.Scan(&key, &n); err != nil {
+			return err
+		}
+		out[key] = n
+	}
+	return rows.Err()
+}
 
-			&v.DiskTotalBytes,
-			&v.DiskFreeBytes,
+func (s *SQLiteStore) ReserveEnrollRegistration(tokenHash string, max int) (bool, error) {
+	// One statement, so concurrent enrolls can't both take the last slot.
+	res, err := s.conn().Exec(
+		`INSERT INTO enroll_token_uses (token_hash, registrations, last_used_at) VALUES (?, 1, ?)
+		 ON CONFLICT(token_hash) DO UPDATE
+		    SET registrations = registrations + 1, last_used_at = excluded.last_used_at
+		  WHERE registrations < ?`,
+		tokenHash, time.Now().Unix(), max,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
 
-			&v.UpdatedAt,
-		); err != nil {
+func (s *SQLiteStore) CreateEnrollToken(tokenHash string, createdAt, expiresAt int64, createdBy string) error {
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM enroll_tokens WHERE expires_at <= ?`, createdAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO enroll_tokens (token_hash, created_at, expires_at, created_by) VALUES (?, ?, ?, ?)`,
+		tokenHash, createdAt, expiresAt, createdBy,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) EnrollTokenValid(tokenHash string, now int64) (bool, error) {
+	var n int
+	err := s.conn().QueryRow(
+		`SELECT COUNT(*) FROM enroll_tokens WHERE token_hash = ? AND expires_at > ?`,
+		tokenHash, now,
+	).Scan(&n)
+	return n > 0, err
+}
+
+func (s *SQLiteStore) CreateEnrollKey(k EnrollKey) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO enroll_keys (id, public_key, note, created_at, created_by, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.ID, k.PublicKey, k.Note, k.CreatedAt, k.CreatedBy, k.ExpiresAt,
+	)
+	return err
+}
+
+func (s *SQLiteStore) ListEnrollKeys() ([]EnrollKey, error) {
+	rows, err := s.conn().Query(
+		`SELECT id, public_key, note, created_at, created_by, expires_at, used_at, agent_id
+		   FROM enroll_keys ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []EnrollKey{}
+	for rows.Next() {
+		var (
+			k    EnrollKey
+			used sql.NullInt64
+		)
+		if err := rows.Scan(&k.ID, &k.PublicKey, &k.Note, &k.CreatedAt, &k.CreatedBy, &k.ExpiresAt, &used, &k.AgentID); err != nil {
 			return nil, err
 		}
+		if used.Valid {
+			k.UsedAt = &used.Int64
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
 
-		_ = json.Unmarshal([]byte(tagsJSON), &v.Tags)
-		out = append(out, v)
+func (s *SQLiteStore) DeleteEnrollKey(id string) (bool, error) {
+	res, err := s.conn().Exec(`DELETE FROM enroll_keys WHERE id = ?`, id)
+	if err != nil {
+		return false, err
 	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
 
-	return out, nil
+// enrollKeyLive matches enroll_keys rows that may enroll at the bound time:
+// unused and unexpired, or used by an agent that still has this key.
+const enrollKeyLive = `((used_at IS NULL AND expires_at > ?)
+	OR EXISTS (SELECT 1 FROM agents a WHERE a.public_key = enroll_keys.public_key))`
+
+func (s *SQLiteStore) SetEnrollChallenge(publicKey, challenge string, expiresAt, now int64) (bool, error) {
+	res, err := s.conn().Exec(
+		`UPDATE enroll_keys SET challenge = ?, challenge_expires_at = ?
+		  WHERE public_key = ? AND `+enrollKeyLive,
+		challenge, expiresAt, publicKey, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) ConsumeEnrollChallenge(publicKey, challenge string, now int64) (bool, error) {
+	res, err := s.conn().Exec(
+		`UPDATE enroll_keys SET challenge = '', challenge_expires_at = 0
+		  WHERE public_key = ? AND challenge = ? AND challenge <> '' AND challenge_expires_at > ?
+		    AND `+enrollKeyLive,
+		publicKey, challenge, now, now,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) MarkEnrollKeyUsed(publicKey, agentID string, at int64) error {
+	_, err := s.conn().Exec(
+		`UPDATE enroll_keys SET used_at = COALESCE(used_at, ?), agent_id = ? WHERE public_key = ?`,
+		at, agentID, publicKey,
+	)
+	return err
+}
+
+func (s *SQLiteStore) CreateGroup(g AgentGroup) error {
+	_, err := s.conn().Exec(
+		`INSERT INTO agent_groups (id, name, description, created_at) VALUES (?, ?, ?, ?)`,
+		g.ID, g.Name, g.Description, g.CreatedAt,
+	)
+	return err
+}
+
+const groupColumns = `g.id, g.name, g.description, g.created_at,
+	(SELECT COUNT(*) FROM agent_group_members m WHERE m.group_id = g.id)`
+
+func scanGroup(row rowScanner) (*AgentGroup, error) {
+	var g AgentGroup
+	if err := row.Scan(&g.ID, &g.Name, &g.Description, &g.CreatedAt, &g.MemberCount); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *SQLiteStore) GetGroup(id string) (*AgentGroup, error) {
+	g, err := scanGroup(s.conn().QueryRow(`SELECT `+groupColumns+` FROM agent_groups g WHERE g.id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return g, err
+}
+
+func (s *SQLiteStore) ListGroups() ([]AgentGroup, error) {
+	rows, err := s.conn().Query(`SELECT ` + groupColumns + ` FROM agent_groups g ORDER BY g.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []AgentGroup{}
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *g)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) DeleteGroup(id string) (bool, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM agent_group_members WHERE group_id = ?`, id); err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`DELETE FROM agent_groups WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, tx.Commit()
+}
+
+// AddGroupMembers adds agents to a group; ones already in it are ignored.
+func (s *SQLiteStore) AddGroupMembers(groupID string, agentIDs []string) (int, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	added := 0
+	for _, id := range agentIDs {
+		res, err := tx.Exec(
+			`INSERT OR IGNORE INTO agent_group_members (group_id, agent_id, added_at) VALUES (?, ?, ?)`,
+			groupID, id, now,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		added += int(n)
+	}
+	return added, tx.Commit()
+}
+
+func (s *SQLiteStore) RemoveGroupMember(groupID, agentID string) (bool, error) {
+	res, err := s.conn().Exec(`DELETE FROM agent_group_members WHERE group_id = ? AND agent_id = ?`, groupID, agentID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *SQLiteStore) ListGroupMembers(groupID string) ([]string, error) {
+	rows, err := s.conn().Query(
+		`SELECT agent_id FROM agent_group_members WHERE group_id = ? ORDER BY agent_id`, groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
 }
+
+func (s *SQLiteStore) SchemaStatus() (*SchemaStatus, error) { return SQLiteSchemaStatus(s.DB) }
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"rackroom/internal/shared"
+)
+
+func TestSQLiteDequeueJobsHandsOutOnce(t *testing.T) {
+	api, _ := newTestAPI(t)
+	agentID, err := api.Store.CreateAgent("pubkey", shared.AgentInfo{Hostname: "h1", OS: "linux", Arch: "amd64"}, nil, ApprovalApproved)
+	if err != nil {
+		t.Fatalf("CreateAgent: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := api.Store.QueueJob(agentID, shared.Job{JobID: newUUID(), Shell: "bash", Command: "true", TimeoutSeconds: 60}, 0); err != nil {
+			t.Fatalf("QueueJob: %v", err)
+		}
+	}
+
+	jobs, _, err := api.Store.DequeueJobs(agentID, 5, nil)
+	if err != nil || len(jobs) != 2 {
+		t.Fatalf("first DequeueJobs = %d jobs, %v; want 2", len(jobs), err)
+	}
+	for _, j := range jobs {
+		d, err := api.Store.GetJobDetail(j.JobID)
+		if err != nil || d == nil || d.Status != "running" {
+			t.Errorf("job %s after dequeue: %+v, %v; want running", j.JobID, d, err)
+		}
+	}
+	again, _, err := api.Store.DequeueJobs(agentID, 5, nil)
+	if err != nil || len(again) != 0 {
+		t.Errorf("second DequeueJobs = %d jobs, %v; want none", len(again), err)
+	}
+}
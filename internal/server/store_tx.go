@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// -----------------------------------------------------------------------------
+// Store transactions (Store.InTx)
+// -----------------------------------------------------------------------------
+//
+// The SQL stores run each method on their *sql.DB, opening a transaction of
+// their own where a method needs one. InTx hands its function a copy of the
+// store bound to one open transaction instead: every call on it runs in that
+// transaction, and a method that would begin its own gets a savepoint in it,
+// as does a nested InTx. Both SQLite and PostgreSQL have savepoints, so a
+// failed step rolls back just its own writes and the rest can still commit.
+
+// sqlConn is what a store method runs statements on: the database, or the
+// transaction InTx opened.
+type sqlConn interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// storeTx is a transaction a store method began: a *sql.Tx, or a savepoint
+// within InTx's. Rollback after Commit does nothing, as with *sql.Tx.
+type storeTx interface {
+	sqlConn
+	Commit() error
+	Rollback() error
+}
+
+// txScope is the transaction an InTx store is bound to. Like the *sql.Tx it
+// wraps, it is used by one goroutine at a time.
+type txScope struct {
+	tx         *sql.Tx
+	savepoints int
+}
+
+// savepoint opens a savepoint named uniquely within the transaction.
+func (sc *txScope) savepoint() (storeTx, error) {
+	sc.savepoints++
+	name := "rr_sp_" + strconv.Itoa(sc.savepoints)
+	if _, err := sc.tx.Exec(`SAVEPOINT ` + name); err != nil {
+		return nil, err
+	}
+	return &savepointTx{sqlConn: sc.tx, name: name}, nil
+}
+
+type savepointTx struct {
+	sqlConn
+	name string
+	done bool
+}
+
+func (sp *savepointTx) Commit() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	if _, err := sp.Exec(`RELEASE SAVEPOINT ` + sp.name); err != nil {
+		// Postgres refuses RELEASE once a statement in the savepoint
+		// failed; undo it so the transaction stays usable.
+		_, _ = sp.Exec(`ROLLBACK TO SAVEPOINT ` + sp.name)
+		_, _ = sp.Exec(`RELEASE SAVEPOINT ` + sp.name)
+		return err
+	}
+	return nil
+}
+
+func (sp *savepointTx) Rollback() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	if _, err := sp.Exec(`ROLLBACK TO SAVEPOINT ` + sp.name); err != nil {
+		return err
+	}
+	_, err := sp.Exec(`RELEASE SAVEPOINT ` + sp.name)
+	return err
+}
+
+// storeConn is what the store's plain statements run on.
+func storeConn(db *sql.DB, scope *txScope) sqlConn {
+	if scope != nil {
+		return scope.tx
+	}
+	return db
+}
+
+// storeBegin starts what a store method runs as its own transaction.
+func storeBegin(db *sql.DB, scope *txScope, opts *sql.TxOptions) (storeTx, error) {
+	if scope != nil {
+		// Isolation was fixed when InTx began.
+		return scope.savepoint()
+	}
+	return db.BeginTx(context.Background(), opts)
+}
+
+// runInTx runs fn with a store bound to a new transaction (bind makes it),
+// or to a savepoint when scope is already one.
+func runInTx(db *sql.DB, scope *txScope, bind func(*txScope) Store, fn func(Store) error) error {
+	var (
+		tx  storeTx
+		err error
+	)
+	if scope != nil {
+		tx, err = scope.savepoint()
+	} else {
+		var sqlTx *sql.Tx
+		sqlTx, err = db.Begin()
+		tx, scope = sqlTx, &txScope{tx: sqlTx}
+	}
+	if err != nil {
+		return err
+	}
+	if err := fn(bind(scope)); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"rackroom/internal/shared"
+)
+
+func TestInTxSavepoints(t *testing.T) {
+	api, _ := newTestAPI(t)
+	errFail := errors.New("fail")
+	info := func(host string) shared.AgentInfo {
+		return shared.AgentInfo{Hostname: host, OS: "linux", Arch: "amd64"}
+	}
+	hostname := func(id string) string {
+		t.Helper()
+		rec, err := api.Store.GetAgentByID(id)
+		if err != nil || rec == nil {
+			t.Fatalf("GetAgentByID(%s): %v", id, err)
+		}
+		return rec.Info.Hostname
+	}
+
+	var kept, undone string
+	err := api.Store.InTx(func(st Store) error {
+		var err error
+		if kept, err = st.CreateAgent("key-kept", info("kept"), nil, ApprovalApproved); err != nil {
+			return err
+		}
+		// A failed nested InTx undoes only its own writes...
+		err = st.InTx(func(st Store) error {
+			if err := st.UpdateAgentSeen(kept, info("renamed"), nil); err != nil {
+				return err
+			}
+			if undone, err = st.CreateAgent("key-undone", info("undone"), nil, ApprovalApproved); err != nil {
+				return err
+			}
+			return errFail
+		})
+		if !errors.Is(err, errFail) {
+			t.Errorf("nested InTx = %v, want errFail", err)
+		}
+		// ...and leaves the transaction usable.
+		return st.UpdateAgentSeen(kept, info("kept-2"), nil)
+	})
+	if err != nil {
+		t.Fatalf("InTx: %v", err)
+	}
+	if got := hostname(kept); got != "kept-2" {
+		t.Errorf("hostname = %q, want kept-2", got)
+	}
+	if rec, _ := api.Store.GetAgentByID(undone); rec != nil {
+		t.Errorf("agent created in the failed savepoint was kept")
+	}
+
+	// A failed outer InTx undoes everything, savepoints included.
+	err = api.Store.InTx(func(st Store) error {
+		if err := st.InTx(func(st Store) error { return st.UpdateAgentSeen(kept, info("lost"), nil) }); err != nil {
+			return err
+		}
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatalf("InTx = %v, want errFail", err)
+	}
+	if got := hostname(kept); got != "kept-2" {
+		t.Errorf("hostname after rollback = %q, want kept-2", got)
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// -----------------------------------------------------------------------------
+// Live heartbeat stream (NDJSON, for dashboards)
+// -----------------------------------------------------------------------------
+//
+// Heartbeat publishes to heartbeatHub; every connected stream client has its
+// own buffered channel. A client that can't keep up misses events rather
+// than slowing down heartbeats: the next heartbeat from the same agent
+// brings it up to date anyway.
+
+const (
+	// heartbeatStreamBuffer is how many events a client may fall behind by
+	// before new ones are dropped for it.
+	heartbeatStreamBuffer = 256
+	// maxHeartbeatStreams caps concurrent stream clients.
+	maxHeartbeatStreams = 64
+	// heartbeatStreamKeepalive is how often an idle stream gets a keepalive
+	// line, so proxies don't time it out.
+	heartbeatStreamKeepalive = 30 * time.Second
+)
+
+// HeartbeatEvent is one line of /v1/admin/stream/heartbeats.
+type HeartbeatEvent struct {
+	Type       string `json:"type"` // "heartbeat" | "keepalive"
+	AgentID    string `json:"agent_id,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+	ServerTime int64  `json:"server_time"`
+}
+
+type heartbeatHub struct {
+	mu   sync.Mutex
+	subs map[chan HeartbeatEvent]struct{}
+}
+
+// subscribe registers a client; ok is false when maxHeartbeatStreams are
+// already connected. cancel must be called once the client is gone.
+func (h *heartbeatHub) subscribe() (ch chan HeartbeatEvent, cancel func(), ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= maxHeartbeatStreams {
+		return nil, nil, false
+	}
+	if h.subs == nil {
+		h.subs = make(map[chan HeartbeatEvent]struct{})
+	}
+	ch = make(chan HeartbeatEvent, heartbeatStreamBuffer)
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}, true
+}
+
+// publish never blocks: a client whose buffer is full misses ev.
+func (h *heartbeatHub) publish(ev HeartbeatEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// AdminStreamHeartbeats holds the connection open and writes one JSON line
+// per agent heartbeat as it arrives, plus a keepalive line every 30s.
+//
+// Route:
+//   GET /v1/admin/stream/heartbeats   (application/x-ndjson)
+
+func (api *API) AdminStreamHeartbeats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, 405, map[string]any{"error": "method not allowed"})
+		return
+	}
+	ch, cancel, ok := api.heartbeats.subscribe()
+	if !ok {
+		writeJSON(w, 503, map[string]any{"error": "too many stream clients"})
+		return
+	}
+	defer cancel()
+
+	// The server's WriteTimeout would cut the stream off; the client
+	// disconnecting (r.Context) is what ends it.
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	keepalive := time.NewTicker(heartbeatStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		var ev HeartbeatEvent
+		select {
+		case <-r.Context().Done():
+			return
+		case ev = <-ch:
+		case <-keepalive.C:
+			ev = HeartbeatEvent{Type: "keepalive", ServerTime: time.Now().Unix()}
+		}
+		if err := enc.Encode(ev); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
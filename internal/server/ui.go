@@ -0,0 +1,62 @@
+package server
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// -----------------------------------------------------------------------------
+// Web UI (static files)
+// -----------------------------------------------------------------------------
+//
+// The operator UI is plain files served from disk (RR_UI_DIR, default
+// ./web/rmm-ui relative to the working directory). Started from anywhere
+// else, that directory doesn't exist and a bare FileServer turns every page
+// into an unexplained 404, so a missing UI gets a placeholder page instead.
+
+// UIHandler serves the web UI from dir, or a placeholder explaining where the
+// UI was looked for if dir isn't a directory. The resolved path is logged
+// either way.
+func UIHandler(dir string) http.Handler {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	if fi, err := os.Stat(abs); err != nil || !fi.IsDir() {
+		log.Printf("ui: %s not found; serving a placeholder (set RR_UI_DIR)", abs)
+		return uiPlaceholder(abs)
+	}
+	log.Printf("ui: serving %s", abs)
+	return http.FileServer(http.Dir(abs))
+}
+
+var uiPlaceholderPage = template.Must(template.New("ui").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>RackRoom: web UI not found</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 3em auto">
+<h1>Web UI not found</h1>
+<p>rr-server is running, but the web UI files aren't where it looked:</p>
+<pre>{{.}}</pre>
+<p>Start rr-server from the repository root, or set <code>RR_UI_DIR</code> to the
+<code>web/rmm-ui</code> directory. The API under <code>/v1/</code> is unaffected.</p>
+</body></html>
+`))
+
+// uiPlaceholder answers every non-API path with 404 and, for browsers, the
+// placeholder page.
+func uiPlaceholder(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Error(w, "web UI not found on server (RR_UI_DIR="+dir+")", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		if r.Method != http.MethodHead {
+			_ = uiPlaceholderPage.Execute(w, dir)
+		}
+	})
+}
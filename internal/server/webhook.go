@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FactsWebhook pushes "facts changed" events to an external system (e.g. a CMDB).
+//
+// Deliveries run in the background so heartbeats never wait on the receiver:
+// Notify queues each event for one of Workers delivery goroutines, picked by
+// agent so one agent's events go out in order. The queue holds QueueSize
+// events in all; when an agent's share of it is full, its new events go
+// straight to the dead-letter file rather than piling up in memory.
+// Each POST carries:
+//   - X-RR-Event:     event name ("agent.facts_changed")
+//   - X-RR-Timestamp: unix seconds
+//   - X-RR-Signature: hex HMAC-SHA256 over "<timestamp>.<body>" using Secret
+//     (left out if Secret is empty; rr-server refuses to start without one)
+//
+// The body is a FactsChangedEvent; its facts are in the shape of the admin
+// facts listing (AgentFactsView).
+//
+// Failed deliveries are retried with exponential backoff; after MaxAttempts the
+// event is appended to DeadLetterPath (JSON lines) so nothing is silently lost.
+type FactsWebhook struct {
+	URL            string
+	Secret         string
+	DeadLetterPath string
+	MaxAttempts    int
+	Backoff        time.Duration // first retry delay; doubles per attempt
+	Client         *http.Client
+	Workers        int // delivery goroutines; fixed at the first Notify
+	QueueSize      int // events waiting across all workers
+
+	mu     sync.Mutex // serializes dead-letter writes
+	start  sync.Once
+	queues []chan FactsChangedEvent // one per worker
+}
+
+func NewFactsWebhook(url, secret, deadLetterPath string) *FactsWebhook {
+	return &FactsWebhook{
+		URL:            url,
+		Secret:         secret,
+		DeadLetterPath: deadLetterPath,
+		MaxAttempts:    5,
+		Backoff:        time.Second,
+		Client:         &http.Client{Timeout: 10 * time.Second},
+		Workers:        4,
+		QueueSize:      1024,
+	}
+}
+
+type FactChange struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+type FactsChangedEvent struct {
+	Event   string         `json:"event"`
+	AgentID string         `json:"agent_id"`
+	At      int64          `json:"at"`
+	Changes []FactChange   `json:"changes"`
+	Facts   AgentFactsView `json:"facts"`
+}
+
+// materialFactChanges compares the fields a CMDB cares about (hardware, OS,
+// addressing). Free space/RAM and uptime change constantly and are ignored.
+func materialFactChanges(prev, next AgentFacts) []FactChange {
+	var out []FactChange
+	add := func(field string, a, b any) {
+		if a != b {
+			out = append(out, FactChange{Field: field, Old: a, New: b})
+		}
+	}
+	add("os_caption", prev.OSCaption, next.OSCaption)
+	add("os_version", prev.OSVersion, next.OSVersion)
+	add("os_build", prev.OSBuild, next.OSBuild)
+	add("cpu_name", prev.CPUName, next.CPUName)
+	add("cpu_cores", prev.CPUCores, next.CPUCores)
+	add("cpu_logical", prev.CPULogical, next.CPULogical)
+	add("ram_total_bytes", prev.RAMTotalBytes, next.RAMTotalBytes)
+	add("ipv4_primary", prev.IPv4Primary, next.IPv4Primary)
+	add("disk_total_bytes", prev.DiskTotalBytes, next.DiskTotalBytes)
+	return out
+}
+
+// Notify queues an event for background delivery, or dead-letters it when
+// the queue is full. It never blocks.
+func (wh *FactsWebhook) Notify(ev FactsChangedEvent) {
+	if wh == nil || wh.URL == "" {
+		return
+	}
+	wh.start.Do(wh.startWorkers)
+
+	h := fnv.New32a()
+	h.Write([]byte(ev.AgentID))
+	select {
+	case wh.queues[h.Sum32()%uint32(len(wh.queues))] <- ev:
+	default:
+		log.Printf("webhook: queue full; dead-lettering event agent_id=%s", ev.AgentID)
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("webhook: marshal failed agent_id=%s: %v", ev.AgentID, err)
+			return
+		}
+		wh.deadLetter(body, 0, errors.New("delivery queue full"))
+	}
+}
+
+func (wh *FactsWebhook) startWorkers() {
+	workers := wh.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	per := wh.QueueSize / workers
+	if per <= 0 {
+		per = 1
+	}
+	wh.queues = make([]chan FactsChangedEvent, workers)
+	for i := range wh.queues {
+		q := make(chan FactsChangedEvent, per)
+		wh.queues[i] = q
+		go func() {
+			for ev := range q {
+				wh.deliver(ev)
+			}
+		}()
+	}
+}
+
+func (wh *FactsWebhook) deliver(ev FactsChangedEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("webhook: marshal failed agent_id=%s: %v", ev.AgentID, err)
+		return
+	}
+
+	attempts := wh.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+	delay := wh.Backoff
+
+	var lastErr error
+	for i := 1; i <= attempts; i++ {
+		if lastErr = wh.post(ev.Event, body); lastErr == nil {
+			return
+		}
+		log.Printf("webhook: attempt %d/%d failed agent_id=%s: %v", i, attempts, ev.AgentID, lastErr)
+		if i < attempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	wh.deadLetter(body, attempts, lastErr)
+}
+
+func (wh *FactsWebhook) post(event string, body []byte) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-RR-Event", event)
+	req.Header.Set("X-RR-Timestamp", ts)
+	if wh.Secret != "" {
+		req.Header.Set("X-RR-Signature", webhookSignature(wh.Secret, ts, body))
+	}
+
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// webhookSignature is what receivers recompute to authenticate a delivery.
+func webhookSignature(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *FactsWebhook) deadLetter(body []byte, attempts int, cause error) {
+	if cause == nil {
+		cause = errors.New("unknown")
+	}
+	line, _ := json.Marshal(map[string]any{
+		"at":       time.Now().Unix(),
+		"url":      wh.URL,
+		"attempts": attempts,
+		"error":    cause.Error(),
+		"payload":  json.RawMessage(body),
+	})
+
+	if wh.DeadLetterPath == "" {
+		log.Printf("webhook: dead letter: %s", line)
+		return
+	}
+
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	f, err := os.OpenFile(wh.DeadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("webhook: dead letter open failed (%v): %s", err, line)
+		return
+	}
+	defer f.Close()
+	_, _ = f.Write(append(line, '\n'))
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFactsWebhookDelivery(t *testing.T) {
+	type delivery struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan delivery, 1)
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got <- delivery{r.Header, b}
+	}))
+	defer recv.Close()
+
+	for _, secret := range []string{"s3cret", ""} {
+		wh := NewFactsWebhook(recv.URL, secret, "")
+		wh.deliver(FactsChangedEvent{
+			Event:   "agent.facts_changed",
+			AgentID: "agent-1",
+			Changes: []FactChange{{Field: "os_build", Old: "1", New: "2"}},
+			Facts:   AgentFactsView{AgentID: "agent-1", Hostname: "h1", OSBuild: "2"},
+		})
+		d := <-got
+
+		var payload struct {
+			Facts map[string]any `json:"facts"`
+		}
+		if err := json.Unmarshal(d.body, &payload); err != nil {
+			t.Fatalf("payload is not JSON: %s", d.body)
+		}
+		if payload.Facts["os_build"] != "2" || payload.Facts["hostname"] != "h1" {
+			t.Errorf("facts = %v, want snake_case keys os_build and hostname", payload.Facts)
+		}
+		if _, ok := payload.Facts["OSBuild"]; ok {
+			t.Errorf("facts carry Go field names: %v", payload.Facts)
+		}
+
+		sig := d.header.Get("X-RR-Signature")
+		if secret == "" {
+			if sig != "" {
+				t.Errorf("unsigned webhook sent X-RR-Signature %q", sig)
+			}
+			continue
+		}
+		if want := webhookSignature(secret, d.header.Get("X-RR-Timestamp"), d.body); sig != want {
+			t.Errorf("X-RR-Signature = %q, want %q", sig, want)
+		}
+	}
+}
+
+func TestFactsWebhookQueueFull(t *testing.T) {
+	arrived := make(chan string, 4)
+	release := make(chan struct{})
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev FactsChangedEvent
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		arrived <- ev.Changes[0].New.(string)
+		<-release
+	}))
+	defer recv.Close()
+	defer close(release)
+
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	wh := NewFactsWebhook(recv.URL, "s3cret", deadLetters)
+	wh.Workers, wh.QueueSize = 1, 1
+	event := func(n string) FactsChangedEvent {
+		return FactsChangedEvent{Event: "agent.facts_changed", AgentID: "agent-1", Changes: []FactChange{{Field: "os_build", New: n}}}
+	}
+
+	wh.Notify(event("1"))
+	if got := <-arrived; got != "1" {
+		t.Fatalf("first delivery = %s, want 1", got)
+	}
+	wh.Notify(event("2")) // waits in the queue behind 1
+	wh.Notify(event("3")) // queue full
+
+	b, err := os.ReadFile(deadLetters)
+	if err != nil || !strings.Contains(string(b), `"new":"3"`) || strings.Count(string(b), "\n") != 1 {
+		t.Fatalf("dead letters = %q (%v), want just event 3", b, err)
+	}
+	release <- struct{}{}
+	if got := <-arrived; got != "2" {
+		t.Errorf("second delivery = %s, want 2", got)
+	}
+}
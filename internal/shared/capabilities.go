@@ -0,0 +1,15 @@
+package shared
+
+import "strings"
+
+// Capabilities are advertised by agents as "<class>:<name>" strings, e.g.
+// "kind:command", "shell:bash", "feature:run_as". The server refuses to queue
+// a job whose kind (or explicit shell) the target agent doesn't list.
+
+// LegacyCapabilities is assumed for agents that predate capability
+// advertisement: they can run plain commands.
+var LegacyCapabilities = []string{CapabilityKind("command")}
+
+func CapabilityKind(kind string) string    { return "kind:" + strings.ToLower(kind) }
+func CapabilityShell(shell string) string  { return "shell:" + strings.ToLower(shell) }
+func CapabilityFeature(name string) string { return "feature:" + strings.ToLower(name) }
@@ -14,6 +14,94 @@ type AgentConfig struct {
 	PollSeconds      int      `json:"poll_seconds"`
 	InventorySeconds int      `json:"inventory_seconds"`
 	Tags             []string `json:"tags"`
+
+	// EnrollWithKey enrolls by signing a server challenge with this agent's
+	// key instead of sending enroll_token; an admin must have pre-authorized
+	// the public key (shown by rr-agent -print-config) first.
+	EnrollWithKey bool `json:"enroll_with_key,omitempty"`
+
+	// InventoryProcesses adds the top N processes by CPU time and by memory to
+	// each inventory snapshot (key "processes"). 0 (default) = off.
+	InventoryProcesses int `json:"inventory_processes,omitempty"`
+
+	// InventoryPeripherals adds mapped network drives ("network_drives") and
+	// printers ("printers") to each Windows inventory snapshot. Off by default
+	// to keep payloads small; ignored on other platforms.
+	InventoryPeripherals bool `json:"inventory_peripherals,omitempty"`
+
+	// InventoryUpdates adds pending OS updates ("pending_updates": Windows
+	// Update, apt or dnf/yum) to each inventory snapshot. A Windows Update
+	// search can take minutes, so raise inventory_timeout_seconds with it;
+	// a check that doesn't finish in time is just left out.
+	InventoryUpdates bool `json:"inventory_updates,omitempty"`
+
+	// InventoryTimeoutSeconds bounds one inventory collection (default 30);
+	// a collector that runs longer (e.g. wedged WMI) is killed.
+	InventoryTimeoutSeconds int `json:"inventory_timeout_seconds,omitempty"`
+
+	// MaxParallelJobs bounds how many polled jobs run at once (default 4).
+	MaxParallelJobs int `json:"max_parallel_jobs,omitempty"`
+
+	// PollBatchSize caps how many jobs one poll asks for (the server clamps
+	// it too). Default: as many as there are idle workers.
+	PollBatchSize int `json:"poll_batch_size,omitempty"`
+
+	// OutputEncoding is how job stdout/stderr bytes are turned into UTF-8:
+	// "auto" (default; Windows OEM code page when not UTF-8), "utf-8", or a
+	// code page such as "cp437" / "cp1252".
+	OutputEncoding string `json:"output_encoding,omitempty"`
+
+	// Shells maps job shell names to the argv that runs a command, which is
+	// appended as the last argument, e.g. {"sh": ["/bin/sh", "-c"]}. Entries
+	// add shells or replace the built-in bash, cmd and powershell.
+	Shells map[string][]string `json:"shells,omitempty"`
+
+	// DefaultShell runs jobs that don't name a shell (default "bash", "cmd"
+	// on Windows). Hosts without bash can point it at e.g. "sh".
+	DefaultShell string `json:"default_shell,omitempty"`
+
+	// ServiceName is the service an uninstall job deregisters (default
+	// "rr-agent" systemd unit, "RackRoomAgent" on Windows).
+	ServiceName string `json:"service_name,omitempty"`
+
+	// HMACSigning signs requests with HMAC-SHA256 under a per-agent secret
+	// instead of ed25519, for hosts where that's too slow. The secret is
+	// fetched once over an ed25519-signed request (servers only issue it
+	// over HTTPS) and kept in HMACSecret; clear it to fetch a new one.
+	HMACSigning bool   `json:"hmac_signing,omitempty"`
+	HMACSecret  string `json:"hmac_secret,omitempty"`
+
+	// LogFile, if set, receives the agent's log (instead of stderr) as
+	// key=value lines with the agent_id, rotated once it reaches
+	// LogMaxSizeMB (default 10); three rotated files are kept.
+	LogFile      string `json:"log_file,omitempty"`
+	LogMaxSizeMB int    `json:"log_max_size_mb,omitempty"`
+
+	// DiskMinFreeMB is how much free space the volume holding the agent's
+	// config must keep (default 1024); below it the agent logs a warning,
+	// deletes its rotated log files and reports disk_pressure in heartbeats.
+	// Negative turns the check off.
+	DiskMinFreeMB int `json:"disk_min_free_mb,omitempty"`
+
+	// TimeOffsetSeconds is added to the clock when signing requests, for
+	// machines without NTP whose clock is too far off for the server's
+	// timestamp window. Negative if the local clock runs ahead.
+	TimeOffsetSeconds int64 `json:"time_offset_seconds,omitempty"`
+
+	// RunAsCredentials are Windows logons jobs may reference by name in
+	// run_as.credential. Keep this file readable by the agent account only.
+	RunAsCredentials map[string]RunAsCredential `json:"run_as_credentials,omitempty"`
+
+	// Server protocol range as reported at enroll (informational).
+	ServerProtocolVersion    int `json:"server_protocol_version,omitempty"`
+	ServerMinProtocolVersion int `json:"server_min_protocol_version,omitempty"`
+}
+
+// RunAsCredential is a local logon used for Windows run_as jobs.
+type RunAsCredential struct {
+	User     string `json:"user"`
+	Domain   string `json:"domain,omitempty"` // "." or empty = local account
+	Password string `json:"password"`
 }
 
 func LoadAgentConfig(path string) (*AgentConfig, error) {
@@ -34,6 +122,15 @@ func LoadAgentConfig(path string) (*AgentConfig, error) {
 	if c.InventorySeconds <= 0 {
 		c.InventorySeconds = 3600
 	}
+	if c.InventoryTimeoutSeconds <= 0 {
+		c.InventoryTimeoutSeconds = 30
+	}
+	if c.MaxParallelJobs <= 0 {
+		c.MaxParallelJobs = 4
+	}
+	if c.DiskMinFreeMB == 0 {
+		c.DiskMinFreeMB = 1024
+	}
 	return &c, nil
 }
 
@@ -2,9 +2,14 @@ package shared
 
 import (
 	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
+	"net/url"
+	"sort"
+	"strings"
 )
 
 func GenKeypair() (pubB64 string, privB64 string, err error) {
@@ -42,18 +47,115 @@ func BodySHA256(body []byte) string {
 	return base64.StdEncoding.EncodeToString(h[:])
 }
 
-// signature covers: timestamp + method + path + bodySha
-func Sign(priv ed25519.PrivateKey, timestamp, method, path, bodySha string) string {
-	msg := []byte(timestamp + "\n" + method + "\n" + path + "\n" + bodySha)
-	sig := ed25519.Sign(priv, msg)
+// CanonicalQuery renders query params in a stable form for signing: keys
+// sorted, each key's values sorted, everything query-escaped ("a=1&b=2").
+// Both sides must sign/verify the canonical form, not the raw query string.
+func CanonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// SignedMessage is the exact bytes a request signature covers: timestamp +
+// method + path + bodySha, plus the canonical query when there is one. An
+// empty query leaves the message exactly as it was before queries were
+// signed, so existing agents keep verifying.
+func SignedMessage(timestamp, method, path, query, bodySha string) []byte {
+	msg := timestamp + "\n" + method + "\n" + path + "\n" + bodySha
+	if query != "" {
+		msg += "\n" + query
+	}
+	return []byte(msg)
+}
+
+func Sign(priv ed25519.PrivateKey, timestamp, method, path, query, bodySha string) string {
+	sig := ed25519.Sign(priv, SignedMessage(timestamp, method, path, query, bodySha))
 	return base64.StdEncoding.EncodeToString(sig)
 }
 
-func Verify(pub ed25519.PublicKey, signatureB64, timestamp, method, path, bodySha string) bool {
+func Verify(pub ed25519.PublicKey, signatureB64, timestamp, method, path, query, bodySha string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, SignedMessage(timestamp, method, path, query, bodySha), sig)
+}
+
+// enrollChallengeMessage is what key enrollment signs. Request signatures
+// start with a timestamp, so the prefix keeps the two from ever overlapping.
+func enrollChallengeMessage(challenge string) []byte {
+	return []byte("rackroom-enroll\n" + challenge)
+}
+
+func SignEnrollChallenge(priv ed25519.PrivateKey, challenge string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(priv, enrollChallengeMessage(challenge)))
+}
+
+func VerifyEnrollChallenge(pub ed25519.PublicKey, signatureB64, challenge string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signatureB64)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, enrollChallengeMessage(challenge), sig)
+}
+
+// AuthModeHeader selects how a signed request is authenticated. Absent means
+// ed25519; AuthModeHMAC means X-Signature is an HMAC-SHA256 under the
+// agent's shared secret (see SignHMAC).
+const (
+	AuthModeHeader = "X-Auth-Mode"
+	AuthModeHMAC   = "hmac-sha256"
+)
+
+// GenHMACSecret returns a fresh 32-byte per-agent secret, base64-encoded.
+func GenHMACSecret() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+func DecodeHMACSecret(b64 string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 32 {
+		return nil, errors.New("hmac secret too short")
+	}
+	return b, nil
+}
+
+// SignHMAC is Sign's cheap alternative: the same message, authenticated with
+// HMAC-SHA256 under the agent's shared secret instead of its private key.
+func SignHMAC(secret []byte, timestamp, method, path, query, bodySha string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write(SignedMessage(timestamp, method, path, query, bodySha))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+func VerifyHMAC(secret []byte, signatureB64, timestamp, method, path, query, bodySha string) bool {
 	sig, err := base64.StdEncoding.DecodeString(signatureB64)
 	if err != nil {
 		return false
 	}
-	msg := []byte(timestamp + "\n" + method + "\n" + path + "\n" + bodySha)
-	return ed25519.Verify(pub, msg, sig)
+	m := hmac.New(sha256.New, secret)
+	m.Write(SignedMessage(timestamp, method, path, query, bodySha))
+	return hmac.Equal(sig, m.Sum(nil))
 }
@@ -1,18 +1,63 @@
 package shared
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the agent<->server protocol spoken by this build. Bump it
+// when a change needs both sides to agree. MinProtocolVersion is the oldest
+// version a server built from this tree still accepts by default. Agents that
+// predate negotiation send no version and count as version 1.
+//
+// History:
+//   - 1: initial protocol
+//   - 2: signed job polls, canonical query strings in signatures
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
 
 type EnrollRequest struct {
 	EnrollToken string    `json:"enroll_token"`
 	PublicKey   string    `json:"public_key"` // base64
 	Info        AgentInfo `json:"info"`
 	Tags        []string  `json:"tags,omitempty"`
+
+	// Capabilities lists what this agent can run ("kind:command", "shell:bash", ...).
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	ProtocolVersion int `json:"protocol_version,omitempty"`
+
+	// Challenge and Signature enroll a pre-authorized key instead of using
+	// EnrollToken: the challenge from /v1/enroll/challenge, signed with the
+	// private half of PublicKey (see SignEnrollChallenge).
+	Challenge string `json:"challenge,omitempty"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// EnrollChallengeRequest asks for a challenge to sign for key enrollment.
+type EnrollChallengeRequest struct {
+	PublicKey string `json:"public_key"` // base64
+}
+
+// EnrollChallengeResponse carries a single-use challenge for PublicKey.
+type EnrollChallengeResponse struct {
+	Challenge string `json:"challenge"`
+	ExpiresAt int64  `json:"expires_at"`
 }
 
+// EnrollResponse carries the server's supported protocol range. A server that
+// no longer supports the agent's version answers 426 with the same fields.
 type EnrollResponse struct {
 	AgentID    string `json:"agent_id"`
 	ServerTime int64  `json:"server_time"`
 	Message    string `json:"message"`
+
+	ProtocolVersion    int `json:"protocol_version"`
+	MinProtocolVersion int `json:"min_protocol_version"`
 }
 
 type AgentInfo struct {
@@ -26,18 +71,182 @@ type HeartbeatResponse struct {
 	ServerTime int64 `json:"server_time"`
 }
 
+// HeartbeatBatchRequest is what a relay (rr-relay) posts to
+// /v1/heartbeat/batch: heartbeats it collected from the agents at its site,
+// each still signed by its own agent and verified on its own.
+type HeartbeatBatchRequest struct {
+	Entries []HeartbeatBatchEntry `json:"entries"`
+}
+
+// HeartbeatBatchEntry is one agent's POST /v1/heartbeat as the relay received
+// it: the HeartbeatBatchHeaders it carried and the plain (decompressed) body
+// they sign.
+type HeartbeatBatchEntry struct {
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// HeartbeatBatchHeaders are the request headers a batch entry may carry.
+var HeartbeatBatchHeaders = []string{"X-Agent-Id", "X-PubKey", "X-Timestamp", "X-Signature", "X-Body-Sha256", AuthModeHeader}
+
+// MaxHeartbeatBatchEntries caps the entries in one HeartbeatBatchRequest.
+const MaxHeartbeatBatchEntries = 500
+
+// HeartbeatBatchResponse has one result per entry, in order.
+type HeartbeatBatchResponse struct {
+	Results []HeartbeatBatchResult `json:"results"`
+}
+
+// HeartbeatBatchResult is the status and body /v1/heartbeat would have
+// answered the entry's agent with, for the relay to pass back.
+type HeartbeatBatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// HMACSecretResponse hands an agent its new shared secret for HMAC request
+// signing (POST /v1/hmac-secret, ed25519-signed). Any previous secret stops
+// working.
+type HMACSecretResponse struct {
+	Secret string `json:"secret"` // base64
+}
+
+// PingResponse answers the signed no-op GET /v1/ping with how the server
+// sees the caller.
+type PingResponse struct {
+	Ok              bool   `json:"ok"`
+	AgentID         string `json:"agent_id"`
+	ApprovalStatus  string `json:"approval_status"`
+	ServerTime      int64  `json:"server_time"`
+	ProtocolVersion int    `json:"protocol_version"`
+}
+
+// WhoamiResponse answers the signed GET /v1/agent/whoami with the identity
+// the server resolved the request to. AgentID is canonical: an agent whose
+// configured id differs should adopt it.
+type WhoamiResponse struct {
+	AgentID        string   `json:"agent_id"`
+	Hostname       string   `json:"hostname"`
+	Tags           []string `json:"tags"`
+	TagsSource     string   `json:"tags_source"`
+	ApprovalStatus string   `json:"approval_status"`
+	Disabled       bool     `json:"disabled"`
+	ServerTime     int64    `json:"server_time"`
+}
+
+// Job kinds. Agents advertise the kinds they understand as "kind:<name>".
+const (
+	JobKindCommand   = "command"
+	JobKindUninstall = "uninstall" // remove the agent from the host; needs Confirm
+	JobKindGetFile   = "get_file"  // return the file at Command (a path), base64
+)
+
+// MaxGetFileBytes caps the file a get_file job returns. Its base64 has to fit
+// in one job result body.
+const MaxGetFileBytes = 1 << 20
+
 type Job struct {
 	JobID          string `json:"job_id"`
-	Kind           string `json:"kind"`  // "command"
-	Shell          string `json:"shell"` // "bash" | "cmd" | "pwsh" (later)
+	Kind           string `json:"kind"`  // JobKindCommand | JobKindUninstall | JobKindGetFile
+	Shell          string `json:"shell"` // "bash" | "cmd" | "powershell"
 	Command        string `json:"command"`
 	TimeoutSeconds int    `json:"timeout_seconds"`
+
+	// RunAs, if set, runs the job as another user instead of the agent's
+	// own account. Agents advertise support as "feature:run_as".
+	RunAs *RunAs `json:"run_as,omitempty"`
+
+	// Confirm must equal the target agent id for an uninstall job, so one
+	// can't be queued (or run) by accident or against the wrong agent.
+	Confirm string `json:"confirm,omitempty"`
+
+	// Priority orders an agent's queue: higher is dequeued first, equal
+	// priorities in submission order. JobPriorityMin..JobPriorityMax, default 0.
+	Priority int `json:"priority,omitempty"`
+
+	// BatchID is shared by jobs queued together (one per group member).
+	// Informational for agents.
+	BatchID string `json:"batch_id,omitempty"`
+
+	// CommandEncoding is PayloadEncodingBase64 when Command is a base64
+	// script (for payloads that don't survive as JSON text); "" = plain.
+	CommandEncoding string `json:"command_encoding,omitempty"`
+
+	// PreCommand and PostCommand, if set, run in the same shell and as the
+	// same user before and after Command, each with its own TimeoutSeconds,
+	// and their output goes into the result under delimiter lines. A failing
+	// PreCommand skips Command; PostCommand runs regardless, for teardown.
+	// Always plain text. Agents advertise support as "feature:job_hooks".
+	PreCommand  string `json:"pre_command,omitempty"`
+	PostCommand string `json:"post_command,omitempty"`
+}
+
+// HasHooks reports whether j carries a pre or post command.
+func (j Job) HasHooks() bool {
+	return j.PreCommand != "" || j.PostCommand != ""
+}
+
+// Payload encodings for Job.CommandEncoding and JobResult.OutputEncoding.
+// The empty string means the same as PayloadEncodingUTF8.
+const (
+	PayloadEncodingUTF8   = "utf8"
+	PayloadEncodingBase64 = "base64"
+)
+
+// ValidPayloadEncoding reports whether enc is a known payload encoding.
+func ValidPayloadEncoding(enc string) bool {
+	return enc == "" || enc == PayloadEncodingUTF8 || enc == PayloadEncodingBase64
+}
+
+// PlainCommand returns the command to run, decoding it if it was sent base64.
+func (j Job) PlainCommand() (string, error) {
+	switch j.CommandEncoding {
+	case "", PayloadEncodingUTF8:
+		return j.Command, nil
+	case PayloadEncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(j.Command)
+		if err != nil {
+			return "", fmt.Errorf("command is not valid base64: %w", err)
+		}
+		return string(b), nil
+	}
+	return "", fmt.Errorf("unknown command_encoding %q", j.CommandEncoding)
+}
+
+// Job priority bounds. Routine bulk work can go below 0 and urgent
+// interactive work (e.g. isolating a host) above it.
+const (
+	JobPriorityMin = -10
+	JobPriorityMax = 10
+)
+
+// RunAs names the user a job runs as. On Linux the agent switches user
+// directly when it runs as root, otherwise via "sudo -n -u". On Windows a
+// logon needs a password, so Credential must name an entry in the agent's
+// run_as_credentials config; secrets never travel with the job.
+type RunAs struct {
+	User       string `json:"user,omitempty"`
+	Credential string `json:"credential,omitempty"`
 }
 
 type JobsPollResponse struct {
 	Jobs []Job `json:"jobs"`
 }
 
+// ExitCodeTimeout is reported for a job killed at its timeout (the same code
+// coreutils timeout(1) uses), together with JobResult.TimedOut.
+const ExitCodeTimeout = 124
+
+// ExitCodeInterrupted is reported for a job killed because the agent was
+// shutting down (128 + SIGTERM, as shells report it), together with
+// JobResult.Interrupted.
+const ExitCodeInterrupted = 143
+
+// ExitCodeShellUnavailable is reported when the agent can't run the job's
+// shell at all (unknown name or binary not installed), like a shell's own
+// "command not found".
+const ExitCodeShellUnavailable = 127
+
 type JobResult struct {
 	JobID      string `json:"job_id"`
 	AgentID    string `json:"agent_id"`
@@ -46,6 +255,22 @@ type JobResult struct {
 	Stderr     string `json:"stderr"`
 	StartedAt  int64  `json:"started_at"`
 	FinishedAt int64  `json:"finished_at"`
+
+	// TimedOut means the job was killed at its timeout; Stdout/Stderr are
+	// whatever it wrote before that (partial output).
+	TimedOut bool `json:"timed_out,omitempty"`
+
+	// Interrupted means the agent was stopped while the job ran and killed
+	// it; Stdout/Stderr are partial as with TimedOut.
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	// Truncated means Stdout/Stderr were cut short of what the job wrote;
+	// the server sets it when it caps a result's output.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// OutputEncoding is PayloadEncodingBase64 when Stdout and Stderr are
+	// base64 of raw bytes (binary output); "" = UTF-8 text.
+	OutputEncoding string `json:"output_encoding,omitempty"`
 }
 
 type SubmitJobRequest struct {
@@ -54,6 +279,45 @@ type SubmitJobRequest struct {
 	Shell          string `json:"shell"`
 	Command        string `json:"command"`
 	TimeoutSeconds int    `json:"timeout_seconds"`
+	RunAs          *RunAs `json:"run_as,omitempty"`
+	Confirm        string `json:"confirm,omitempty"`
+	Priority       int    `json:"priority,omitempty"`
+
+	// TargetGroupID queues one job per member of the group instead of a
+	// single job. Selector does the same for every agent whose facts match.
+	// Exactly one of TargetAgentID, TargetGroupID and Selector is set.
+	TargetGroupID string        `json:"target_group_id,omitempty"`
+	Selector      *FactSelector `json:"selector,omitempty"`
+
+	// CommandEncoding "base64" means Command is a base64-encoded script.
+	CommandEncoding string `json:"command_encoding,omitempty"`
+
+	// PreCommand / PostCommand wrap Command with setup and teardown (see Job).
+	PreCommand  string `json:"pre_command,omitempty"`
+	PostCommand string `json:"post_command,omitempty"`
+}
+
+// FactSelector matches agents whose facts meet every condition, e.g.
+// {"where": [{"field": "disk_free_bytes", "op": "<", "value": 5368709120}]}.
+type FactSelector struct {
+	Where []FactCondition `json:"where"`
+}
+
+// FactCondition compares one fact to Value. Numeric facts take = != < <= >
+// >= and a number; text facts take = != prefix contains and a string.
+type FactCondition struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value any    `json:"value"`
+}
+
+// UnmarshalJSON decodes a number Value as json.Number rather than float64, so
+// byte counts above 2^53 reach the server exactly.
+func (c *FactCondition) UnmarshalJSON(b []byte) error {
+	type plain FactCondition
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode((*plain)(c))
 }
 
 type HeartbeatRequest struct {
@@ -61,6 +325,64 @@ type HeartbeatRequest struct {
 	Info    AgentInfo `json:"info"`
 	Tags    []string  `json:"tags,omitempty"`
 
-	// Inventory snapshot JSON (v0). Send occasionally.
+	// Capabilities is re-sent on every heartbeat so upgrades are picked up.
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Inventory snapshot JSON (v0). Send occasionally. Kept raw end to end
+	// (the server decodes it into int64 fields) so byte counts never pass
+	// through float64.
 	Inventory json.RawMessage `json:"inventory,omitempty"`
+
+	// InventoryError is why the last inventory collection failed (e.g. it
+	// timed out), so the server can surface it. Empty once one succeeds.
+	InventoryError string `json:"inventory_error,omitempty"`
+
+	// HeartbeatIntervalSeconds is how often the agent heartbeats, so the
+	// server can tell when it has missed several in a row.
+	HeartbeatIntervalSeconds int `json:"heartbeat_interval_seconds,omitempty"`
+
+	// Jobs is what the agent's job workers are doing; older agents omit it.
+	Jobs *AgentJobState `json:"jobs,omitempty"`
+
+	// DiskFreeBytes is the free space on the agent's own volume (0 = not
+	// checked); DiskPressure is set while it is below disk_min_free_mb.
+	DiskFreeBytes int64 `json:"disk_free_bytes,omitempty"`
+	DiskPressure  bool  `json:"disk_pressure,omitempty"`
+
+	// QuickFacts are measured on every heartbeat, between the full
+	// inventories; older agents and unsupported platforms omit them.
+	QuickFacts *QuickFacts `json:"quick_facts,omitempty"`
+}
+
+// QuickFacts are the few fast-moving facts an agent can read with cheap
+// system calls (no collector process), sent with every heartbeat so they
+// stay fresh while the full inventory keeps its slower cadence. A zero field
+// wasn't measured; the server keeps the inventory's value for it.
+type QuickFacts struct {
+	CollectedAt int64 `json:"collected_at"`
+
+	RAMTotalBytes int64 `json:"ram_total_bytes,omitempty"`
+	RAMFreeBytes  int64 `json:"ram_free_bytes,omitempty"`
+
+	// Fixed drives on Windows, as in its inventory; the root filesystem
+	// elsewhere.
+	DiskTotalBytes int64 `json:"disk_total_bytes,omitempty"`
+	DiskFreeBytes  int64 `json:"disk_free_bytes,omitempty"`
+
+	UptimeSeconds int64 `json:"uptime_seconds,omitempty"`
+	BootTime      int64 `json:"boot_time,omitempty"` // unix seconds
+}
+
+// AgentJobState is the agent's own count of its jobs at heartbeat time, so a
+// slow poller that is busy can be told apart from one that is stuck.
+type AgentJobState struct {
+	Running     int `json:"running"`
+	Waiting     int `json:"waiting"`      // polled, waiting for a free worker
+	MaxParallel int `json:"max_parallel"` // worker count (max_parallel_jobs)
+
+	// CompletedRecent is how many jobs finished in the last
+	// RecentWindowSeconds.
+	CompletedRecent     int   `json:"completed_recent"`
+	RecentWindowSeconds int   `json:"recent_window_seconds"`
+	LastFinishedAt      int64 `json:"last_finished_at,omitempty"` // unix seconds, since the agent started
 }